@@ -7,5 +7,68 @@ $$
   SELECT replace(CAST($1 AS TEXT), '-', '')
 $$ LANGUAGE sql;
 
+DROP FUNCTION IF EXISTS audit_log_append_only() CASCADE;
+
+-- the audit log is append-only: its entries cannot be changed or deleted
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS
+$$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+  FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+
+DROP FUNCTION IF EXISTS create_events_partition(TIMESTAMP) CASCADE;
+
+-- create_events_partition creates the table of the events of the month starting at month_start,
+-- and its indexes, unless it exists
+CREATE FUNCTION create_events_partition(month_start TIMESTAMP) RETURNS void AS
+$$
+DECLARE
+  part_name TEXT := 'events_' || to_char(month_start, 'YYYY_MM');
+BEGIN
+  EXECUTE format('CREATE TABLE IF NOT EXISTS %I (
+      PRIMARY KEY (id),
+      CHECK (time >= %L AND time < %L)
+    ) INHERITS (events)', part_name, month_start, month_start + interval '1 month');
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, time, id)', part_name || '_site_time', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, level, time)', part_name || '_level', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, code, time)', part_name || '_code', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, partition_id, time)', part_name || '_partition_id', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, zone_id, time)', part_name || '_zone_id', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I USING gin(to_tsvector(''english'', description))', part_name || '_description', part_name);
+END
+$$ LANGUAGE plpgsql;
+
+DROP FUNCTION IF EXISTS events_insert() CASCADE;
+
+-- events_insert stores the inserted events in the table of their month, created on its first event
+CREATE FUNCTION events_insert() RETURNS trigger AS
+$$
+DECLARE
+  part_name TEXT := 'events_' || to_char(NEW.time, 'YYYY_MM');
+BEGIN
+  LOOP
+    BEGIN
+      EXECUTE format('INSERT INTO %I SELECT ($1).*', part_name) USING NEW;
+      RETURN NULL;
+    EXCEPTION WHEN undefined_table THEN
+      BEGIN
+        PERFORM create_events_partition(date_trunc('month', NEW.time));
+      EXCEPTION WHEN duplicate_table OR unique_violation THEN
+        -- created concurrently by another insert
+        NULL;
+      END;
+    END;
+  END LOOP;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER events_insert
+  BEFORE INSERT ON events
+  FOR EACH ROW EXECUTE PROCEDURE events_insert();
 
 COMMIT;
@@ -0,0 +1,12 @@
+-- store the hashes of the auth tokens, rather than the tokens. The existing tokens,
+-- which were handed out as normalized uuids, remain valid.
+BEGIN;
+
+ALTER TABLE auth_tokens ADD COLUMN token_hash TEXT;
+UPDATE auth_tokens SET token_hash = encode(digest(normalize_uuid(token), 'sha256'), 'hex');
+ALTER TABLE auth_tokens DROP COLUMN token;
+ALTER TABLE auth_tokens ALTER COLUMN token_hash SET NOT NULL;
+ALTER TABLE auth_tokens ADD PRIMARY KEY (token_hash);
+CREATE INDEX auth_tokens_rec_id ON auth_tokens(rec_id);
+
+COMMIT;
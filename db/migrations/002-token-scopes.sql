@@ -0,0 +1,18 @@
+-- identify the auth tokens, to list and revoke them, and give the tokens of the users a name
+-- and a scope. The existing user tokens, handed out by signup and login, get the admin scope.
+BEGIN;
+
+ALTER TABLE auth_tokens DROP CONSTRAINT auth_tokens_pkey;
+ALTER TABLE auth_tokens ADD COLUMN id uuid NOT NULL DEFAULT gen_random_uuid();
+ALTER TABLE auth_tokens ALTER COLUMN id DROP DEFAULT;
+ALTER TABLE auth_tokens ADD PRIMARY KEY (id);
+ALTER TABLE auth_tokens ADD UNIQUE (token_hash);
+
+ALTER TABLE auth_tokens ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_tokens ADD COLUMN scope TEXT;
+UPDATE auth_tokens SET name = 'login', scope = 'admin' WHERE rec_id IN (SELECT id FROM users);
+
+ALTER TABLE auth_tokens ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE auth_tokens ALTER COLUMN created_at DROP DEFAULT;
+
+COMMIT;
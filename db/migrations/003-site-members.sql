@@ -0,0 +1,28 @@
+-- share the sites between several users, each with a role, and invite them by email.
+-- The owners of the existing sites become their first members.
+BEGIN;
+
+CREATE TABLE site_members(
+  site_id uuid NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+  user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role TEXT NOT NULL,
+  PRIMARY KEY (site_id, user_id)
+);
+CREATE INDEX site_members_user_id ON site_members(user_id);
+
+CREATE TABLE site_invitations(
+  id uuid PRIMARY KEY,
+  site_id uuid NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+  email TEXT NOT NULL,
+  role TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  invited_by uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX site_invitations_site_id ON site_invitations(site_id);
+
+INSERT INTO site_members(site_id, user_id, role)
+  SELECT id, owner_id, 'owner' FROM sites WHERE owner_id IS NOT NULL;
+
+COMMIT;
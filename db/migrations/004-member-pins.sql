@@ -0,0 +1,14 @@
+-- store the panel code of the members, encrypted with the public key of the local daemon of the site
+BEGIN;
+
+ALTER TABLE sites ADD COLUMN pin_key TEXT;
+
+CREATE TABLE member_pins(
+  site_id uuid NOT NULL,
+  user_id uuid NOT NULL,
+  encrypted_pin BYTEA NOT NULL,
+  PRIMARY KEY (site_id, user_id),
+  FOREIGN KEY (site_id, user_id) REFERENCES site_members(site_id, user_id) ON DELETE CASCADE
+);
+
+COMMIT;
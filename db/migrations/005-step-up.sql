@@ -0,0 +1,14 @@
+-- require a TOTP code or a recent re-authentication for the disarm and panic commands
+BEGIN;
+
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_failures INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_failed_at TIMESTAMP;
+
+ALTER TABLE sites ADD COLUMN step_up_roles TEXT[] NOT NULL DEFAULT '{owner,admin,arm-only}';
+
+ALTER TABLE auth_tokens ADD COLUMN reauthenticated_at TIMESTAMP;
+
+COMMIT;
@@ -0,0 +1,35 @@
+-- the append-only audit log of the actions on the cloud, readable by the admins of the cloud
+BEGIN;
+
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE audit_log(
+  id BIGSERIAL PRIMARY KEY,
+  time TIMESTAMP NOT NULL,
+  actor_type TEXT NOT NULL,
+  actor_id uuid,
+  actor_email TEXT NOT NULL DEFAULT '',
+  token_id uuid,
+  ip TEXT NOT NULL DEFAULT '',
+  site_id uuid,
+  action TEXT NOT NULL,
+  payload JSONB,
+  status INT NOT NULL,
+  outcome TEXT NOT NULL,
+  error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_log_site_id ON audit_log(site_id, id);
+CREATE INDEX audit_log_actor_id ON audit_log(actor_id, id);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS
+$$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+  FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+
+COMMIT;
@@ -0,0 +1,73 @@
+-- store every event of the sites, not just the last one, with the columns they are filtered on, in
+-- a table partitioned by month. The existing events are moved to it.
+BEGIN;
+
+ALTER TABLE events RENAME TO events_old;
+ALTER TABLE events_old DROP CONSTRAINT events_pkey;
+
+CREATE TABLE events(
+  id BIGSERIAL PRIMARY KEY,
+  site_id uuid NOT NULL,
+  time TIMESTAMP NOT NULL,
+  level TEXT NOT NULL,
+  code TEXT NOT NULL,
+  partition_id TEXT NOT NULL DEFAULT '',
+  zone_id TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  data JSONB NOT NULL
+);
+
+-- create_events_partition creates the table of the events of the month starting at month_start,
+-- and its indexes, unless it exists
+CREATE FUNCTION create_events_partition(month_start TIMESTAMP) RETURNS void AS
+$$
+DECLARE
+  part_name TEXT := 'events_' || to_char(month_start, 'YYYY_MM');
+BEGIN
+  EXECUTE format('CREATE TABLE IF NOT EXISTS %I (
+      PRIMARY KEY (id),
+      CHECK (time >= %L AND time < %L)
+    ) INHERITS (events)', part_name, month_start, month_start + interval '1 month');
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, time, id)', part_name || '_site_time', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, level, time)', part_name || '_level', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, code, time)', part_name || '_code', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, partition_id, time)', part_name || '_partition_id', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I(site_id, zone_id, time)', part_name || '_zone_id', part_name);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS %I ON %I USING gin(to_tsvector(''english'', description))', part_name || '_description', part_name);
+END
+$$ LANGUAGE plpgsql;
+
+-- events_insert stores the inserted events in the table of their month, created on its first event
+CREATE FUNCTION events_insert() RETURNS trigger AS
+$$
+DECLARE
+  part_name TEXT := 'events_' || to_char(NEW.time, 'YYYY_MM');
+BEGIN
+  LOOP
+    BEGIN
+      EXECUTE format('INSERT INTO %I SELECT ($1).*', part_name) USING NEW;
+      RETURN NULL;
+    EXCEPTION WHEN undefined_table THEN
+      BEGIN
+        PERFORM create_events_partition(date_trunc('month', NEW.time));
+      EXCEPTION WHEN duplicate_table OR unique_violation THEN
+        -- created concurrently by another insert
+        NULL;
+      END;
+    END;
+  END LOOP;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER events_insert
+  BEFORE INSERT ON events
+  FOR EACH ROW EXECUTE PROCEDURE events_insert();
+
+INSERT INTO events(site_id, time, level, code, partition_id, zone_id, description, data)
+  SELECT site_id, time, level, COALESCE(data->>'Code', ''), COALESCE(data->>'PartitionID', ''),
+    COALESCE(data->>'ZoneID', ''), COALESCE(data->>'Description', ''), COALESCE(data, '{}')
+  FROM events_old ORDER BY time;
+
+DROP TABLE events_old;
+
+COMMIT;
@@ -4,31 +4,122 @@ DROP TABLE IF EXISTS users CASCADE;
 CREATE TABLE users(
   id uuid PRIMARY KEY,
   email TEXT NOT NULL UNIQUE,
-  password TEXT NOT NULL
+  password TEXT NOT NULL,
+  -- the base32 TOTP secret, pending until totp_enabled, and the last time step used,
+  -- so that a code cannot be replayed
+  totp_secret TEXT,
+  totp_enabled BOOLEAN NOT NULL DEFAULT false,
+  totp_last_step BIGINT NOT NULL DEFAULT 0,
+  -- the failed TOTP verifications since totp_failed_at, the last one: TOTP locks after too many
+  totp_failures INT NOT NULL DEFAULT 0,
+  totp_failed_at TIMESTAMP,
+  -- the admins of the cloud read its whole audit log
+  is_admin BOOLEAN NOT NULL DEFAULT false
 );
 
 DROP TABLE IF EXISTS devices CASCADE;
 CREATE TABLE sites(
   id uuid PRIMARY KEY,
   owner_id uuid REFERENCES users(id) ON DELETE RESTRICT,
-  state_shadow JSONB
+  state_shadow JSONB,
+  -- the PEM public key of the local daemon, with which the members encrypt their panel code
+  pin_key TEXT,
+  -- the roles of the members whose disarm and panic commands require a step-up
+  step_up_roles TEXT[] NOT NULL DEFAULT '{owner,admin,arm-only}'
 );
 
 
+-- the role of the members: owner, admin, arm-only or view-only. The user who claimed
+-- the site, its owner_id, is its owner.
+DROP TABLE IF EXISTS site_members CASCADE;
+CREATE TABLE site_members(
+  site_id uuid NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+  user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role TEXT NOT NULL,
+  PRIMARY KEY (site_id, user_id)
+);
+CREATE INDEX site_members_user_id ON site_members(user_id);
+
+
+-- the panel code of the members, encrypted with the pin_key of the site: the cloud cannot read it
+DROP TABLE IF EXISTS member_pins CASCADE;
+CREATE TABLE member_pins(
+  site_id uuid NOT NULL,
+  user_id uuid NOT NULL,
+  encrypted_pin BYTEA NOT NULL,
+  PRIMARY KEY (site_id, user_id),
+  FOREIGN KEY (site_id, user_id) REFERENCES site_members(site_id, user_id) ON DELETE CASCADE
+);
+
+
+-- token_hash is the hex sha256 of the token sent to the email
+DROP TABLE IF EXISTS site_invitations CASCADE;
+CREATE TABLE site_invitations(
+  id uuid PRIMARY KEY,
+  site_id uuid NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+  email TEXT NOT NULL,
+  role TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  invited_by uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX site_invitations_site_id ON site_invitations(site_id);
+
+
 DROP TABLE IF EXISTS auth_tokens CASCADE;
+-- token_hash is the hex sha256 of the token: the tokens themselves are not stored.
+-- name and scope are only set on the tokens of users.
 CREATE TABLE auth_tokens(
-  token uuid PRIMARY KEY,
+  id uuid PRIMARY KEY,
+  token_hash TEXT NOT NULL UNIQUE,
   rec_id uuid NOT NULL,
-  expires_at TIMESTAMP
+  name TEXT NOT NULL DEFAULT '',
+  scope TEXT,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP,
+  -- when the user last re-authenticated with the token, for the commands which require a step-up
+  reauthenticated_at TIMESTAMP
+);
+CREATE INDEX auth_tokens_rec_id ON auth_tokens(rec_id);
+
+
+-- the actions on the cloud, appended by the api: the audit_log_append_only trigger rejects changes.
+-- The ids are not foreign keys, so that the entries outlive the users, tokens and sites.
+DROP TABLE IF EXISTS audit_log CASCADE;
+CREATE TABLE audit_log(
+  id BIGSERIAL PRIMARY KEY,
+  time TIMESTAMP NOT NULL,
+  actor_type TEXT NOT NULL,
+  actor_id uuid,
+  actor_email TEXT NOT NULL DEFAULT '',
+  token_id uuid,
+  ip TEXT NOT NULL DEFAULT '',
+  site_id uuid,
+  action TEXT NOT NULL,
+  payload JSONB,
+  status INT NOT NULL,
+  outcome TEXT NOT NULL,
+  error TEXT NOT NULL DEFAULT ''
 );
+CREATE INDEX audit_log_site_id ON audit_log(site_id, id);
+CREATE INDEX audit_log_actor_id ON audit_log(actor_id, id);
 
 
 DROP TABLE IF EXISTS events CASCADE;
+-- the events of the sites, partitioned by month: the rows are stored in the events_YYYY_MM tables,
+-- created on the first insert of their month by the events_insert trigger, with their indexes.
+-- data is the whole event.
 CREATE TABLE events(
-  site_id uuid PRIMARY KEY,
-  level TEXT NOT NULL,
+  id BIGSERIAL PRIMARY KEY,
+  site_id uuid NOT NULL,
   time TIMESTAMP NOT NULL,
-  data JSONB
+  level TEXT NOT NULL,
+  code TEXT NOT NULL,
+  partition_id TEXT NOT NULL DEFAULT '',
+  zone_id TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  data JSONB NOT NULL
 );
 
 COMMIT;
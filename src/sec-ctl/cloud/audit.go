@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sec-ctl/cloud/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultAuditLimit = 100
+const maxAuditLimit = 1000
+
+// maxAuditErrorSize bounds the response body read for the error of a failed action
+const maxAuditErrorSize = 1024
+
+// auditWriter captures the body of the error responses, for the error of the audit entries
+type auditWriter struct {
+	gin.ResponseWriter
+	errBody bytes.Buffer
+}
+
+func (w *auditWriter) Write(data []byte) (int, error) {
+	w.captureError(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	w.captureError([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *auditWriter) captureError(data []byte) {
+	if w.Status() >= 400 && w.errBody.Len() < maxAuditErrorSize {
+		w.errBody.Write(data)
+	}
+}
+
+// errorMessage returns the error of the response, as set by the handlers with {"error": ...}
+func (w *auditWriter) errorMessage() string {
+	var rsp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.errBody.Bytes(), &rsp); err == nil && rsp.Error != "" {
+		return rsp.Error
+	}
+	return http.StatusText(w.Status())
+}
+
+// auditedActions are the actions recorded in the audit log, by the method and pattern of their route
+var auditedActions = map[string]string{
+	"POST /signup":                                "signup",
+	"POST /login":                                 "login",
+	"POST /reauth":                                "reauth",
+	"POST /totp":                                  "totp.enroll",
+	"POST /totp/confirm":                          "totp.confirm",
+	"DELETE /totp":                                "totp.disable",
+	"POST /tokens":                                "token.create",
+	"DELETE /tokens/:id":                          "token.revoke",
+	"GET /ws":                                     "site.connect",
+	"POST /sites":                                 "site.register",
+	"POST /sites/:id/claimToken":                  "site.claimToken.renew",
+	"POST /sites/:id/token":                       "site.token.rotate",
+	"PUT /sites/:id/pinKey":                       "site.pinKey.set",
+	"POST /sites/:id/claim":                       "site.claim",
+	"POST /sites/:id/claim/form":                  "site.claim",
+	"POST /sites/:id/commands":                    "site.command",
+	"PUT /sites/:id/stepUp":                       "site.stepUp.set",
+	"PUT /sites/:id/members/:userID":              "member.role",
+	"DELETE /sites/:id/members/:userID":           "member.remove",
+	"POST /sites/:id/invitations":                 "invitation.create",
+	"DELETE /sites/:id/invitations/:invitationID": "invitation.revoke",
+	"POST /invitations/accept":                    "invitation.accept",
+	"PUT /sites/:id/pin":                          "pin.set",
+	"DELETE /sites/:id/pin":                       "pin.delete",
+}
+
+// siteRoutePrefix is the prefix of the routes of a site, whose id parameter is the site acted on
+const siteRoutePrefix = "/sites/:id/"
+
+// audit records the requests of the auditedActions in the audit log, once handled: who sent
+// them, with which token and from where, on which site, and their outcome. It runs before the
+// authentication, so that the rejected requests are recorded too, eg an invalid token or a member
+// whose role does not allow a command. The payload has the url parameters, and what the handler
+// adds with setAuditPayload.
+func (rest rest) audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routePattern(c)
+		action, ok := auditedActions[c.Request.Method+" "+route]
+		if !ok {
+			c.Next()
+			return
+		}
+
+		w := &auditWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		payload := map[string]interface{}{}
+		c.Set("AuditPayload", payload)
+		start := time.Now()
+
+		c.Next()
+
+		e := db.AuditEntry{
+			Time:      start,
+			ActorType: db.ActorAnonymous,
+			IP:        c.ClientIP(),
+			Action:    action,
+			Status:    w.Status(),
+			Outcome:   db.OutcomeSuccess,
+		}
+		if site, ok := c.Get("Site"); ok {
+			e.SiteID = site.(db.Site).ID
+			// the site authenticated itself, unless a user accessed it
+			e.ActorType, e.ActorID = db.ActorSite, e.SiteID
+		} else if siteID, ok := c.Get("AuditSiteID"); ok {
+			e.SiteID = siteID.(db.UUID)
+		} else if siteID := db.UUID(c.Param("id")); strings.HasPrefix(route, siteRoutePrefix) && validUUID(siteID) {
+			// the request was rejected before the site was fetched
+			e.SiteID = siteID
+		}
+		if user, ok := c.Get("User"); ok {
+			e.ActorType, e.ActorID, e.ActorEmail = db.ActorUser, user.(db.User).ID, user.(db.User).Email
+		}
+		if tokenID, ok := c.Get("TokenID"); ok {
+			e.TokenID = tokenID.(db.UUID)
+		}
+		if e.Status >= 400 {
+			e.Outcome, e.Error = db.OutcomeFailure, w.errorMessage()
+		}
+
+		for _, p := range c.Params {
+			payload[p.Key] = p.Value
+		}
+		if len(payload) > 0 {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				logger.Panicf("Unable to jsonify the audit payload of %v: %v", action, err)
+			}
+			e.Payload = data
+		}
+
+		if err := rest.db.RecordAudit(e); err != nil {
+			logger.Printf("failed to record %v of %v in the audit log: %v", action, e.ActorID, err)
+		}
+	}
+}
+
+// routePattern returns the pattern of the route of the request, eg /sites/:id/commands, by
+// replacing the values of its parameters in its path by their name
+func routePattern(c *gin.Context) string {
+	segs := strings.Split(c.Request.URL.Path, "/")
+	params := c.Params
+	for i, seg := range segs {
+		if len(params) > 0 && seg == params[0].Value {
+			segs[i] = ":" + params[0].Key
+			params = params[1:]
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// setAuditPayload adds the value to the payload of the audit entry of the request. It must not
+// have secrets, eg passwords or codes.
+func setAuditPayload(c *gin.Context, key string, value interface{}) {
+	if payload, ok := c.Get("AuditPayload"); ok {
+		payload.(map[string]interface{})[key] = value
+	}
+}
+
+// setupAudit sets up the routes to read the audit log: the whole log for the admins of the
+// cloud, and that of a site for its owner. They return the entries as json, or stream all of
+// them as NDJSON with format=ndjson.
+func (rest rest) setupAudit(sitesRouter *gin.RouterGroup) {
+
+	rest.gin.GET("/audit", rest.authUserByToken(), requireScope(db.ScopeAdmin), rest.requireAdmin(), func(c *gin.Context) {
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		filter.SiteID = db.UUID(c.Query("site"))
+		if filter.SiteID != "" && !validUUID(filter.SiteID) {
+			c.JSON(400, &gin.H{"error": "Invalid site: must be the id of a site"})
+			return
+		}
+
+		rest.serveAuditLog(c, filter)
+	})
+
+	sitesRouter.GET("/audit", requireScope(db.ScopeAdmin), requireRole(db.RoleOwner), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		filter.SiteID = site.ID
+
+		rest.serveAuditLog(c, filter)
+	})
+}
+
+func (rest rest) serveAuditLog(c *gin.Context, filter db.AuditFilter) {
+	if c.Query("format") != "ndjson" {
+		entries, err := rest.db.GetAuditLog(filter)
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, entries)
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(200)
+	enc := json.NewEncoder(c.Writer)
+	if err := rest.db.ExportAuditLog(filter, func(e db.AuditEntry) error { return enc.Encode(e) }); err != nil {
+		// the response started: it is cut short
+		logger.Printf("failed to export the audit log: %v", err)
+	}
+}
+
+// requireAdmin rejects the requests of the users who do not administer the cloud
+func (rest rest) requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("User").(db.User)
+
+		admin, err := rest.db.IsAdmin(user.ID)
+		if err != nil {
+			logger.Println("unexpected error", err)
+			c.AbortWithStatus(500)
+		} else if !admin {
+			c.AbortWithStatusJSON(403, &gin.H{"error": "Only the admins of the cloud may do this"})
+		}
+	}
+}
+
+// parseAuditFilter reads the audit filter from the query parameters: actor, action, outcome,
+// since and until (RFC 3339), before and limit
+func parseAuditFilter(c *gin.Context) (db.AuditFilter, error) {
+	filter := db.AuditFilter{
+		ActorID: db.UUID(c.Query("actor")),
+		Action:  c.Query("action"),
+		Outcome: c.Query("outcome"),
+		Limit:   defaultAuditLimit,
+	}
+
+	if filter.ActorID != "" && !validUUID(filter.ActorID) {
+		return db.AuditFilter{}, fmt.Errorf("Invalid actor: must be the id of a user or site")
+	}
+
+	var err error
+	if since := c.Query("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return db.AuditFilter{}, fmt.Errorf("Invalid since: %v", err)
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return db.AuditFilter{}, fmt.Errorf("Invalid until: %v", err)
+		}
+	}
+	if before := c.Query("before"); before != "" {
+		if filter.Before, err = strconv.ParseInt(before, 10, 64); err != nil || filter.Before <= 0 {
+			return db.AuditFilter{}, fmt.Errorf("Invalid before %v: must be the id of an entry", before)
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil || n == 0 || n > maxAuditLimit {
+			return db.AuditFilter{}, fmt.Errorf("Invalid limit %v: must be between 1 and %d", limit, maxAuditLimit)
+		}
+		filter.Limit = uint(n)
+	}
+
+	return filter, nil
+}
+
+// validUUID returns whether id is a uuid, with or without hyphens
+func validUUID(id db.UUID) bool {
+	data, err := hex.DecodeString(id.String())
+	return err == nil && len(data) == 16
+}
@@ -1,23 +1,42 @@
 package config
 
-import "sec-ctl/pkg/util"
+import (
+	"sec-ctl/pkg/util"
+	"time"
+)
 
 // Config represents the cloud configuration options
 type Config struct {
 	RESTBindHost string
-	RESTBindPort uint16
+	RESTBindPort uint16 `config:"min=1"`
 
 	WSBindHost string
-	WSBindPort uint16
+	WSBindPort uint16 `config:"min=1"`
+	// WSPingInterval is the delay between pings of the sites, 0 to disable them. A site which does not
+	// answer within WSPingTimeout is disconnected.
+	WSPingInterval time.Duration `config:"min=0s"`
+	WSPingTimeout  time.Duration `config:"min=1s"`
 
 	DBHost     string
-	DBPort     uint16
-	DBUsername string
-	DBPassword string
-	DBName     string
+	DBPort     uint16 `config:"min=1"`
+	DBUsername string `config:"required"`
+	DBPassword string `config:"secret"`
+	DBName     string `config:"required"`
 
 	RedisHost string
-	RedisPort uint16
+	RedisPort uint16 `config:"min=1"`
+
+	// PublicBaseURL is the URL of the api as seen by its users, for the links of the emails
+	PublicBaseURL string `config:"required"`
+	// SMTPAddr is the host:port of the SMTP server sending the emails, eg the invitations of
+	// the site members. Emails are not sent if unset.
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string `config:"secret"`
+
+	// ShutdownTimeout bounds the graceful shutdown on SIGTERM
+	ShutdownTimeout time.Duration `config:"min=0s"`
 }
 
 // AppName returns the name of the app being configured
@@ -31,12 +50,20 @@ var defaultConfig = Config{
 	WSBindHost:   "0.0.0.0",
 	WSBindPort:   9754,
 
+	WSPingInterval: 15 * time.Second,
+	WSPingTimeout:  10 * time.Second,
+
 	DBPort:     5432,
 	DBPassword: "secctl_dev",
 	DBUsername: "secctl_dev",
 	DBName:     "secctl_dev",
 
 	RedisPort: 6739,
+
+	PublicBaseURL: "http://localhost:9753",
+	SMTPFrom:      "secctl@localhost",
+
+	ShutdownTimeout: 8 * time.Second,
 }
 
 // Load loads the configuration
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ActorType is what performed an audited action
+type ActorType string
+
+const (
+	// ActorUser is a user, authenticated by a token, or logging in
+	ActorUser ActorType = "user"
+	// ActorSite is the local daemon of a site, authenticated by the token of the site
+	ActorSite ActorType = "site"
+	// ActorAnonymous is an unauthenticated client, eg failing to log in
+	ActorAnonymous ActorType = "anonymous"
+)
+
+const (
+	// OutcomeSuccess is the outcome of the actions which succeeded
+	OutcomeSuccess = "success"
+	// OutcomeFailure is the outcome of the actions which were rejected, or failed
+	OutcomeFailure = "failure"
+)
+
+// AuditEntry records an action on the cloud: who performed it, with which token and from where,
+// on which site, and its outcome. Payload describes the action, without its secrets.
+type AuditEntry struct {
+	ID         int64
+	Time       time.Time
+	ActorType  ActorType `db:"actor_type"`
+	ActorID    UUID      `db:"actor_id"`
+	ActorEmail string    `db:"actor_email"`
+	TokenID    UUID      `db:"token_id"`
+	IP         string
+	SiteID     UUID `db:"site_id"`
+	Action     string
+	Payload    json.RawMessage
+	Status     int
+	Outcome    string
+	Error      string
+}
+
+// auditColumns selects the columns of AuditEntry
+const auditColumns = `id, time, actor_type, COALESCE(normalize_uuid(actor_id), '') AS actor_id, actor_email,
+	COALESCE(normalize_uuid(token_id), '') AS token_id, ip, COALESCE(normalize_uuid(site_id), '') AS site_id,
+	action, COALESCE(payload, 'null') AS payload, status, outcome, error`
+
+// AuditFilter restricts the entries returned by GetAuditLog. Zero fields are ignored.
+type AuditFilter struct {
+	SiteID  UUID
+	ActorID UUID
+	Action  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	// Before only returns the entries older than the entry with this id, to get the next page
+	Before int64
+	Limit  uint
+}
+
+// RecordAudit appends the entry to the audit log, which cannot be changed once written
+func (db *DB) RecordAudit(e AuditEntry) error {
+	var payload interface{}
+	if len(e.Payload) > 0 {
+		payload = string(e.Payload)
+	}
+
+	_, err := db.conn.Exec(`
+		INSERT INTO
+			audit_log(time, actor_type, actor_id, actor_email, token_id, ip, site_id, action, payload, status, outcome, error)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, e.Time, e.ActorType, nullUUID(e.ActorID), e.ActorEmail, nullUUID(e.TokenID), e.IP, nullUUID(e.SiteID),
+		e.Action, payload, e.Status, e.Outcome, e.Error)
+	return err
+}
+
+// GetAuditLog returns the latest entries of the audit log matching the filter, most recent first
+func (db *DB) GetAuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	query, args := auditQuery(filter)
+
+	entries := []AuditEntry{}
+	if err := db.conn.Select(&entries, query, args...); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ExportAuditLog calls fn with every entry of the audit log matching the filter, most recent first,
+// until fn returns an error. The limit of the filter is ignored.
+func (db *DB) ExportAuditLog(filter AuditFilter, fn func(AuditEntry) error) error {
+	filter.Limit = 0
+	query, args := auditQuery(filter)
+
+	rows, err := db.conn.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.StructScan(&e); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func auditQuery(filter AuditFilter) (string, []interface{}) {
+	query := "SELECT " + auditColumns + " FROM audit_log WHERE true"
+	var args []interface{}
+	where := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+cond, len(args))
+	}
+
+	if filter.SiteID != "" {
+		where("site_id = $%d", filter.SiteID)
+	}
+	if filter.ActorID != "" {
+		where("actor_id = $%d", filter.ActorID)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.Outcome != "" {
+		where("outcome = $%d", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		where("time >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("time < $%d", filter.Until)
+	}
+	if filter.Before > 0 {
+		where("id < $%d", filter.Before)
+	}
+
+	// the ids follow the order of the entries, and page through them
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	return query, args
+}
+
+// IsAdmin returns whether the user administers the cloud, and may read its whole audit log
+func (db *DB) IsAdmin(userID UUID) (bool, error) {
+	var admin bool
+	err := db.conn.Get(&admin, `SELECT is_admin FROM users WHERE id = $1`, userID)
+	return admin, err
+}
+
+// nullUUID returns id, or nil if it is empty
+func nullUUID(id UUID) interface{} {
+	if id == "" {
+		return nil
+	}
+	return id
+}
@@ -1,11 +1,18 @@
 package db
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sec-ctl/cloud/config"
+	"sec-ctl/pkg/sites"
 	"strings"
 	"time"
-	"sec-ctl/cloud/config"
 
 	"github.com/jmoiron/sqlx"
 	// load postgres driver
@@ -14,6 +21,20 @@ import (
 
 const bcryptSaltSize = 8
 
+// ClaimTokenTTL is how long a site can be claimed with its claim token
+const ClaimTokenTTL = 7 * 24 * time.Hour
+
+var (
+	// ErrInvalidClaim is returned when claiming an unknown or already claimed site, or with a wrong token
+	ErrInvalidClaim = errors.New("Invalid site id, invalid claim token, or already claimed")
+	// ErrClaimTokenExpired is returned when claiming a site with an expired claim token
+	ErrClaimTokenExpired = errors.New("Claim token expired")
+	// ErrAlreadyClaimed is returned when regenerating the claim token of a claimed site
+	ErrAlreadyClaimed = errors.New("Site is already claimed")
+	// ErrUnknownEvent is returned when the events are paged from an event the site does not have
+	ErrUnknownEvent = errors.New("Unknown event")
+)
+
 // UUID represents a PostgreSQL uuid
 type UUID string
 
@@ -30,18 +51,31 @@ type User struct {
 	Email string
 }
 
+// Site is a site, identified by its normalized id. OwnerID is empty until the site is claimed.
 type Site struct {
-	ID          UUID
-	OwnerID     UUID `db:"owner_id"`
-	StateShadow string
+	ID      UUID
+	OwnerID UUID `db:"owner_id"`
 }
 
+// siteColumns selects the columns of Site
+const siteColumns = "normalize_uuid(sites.id) AS id, COALESCE(CAST(sites.owner_id AS TEXT), '') AS owner_id"
+
+// Event is an event of a site, with the columns it is filtered on. Data is the json of the whole event.
 type Event struct {
-	Level string
-	Time  time.Time
-	Data  string
+	ID          int64
+	SiteID      UUID `db:"site_id"`
+	Time        time.Time
+	Level       string
+	Code        string
+	PartitionID string `db:"partition_id"`
+	ZoneID      string `db:"zone_id"`
+	Description string
+	Data        string
 }
 
+// eventColumns selects the columns of Event
+const eventColumns = "id, normalize_uuid(site_id) AS site_id, time, level, code, partition_id, zone_id, description, data"
+
 func OpenDB(cfg config.Config) (*DB, error) {
 	connStr := fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
@@ -63,26 +97,21 @@ func OpenDB(cfg config.Config) (*DB, error) {
 	return db, nil
 }
 
-func (db *DB) AuthUser(email string, password string) (User, error) {
-
-	var u User
-	err := db.conn.Select(&u, "SELECT * FROM users where email = $1 AND password = crypt($2, password)", email, password)
-	if err != nil {
-		return User{}, err
-	}
+// Close closes the connections to the database
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
 
-	return u, nil
+// Ping checks that the database is reachable
+func (db *DB) Ping(ctx context.Context) error {
+	return db.conn.PingContext(ctx)
 }
 
-func (db *DB) AuthUserByToken(token string) (User, error) {
-	var u User
-	err := db.conn.Get(&u, `
-		SELECT users.*
-			FROM users
-				JOIN auth_tokens ON auth_tokens.rec_id = users.id
-			WHERE token = $1
-	`)
+// AuthUser returns the user with the email and password
+func (db *DB) AuthUser(email string, password string) (User, error) {
 
+	var u User
+	err := db.conn.Get(&u, "SELECT id, email FROM users WHERE email = $1 AND password = crypt($2, password)", email, password)
 	if err != nil {
 		return User{}, err
 	}
@@ -90,6 +119,7 @@ func (db *DB) AuthUserByToken(token string) (User, error) {
 	return u, nil
 }
 
+// CreateUser creates a user, and returns it with a session token of scope admin
 func (db *DB) CreateUser(email string, password string) (User, string, error) {
 
 	u := User{
@@ -100,19 +130,20 @@ func (db *DB) CreateUser(email string, password string) (User, string, error) {
 	if err != nil {
 		return User{}, "", err
 	}
+	defer tx.Rollback()
 
 	r := tx.QueryRow(`
 		INSERT
 			INTO users(id, email, password)
-			VALUES (gen_random_uuid(), $2, crypt($3, gen_salt('fo', $4))
+			VALUES (gen_random_uuid(), $1, crypt($2, gen_salt('bf', $3)))
 			RETURNING id
-	`, u.ID, email, password, bcryptSaltSize)
+	`, email, password, bcryptSaltSize)
 	err = r.Scan(&u.ID)
 	if err != nil {
 		return User{}, "", err
 	}
 
-	tok, err := createAuthToken(tx, u.ID, time.Time{})
+	_, tok, err := createUserToken(tx, u.ID, SessionTokenName, ScopeAdmin, time.Now().Add(SessionTokenTTL))
 	if err != nil {
 		return User{}, "", err
 	}
@@ -124,10 +155,17 @@ func (db *DB) CreateUser(email string, password string) (User, string, error) {
 	return u, tok, nil
 }
 
+// AuthSiteByToken returns the site authenticated by its permanent token. Claim tokens,
+// which expire, do not authenticate the site.
 func (db *DB) AuthSiteByToken(token string) (Site, error) {
 
 	var s Site
-	err := db.conn.Select(&s, "SELECT * FROM users where token = $1 AND owner_id IS NOT NULL", token)
+	err := db.conn.Get(&s, `
+		SELECT `+siteColumns+`
+			FROM sites
+				JOIN auth_tokens ON auth_tokens.rec_id = sites.id
+			WHERE token_hash = $1 AND expires_at IS NULL
+	`, hashToken(token))
 	if err != nil {
 		return Site{}, err
 	}
@@ -135,58 +173,125 @@ func (db *DB) AuthSiteByToken(token string) (Site, error) {
 	return s, nil
 }
 
+// ClaimSite makes the user the owner of the site, and its first member, if the claim token is valid,
+// and deletes the claim token
 func (db *DB) ClaimSite(user User, siteID UUID, claimToken string) error {
 	tx, err := db.conn.Beginx()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	r, err := tx.Exec(`
-		UPDATE sites
-			SET owner_id = $1
+	var expiresAt time.Time
+	err = tx.Get(&expiresAt, `
+		SELECT expires_at
 			FROM auth_tokens
-			WHERE users.id = $2
-				AND owner_id IS NULL
-				AND auth_tokens.rec_id = sites.id
-				AND auth_tokens.token = $3
-	`, user.ID, siteID, claimToken)
-	if err != nil {
+				JOIN sites ON sites.id = auth_tokens.rec_id
+			WHERE sites.id = $1
+				AND sites.owner_id IS NULL
+				AND auth_tokens.token_hash = $2
+				AND auth_tokens.expires_at IS NOT NULL
+			FOR UPDATE
+	`, siteID, hashToken(claimToken))
+	if err == sql.ErrNoRows {
+		return ErrInvalidClaim
+	} else if err != nil {
 		return err
 	}
 
-	n, err := r.RowsAffected()
-	if err != nil {
+	if expiresAt.Before(time.Now()) {
+		return ErrClaimTokenExpired
+	}
+
+	if _, err = tx.Exec(`UPDATE sites SET owner_id = $1 WHERE id = $2`, user.ID, siteID); err != nil {
 		return err
 	}
 
-	if n == 0 {
-		return fmt.Errorf("Invalid Site id, invalid claim token, or already claimed")
+	if err = addMember(tx, siteID, user.ID, RoleOwner); err != nil {
+		return err
 	}
 
-	_, err = tx.Exec(`DELETE FROM auth_tokens WHERE token = $1`, claimToken)
-	if err != nil {
+	if err = deleteClaimTokens(tx, siteID); err != nil {
 		return err
 	}
 
+	return tx.Commit()
+}
+
+// RegenerateClaimToken replaces the claim tokens of an unclaimed site with a new one
+func (db *DB) RegenerateClaimToken(siteID UUID) (string, time.Time, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var s Site
+	err = tx.Get(&s, `SELECT `+siteColumns+` FROM sites WHERE id = $1 FOR UPDATE`, siteID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if s.OwnerID != "" {
+		return "", time.Time{}, ErrAlreadyClaimed
+	}
+
+	if err = deleteClaimTokens(tx, siteID); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(ClaimTokenTTL)
+	tok, err := createAuthToken(tx, siteID, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
 	if err = tx.Commit(); err != nil {
-		return err
+		return "", time.Time{}, err
 	}
 
-	return err
+	return tok, expiresAt, nil
+}
+
+// RotateSiteToken replaces the permanent token of the site with a new one, which is returned.
+// The previous token no longer authenticates the site.
+func (db *DB) RotateSiteToken(siteID UUID) (string, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM auth_tokens WHERE rec_id = $1 AND expires_at IS NULL`, siteID); err != nil {
+		return "", err
+	}
+
+	tok, err := createAuthToken(tx, siteID, time.Time{})
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return tok, nil
 }
 
 func (db *DB) FetchSiteByID(id UUID) (Site, error) {
 	s := Site{}
-	err := db.conn.Get(&s, `SELECT * FROM sites WHERE id = $1`, id)
+	err := db.conn.Get(&s, `SELECT `+siteColumns+` FROM sites WHERE id = $1`, id)
 	return s, err
 }
 
-func (db *DB) CreateSite() (Site, string, string, error) {
+// CreateSite creates an unclaimed site, and returns it with its permanent token,
+// and a claim token expiring after ClaimTokenTTL
+func (db *DB) CreateSite() (Site, string, string, time.Time, error) {
 
 	tx, err := db.conn.Beginx()
 	if err != nil {
-		return Site{}, "", "", err
+		return Site{}, "", "", time.Time{}, err
 	}
+	defer tx.Rollback()
 
 	s := Site{}
 
@@ -198,27 +303,29 @@ func (db *DB) CreateSite() (Site, string, string, error) {
 	`).Scan(&s.ID)
 
 	if err != nil {
-		return Site{}, "", "", err
+		return Site{}, "", "", time.Time{}, err
 	}
 
 	tok, err := createAuthToken(tx, s.ID, time.Time{})
 	if err != nil {
-		return Site{}, "", "", err
+		return Site{}, "", "", time.Time{}, err
 	}
 
-	tmpTok, err := createAuthToken(tx, s.ID, time.Now().Add(7*24*time.Hour))
+	claimExpiresAt := time.Now().Add(ClaimTokenTTL)
+	claimTok, err := createAuthToken(tx, s.ID, claimExpiresAt)
 	if err != nil {
-		return Site{}, "", "", err
+		return Site{}, "", "", time.Time{}, err
 	}
 
 	if err = tx.Commit(); err != nil {
-		return Site{}, "", "", err
+		return Site{}, "", "", time.Time{}, err
 	}
 
-	return s, tok, tmpTok, nil
+	return s, tok, claimTok, claimExpiresAt, nil
 }
 
-func (db *DB) SaveEvent(level string, tstamp time.Time, siteID UUID, evt interface{}) error {
+// SaveEvent stores the event of the site
+func (db *DB) SaveEvent(siteID UUID, evt sites.Event) error {
 
 	data, err := json.Marshal(evt)
 	if err != nil {
@@ -226,45 +333,135 @@ func (db *DB) SaveEvent(level string, tstamp time.Time, siteID UUID, evt interfa
 	}
 
 	_, err = db.conn.Exec(`
-		INSERT INTO events(level, time, site_id, data)
-		VALUES ($1, $2, $3, $4)
-	`, level, tstamp, siteID, data)
+		INSERT INTO
+			events(site_id, time, level, code, partition_id, zone_id, description, data)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, siteID, evt.Time, evt.Level, evt.Code, evt.PartitionID, evt.ZoneID, evt.Description, string(data))
 	return err
 }
 
-func (db *DB) GetLatestEvents(siteID UUID, max uint) ([]Event, error) {
+// EventFilter restricts the events returned by GetEvents. Zero fields are ignored.
+type EventFilter struct {
+	Level       string
+	Code        string
+	Since       time.Time
+	Until       time.Time
+	PartitionID string
+	ZoneID      string
+	// Search only returns the events whose description matches all its words
+	Search string
+	// Before only returns the events older than the event of the site with this id: pass the ID of
+	// the last event of a page to get the next one. GetEvents fails with ErrUnknownEvent if the site
+	// has no such event.
+	Before int64
+	Limit  uint
+}
+
+// GetEvents returns the latest events of the site matching the filter, most recent first
+func (db *DB) GetEvents(siteID UUID, filter EventFilter) ([]Event, error) {
 
-	var evts []Event
-	err := db.conn.Select(&evts, "SELECT * FROM events WHERE site_id = $1 ORDER BY time DESC LIMIT $2", siteID, max)
-	if err != nil {
+	query := "SELECT " + eventColumns + " FROM events WHERE site_id = $1"
+	args := []interface{}{siteID}
+	where := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+cond, len(args))
+	}
+
+	if filter.Level != "" {
+		where("level = $%d", filter.Level)
+	}
+	if filter.Code != "" {
+		where("code = $%d", filter.Code)
+	}
+	// the time range restricts the query to the partitions of its months
+	if !filter.Since.IsZero() {
+		where("time >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("time < $%d", filter.Until)
+	}
+	if filter.PartitionID != "" {
+		where("partition_id = $%d", filter.PartitionID)
+	}
+	if filter.ZoneID != "" {
+		where("zone_id = $%d", filter.ZoneID)
+	}
+	if filter.Search != "" {
+		where("to_tsvector('english', description) @@ plainto_tsquery('english', $%d)", filter.Search)
+	}
+	if filter.Before > 0 {
+		var before time.Time
+		err := db.conn.Get(&before, `SELECT time FROM events WHERE site_id = $1 AND id = $2`, siteID, filter.Before)
+		if err == sql.ErrNoRows {
+			return nil, ErrUnknownEvent
+		} else if err != nil {
+			return nil, err
+		}
+		// the events are ordered by time, then id for those of the same time. The bound on the
+		// time alone restricts the query to the partitions up to its month.
+		where("time <= $%d", before)
+		args = append(args, filter.Before)
+		query += fmt.Sprintf(" AND (time, id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY time DESC, id DESC LIMIT $%d", len(args))
+
+	evts := []Event{}
+	if err := db.conn.Select(&evts, query, args...); err != nil {
 		return nil, err
 	}
 
 	return evts, nil
+}
 
+func deleteClaimTokens(tx *sqlx.Tx, siteID UUID) error {
+	_, err := tx.Exec(`DELETE FROM auth_tokens WHERE rec_id = $1 AND expires_at IS NOT NULL`, siteID)
+	return err
 }
 
-func createAuthToken(tx *sqlx.Tx, recID UUID, expiresAt time.Time) (string, error) {
+// tokenSize is the number of random bytes of the tokens
+const tokenSize = 32
 
-	var expiresAtOrNull interface{}
-	if expiresAt.IsZero() {
-		expiresAtOrNull = nil
-	} else {
-		expiresAtOrNull = expiresAt
+// createAuthToken creates a token authenticating the record, and returns it. Only its hash is stored.
+func createAuthToken(tx *sqlx.Tx, recID UUID, expiresAt time.Time) (string, error) {
+	tok, err := newToken()
+	if err != nil {
+		return "", err
 	}
 
-	var tok string
-	r := tx.QueryRow(`
+	_, err = tx.Exec(`
 		INSERT INTO
-			auth_tokens(rec_id, token, expires_at)
-			VALUES ($1, gen_random_uuid(), $2)
-			RETURNING normalize_uuid(token)
-	`, recID, expiresAtOrNull)
-
-	err := r.Scan(&tok)
+			auth_tokens(id, rec_id, token_hash, created_at, expires_at)
+			VALUES (gen_random_uuid(), $1, $2, $3, $4)
+	`, recID, hashToken(tok), time.Now(), nullTime(expiresAt))
 	if err != nil {
 		return "", err
 	}
 
 	return tok, nil
 }
+
+// newToken returns a new random token
+func newToken() (string, error) {
+	buf := make([]byte, tokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// nullTime returns t, or nil if it is zero
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// hashToken returns the hash of the token, as stored in auth_tokens. The tokens are random, rather than
+// chosen by users, so that a fast hash is enough.
+func hashToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,14 +1,422 @@
 package db
 
 import (
+	"database/sql"
+	"fmt"
 	"os"
-	"testing"
 	"sec-ctl/cloud/config"
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/totp"
+	"testing"
+	"time"
+
+	"github.com/vincentcr/testify/assert"
 )
 
 func TestFoo(t *testing.T) {
 }
 
+func TestSiteTokensAreHashed(t *testing.T) {
+	site, tok, claimTok, _, err := db.CreateSite()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var stored int
+	err = db.conn.Get(&stored, `SELECT COUNT(*) FROM auth_tokens WHERE token_hash = $1 OR token_hash = $2`, tok, claimTok)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stored)
+
+	authed, err := db.AuthSiteByToken(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, site.ID, authed.ID)
+
+	_, err = db.AuthSiteByToken(claimTok)
+	assert.Error(t, err)
+}
+
+func TestRotateSiteToken(t *testing.T) {
+	site, oldTok, _, _, err := db.CreateSite()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	newTok, err := db.RotateSiteToken(site.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldTok, newTok)
+
+	_, err = db.AuthSiteByToken(oldTok)
+	assert.Error(t, err)
+
+	authed, err := db.AuthSiteByToken(newTok)
+	assert.NoError(t, err)
+	assert.Equal(t, site.ID, authed.ID)
+}
+
+// createTestUser creates a user with a unique email
+func createTestUser(t *testing.T) (User, string) {
+	user, tok, err := db.CreateUser(fmt.Sprintf("test-%d@example.com", time.Now().UnixNano()), "secret")
+	assert.NoError(t, err)
+	return user, tok
+}
+
+func TestSessionTokenExpires(t *testing.T) {
+	user, tok := createTestUser(t)
+
+	authed, info, err := db.AuthUserByToken(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, authed.ID)
+	assert.Equal(t, ScopeAdmin, info.Scope)
+	assert.Equal(t, SessionTokenName, info.Name)
+
+	_, err = db.conn.Exec(`UPDATE auth_tokens SET expires_at = $1 WHERE token_hash = $2`, time.Now().Add(-time.Minute), hashToken(tok))
+	assert.NoError(t, err)
+	_, _, err = db.AuthUserByToken(tok)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestCreateListAndRevokeTokens(t *testing.T) {
+	user, _ := createTestUser(t)
+
+	_, _, err := db.CreateToken(user.ID, "bad", Scope("root"), time.Time{})
+	assert.Equal(t, ErrInvalidScope, err)
+
+	info, tok, err := db.CreateToken(user.ID, "dashboard", ScopeReadOnly, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "dashboard", info.Name)
+	assert.Nil(t, info.ExpiresAt)
+
+	_, authedInfo, err := db.AuthUserByToken(tok)
+	assert.NoError(t, err)
+	assert.Equal(t, info.ID, authedInfo.ID)
+	assert.Equal(t, ScopeReadOnly, authedInfo.Scope)
+	assert.False(t, authedInfo.Scope.Allows(ScopeCommand))
+
+	tokens, err := db.ListTokens(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(tokens)) // with the session token of the signup
+	assert.Equal(t, info.ID, tokens[0].ID)
+
+	other, _ := createTestUser(t)
+	assert.Equal(t, sql.ErrNoRows, db.RevokeToken(other.ID, info.ID))
+
+	assert.NoError(t, db.RevokeToken(user.ID, info.ID))
+	_, _, err = db.AuthUserByToken(tok)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+// createClaimedSite creates a site claimed by a new user
+func createClaimedSite(t *testing.T) (Site, User) {
+	owner, _ := createTestUser(t)
+	site, _, claimTok, _, err := db.CreateSite()
+	assert.NoError(t, err)
+	assert.NoError(t, db.ClaimSite(owner, site.ID, claimTok))
+	return site, owner
+}
+
+func TestClaimMakesOwner(t *testing.T) {
+	site, owner := createClaimedSite(t)
+
+	m, err := db.FetchSiteMembership(owner.ID, site.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleOwner, m.Role)
+
+	sites, err := db.FetchSitesByMember(owner.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []SiteMembership{{Site: m.Site, Role: RoleOwner}}, sites)
+
+	stranger, _ := createTestUser(t)
+	m, err = db.FetchSiteMembership(stranger.ID, site.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Role(""), m.Role)
+}
+
+func TestInvitation(t *testing.T) {
+	site, owner := createClaimedSite(t)
+	invited, _ := createTestUser(t)
+	stranger, _ := createTestUser(t)
+
+	inv, tok, err := db.CreateInvitation(site.ID, owner.ID, invited.Email, RoleArmOnly)
+	assert.NoError(t, err)
+
+	invs, err := db.ListInvitations(site.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(invs))
+
+	_, err = db.AcceptInvitation(stranger, tok)
+	assert.Equal(t, ErrInvitationEmailMismatch, err)
+	_, err = db.AcceptInvitation(invited, "nope")
+	assert.Equal(t, ErrInvalidInvitation, err)
+
+	accepted, err := db.AcceptInvitation(invited, tok)
+	assert.NoError(t, err)
+	assert.Equal(t, inv.ID, accepted.ID)
+
+	members, err := db.ListMembers(site.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Member{
+		{UserID: UUID(owner.ID.String()), Email: owner.Email, Role: RoleOwner},
+		{UserID: UUID(invited.ID.String()), Email: invited.Email, Role: RoleArmOnly},
+	}, members)
+
+	// the invitation is used up, and the user is now a member
+	_, err = db.AcceptInvitation(invited, tok)
+	assert.Equal(t, ErrInvalidInvitation, err)
+	_, _, err = db.CreateInvitation(site.ID, owner.ID, invited.Email, RoleAdmin)
+	assert.Equal(t, ErrAlreadyMember, err)
+
+	assert.NoError(t, db.SetMemberRole(site.ID, invited.ID, RoleViewOnly))
+	assert.NoError(t, db.RemoveMember(site.ID, invited.ID))
+	assert.Equal(t, sql.ErrNoRows, db.RemoveMember(site.ID, invited.ID))
+}
+
+func TestMemberPINs(t *testing.T) {
+	site, owner := createClaimedSite(t)
+
+	_, err := db.FetchPINKey(site.ID)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	changed, err := db.SetPINKey(site.ID, "key1")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoError(t, db.SetMemberPIN(site.ID, owner.ID, []byte{1, 2, 3}))
+
+	encryptedPIN, err := db.FetchMemberPIN(site.ID, owner.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, encryptedPIN)
+	members, err := db.ListMembers(site.ID)
+	assert.NoError(t, err)
+	assert.True(t, members[0].HasPIN)
+
+	// publishing the same key again keeps the codes, but a new key deletes them
+	changed, err = db.SetPINKey(site.ID, "key1")
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	_, err = db.FetchMemberPIN(site.ID, owner.ID)
+	assert.NoError(t, err)
+
+	changed, err = db.SetPINKey(site.ID, "key2")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	_, err = db.FetchMemberPIN(site.ID, owner.ID)
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.Equal(t, sql.ErrNoRows, db.DeleteMemberPIN(site.ID, owner.ID))
+}
+
+func TestTOTP(t *testing.T) {
+	user, _ := createTestUser(t)
+
+	assert.Equal(t, ErrTOTPNotEnabled, db.VerifyTOTP(user.ID, "123456"))
+	secret, err := db.EnrollTOTP(user.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrInvalidTOTP, db.ConfirmTOTP(user.ID, "000000"))
+	assert.NoError(t, db.ConfirmTOTP(user.ID, code))
+	enabled, err := db.TOTPEnabled(user.ID)
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+
+	// the code used to confirm cannot be replayed
+	assert.Equal(t, ErrInvalidTOTP, db.VerifyTOTP(user.ID, code))
+	next, err := totp.Code(secret, totp.Step(time.Now())+1)
+	assert.NoError(t, err)
+	assert.NoError(t, db.VerifyTOTP(user.ID, next))
+
+	_, err = db.EnrollTOTP(user.ID)
+	assert.Equal(t, ErrTOTPAlreadyEnabled, err)
+	assert.NoError(t, db.DisableTOTP(user.ID))
+}
+
+func TestTOTPLockout(t *testing.T) {
+	user, _ := createTestUser(t)
+
+	secret, err := db.EnrollTOTP(user.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	code := func(offset int64) string {
+		code, err := totp.Code(secret, totp.Step(time.Now())+offset)
+		assert.NoError(t, err)
+		return code
+	}
+	assert.NoError(t, db.ConfirmTOTP(user.ID, code(0)))
+
+	// an expired code is invalid
+	for i := 0; i < MaxTOTPFailures; i++ {
+		assert.Equal(t, ErrInvalidTOTP, db.VerifyTOTP(user.ID, code(-10)))
+	}
+	// even a valid code is rejected, once locked
+	assert.Equal(t, ErrTOTPLocked, db.VerifyTOTP(user.ID, code(1)))
+
+	_, err = db.conn.Exec(`UPDATE users SET totp_failed_at = $2 WHERE id = $1`, user.ID, time.Now().Add(-TOTPLockout-time.Minute))
+	assert.NoError(t, err)
+	assert.NoError(t, db.VerifyTOTP(user.ID, code(1)))
+}
+
+func TestReauthenticate(t *testing.T) {
+	_, tok := createTestUser(t)
+
+	recent, err := db.Reauthenticated(tok)
+	assert.NoError(t, err)
+	assert.False(t, recent)
+
+	until, err := db.Reauthenticate(tok)
+	assert.NoError(t, err)
+	assert.True(t, until.After(time.Now()))
+	recent, err = db.Reauthenticated(tok)
+	assert.NoError(t, err)
+	assert.True(t, recent)
+
+	_, err = db.conn.Exec(`UPDATE auth_tokens SET reauthenticated_at = $1 WHERE token_hash = $2`, time.Now().Add(-ReauthTTL), hashToken(tok))
+	assert.NoError(t, err)
+	recent, err = db.Reauthenticated(tok)
+	assert.NoError(t, err)
+	assert.False(t, recent)
+}
+
+func TestStepUpRoles(t *testing.T) {
+	site, _ := createClaimedSite(t)
+
+	roles, err := db.FetchStepUpRoles(site.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Role{RoleOwner, RoleAdmin, RoleArmOnly}, roles)
+
+	assert.NoError(t, db.SetStepUpRoles(site.ID, []Role{}))
+	roles, err = db.FetchStepUpRoles(site.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Role{}, roles)
+
+	assert.Equal(t, ErrInvalidRole, db.SetStepUpRoles(site.ID, []Role{"nope"}))
+}
+
+func TestEvents(t *testing.T) {
+	site, _ := createClaimedSite(t)
+
+	// in two months, to span two partitions
+	t0 := time.Date(2026, 1, 31, 23, 59, 0, 0, time.UTC)
+	saved := []*sites.Event{
+		sites.NewEvent(sites.LevelInfo, "ZoneOpen").SetZoneID("001").SetDescription("Zone open"),
+		sites.NewEvent(sites.LevelAlarm, "PartitionInAlarm").SetPartitionID("1").SetDescription("Partition in alarm"),
+		sites.NewEvent(sites.LevelAlarm, "FireAlarm").SetDescription("Fire alarm triggered"),
+	}
+	for i, evt := range saved {
+		evt.Time = t0.Add(time.Duration(i) * time.Minute)
+		assert.NoError(t, db.SaveEvent(site.ID, *evt))
+	}
+
+	evts, err := db.GetEvents(site.ID, EventFilter{Limit: 10})
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(evts)) {
+		assert.Equal(t, "FireAlarm", evts[0].Code)
+		assert.Equal(t, site.ID, evts[0].SiteID)
+		assert.Equal(t, "ZoneOpen", evts[2].Code)
+		assert.Equal(t, "001", evts[2].ZoneID)
+	}
+
+	evts, err = db.GetEvents(site.ID, EventFilter{Level: "ALARM", PartitionID: "1", Limit: 10})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(evts)) {
+		assert.Equal(t, "PartitionInAlarm", evts[0].Code)
+	}
+
+	evts, err = db.GetEvents(site.ID, EventFilter{Search: "alarms", Since: t0.Add(time.Minute), Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(evts))
+
+	evts, err = db.GetEvents(site.ID, EventFilter{Code: "ZoneOpen", Until: t0.Add(time.Minute), Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(evts))
+
+	page, err := db.GetEvents(site.ID, EventFilter{Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(page))
+	page, err = db.GetEvents(site.ID, EventFilter{Before: page[1].ID, Limit: 2})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(page)) {
+		assert.Equal(t, "ZoneOpen", page[0].Code)
+	}
+
+	other, _ := createClaimedSite(t)
+	evts, err = db.GetEvents(other.ID, EventFilter{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(evts))
+
+	// the cursor must be an event of the site
+	_, err = db.GetEvents(other.ID, EventFilter{Before: page[0].ID, Limit: 2})
+	assert.Equal(t, ErrUnknownEvent, err)
+}
+
+func TestAuditLog(t *testing.T) {
+	site, owner := createClaimedSite(t)
+
+	record := func(action, outcome string) {
+		assert.NoError(t, db.RecordAudit(AuditEntry{
+			Time:      time.Now(),
+			ActorType: ActorUser,
+			ActorID:   owner.ID,
+			SiteID:    site.ID,
+			Action:    action,
+			Payload:   []byte(`{"Command":{"Code":"Disarm"}}`),
+			Status:    200,
+			Outcome:   outcome,
+		}))
+	}
+	record("site.command", OutcomeSuccess)
+	record("site.command", OutcomeFailure)
+	record("pin.set", OutcomeSuccess)
+
+	entries, err := db.GetAuditLog(AuditFilter{SiteID: site.ID})
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(entries)) {
+		assert.Equal(t, "pin.set", entries[0].Action)
+		assert.Equal(t, owner.ID.String(), entries[0].ActorID.String())
+		assert.Equal(t, site.ID, entries[0].SiteID)
+		assert.Equal(t, UUID(""), entries[0].TokenID)
+		assert.JSONEq(t, `{"Command":{"Code":"Disarm"}}`, string(entries[0].Payload))
+	}
+
+	entries, err = db.GetAuditLog(AuditFilter{SiteID: site.ID, Action: "site.command", Outcome: OutcomeFailure})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	page, err := db.GetAuditLog(AuditFilter{SiteID: site.ID, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(page))
+	page, err = db.GetAuditLog(AuditFilter{SiteID: site.ID, Before: page[1].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page))
+
+	var exported int
+	assert.NoError(t, db.ExportAuditLog(AuditFilter{ActorID: owner.ID, Limit: 1}, func(AuditEntry) error {
+		exported++
+		return nil
+	}))
+	assert.Equal(t, 3, exported)
+
+	// the log is append-only
+	_, err = db.conn.Exec(`UPDATE audit_log SET outcome = 'success' WHERE site_id = $1`, site.ID)
+	assert.Error(t, err)
+	_, err = db.conn.Exec(`DELETE FROM audit_log WHERE site_id = $1`, site.ID)
+	assert.Error(t, err)
+
+	admin, err := db.IsAdmin(owner.ID)
+	assert.NoError(t, err)
+	assert.False(t, admin)
+}
+
+func TestRoles(t *testing.T) {
+	assert.True(t, RoleOwner.Allows(RoleAdmin))
+	assert.True(t, RoleArmOnly.Allows(RoleArmOnly))
+	assert.False(t, RoleViewOnly.Allows(RoleArmOnly))
+	assert.False(t, Role("").Allows(RoleViewOnly))
+	assert.True(t, RoleAdmin.Outranks(RoleArmOnly))
+	assert.False(t, RoleAdmin.Outranks(RoleAdmin))
+}
+
 var db *DB
 
 func TestMain(m *testing.M) {
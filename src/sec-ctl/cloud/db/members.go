@@ -0,0 +1,301 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Role is what a member may do on a site
+type Role string
+
+const (
+	// RoleViewOnly allows reading the state and the events of the site
+	RoleViewOnly Role = "view-only"
+	// RoleArmOnly also allows arming the partitions, and triggering panic alarms
+	RoleArmOnly Role = "arm-only"
+	// RoleAdmin also allows every other command, and managing the members with a lower role
+	RoleAdmin Role = "admin"
+	// RoleOwner is the role of the user who claimed the site, which also allows managing the admins
+	RoleOwner Role = "owner"
+)
+
+// roleRanks orders the roles, each allowing what the lower ones do
+var roleRanks = map[Role]int{
+	RoleViewOnly: 1,
+	RoleArmOnly:  2,
+	RoleAdmin:    3,
+	RoleOwner:    4,
+}
+
+// Valid returns whether r is a known role
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Allows returns whether a member with role r may do what requires the role required
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[required]
+}
+
+// Outranks returns whether r is higher than other, ie whether a member with role r may manage
+// the members with role other, and grant it
+func (r Role) Outranks(other Role) bool {
+	return r.Valid() && roleRanks[r] > roleRanks[other]
+}
+
+// InvitationTTL is how long an invitation can be accepted
+const InvitationTTL = 7 * 24 * time.Hour
+
+var (
+	// ErrInvalidRole is returned when granting an unknown role
+	ErrInvalidRole = errors.New("Invalid role: must be owner, admin, arm-only or view-only")
+	// ErrInvalidInvitation is returned when accepting an invitation with an unknown token
+	ErrInvalidInvitation = errors.New("Invalid invitation token")
+	// ErrInvitationExpired is returned when accepting an expired invitation
+	ErrInvitationExpired = errors.New("Invitation expired")
+	// ErrInvitationEmailMismatch is returned when accepting an invitation sent to another email
+	ErrInvitationEmailMismatch = errors.New("Invitation was sent to another email")
+	// ErrAlreadyMember is returned when inviting or accepting an invitation for a member of the site
+	ErrAlreadyMember = errors.New("User is already a member of the site")
+)
+
+// Member is a user with a role on a site
+type Member struct {
+	UserID UUID `db:"user_id"`
+	Email  string
+	Role   Role
+	// HasPIN is whether the member stored their encrypted panel code
+	HasPIN bool `db:"has_pin"`
+}
+
+// SiteMembership is a site with the role of a user on it
+type SiteMembership struct {
+	Site
+	Role Role
+}
+
+// Invitation invites a user, by email, to become a member of a site
+type Invitation struct {
+	ID        UUID
+	SiteID    UUID `db:"site_id"`
+	Email     string
+	Role      Role
+	InvitedBy UUID      `db:"invited_by"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// invitationColumns selects the columns of Invitation
+const invitationColumns = `normalize_uuid(id) AS id, normalize_uuid(site_id) AS site_id, email, role,
+	normalize_uuid(invited_by) AS invited_by, created_at, expires_at`
+
+// FetchSiteMembership returns the site with the role of the user on it, which is empty if the user
+// is not a member. It returns sql.ErrNoRows if there is no such site.
+func (db *DB) FetchSiteMembership(userID UUID, siteID UUID) (SiteMembership, error) {
+	var m SiteMembership
+	err := db.conn.Get(&m, `
+		SELECT `+siteColumns+`, COALESCE(site_members.role, '') AS role
+			FROM sites
+				LEFT JOIN site_members ON site_members.site_id = sites.id AND site_members.user_id = $2
+			WHERE sites.id = $1
+	`, siteID, userID)
+	return m, err
+}
+
+// FetchSitesByMember returns the sites of which the user is a member, with their role
+func (db *DB) FetchSitesByMember(userID UUID) ([]SiteMembership, error) {
+	ms := []SiteMembership{}
+	err := db.conn.Select(&ms, `
+		SELECT `+siteColumns+`, site_members.role
+			FROM sites
+				JOIN site_members ON site_members.site_id = sites.id
+			WHERE site_members.user_id = $1
+			ORDER BY sites.id
+	`, userID)
+	return ms, err
+}
+
+// ListMembers returns the members of the site, by decreasing role then email
+func (db *DB) ListMembers(siteID UUID) ([]Member, error) {
+	members := []Member{}
+	err := db.conn.Select(&members, `
+		SELECT normalize_uuid(users.id) AS user_id, users.email, site_members.role,
+				member_pins.user_id IS NOT NULL AS has_pin
+			FROM site_members
+				JOIN users ON users.id = site_members.user_id
+				LEFT JOIN member_pins ON member_pins.site_id = site_members.site_id
+					AND member_pins.user_id = site_members.user_id
+			WHERE site_members.site_id = $1
+			ORDER BY
+				CASE site_members.role WHEN 'owner' THEN 1 WHEN 'admin' THEN 2 WHEN 'arm-only' THEN 3 ELSE 4 END,
+				users.email
+	`, siteID)
+	return members, err
+}
+
+// SetMemberRole changes the role of the member. It returns sql.ErrNoRows if the user is not a member.
+func (db *DB) SetMemberRole(siteID UUID, userID UUID, role Role) error {
+	if !role.Valid() {
+		return ErrInvalidRole
+	}
+	res, err := db.conn.Exec(`UPDATE site_members SET role = $3 WHERE site_id = $1 AND user_id = $2`, siteID, userID, role)
+	return expectRowAffected(res, err)
+}
+
+// RemoveMember removes the user from the members of the site. It returns sql.ErrNoRows if the user
+// is not a member.
+func (db *DB) RemoveMember(siteID UUID, userID UUID) error {
+	res, err := db.conn.Exec(`DELETE FROM site_members WHERE site_id = $1 AND user_id = $2`, siteID, userID)
+	return expectRowAffected(res, err)
+}
+
+// CreateInvitation invites the email to become a member of the site with the role, and returns
+// the invitation with its token, expiring after InvitationTTL. Only the hash of the token is stored.
+func (db *DB) CreateInvitation(siteID UUID, invitedBy UUID, email string, role Role) (Invitation, string, error) {
+	if !role.Valid() {
+		return Invitation{}, "", ErrInvalidRole
+	}
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return Invitation{}, "", err
+	}
+	defer tx.Rollback()
+
+	var isMember bool
+	err = tx.Get(&isMember, `
+		SELECT EXISTS(
+			SELECT 1
+				FROM site_members
+					JOIN users ON users.id = site_members.user_id
+				WHERE site_members.site_id = $1 AND lower(users.email) = lower($2)
+		)
+	`, siteID, email)
+	if err != nil {
+		return Invitation{}, "", err
+	} else if isMember {
+		return Invitation{}, "", ErrAlreadyMember
+	}
+
+	tok, err := newToken()
+	if err != nil {
+		return Invitation{}, "", err
+	}
+
+	now := time.Now()
+	var inv Invitation
+	err = tx.Get(&inv, `
+		INSERT INTO
+			site_invitations(id, site_id, email, role, token_hash, invited_by, created_at, expires_at)
+			VALUES (gen_random_uuid(), $1, $2, $3, $4, $5, $6, $7)
+			RETURNING `+invitationColumns+`
+	`, siteID, email, role, hashToken(tok), invitedBy, now, now.Add(InvitationTTL))
+	if err != nil {
+		return Invitation{}, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Invitation{}, "", err
+	}
+
+	return inv, tok, nil
+}
+
+// ListInvitations returns the pending invitations of the site, most recent first
+func (db *DB) ListInvitations(siteID UUID) ([]Invitation, error) {
+	invs := []Invitation{}
+	err := db.conn.Select(&invs, `
+		SELECT `+invitationColumns+`
+			FROM site_invitations
+			WHERE site_id = $1 AND expires_at > $2
+			ORDER BY created_at DESC
+	`, siteID, time.Now())
+	return invs, err
+}
+
+// RevokeInvitation deletes the invitation. It returns sql.ErrNoRows if the site has no such invitation.
+func (db *DB) RevokeInvitation(siteID UUID, invitationID UUID) error {
+	res, err := db.conn.Exec(`DELETE FROM site_invitations WHERE site_id = $1 AND id = $2`, siteID, invitationID)
+	return expectRowAffected(res, err)
+}
+
+// AcceptInvitation makes the user a member of the site with the role of the invitation, if it was
+// sent to their email, and deletes it
+func (db *DB) AcceptInvitation(user User, token string) (Invitation, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return Invitation{}, err
+	}
+	defer tx.Rollback()
+
+	var inv Invitation
+	err = tx.Get(&inv, `
+		SELECT `+invitationColumns+`
+			FROM site_invitations
+			WHERE token_hash = $1
+			FOR UPDATE
+	`, hashToken(token))
+	if err == sql.ErrNoRows {
+		return Invitation{}, ErrInvalidInvitation
+	} else if err != nil {
+		return Invitation{}, err
+	}
+
+	if inv.ExpiresAt.Before(time.Now()) {
+		return Invitation{}, ErrInvitationExpired
+	}
+	if !strings.EqualFold(inv.Email, user.Email) {
+		return Invitation{}, ErrInvitationEmailMismatch
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO site_members(site_id, user_id, role)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+	`, inv.SiteID, user.ID, inv.Role)
+	if err = expectRowAffected(res, err); err == sql.ErrNoRows {
+		return Invitation{}, ErrAlreadyMember
+	} else if err != nil {
+		return Invitation{}, err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM site_invitations WHERE id = $1`, inv.ID); err != nil {
+		return Invitation{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return Invitation{}, err
+	}
+
+	return inv, nil
+}
+
+// addMember makes the user a member of the site with the role, or changes their role if they are one
+func addMember(tx *sqlx.Tx, siteID UUID, userID UUID, role Role) error {
+	_, err := tx.Exec(`
+		INSERT INTO site_members(site_id, user_id, role)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (site_id, user_id) DO UPDATE SET role = EXCLUDED.role
+	`, siteID, userID, role)
+	return err
+}
+
+// expectRowAffected returns sql.ErrNoRows if the statement affected no row
+func expectRowAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
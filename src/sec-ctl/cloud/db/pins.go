@@ -0,0 +1,69 @@
+package db
+
+import "database/sql"
+
+// SetPINKey sets the public key with which the members encrypt their code for the local daemon of
+// the site. If it changed, the codes encrypted with the previous key are deleted, as the daemon can
+// no longer decrypt them. It returns whether the key changed.
+func (db *DB) SetPINKey(siteID UUID, pinKey string) (bool, error) {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.Get(&current, `SELECT COALESCE(pin_key, '') FROM sites WHERE id = $1 FOR UPDATE`, siteID)
+	if err != nil {
+		return false, err
+	}
+	if current == pinKey {
+		return false, nil
+	}
+
+	if _, err = tx.Exec(`UPDATE sites SET pin_key = $2 WHERE id = $1`, siteID, pinKey); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(`DELETE FROM member_pins WHERE site_id = $1`, siteID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// FetchPINKey returns the public key of the site published by its local daemon, or sql.ErrNoRows
+// if it did not publish one yet
+func (db *DB) FetchPINKey(siteID UUID) (string, error) {
+	var pinKey sql.NullString
+	if err := db.conn.Get(&pinKey, `SELECT pin_key FROM sites WHERE id = $1`, siteID); err != nil {
+		return "", err
+	} else if !pinKey.Valid {
+		return "", sql.ErrNoRows
+	}
+	return pinKey.String, nil
+}
+
+// SetMemberPIN stores the encrypted code of the member of the site
+func (db *DB) SetMemberPIN(siteID UUID, userID UUID, encryptedPIN []byte) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO member_pins(site_id, user_id, encrypted_pin)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (site_id, user_id) DO UPDATE SET encrypted_pin = EXCLUDED.encrypted_pin
+	`, siteID, userID, encryptedPIN)
+	return err
+}
+
+// FetchMemberPIN returns the encrypted code of the member of the site, or sql.ErrNoRows if they
+// did not set one
+func (db *DB) FetchMemberPIN(siteID UUID, userID UUID) ([]byte, error) {
+	var encryptedPIN []byte
+	err := db.conn.Get(&encryptedPIN, `SELECT encrypted_pin FROM member_pins WHERE site_id = $1 AND user_id = $2`, siteID, userID)
+	return encryptedPIN, err
+}
+
+// DeleteMemberPIN deletes the code of the member of the site. It returns sql.ErrNoRows if they did
+// not set one.
+func (db *DB) DeleteMemberPIN(siteID UUID, userID UUID) error {
+	res, err := db.conn.Exec(`DELETE FROM member_pins WHERE site_id = $1 AND user_id = $2`, siteID, userID)
+	return expectRowAffected(res, err)
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"sec-ctl/pkg/totp"
+
+	"github.com/lib/pq"
+)
+
+// ReauthTTL is how long a re-authentication of a token allows the commands which require a step-up
+const ReauthTTL = 5 * time.Minute
+
+// MaxTOTPFailures is the number of failed TOTP verifications of a user after which TOTP is locked
+// for TOTPLockout after the last one, so that the codes cannot be guessed
+const MaxTOTPFailures = 5
+
+// TOTPLockout is how long the failed TOTP verifications of a user are counted
+const TOTPLockout = 15 * time.Minute
+
+var (
+	// ErrTOTPNotEnabled is returned when verifying a code of a user without TOTP, or confirming
+	// TOTP before enrolling
+	ErrTOTPNotEnabled = errors.New("TOTP is not enabled")
+	// ErrTOTPAlreadyEnabled is returned when enrolling a user whose TOTP is already enabled
+	ErrTOTPAlreadyEnabled = errors.New("TOTP is already enabled")
+	// ErrInvalidTOTP is returned when verifying a wrong, expired or already used code
+	ErrInvalidTOTP = errors.New("Invalid or already used TOTP code")
+	// ErrTOTPLocked is returned when verifying a code of a user after MaxTOTPFailures failures
+	ErrTOTPLocked = errors.New("Too many invalid TOTP codes: try again later")
+)
+
+// totpState is the TOTP secret of a user, which is pending until confirmed
+type totpState struct {
+	Secret   sql.NullString `db:"totp_secret"`
+	Enabled  bool           `db:"totp_enabled"`
+	LastStep int64          `db:"totp_last_step"`
+	Failures int            `db:"totp_failures"`
+	FailedAt *time.Time     `db:"totp_failed_at"`
+}
+
+// TOTPEnabled returns whether the user enabled TOTP
+func (db *DB) TOTPEnabled(userID UUID) (bool, error) {
+	var enabled bool
+	err := db.conn.Get(&enabled, `SELECT totp_enabled FROM users WHERE id = $1`, userID)
+	return enabled, err
+}
+
+// EnrollTOTP generates a new TOTP secret for the user, which ConfirmTOTP enables once the user
+// proves they have it, and returns it
+func (db *DB) EnrollTOTP(userID UUID) (string, error) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := db.conn.Exec(`UPDATE users SET totp_secret = $2 WHERE id = $1 AND NOT totp_enabled`, userID, secret)
+	if err = expectRowAffected(res, err); err == sql.ErrNoRows {
+		return "", ErrTOTPAlreadyEnabled
+	} else if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTP enables the TOTP secret of the user, if the code is valid
+func (db *DB) ConfirmTOTP(userID UUID, code string) error {
+	return db.withTOTP(userID, func(st totpState) (int64, error) {
+		if st.Enabled {
+			return 0, ErrTOTPAlreadyEnabled
+		} else if !st.Secret.Valid {
+			return 0, ErrTOTPNotEnabled
+		}
+		return validateTOTP(st, code)
+	})
+}
+
+// VerifyTOTP checks the code of the user, which cannot be used again
+func (db *DB) VerifyTOTP(userID UUID, code string) error {
+	return db.withTOTP(userID, func(st totpState) (int64, error) {
+		if !st.Enabled {
+			return 0, ErrTOTPNotEnabled
+		}
+		return validateTOTP(st, code)
+	})
+}
+
+// DisableTOTP deletes the TOTP secret of the user
+func (db *DB) DisableTOTP(userID UUID) error {
+	res, err := db.conn.Exec(`
+		UPDATE users SET totp_secret = NULL, totp_enabled = false, totp_last_step = 0, totp_failures = 0
+			WHERE id = $1 AND totp_secret IS NOT NULL
+	`, userID)
+	if err = expectRowAffected(res, err); err == sql.ErrNoRows {
+		return ErrTOTPNotEnabled
+	}
+	return err
+}
+
+// withTOTP locks the TOTP state of the user, and enables it with the step returned by check as
+// the last one used, unless check fails. It counts the invalid codes, and fails with ErrTOTPLocked
+// without calling check after MaxTOTPFailures of them within TOTPLockout.
+func (db *DB) withTOTP(userID UUID, check func(totpState) (int64, error)) error {
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var st totpState
+	err = tx.Get(&st, `
+		SELECT totp_secret, totp_enabled, totp_last_step, totp_failures, totp_failed_at
+			FROM users WHERE id = $1 FOR UPDATE
+	`, userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	failures := st.Failures
+	if st.FailedAt == nil || st.FailedAt.Before(now.Add(-TOTPLockout)) {
+		failures = 0
+	}
+	if failures >= MaxTOTPFailures {
+		return ErrTOTPLocked
+	}
+
+	step, err := check(st)
+	if err == ErrInvalidTOTP {
+		_, err = tx.Exec(`UPDATE users SET totp_failures = $2, totp_failed_at = $3 WHERE id = $1`, userID, failures+1, now)
+		if err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		return ErrInvalidTOTP
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET totp_enabled = true, totp_last_step = $2, totp_failures = 0 WHERE id = $1`, userID, step)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// validateTOTP returns the step of the code, unless it is invalid or a step already used
+func validateTOTP(st totpState, code string) (int64, error) {
+	step, ok := totp.Validate(st.Secret.String, code, time.Now())
+	if !ok || step <= st.LastStep {
+		return 0, ErrInvalidTOTP
+	}
+	return step, nil
+}
+
+// Reauthenticate records that the user of the token re-authenticated, and returns until when it
+// allows the commands which require a step-up
+func (db *DB) Reauthenticate(token string) (time.Time, error) {
+	now := time.Now()
+	res, err := db.conn.Exec(`UPDATE auth_tokens SET reauthenticated_at = $2 WHERE token_hash = $1`, hashToken(token), now)
+	if err = expectRowAffected(res, err); err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(ReauthTTL), nil
+}
+
+// Reauthenticated returns whether the user of the token re-authenticated within ReauthTTL
+func (db *DB) Reauthenticated(token string) (bool, error) {
+	var recent bool
+	err := db.conn.Get(&recent, `
+		SELECT COALESCE(reauthenticated_at > $2, false)
+			FROM auth_tokens
+			WHERE token_hash = $1
+	`, hashToken(token), time.Now().Add(-ReauthTTL))
+	return recent, err
+}
+
+// FetchStepUpRoles returns the roles of the members of the site whose disarm and panic commands
+// require a step-up
+func (db *DB) FetchStepUpRoles(siteID UUID) ([]Role, error) {
+	var names pq.StringArray
+	if err := db.conn.Get(&names, `SELECT step_up_roles FROM sites WHERE id = $1`, siteID); err != nil {
+		return nil, err
+	}
+
+	roles := make([]Role, len(names))
+	for i, name := range names {
+		roles[i] = Role(name)
+	}
+	return roles, nil
+}
+
+// SetStepUpRoles sets the roles of the members of the site whose disarm and panic commands
+// require a step-up
+func (db *DB) SetStepUpRoles(siteID UUID, roles []Role) error {
+	names := make(pq.StringArray, len(roles))
+	for i, role := range roles {
+		if !role.Valid() {
+			return ErrInvalidRole
+		}
+		names[i] = string(role)
+	}
+
+	res, err := db.conn.Exec(`UPDATE sites SET step_up_roles = $2 WHERE id = $1`, siteID, names)
+	return expectRowAffected(res, err)
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Scope is what a user token allows
+type Scope string
+
+const (
+	// ScopeReadOnly allows reading the sites, their state and their events
+	ScopeReadOnly Scope = "read-only"
+	// ScopeCommand also allows sending commands to the sites
+	ScopeCommand Scope = "command"
+	// ScopeAdmin also allows claiming sites and managing the tokens of the user
+	ScopeAdmin Scope = "admin"
+)
+
+// scopeRanks orders the scopes, each allowing what the lower ones do
+var scopeRanks = map[Scope]int{
+	ScopeReadOnly: 1,
+	ScopeCommand:  2,
+	ScopeAdmin:    3,
+}
+
+// Valid returns whether s is a known scope
+func (s Scope) Valid() bool {
+	_, ok := scopeRanks[s]
+	return ok
+}
+
+// Allows returns whether a token of scope s may do what requires the scope required
+func (s Scope) Allows(required Scope) bool {
+	return s.Valid() && scopeRanks[s] >= scopeRanks[required]
+}
+
+// SessionTokenTTL is how long the tokens returned by signup and login are valid
+const SessionTokenTTL = 30 * 24 * time.Hour
+
+// SessionTokenName is the name of the tokens returned by signup and login
+const SessionTokenName = "login"
+
+// ErrInvalidScope is returned when creating a token with an unknown scope
+var ErrInvalidScope = errors.New("Invalid scope: must be read-only, command or admin")
+
+// TokenInfo describes a token of a user. The token itself is only returned on creation.
+type TokenInfo struct {
+	ID        UUID
+	Name      string
+	Scope     Scope
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt *time.Time `db:"expires_at"`
+}
+
+// tokenColumns selects the columns of TokenInfo
+const tokenColumns = "normalize_uuid(id) AS id, name, scope, created_at, expires_at"
+
+// AuthUserByToken returns the user authenticated by the token, and the description of the token,
+// with its scope, unless the token expired
+func (db *DB) AuthUserByToken(token string) (User, TokenInfo, error) {
+	var u User
+	var t TokenInfo
+	err := db.conn.QueryRow(`
+		SELECT users.id, users.email, normalize_uuid(auth_tokens.id), auth_tokens.name, auth_tokens.scope,
+				auth_tokens.created_at, auth_tokens.expires_at
+			FROM users
+				JOIN auth_tokens ON auth_tokens.rec_id = users.id
+			WHERE token_hash = $1
+				AND (expires_at IS NULL OR expires_at > $2)
+	`, hashToken(token), time.Now()).Scan(&u.ID, &u.Email, &t.ID, &t.Name, &t.Scope, &t.CreatedAt, &t.ExpiresAt)
+	if err != nil {
+		return User{}, TokenInfo{}, err
+	}
+
+	return u, t, nil
+}
+
+// CreateToken creates a token for the user, and returns its description with the token itself.
+// The token does not expire if expiresAt is zero.
+func (db *DB) CreateToken(userID UUID, name string, scope Scope, expiresAt time.Time) (TokenInfo, string, error) {
+	if !scope.Valid() {
+		return TokenInfo{}, "", ErrInvalidScope
+	}
+
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return TokenInfo{}, "", err
+	}
+	defer tx.Rollback()
+
+	t, tok, err := createUserToken(tx, userID, name, scope, expiresAt)
+	if err != nil {
+		return TokenInfo{}, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return TokenInfo{}, "", err
+	}
+
+	return t, tok, nil
+}
+
+// ListTokens returns the tokens of the user which did not expire, most recent first
+func (db *DB) ListTokens(userID UUID) ([]TokenInfo, error) {
+	tokens := []TokenInfo{}
+	err := db.conn.Select(&tokens, `
+		SELECT `+tokenColumns+`
+			FROM auth_tokens
+			WHERE rec_id = $1
+				AND (expires_at IS NULL OR expires_at > $2)
+			ORDER BY created_at DESC
+	`, userID, time.Now())
+	return tokens, err
+}
+
+// RevokeToken deletes the token of the user. It returns sql.ErrNoRows if the user has no such token.
+func (db *DB) RevokeToken(userID UUID, tokenID UUID) error {
+	res, err := db.conn.Exec(`DELETE FROM auth_tokens WHERE rec_id = $1 AND id = $2`, userID, tokenID)
+	return expectRowAffected(res, err)
+}
+
+func createUserToken(tx *sqlx.Tx, userID UUID, name string, scope Scope, expiresAt time.Time) (TokenInfo, string, error) {
+	tok, err := newToken()
+	if err != nil {
+		return TokenInfo{}, "", err
+	}
+
+	var t TokenInfo
+	err = tx.Get(&t, `
+		INSERT INTO
+			auth_tokens(id, rec_id, token_hash, name, scope, created_at, expires_at)
+			VALUES (gen_random_uuid(), $1, $2, $3, $4, $5, $6)
+			RETURNING `+tokenColumns+`
+	`, userID, hashToken(tok), name, scope, time.Now(), nullTime(expiresAt))
+	if err != nil {
+		return TokenInfo{}, "", err
+	}
+
+	return t, tok, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"sec-ctl/cloud/db"
+	"sec-ctl/pkg/health"
+)
+
+// newHealthChecker checks that the queue consume loops are not stalled, for liveness, and that the
+// database and redis are reachable, for readiness
+func newHealthChecker(reg *siteRegistry, queue *queue, dbConn *db.DB) *health.Checker {
+	checker := health.NewChecker()
+
+	checker.AddLiveness("consumers", func(ctx context.Context) health.Component {
+		running, stalled := queue.consumeLoopsStatus()
+		sort.Strings(stalled)
+		details := map[string]interface{}{
+			"Running":        running,
+			"ConnectedSites": reg.countConnectedSites(),
+		}
+		if len(stalled) > 0 {
+			details["Stalled"] = stalled
+			return health.Down("consume loops stalled", details)
+		}
+		return health.Up(details)
+	})
+
+	checker.AddReadiness("db", func(ctx context.Context) health.Component {
+		if err := dbConn.Ping(ctx); err != nil {
+			return health.Down(err.Error(), nil)
+		}
+		return health.Up(nil)
+	})
+
+	checker.AddReadiness("redis", func(ctx context.Context) health.Component {
+		if err := queue.ping(); err != nil {
+			return health.Down(err.Error(), nil)
+		}
+		return health.Up(nil)
+	})
+
+	return checker
+}
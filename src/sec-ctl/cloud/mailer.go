@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"sec-ctl/cloud/config"
+)
+
+var errMailDisabled = errors.New("no SMTP server configured")
+
+// mailer sends plain text emails through the SMTP server of the config, if any
+type mailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newMailer(cfg config.Config) *mailer {
+	m := &mailer{addr: cfg.SMTPAddr, from: cfg.SMTPFrom}
+	if cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		m.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return m
+}
+
+// enabled returns whether an SMTP server is configured
+func (m *mailer) enabled() bool {
+	return m.addr != ""
+}
+
+// send emails body to the address, which must have been validated: it is written as is in the headers
+func (m *mailer) send(to string, subject string, body string) error {
+	if !m.enabled() {
+		return errMailDisabled
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.from, to, subject, strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
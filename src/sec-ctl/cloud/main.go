@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"sec-ctl/cloud/config"
 	"sec-ctl/cloud/db"
+	"sec-ctl/pkg/util"
+	"syscall"
 )
 
 var logger = log.New(os.Stderr, "[cloud] ", log.LstdFlags|log.Lshortfile)
@@ -26,7 +29,24 @@ func main() {
 		logger.Panicln(err)
 	}
 
-	registry := newRegistry(db, queue)
+	// on SIGTERM, eg docker stop, stop taking requests, close the site connections,
+	// and put the messages being consumed back in their queue
+	ctx, stop := util.WithSignals(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	deadline, cancel := util.WithShutdownDeadline(ctx, cfg.ShutdownTimeout)
+	defer cancel()
 
-	runRESTAPI(registry, db, cfg.RESTBindHost, cfg.RESTBindPort)
+	registry := newRegistry(ctx, db, queue)
+
+	checker := newHealthChecker(registry, queue, db)
+
+	if err := runRESTAPI(ctx, deadline, cfg, registry, db, checker); err != nil {
+		logger.Panicln(err)
+	}
+
+	logger.Println("shutting down")
+	registry.shutdown(deadline)
+	queue.close()
+	db.Close()
+	logger.Println("shut down")
 }
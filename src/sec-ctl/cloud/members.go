@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"sec-ctl/cloud/db"
+	"sec-ctl/pkg/sites"
+
+	"github.com/gin-gonic/gin"
+)
+
+const invitationMailMsg = `%s invited you to the SecCtl site %s, as %s.
+
+To accept, log in or sign up with this email, then run:
+
+  secctl accept %s
+
+or POST {"Token": "%s"} to %s/invitations/accept.
+
+The invitation expires on %s.
+`
+
+// createdInvitation is a new invitation. Its token is only returned, once, if the cloud does not
+// send emails: otherwise only the invitee gets it, by email.
+type createdInvitation struct {
+	db.Invitation
+	Token string `json:",omitempty"`
+	// Emailed is whether the token was sent to the email, rather than to be passed on by the inviter
+	Emailed bool
+}
+
+// memberStore is the storage of the site members, which the member routes use to enforce the roles
+type memberStore interface {
+	ListMembers(siteID db.UUID) ([]db.Member, error)
+	FetchSiteMembership(userID db.UUID, siteID db.UUID) (db.SiteMembership, error)
+	SetMemberRole(siteID db.UUID, userID db.UUID, role db.Role) error
+	RemoveMember(siteID db.UUID, userID db.UUID) error
+}
+
+// commandRole returns the role required to send the command: arm-only members arm the partitions
+// and trigger panic alarms, and only admins disarm them or bypass zones
+func commandRole(code sites.UserCommandCode) db.Role {
+	switch code {
+	case sites.CmdArmAway, sites.CmdArmStay, sites.CmdArmWithPIN, sites.CmdArmWithZeroEntryDelay, sites.CmdPanic:
+		return db.RoleArmOnly
+	default:
+		return db.RoleAdmin
+	}
+}
+
+// canManage returns whether a member with role may change or remove a member with role target,
+// or grant target. Admins manage the lower roles, and the owner manages the admins too.
+func canManage(role db.Role, target db.Role) bool {
+	return role.Allows(db.RoleAdmin) && role.Outranks(target)
+}
+
+// setupMembers sets up the routes to share the site:
+//
+//   - admins invite a user with POST /sites/:id/invitations, which emails them an invitation token;
+//   - the user accepts it with POST /invitations/accept, to become a member with the invited role;
+//   - admins change the role of the members, or remove them, under /sites/:id/members.
+//
+// Members may also leave the site with DELETE /sites/:id/members/:userID, except its owner.
+func (rest rest) setupMembers(sitesRouter *gin.RouterGroup) {
+
+	sitesRouter.GET("/members", requireRole(db.RoleAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+
+		members, err := rest.members.ListMembers(site.ID)
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, members)
+	})
+
+	sitesRouter.PUT("/members/:userID", requireScope(db.ScopeAdmin), requireRole(db.RoleAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		role := c.MustGet("Role").(db.Role)
+		userID := db.UUID(c.Param("userID"))
+
+		var roleForm struct {
+			Role db.Role `binding:"required"`
+		}
+		if err := c.BindJSON(&roleForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		setAuditPayload(c, "Role", roleForm.Role)
+		if !roleForm.Role.Valid() {
+			c.JSON(400, &gin.H{"error": db.ErrInvalidRole.Error()})
+			return
+		}
+
+		target, ok := rest.fetchMember(c, site.ID, userID)
+		if !ok {
+			return
+		}
+		if !canManage(role, target.Role) || !canManage(role, roleForm.Role) {
+			c.JSON(403, &gin.H{"error": fmt.Sprintf("Role %s cannot change %s to %s", role, target.Role, roleForm.Role)})
+			return
+		}
+
+		if err := rest.members.SetMemberRole(site.ID, userID, roleForm.Role); err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"UserID": userID, "Role": roleForm.Role})
+	})
+
+	sitesRouter.DELETE("/members/:userID", requireScope(db.ScopeAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		user := c.MustGet("User").(db.User)
+		role := c.MustGet("Role").(db.Role)
+		userID := db.UUID(c.Param("userID"))
+
+		target, ok := rest.fetchMember(c, site.ID, userID)
+		if !ok {
+			return
+		}
+		if target.Role == db.RoleOwner {
+			c.JSON(409, &gin.H{"error": "The owner cannot be removed from the site"})
+			return
+		}
+		// the user ids of the urls are normalized, unlike that of the user
+		if userID.String() != user.ID.String() && !canManage(role, target.Role) {
+			c.JSON(403, &gin.H{"error": fmt.Sprintf("Role %s cannot remove %s", role, target.Role)})
+			return
+		}
+
+		if err := rest.members.RemoveMember(site.ID, userID); err != nil && err != sql.ErrNoRows {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"UserID": userID})
+	})
+
+	sitesRouter.GET("/invitations", requireRole(db.RoleAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+
+		invs, err := rest.db.ListInvitations(site.ID)
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, invs)
+	})
+
+	sitesRouter.POST("/invitations", requireScope(db.ScopeAdmin), requireRole(db.RoleAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		user := c.MustGet("User").(db.User)
+		role := c.MustGet("Role").(db.Role)
+
+		var invitationForm struct {
+			Email string  `binding:"required"`
+			Role  db.Role `binding:"required"`
+		}
+		if err := c.BindJSON(&invitationForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		setAuditPayload(c, "Email", invitationForm.Email)
+		setAuditPayload(c, "Role", invitationForm.Role)
+		if addr, err := mail.ParseAddress(invitationForm.Email); err != nil || addr.Address != invitationForm.Email {
+			c.JSON(400, &gin.H{"error": "Invalid email"})
+			return
+		}
+		if !invitationForm.Role.Valid() {
+			c.JSON(400, &gin.H{"error": db.ErrInvalidRole.Error()})
+			return
+		}
+		if !canManage(role, invitationForm.Role) {
+			c.JSON(403, &gin.H{"error": fmt.Sprintf("Role %s cannot invite %s", role, invitationForm.Role)})
+			return
+		}
+
+		inv, tok, err := rest.db.CreateInvitation(site.ID, user.ID, invitationForm.Email, invitationForm.Role)
+		if err == db.ErrAlreadyMember {
+			c.JSON(409, &gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		if !rest.mailer.enabled() {
+			c.JSON(200, createdInvitation{Invitation: inv, Token: tok})
+			return
+		}
+
+		// the token must only reach the mailbox of the invitee: an invitation which could not be
+		// emailed is revoked rather than returned
+		if err := rest.mailInvitation(user, inv, tok); err != nil {
+			logger.Printf("failed to email the invitation %v of site %v: %v", inv.ID, site.ID, err)
+			if err := rest.db.RevokeInvitation(site.ID, inv.ID); err != nil {
+				logger.Printf("failed to revoke the invitation %v of site %v: %v", inv.ID, site.ID, err)
+			}
+			c.JSON(502, &gin.H{"error": "Unable to email the invitation"})
+			return
+		}
+
+		c.JSON(200, createdInvitation{Invitation: inv, Emailed: true})
+	})
+
+	sitesRouter.DELETE("/invitations/:invitationID", requireScope(db.ScopeAdmin), requireRole(db.RoleAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		id := db.UUID(c.Param("invitationID"))
+
+		err := rest.db.RevokeInvitation(site.ID, id)
+		if err == sql.ErrNoRows {
+			c.JSON(404, &gin.H{"error": "Invitation not found"})
+			return
+		} else if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"ID": id})
+	})
+
+	rest.gin.POST("/invitations/accept", rest.authUserByToken(), requireScope(db.ScopeAdmin), func(c *gin.Context) {
+		user := c.MustGet("User").(db.User)
+
+		var acceptForm struct {
+			Token string `binding:"required"`
+		}
+		if err := c.BindJSON(&acceptForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		inv, err := rest.db.AcceptInvitation(user, acceptForm.Token)
+		switch err {
+		case nil:
+			c.Set("AuditSiteID", inv.SiteID)
+			setAuditPayload(c, "Role", inv.Role)
+			c.JSON(200, &gin.H{"SiteID": inv.SiteID, "Role": inv.Role})
+		case db.ErrInvalidInvitation:
+			c.JSON(404, &gin.H{"error": err.Error()})
+		case db.ErrInvitationExpired:
+			c.JSON(410, &gin.H{"error": err.Error()})
+		case db.ErrInvitationEmailMismatch:
+			c.JSON(403, &gin.H{"error": err.Error()})
+		case db.ErrAlreadyMember:
+			c.JSON(409, &gin.H{"error": err.Error()})
+		default:
+			c.JSON(500, &gin.H{"error": err.Error()})
+		}
+	})
+}
+
+// fetchMember returns the member of the site, or responds 404 if the user is not one
+func (rest rest) fetchMember(c *gin.Context, siteID db.UUID, userID db.UUID) (db.SiteMembership, bool) {
+	m, err := rest.members.FetchSiteMembership(userID, siteID)
+	if err == nil && m.Role == "" {
+		err = sql.ErrNoRows
+	}
+
+	if err == sql.ErrNoRows {
+		c.JSON(404, &gin.H{"error": "Member not found"})
+		return db.SiteMembership{}, false
+	} else if err != nil {
+		c.JSON(500, &gin.H{"error": err.Error()})
+		return db.SiteMembership{}, false
+	}
+	return m, true
+}
+
+// mailInvitation sends the invitation token to the invited email
+func (rest rest) mailInvitation(inviter db.User, inv db.Invitation, tok string) error {
+	baseURL := strings.TrimRight(rest.publicBaseURL, "/")
+	body := fmt.Sprintf(invitationMailMsg, inviter.Email, inv.SiteID, inv.Role, tok, tok, baseURL,
+		inv.ExpiresAt.Format(time.RFC1123))
+	return rest.mailer.send(inv.Email, "You are invited to a SecCtl site", body)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"sec-ctl/cloud/db"
+	"sec-ctl/pkg/sites"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vincentcr/testify/assert"
+)
+
+const (
+	testSiteID   = db.UUID("5173a9d1e4c04d5c8d8b6e2a1f0e9c7b")
+	testOwnerID  = db.UUID("00000000000000000000000000000001")
+	testAdminID  = db.UUID("00000000000000000000000000000002")
+	testAdmin2ID = db.UUID("00000000000000000000000000000003")
+	testArmID    = db.UUID("00000000000000000000000000000004")
+	testViewID   = db.UUID("00000000000000000000000000000005")
+)
+
+// fakeMemberStore keeps the roles of the members of the test site
+type fakeMemberStore struct {
+	roles map[db.UUID]db.Role
+}
+
+func newFakeMemberStore() *fakeMemberStore {
+	return &fakeMemberStore{roles: map[db.UUID]db.Role{
+		testOwnerID:  db.RoleOwner,
+		testAdminID:  db.RoleAdmin,
+		testAdmin2ID: db.RoleAdmin,
+		testArmID:    db.RoleArmOnly,
+		testViewID:   db.RoleViewOnly,
+	}}
+}
+
+func (s *fakeMemberStore) ListMembers(siteID db.UUID) ([]db.Member, error) {
+	members := []db.Member{}
+	for userID, role := range s.roles {
+		members = append(members, db.Member{UserID: userID, Role: role})
+	}
+	return members, nil
+}
+
+func (s *fakeMemberStore) FetchSiteMembership(userID db.UUID, siteID db.UUID) (db.SiteMembership, error) {
+	if siteID != testSiteID {
+		return db.SiteMembership{}, sql.ErrNoRows
+	}
+	return db.SiteMembership{Site: db.Site{ID: siteID, OwnerID: testOwnerID}, Role: s.roles[userID]}, nil
+}
+
+func (s *fakeMemberStore) SetMemberRole(siteID db.UUID, userID db.UUID, role db.Role) error {
+	s.roles[userID] = role
+	return nil
+}
+
+func (s *fakeMemberStore) RemoveMember(siteID db.UUID, userID db.UUID) error {
+	delete(s.roles, userID)
+	return nil
+}
+
+// newTestRouter serves the member and command routes of the test site, to the member userID,
+// authenticated with an admin token. The site and role are set the way getSite does.
+func newTestRouter(store *fakeMemberStore, userID db.UUID) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	rest := rest{gin: gin.New(), members: store}
+
+	sitesRouter := rest.gin.Group("/sites/:id", func(c *gin.Context) {
+		c.Set("User", db.User{ID: userID})
+		c.Set("Scope", db.ScopeAdmin)
+		c.Set("Site", db.Site{ID: testSiteID, OwnerID: testOwnerID})
+		c.Set("Role", store.roles[userID])
+	}, requireRole(db.RoleViewOnly))
+	rest.setupCommands(sitesRouter)
+	rest.setupMembers(sitesRouter)
+
+	return rest.gin
+}
+
+func serve(router *gin.Engine, method string, path string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(data)))
+	return w
+}
+
+func TestViewOnlyMemberCannotSendCommands(t *testing.T) {
+	router := newTestRouter(newFakeMemberStore(), testViewID)
+
+	for _, code := range []sites.UserCommandCode{sites.CmdArmAway, sites.CmdPanic, sites.CmdDisarm} {
+		cmd := sites.UserCommand{Code: code, PartitionID: "1"}
+		w := serve(router, "POST", "/sites/"+string(testSiteID)+"/commands", cmd)
+		assert.Equal(t, 403, w.Code, string(code))
+	}
+}
+
+func TestArmOnlyMemberCannotDisarm(t *testing.T) {
+	router := newTestRouter(newFakeMemberStore(), testArmID)
+
+	for _, code := range []sites.UserCommandCode{sites.CmdDisarm, sites.CmdBypassZone, sites.CmdUnbypassZone} {
+		cmd := sites.UserCommand{Code: code, PartitionID: "1", ZoneID: "001"}
+		w := serve(router, "POST", "/sites/"+string(testSiteID)+"/commands", cmd)
+		assert.Equal(t, 403, w.Code, string(code))
+		assert.Contains(t, w.Body.String(), "admin is required", string(code))
+	}
+}
+
+func TestAdminCannotManageAdmins(t *testing.T) {
+	store := newFakeMemberStore()
+	router := newTestRouter(store, testAdminID)
+	membersPath := "/sites/" + string(testSiteID) + "/members/"
+
+	w := serve(router, "PUT", membersPath+string(testAdmin2ID), gin.H{"Role": db.RoleViewOnly})
+	assert.Equal(t, 403, w.Code)
+	w = serve(router, "DELETE", membersPath+string(testAdmin2ID), nil)
+	assert.Equal(t, 403, w.Code)
+	w = serve(router, "PUT", membersPath+string(testViewID), gin.H{"Role": db.RoleAdmin})
+	assert.Equal(t, 403, w.Code, "granting admin")
+	assert.Equal(t, db.RoleAdmin, store.roles[testAdmin2ID])
+	assert.Equal(t, db.RoleViewOnly, store.roles[testViewID])
+
+	// the lower roles are managed
+	w = serve(router, "PUT", membersPath+string(testViewID), gin.H{"Role": db.RoleArmOnly})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, db.RoleArmOnly, store.roles[testViewID])
+	w = serve(router, "DELETE", membersPath+string(testArmID), nil)
+	assert.Equal(t, 200, w.Code)
+	_, ok := store.roles[testArmID]
+	assert.False(t, ok)
+}
+
+func TestOwnerManagesAdmins(t *testing.T) {
+	store := newFakeMemberStore()
+	router := newTestRouter(store, testOwnerID)
+
+	w := serve(router, "PUT", "/sites/"+string(testSiteID)+"/members/"+string(testAdminID), gin.H{"Role": db.RoleViewOnly})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, db.RoleViewOnly, store.roles[testAdminID])
+}
+
+func TestOwnerCannotBeRemoved(t *testing.T) {
+	store := newFakeMemberStore()
+
+	for _, userID := range []db.UUID{testOwnerID, testAdminID} {
+		router := newTestRouter(store, userID)
+		w := serve(router, "DELETE", "/sites/"+string(testSiteID)+"/members/"+string(testOwnerID), nil)
+		assert.Equal(t, 409, w.Code, string(userID))
+		assert.Equal(t, db.RoleOwner, store.roles[testOwnerID])
+	}
+}
+
+func TestMemberLeavesSite(t *testing.T) {
+	store := newFakeMemberStore()
+	router := newTestRouter(store, testViewID)
+	membersPath := "/sites/" + string(testSiteID) + "/members/"
+
+	w := serve(router, "DELETE", membersPath+string(testArmID), nil)
+	assert.Equal(t, 403, w.Code)
+	w = serve(router, "DELETE", membersPath+string(testViewID), nil)
+	assert.Equal(t, 200, w.Code)
+	_, ok := store.roles[testViewID]
+	assert.False(t, ok)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/url"
+	"time"
+
+	"sec-ctl/cloud/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupOnboarding sets up the routes to register a site, and for a user to claim it:
+//
+//   - the local daemon registers with POST /sites, and prints the setup URL of the site;
+//   - the user opens the setup URL, which serves the claim page, and logs in to claim the site,
+//     or claims it through the api with POST /sites/:id/claim;
+//   - once its claim token expired, the local daemon gets a new one with POST /sites/:id/claimToken.
+//
+// The local daemon replaces its own token with POST /sites/:id/token, and publishes the public key
+// with which the members encrypt their panel code with PUT /sites/:id/pinKey.
+func (rest rest) setupOnboarding() {
+
+	rest.gin.POST("/sites", func(c *gin.Context) {
+
+		site, tok, claimTok, claimExpiresAt, err := rest.db.CreateSite()
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+		c.Set("AuditSiteID", site.ID)
+
+		c.JSON(200, &gin.H{
+			"SiteID":         site.ID,
+			"Token":          tok,
+			"SetupURL":       setupURL(site.ID, claimTok),
+			"ClaimExpiresAt": claimExpiresAt,
+		})
+	})
+
+	rest.gin.POST("/sites/:id/claimToken", rest.authSiteByToken(), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		if site.ID != db.UUID(c.Param("id")) {
+			c.JSON(403, &gin.H{"error": "Token does not authenticate this site"})
+			return
+		}
+
+		claimTok, claimExpiresAt, err := rest.db.RegenerateClaimToken(site.ID)
+		if err == db.ErrAlreadyClaimed {
+			c.JSON(409, &gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{
+			"SiteID":         site.ID,
+			"SetupURL":       setupURL(site.ID, claimTok),
+			"ClaimExpiresAt": claimExpiresAt,
+		})
+	})
+
+	rest.gin.POST("/sites/:id/token", rest.authSiteByToken(), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		if site.ID != db.UUID(c.Param("id")) {
+			c.JSON(403, &gin.H{"error": "Token does not authenticate this site"})
+			return
+		}
+
+		tok, err := rest.db.RotateSiteToken(site.ID)
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{
+			"SiteID": site.ID,
+			"Token":  tok,
+		})
+	})
+
+	rest.gin.PUT("/sites/:id/pinKey", rest.authSiteByToken(), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		if site.ID != db.UUID(c.Param("id")) {
+			c.JSON(403, &gin.H{"error": "Token does not authenticate this site"})
+			return
+		}
+
+		var keyForm struct {
+			PublicKey string `binding:"required"`
+		}
+		if err := c.BindJSON(&keyForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		if !validPINKey(keyForm.PublicKey) {
+			c.JSON(400, &gin.H{"error": "Invalid PublicKey: must be a PEM-encoded RSA public key"})
+			return
+		}
+
+		changed, err := rest.db.SetPINKey(site.ID, keyForm.PublicKey)
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+		if changed {
+			logger.Printf("site %v published a new PIN key: the stored panel codes were deleted", site.ID)
+		}
+
+		c.JSON(200, &gin.H{"SiteID": site.ID, "Changed": changed})
+	})
+
+	rest.gin.POST("/sites/:id/claim", rest.authUserByToken(), requireScope(db.ScopeAdmin), func(c *gin.Context) {
+		user := c.MustGet("User").(db.User)
+		siteID := db.UUID(c.Param("id"))
+
+		var claimForm struct {
+			ClaimToken string `binding:"required"`
+		}
+		if err := c.BindJSON(&claimForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		if status, err := rest.claimSite(user, siteID, claimForm.ClaimToken); err != nil {
+			c.JSON(status, &gin.H{"error": err.Error()})
+			return
+		}
+		c.Set("AuditSiteID", siteID)
+
+		c.JSON(200, &gin.H{"SiteID": siteID})
+	})
+
+	rest.gin.GET("/sites/:id/claim", func(c *gin.Context) {
+		renderClaimPage(c, 200, claimPageData{SiteID: c.Param("id"), ClaimToken: c.Query("t")})
+	})
+
+	rest.gin.POST("/sites/:id/claim/form", func(c *gin.Context) {
+		data := claimPageData{
+			SiteID:     c.Param("id"),
+			ClaimToken: c.PostForm("ClaimToken"),
+			Email:      c.PostForm("Email"),
+		}
+		setAuditPayload(c, "Email", data.Email)
+
+		user, err := rest.db.AuthUser(data.Email, c.PostForm("Password"))
+		if err == sql.ErrNoRows {
+			data.Error = "Invalid email or password"
+			renderClaimPage(c, 401, data)
+			return
+		} else if err != nil {
+			logger.Println("unexpected error", err)
+			data.Error = "Internal error, please try again later"
+			renderClaimPage(c, 500, data)
+			return
+		}
+
+		c.Set("User", user)
+
+		if status, err := rest.claimSite(user, db.UUID(data.SiteID), data.ClaimToken); err != nil {
+			data.Error = err.Error()
+			renderClaimPage(c, status, data)
+			return
+		}
+		c.Set("AuditSiteID", db.UUID(data.SiteID))
+
+		data.Claimed = true
+		renderClaimPage(c, 200, data)
+	})
+}
+
+// claimSite claims the site for the user, and returns the http status matching the error, if any
+func (rest rest) claimSite(user db.User, siteID db.UUID, claimToken string) (int, error) {
+	err := rest.db.ClaimSite(user, siteID, claimToken)
+	switch err {
+	case nil:
+		return 200, nil
+	case db.ErrInvalidClaim:
+		return 400, err
+	case db.ErrClaimTokenExpired:
+		return 410, fmt.Errorf("%v: restart the local daemon with -claim to get a new setup URL", err)
+	default:
+		logger.Println("unexpected error", err)
+		return 500, fmt.Errorf("Internal error")
+	}
+}
+
+func setupURL(siteID db.UUID, claimToken string) string {
+	return fmt.Sprintf("/sites/%s/claim?t=%s", siteID, url.QueryEscape(claimToken))
+}
+
+type claimPageData struct {
+	SiteID     string
+	ClaimToken string
+	Email      string
+	Error      string
+	Claimed    bool
+	Expiry     time.Duration
+}
+
+var claimPage = template.Must(template.New("claim").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>SecCtl - Claim your site</title>
+</head>
+<body>
+  <h1>Claim your site</h1>
+  {{if .Claimed}}
+  <p>Site {{.SiteID}} is now yours. The local daemon can connect to the cloud.</p>
+  {{else}}
+  <p>Log in to claim site {{.SiteID}}. The claim link is valid for {{.Expiry}} after the site registered.</p>
+  {{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+  <form method="POST" action="/sites/{{.SiteID}}/claim/form">
+    <input type="hidden" name="ClaimToken" value="{{.ClaimToken}}">
+    <p><label>Email <input type="email" name="Email" value="{{.Email}}" required></label></p>
+    <p><label>Password <input type="password" name="Password" required></label></p>
+    <p><button type="submit">Claim</button></p>
+  </form>
+  {{end}}
+</body>
+</html>
+`))
+
+func renderClaimPage(c *gin.Context, status int, data claimPageData) {
+	data.Expiry = db.ClaimTokenTTL
+
+	var buf bytes.Buffer
+	if err := claimPage.Execute(&buf, data); err != nil {
+		logger.Println("failed to render claim page:", err)
+		c.AbortWithStatus(500)
+		return
+	}
+	c.Data(status, "text/html; charset=utf-8", buf.Bytes())
+}
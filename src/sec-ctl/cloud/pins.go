@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+
+	"sec-ctl/cloud/db"
+	"sec-ctl/pkg/pinvault"
+	"sec-ctl/pkg/sites"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxEncryptedPINSize bounds the encrypted codes, as large as the key of the site
+const maxEncryptedPINSize = 1024
+
+// setupPINs sets up the routes through which the members store their panel code, encrypted with
+// the public key published by the local daemon of the site, for the cloud to attach it to their
+// commands. The cloud never sees the codes.
+func (rest rest) setupPINs(sitesRouter *gin.RouterGroup) {
+
+	sitesRouter.GET("/pinKey", func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		user := c.MustGet("User").(db.User)
+
+		pinKey, err := rest.db.FetchPINKey(site.ID)
+		if err == sql.ErrNoRows {
+			c.JSON(404, &gin.H{"error": "The local daemon of the site did not publish its PIN key yet"})
+			return
+		} else if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		// the code is encrypted for the site and the member
+		c.JSON(200, &gin.H{"SiteID": site.ID, "MemberID": user.ID.String(), "PublicKey": pinKey})
+	})
+
+	sitesRouter.PUT("/pin", requireScope(db.ScopeAdmin), requireRole(db.RoleArmOnly), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		user := c.MustGet("User").(db.User)
+
+		var pinForm struct {
+			EncryptedPIN []byte `binding:"required"`
+		}
+		if err := c.BindJSON(&pinForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		if len(pinForm.EncryptedPIN) > maxEncryptedPINSize {
+			c.JSON(400, &gin.H{"error": "EncryptedPIN is too large"})
+			return
+		}
+
+		if err := rest.db.SetMemberPIN(site.ID, user.ID, pinForm.EncryptedPIN); err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"SiteID": site.ID})
+	})
+
+	sitesRouter.DELETE("/pin", requireScope(db.ScopeAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		user := c.MustGet("User").(db.User)
+
+		err := rest.db.DeleteMemberPIN(site.ID, user.ID)
+		if err == sql.ErrNoRows {
+			c.JSON(404, &gin.H{"error": "No panel code stored"})
+			return
+		} else if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"SiteID": site.ID})
+	})
+}
+
+// attachPIN sets the member who sends the command, and their encrypted code, if the command uses
+// one. It responds with an error and returns false if the command requires a code which the member
+// did not store.
+func (rest rest) attachPIN(c *gin.Context, siteID db.UUID, user db.User, cmd *sites.UserCommand) bool {
+	cmd.MemberID = user.ID.String()
+	if !cmd.NeedsPIN() && cmd.Code != sites.CmdBypassZone && cmd.Code != sites.CmdUnbypassZone {
+		return true
+	}
+
+	encryptedPIN, err := rest.db.FetchMemberPIN(siteID, user.ID)
+	if err == sql.ErrNoRows {
+		if cmd.NeedsPIN() {
+			c.JSON(400, &gin.H{"error": "No panel code stored: set yours with PUT /sites/:id/pin, eg with secctl pin"})
+			return false
+		}
+		return true
+	} else if err != nil {
+		c.JSON(500, &gin.H{"error": err.Error()})
+		return false
+	}
+
+	cmd.EncryptedPIN = encryptedPIN
+	return true
+}
+
+// validPINKey returns whether the key published by a local daemon can encrypt the codes
+func validPINKey(pinKey string) bool {
+	_, err := pinvault.ParsePublicKey(pinKey)
+	return err == nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -17,13 +20,32 @@ type qMessage struct {
 	id         []byte
 	expires    time.Time
 	data       []byte
+	// raw is the message as stored in redis, if it was read from it
+	raw []byte
 }
 
 type queue struct {
 	id          string
 	redisClient *redis.Client
+	// loops are the running consume loops
+	loops sync.Map
 }
 
+// consumeLoop tracks when a consume loop last polled its queue, to detect it stalled
+type consumeLoop struct {
+	routingKey string
+	// lastPoll is in unix nanoseconds, accessed atomically
+	lastPoll int64
+}
+
+func (l *consumeLoop) poll() {
+	atomic.StoreInt64(&l.lastPoll, time.Now().UnixNano())
+}
+
+// consumeStallTimeout is how long a consume loop may go without polling its queue before it is stalled,
+// eg blocked processing a message
+const consumeStallTimeout = 30 * time.Second
+
 func newQueue(redisHost string, redisPort uint16) (*queue, error) {
 	addr := fmt.Sprintf("%s:%d", redisHost, redisPort)
 	redisClient := redis.NewClient(&redis.Options{
@@ -53,18 +75,60 @@ func (q *queue) publishEx(routingKey string, data []byte, expires time.Time) err
 	return q.redisClient.RPush(routingKey, serialized).Err()
 }
 
-func (q *queue) startConsumeLoop(routingKey string, process func(qMessage) error) {
+// broadcast sends data to all the current subscribers of the channel. Unlike publish,
+// the data is lost if there is no subscriber.
+func (q *queue) broadcast(channel string, data []byte) error {
+	return q.redisClient.Publish(channel, string(data)).Err()
+}
+
+// subscribe returns the data broadcast to the channel, until unsubscribe is called
+func (q *queue) subscribe(channel string) (msgs <-chan []byte, unsubscribe func() error) {
+	pubsub := q.redisClient.Subscribe(channel)
+	ch := make(chan []byte)
 
 	go func() {
-		for {
+		defer close(ch)
+		for msg := range pubsub.Channel() {
+			ch <- []byte(msg.Payload)
+		}
+	}()
 
-			processingList := q.processingQueueName(routingKey)
-			if err := q.redisClient.BRPopLPush(routingKey, processingList, time.Duration(0)).Err(); err != nil {
+	return ch, pubsub.Close
+}
+
+// consumePollTimeout is how long the consume loop blocks waiting for a message, before checking its context
+const consumePollTimeout = time.Second
+
+// startConsumeLoop processes the messages of the queue until ctx is done. The messages taken from the
+// queue but not processed by then are put back in it, rather than left in the processing list of this
+// instance. The returned channel is closed once the loop stopped.
+func (q *queue) startConsumeLoop(ctx context.Context, routingKey string, process func(qMessage) error) <-chan struct{} {
+
+	done := make(chan struct{})
+
+	loop := &consumeLoop{routingKey: routingKey}
+	loop.poll()
+	q.loops.Store(loop, struct{}{})
+
+	go func() {
+		defer close(done)
+		defer q.loops.Delete(loop)
+
+		processingList := q.processingQueueName(routingKey)
+		defer q.requeue(routingKey, processingList)
+
+		for ctx.Err() == nil {
+			loop.poll()
+
+			err := q.redisClient.BRPopLPush(routingKey, processingList, consumePollTimeout).Err()
+			if err == redis.Nil { // timed out
+				continue
+			} else if err != nil {
 				// TODO: need better error handling
 				panic(err)
 			}
 
-			for {
+			for ctx.Err() == nil {
 				vals, err := q.redisClient.LRange(processingList, 0, 128).Result()
 
 				if err != nil {
@@ -77,10 +141,19 @@ func (q *queue) startConsumeLoop(routingKey string, process func(qMessage) error
 				}
 
 				for _, val := range vals {
+					if ctx.Err() != nil {
+						break
+					}
+
 					msg := newQMessageUnmarshalled(q, routingKey, []byte(val))
 
 					if !msg.expires.IsZero() && msg.expires.Before(time.Now()) {
 						logger.Printf("Discarding expired msg %v\n", msg)
+						// removed from the processing list like a processed one, not to be read again
+						if err := msg.ack(); err != nil {
+							logger.Printf("queue:%v unable to discard expired message %v: %v", routingKey, msg, err)
+						}
+						loop.poll()
 						continue
 					}
 
@@ -90,11 +163,66 @@ func (q *queue) startConsumeLoop(routingKey string, process func(qMessage) error
 					}
 
 					msg.ack()
+					loop.poll()
 				}
 
 			}
 		}
 	}()
+
+	return done
+}
+
+// requeue puts the messages left in the processing list back in the queue, to be consumed first
+func (q *queue) requeue(routingKey string, processingList string) {
+	vals, err := q.redisClient.LRange(processingList, 0, -1).Result()
+	if err != nil {
+		logger.Printf("queue:%v unable to requeue unprocessed messages: %v", routingKey, err)
+		return
+	} else if len(vals) == 0 {
+		return
+	}
+
+	// the oldest message is last in the processing list, and must be last in the queue to be popped first
+	args := make([]interface{}, len(vals))
+	for i, val := range vals {
+		args[i] = val
+	}
+	_, err = q.redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(routingKey, args...)
+		pipe.Del(processingList)
+		return nil
+	})
+	if err != nil {
+		logger.Printf("queue:%v unable to requeue unprocessed messages: %v", routingKey, err)
+		return
+	}
+	logger.Printf("queue:%v requeued %v unprocessed messages", routingKey, len(vals))
+}
+
+// ping checks that redis is reachable
+func (q *queue) ping() error {
+	return q.redisClient.Ping().Err()
+}
+
+// consumeLoopsStatus returns the number of running consume loops, and the routing keys of those stalled
+func (q *queue) consumeLoopsStatus() (running int, stalled []string) {
+	now := time.Now()
+	q.loops.Range(func(key, _ interface{}) bool {
+		loop := key.(*consumeLoop)
+		running++
+		lastPoll := time.Unix(0, atomic.LoadInt64(&loop.lastPoll))
+		if now.Sub(lastPoll) > consumeStallTimeout {
+			stalled = append(stalled, loop.routingKey)
+		}
+		return true
+	})
+	return running, stalled
+}
+
+// close closes the connection to redis
+func (q *queue) close() error {
+	return q.redisClient.Close()
 }
 
 func (q *queue) processingQueueName(routingKey string) string {
@@ -103,7 +231,10 @@ func (q *queue) processingQueueName(routingKey string) string {
 
 func (msg qMessage) ack() error {
 	processingList := msg.queue.processingQueueName(msg.routingKey)
-	serialized := msg.marshal()
+	serialized := msg.raw
+	if serialized == nil {
+		serialized = msg.marshal()
+	}
 	nRemoved, err := msg.queue.redisClient.LRem(processingList, 1, serialized).Result()
 	if err != nil {
 		return err
@@ -153,7 +284,7 @@ func (msg qMessage) marshal() []byte {
 	return serialized
 }
 
-func (msg qMessage) unmarshal(marshalled []byte) {
+func (msg *qMessage) unmarshal(marshalled []byte) {
 
 	fields := bytes.SplitN(marshalled, qMessageSep, 3)
 	if len(fields) != 3 {
@@ -172,4 +303,5 @@ func (msg qMessage) unmarshal(marshalled []byte) {
 	msg.id = id
 	msg.data = data
 	msg.expires = expires
+	msg.raw = marshalled
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"sec-ctl/cloud/db"
 	"sec-ctl/pkg/sites"
 	"sec-ctl/pkg/ws"
+	"time"
 )
 
 type remoteSite struct {
@@ -17,14 +19,25 @@ type remoteSite struct {
 	alarms              []sites.Alarm
 	eventChs            []chan sites.Event
 	stateChangeChs      []chan sites.StateChange
+
+	// ctx is done once the site is disconnected, or closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// commandsDone is closed once the commands of the site are no longer consumed
+	commandsDone <-chan struct{}
 }
 
 func getSiteQueueName(id db.UUID, purpose string) string {
 	return "sites:" + id.String() + ":" + purpose
 }
 
-func newRemoteSite(site db.Site, conn *ws.Conn, queue *queue) *remoteSite {
+// newRemoteSite relays the commands of the site to its connection, until it is disconnected,
+// or ctx is done
+func newRemoteSite(ctx context.Context, site db.Site, conn *ws.Conn, queue *queue) *remoteSite {
+	ctx, cancel := context.WithCancel(ctx)
 	c := &remoteSite{
+		ctx:            ctx,
+		cancel:         cancel,
 		id:             site.ID,
 		conn:           conn,
 		queue:          queue,
@@ -42,24 +55,28 @@ func newRemoteSite(site db.Site, conn *ws.Conn, queue *queue) *remoteSite {
 		c.send(ws.ControlMessage{Code: ws.CtrlGetState})
 	}()
 
-	go func() {
-		queue.startConsumeLoop(getSiteQueueName(site.ID, "commands"), func(msg qMessage) error {
-			cmd := sites.UserCommand{}
-			err := json.Unmarshal(msg.data, &cmd)
-			if err != nil {
-				return err
-			}
-			err = c.conn.Write(cmd)
-			if err != nil {
-				c.handleConnErr(err)
-			}
+	c.commandsDone = queue.startConsumeLoop(ctx, getSiteQueueName(site.ID, "commands"), func(msg qMessage) error {
+		cmd := sites.UserCommand{}
+		err := json.Unmarshal(msg.data, &cmd)
+		if err != nil {
 			return err
-		})
-	}()
+		}
+		err = c.conn.Write(cmd)
+		if err != nil {
+			c.handleConnErr(err)
+		}
+		return err
+	})
 
 	return c
 }
 
+// close stops consuming the commands of the site, and closes its connection
+func (c *remoteSite) close() {
+	c.cancel()
+	c.conn.Close()
+}
+
 func (c *remoteSite) readLoop() {
 	for {
 		i, err := c.conn.Read()
@@ -90,10 +107,21 @@ func (c *remoteSite) send(obj interface{}) {
 }
 
 func (c *remoteSite) handleConnErr(err error) {
+	if c.ctx.Err() != nil { // closed, or already disconnected
+		return
+	}
 	logger.Println("client disconnected:", err)
+	c.cancel()
+	// the connection may be half-open, eg when the site stopped answering the pings
+	c.conn.Close()
 	c.queue.publish(queueNameSiteRemoved, []byte(c.id))
 }
 
+// latency returns the round-trip time of the last ping of the site
+func (c *remoteSite) latency() time.Duration {
+	return c.conn.Latency()
+}
+
 func (c *remoteSite) Exec(cmd sites.UserCommand) error {
 
 	if err := cmd.Validate(); err != nil {
@@ -1,50 +1,102 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"strings"
+	"io"
+	"sec-ctl/cloud/config"
 	"sec-ctl/cloud/db"
+	"sec-ctl/pkg/health"
 	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/util"
 	"sec-ctl/pkg/ws"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type rest struct {
-	db       *db.DB
-	registry *siteRegistry
-	gin      *gin.Engine
+	db            *db.DB
+	members       memberStore
+	registry      *siteRegistry
+	checker       *health.Checker
+	heartbeat     ws.Heartbeat
+	mailer        *mailer
+	publicBaseURL string
+	gin           *gin.Engine
 }
 
-func runRESTAPI(reg *siteRegistry, db *db.DB, bindHost string, bindPort uint16) error {
+// runRESTAPI serves the api, and the websocket of the sites on its own address, until ctx is done,
+// then waits until deadline for the active requests
+func runRESTAPI(ctx context.Context, deadline context.Context, cfg config.Config, reg *siteRegistry, db *db.DB, checker *health.Checker) error {
 	rest := rest{
-		gin:      gin.Default(),
-		registry: reg,
-		db:       db,
+		gin:           gin.Default(),
+		registry:      reg,
+		db:            db,
+		members:       db,
+		checker:       checker,
+		heartbeat:     ws.Heartbeat{Interval: cfg.WSPingInterval, Timeout: cfg.WSPingTimeout},
+		mailer:        newMailer(cfg),
+		publicBaseURL: cfg.PublicBaseURL,
 	}
 
 	rest.setup()
-	bindAddr := fmt.Sprintf("%s:%d", bindHost, bindPort)
-	return rest.gin.Run(bindAddr)
+	wsEngine := gin.Default()
+	rest.setupWS(wsEngine)
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- util.ListenAndServe(ctx, deadline, fmt.Sprintf("%s:%d", cfg.RESTBindHost, cfg.RESTBindPort), rest.gin)
+	}()
+	go func() {
+		errCh <- util.ListenAndServe(ctx, deadline, fmt.Sprintf("%s:%d", cfg.WSBindHost, cfg.WSBindPort), wsEngine)
+	}()
+
+	// either server failing to start stops the app
+	if err := <-errCh; err != nil {
+		return err
+	}
+	return <-errCh
 }
 
-func (rest rest) setup() {
+// setupWS sets up the websocket endpoint, through which the local daemons of the sites connect
+// with their token
+func (rest rest) setupWS(g *gin.Engine) {
+	g.Use(rest.audit())
 
-	rest.gin.GET("/", func(c *gin.Context) {
-		c.String(200, "tpimon api 1.0")
-	})
+	g.GET("/ws", rest.authSiteByToken(), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+		if site.OwnerID == "" {
+			c.JSON(403, &gin.H{"error": "Site is not claimed"})
+			return
+		}
 
-	rest.gin.GET("/ws", rest.authSiteByToken(), func(c *gin.Context) {
-		conn, err := ws.UpgradeRequest(c.Writer, c.Request)
+		conn, err := ws.UpgradeRequest(c.Writer, c.Request, rest.heartbeat)
 		if err != nil {
 			logger.Println("Unable to upgrade request to websocket:", err)
 			c.JSON(400, &gin.H{"error": "Unable to upgrade to web socket"})
+			return
 		}
 
-		site := c.MustGet("Site").(db.Site)
 		rest.registry.initRemoteSite(site, conn)
 	})
+}
+
+func (rest rest) setup() {
+
+	// the audited actions are recorded even if rejected: audit comes before the authentication
+	rest.gin.Use(rest.audit())
+
+	rest.gin.GET("/", func(c *gin.Context) {
+		c.String(200, "tpimon api 1.0")
+	})
+
+	rest.gin.GET("/healthz", gin.WrapH(health.Handler(rest.checker.Liveness)))
+	rest.gin.GET("/readyz", gin.WrapH(health.Handler(rest.checker.Readiness)))
 
 	rest.gin.POST("/signup", func(c *gin.Context) {
 		var userForm struct {
@@ -56,11 +108,13 @@ func (rest rest) setup() {
 			c.JSON(400, &gin.H{"error": err.Error()})
 			return
 		}
+		setAuditPayload(c, "Email", userForm.Email)
 		user, tok, err := rest.db.CreateUser(userForm.Email, userForm.Password)
 		if err != nil {
 			c.JSON(500, &gin.H{"error": err.Error()})
 			return
 		}
+		c.Set("User", user)
 
 		c.JSON(200, &gin.H{
 			"user":  user,
@@ -68,67 +122,88 @@ func (rest rest) setup() {
 		})
 	})
 
-	rest.gin.POST("/sites", func(c *gin.Context) {
+	rest.gin.POST("/login", func(c *gin.Context) {
+		var loginForm struct {
+			Email    string `binding:"required"`
+			Password string `binding:"required"`
+		}
 
-		site, tok, claimTok, err := rest.db.CreateSite()
-		if err != nil {
+		if err := c.BindJSON(&loginForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		setAuditPayload(c, "Email", loginForm.Email)
+		user, err := rest.db.AuthUser(loginForm.Email, loginForm.Password)
+		if err == sql.ErrNoRows {
+			c.JSON(401, &gin.H{"error": "Invalid email or password"})
+			return
+		} else if err != nil {
 			c.JSON(500, &gin.H{"error": err.Error()})
 			return
 		}
 
-		setupURL := fmt.Sprintf("/sites/%s/firstTime?t=%s", site.ID, claimTok)
+		c.Set("User", user)
+
+		info, tok, err := rest.db.CreateToken(user.ID, db.SessionTokenName, db.ScopeAdmin, time.Now().Add(db.SessionTokenTTL))
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+		c.Set("TokenID", info.ID)
 
 		c.JSON(200, &gin.H{
-			"SiteID":   site.ID,
-			"Token":    tok,
-			"SetupURL": setupURL,
+			"user":      user,
+			"token":     tok,
+			"expiresAt": info.ExpiresAt,
 		})
 	})
 
-	rest.gin.POST("/sites/:id/claim", rest.authUserByToken(), func(c *gin.Context) {
-		site := c.MustGet("Site").(*remoteSite)
+	rest.gin.GET("/sites", rest.authUserByToken(), func(c *gin.Context) {
 		user := c.MustGet("User").(db.User)
 
-		var claimForm struct {
-			ClaimToken string `binding:"required"`
-		}
-		if err := c.BindJSON(&claimForm); err != nil {
-			c.JSON(400, &gin.H{"error": err.Error()})
+		summaries, err := rest.registry.listSites(user)
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
 			return
 		}
 
-		rest.db.ClaimSite(user, site.id, claimForm.ClaimToken)
+		c.JSON(200, summaries)
 	})
 
-	sitesRouter := rest.gin.Group("/sites/:id", rest.authUserByToken(), rest.getSite())
+	rest.setupOnboarding()
+	rest.setupTokens()
+	rest.setupStepUp()
+
+	// every member may read the site: the routes changing it require a higher role
+	sitesRouter := rest.gin.Group("/sites/:id", rest.authUserByToken(), rest.getSite(), requireRole(db.RoleViewOnly))
 	{
 		sitesRouter.GET("/", func(c *gin.Context) {
-			site := c.MustGet("Site").(*remoteSite)
-			c.JSON(200, site.GetState())
-		})
-
-		sitesRouter.POST("/commands", func(c *gin.Context) {
-
-			var cmd sites.UserCommand
-			if err := c.BindJSON(&cmd); err != nil {
-				c.JSON(400, &gin.H{"error": err.Error()})
-				return
-			}
-
 			site := c.MustGet("Site").(db.Site)
-			if err := rest.registry.sendCommand(site.ID, cmd); err != nil {
-				c.JSON(400, &gin.H{"error": err.Error()})
+			remote, ok := rest.registry.getConnectedSite(site.ID)
+			if !ok {
+				c.JSON(503, &gin.H{"error": "Site is not connected"})
 				return
 			}
-
-			c.JSON(202, "Command sent")
+			c.JSON(200, remote.GetState())
 		})
 
+		rest.setupCommands(sitesRouter)
+
 		sitesRouter.GET("/events", func(c *gin.Context) {
 
 			site := c.MustGet("Site").(db.Site)
-			evts, err := rest.registry.getLatestEvents(site.ID, 100)
+
+			filter, err := parseEventFilter(c)
 			if err != nil {
+				c.JSON(400, &gin.H{"error": err.Error()})
+				return
+			}
+
+			evts, err := rest.registry.getEvents(site.ID, filter)
+			if err == db.ErrUnknownEvent {
+				c.JSON(400, &gin.H{"error": fmt.Sprintf("Invalid before %d: the site has no such event", filter.Before)})
+				return
+			} else if err != nil {
 				c.JSON(500, "Internal Error")
 				return
 			}
@@ -136,9 +211,72 @@ func (rest rest) setup() {
 			c.JSON(200, evts)
 
 		})
+
+		sitesRouter.GET("/events/stream", func(c *gin.Context) {
+
+			site := c.MustGet("Site").(db.Site)
+			evts, unsubscribe := rest.registry.subscribeToEvents(site.ID)
+			defer unsubscribe()
+
+			c.Stream(func(w io.Writer) bool {
+				select {
+				case data, ok := <-evts:
+					if ok {
+						c.SSEvent("event", json.RawMessage(data))
+					}
+					return ok
+				case <-c.Request.Context().Done():
+					return false
+				}
+			})
+		})
+
+		rest.setupMembers(sitesRouter)
+		rest.setupPINs(sitesRouter)
+		rest.setupSiteStepUp(sitesRouter)
+		rest.setupAudit(sitesRouter)
 	}
 }
 
+// setupCommands sets up the route sending commands to the site: arm-only members arm it,
+// and the other commands require a higher role, see commandRole
+func (rest rest) setupCommands(sitesRouter *gin.RouterGroup) {
+	sitesRouter.POST("/commands", requireScope(db.ScopeCommand), requireRole(db.RoleArmOnly), func(c *gin.Context) {
+
+		var cmd sites.UserCommand
+		if err := c.BindJSON(&cmd); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		setAuditPayload(c, "Command", cmd.Redacted())
+
+		if role, required := c.MustGet("Role").(db.Role), commandRole(cmd.Code); !role.Allows(required) {
+			c.JSON(403, &gin.H{"error": fmt.Sprintf("Role %s does not allow %s: %s is required", role, cmd.Code, required)})
+			return
+		}
+
+		// the cloud never handles the panel codes: it attaches the encrypted code of the member instead
+		if cmd.PIN != "" || len(cmd.EncryptedPIN) > 0 {
+			c.JSON(400, &gin.H{"error": "Panel codes are not accepted: store yours with PUT /sites/:id/pin, eg with secctl pin"})
+			return
+		}
+		site := c.MustGet("Site").(db.Site)
+		if !rest.checkCommandStepUp(c, site.ID, c.MustGet("Role").(db.Role), cmd) {
+			return
+		}
+		if !rest.attachPIN(c, site.ID, c.MustGet("User").(db.User), &cmd) {
+			return
+		}
+
+		if err := rest.registry.sendCommand(site.ID, cmd); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(202, "Command sent")
+	})
+}
+
 // func setupRoutes(g *gin.Engine, reg *siteRegistry, db *db.DB) {
 
 // 	g.GET("/", func(c *gin.Context) {
@@ -246,6 +384,49 @@ func (rest rest) setup() {
 // 	}
 // }
 
+const defaultEventsLimit = 100
+const maxEventsLimit = 1000
+
+// parseEventFilter reads the event filter from the query parameters:
+// level, code, since and until (RFC 3339), partition, zone, q to search the descriptions, before
+// (the id of the last event of the previous page) and limit
+func parseEventFilter(c *gin.Context) (db.EventFilter, error) {
+	filter := db.EventFilter{
+		Level:       strings.ToUpper(c.Query("level")),
+		Code:        c.Query("code"),
+		PartitionID: c.Query("partition"),
+		ZoneID:      c.Query("zone"),
+		Search:      c.Query("q"),
+		Limit:       defaultEventsLimit,
+	}
+
+	var err error
+	if since := c.Query("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return db.EventFilter{}, fmt.Errorf("Invalid since: %v", err)
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return db.EventFilter{}, fmt.Errorf("Invalid until: %v", err)
+		}
+	}
+	if before := c.Query("before"); before != "" {
+		if filter.Before, err = strconv.ParseInt(before, 10, 64); err != nil || filter.Before <= 0 {
+			return db.EventFilter{}, fmt.Errorf("Invalid before %v: must be the id of an event", before)
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil || n == 0 || n > maxEventsLimit {
+			return db.EventFilter{}, fmt.Errorf("Invalid limit %v: must be between 1 and %d", limit, maxEventsLimit)
+		}
+		filter.Limit = uint(n)
+	}
+
+	return filter, nil
+}
+
 func requestAuthToken(c *gin.Context) string {
 
 	// try _t query param
@@ -270,14 +451,14 @@ func requestAuthToken(c *gin.Context) string {
 	return ""
 }
 
-func authResourceByToken(key string, fetch func(string) (interface{}, error)) gin.HandlerFunc {
+func authResourceByToken(key string, fetch func(c *gin.Context, token string) (interface{}, error)) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		tok := requestAuthToken(c)
 		if tok == "" {
 			c.AbortWithStatusJSON(401, &gin.H{"error": "Authorization required"})
 		} else {
-			res, err := fetch(tok)
+			res, err := fetch(c, tok)
 			if err == nil {
 				c.Set(key, res)
 			} else if err == sql.ErrNoRows {
@@ -290,30 +471,48 @@ func authResourceByToken(key string, fetch func(string) (interface{}, error)) gi
 	}
 }
 
+// authUserByToken authenticates the user, and sets the scope of their token for requireScope, the
+// token itself for checkStepUp, and its id for the audit log
 func (rest rest) authUserByToken() gin.HandlerFunc {
-	return authResourceByToken("User", func(token string) (interface{}, error) {
-		return rest.db.AuthUserByToken(token)
+	return authResourceByToken("User", func(c *gin.Context, token string) (interface{}, error) {
+		user, info, err := rest.db.AuthUserByToken(token)
+		if err == nil {
+			c.Set("Scope", info.Scope)
+			c.Set("Token", token)
+			c.Set("TokenID", info.ID)
+		}
+		return user, err
 	})
 }
 
 func (rest rest) authSiteByToken() gin.HandlerFunc {
-	return authResourceByToken("Site", func(token string) (interface{}, error) {
+	return authResourceByToken("Site", func(c *gin.Context, token string) (interface{}, error) {
 		return rest.db.AuthSiteByToken(token)
 	})
 }
 
+// requireScope rejects the requests whose user token, authenticated by authUserByToken, does not allow scope
+func requireScope(scope db.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if tokScope := c.MustGet("Scope").(db.Scope); !tokScope.Allows(scope) {
+			c.AbortWithStatusJSON(403, &gin.H{"error": fmt.Sprintf("Token scope %s does not allow this: %s is required", tokScope, scope)})
+		}
+	}
+}
+
+// getSite sets the site, and the role of the user on it for requireRole
 func (rest rest) getSite() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		user := c.MustGet("User").(db.User)
 
 		id := db.UUID(c.Param("id"))
-		site, err := rest.registry.getSite(user, id)
+		site, role, err := rest.registry.getSite(user, id)
 
 		if err != nil {
 			if err == sql.ErrNoRows {
 				c.AbortWithStatus(404)
-			} else if err.Error() == "Unauthorized" {
+			} else if err == errNotMember {
 				c.AbortWithStatus(403)
 			} else {
 				logger.Printf("Error fetching site: %v\n", err)
@@ -323,6 +522,15 @@ func (rest rest) getSite() gin.HandlerFunc {
 		}
 
 		c.Set("Site", site)
+		c.Set("Role", role)
+	}
+}
 
+// requireRole rejects the requests of the members whose role on the site, set by getSite, does not allow role
+func requireRole(role db.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if memberRole := c.MustGet("Role").(db.Role); !memberRole.Allows(role) {
+			c.AbortWithStatusJSON(403, &gin.H{"error": fmt.Sprintf("Role %s does not allow this: %s is required", memberRole, role)})
+		}
 	}
 }
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
-	"sync"
-	"time"
+	"errors"
 	"sec-ctl/cloud/db"
 	"sec-ctl/pkg/sites"
 	"sec-ctl/pkg/ws"
+	"sync"
+	"time"
 )
 
 // type siteRegistry struct {
@@ -37,55 +38,119 @@ import (
 const queueNameSiteRemoved = "sites.removed"
 
 type siteRegistry struct {
+	ctx            context.Context
 	db             *db.DB
 	queue          *queue
 	connectedSites sync.Map
+	// consumeLoops tracks the queue consume loops, to wait for them on shutdown
+	consumeLoops sync.WaitGroup
 }
 
-func newRegistry(dbConn *db.DB, queue *queue) *siteRegistry {
+// newRegistry creates the registry of the connected sites, which consumes their queues until ctx is done
+func newRegistry(ctx context.Context, dbConn *db.DB, queue *queue) *siteRegistry {
 
 	sr := &siteRegistry{
+		ctx:            ctx,
 		db:             dbConn,
 		queue:          queue,
 		connectedSites: sync.Map{},
 	}
 
-	queue.startConsumeLoop(queueNameSiteRemoved, func(msg qMessage) error {
+	sr.track(queue.startConsumeLoop(ctx, queueNameSiteRemoved, func(msg qMessage) error {
 		siteID := db.UUID(msg.data)
 		sr.connectedSites.Delete(siteID)
 		return nil
-	})
+	}))
 
 	return sr
 }
 
+// track adds the consume loop to those waited for on shutdown
+func (r *siteRegistry) track(done <-chan struct{}) {
+	r.consumeLoops.Add(1)
+	go func() {
+		<-done
+		r.consumeLoops.Done()
+	}()
+}
+
+// shutdown closes the connections of the sites, and waits until deadline for the consume loops
+// to process their current message, and put the others back in their queue
+func (r *siteRegistry) shutdown(deadline context.Context) {
+	r.connectedSites.Range(func(id, site interface{}) bool {
+		site.(*remoteSite).close()
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		r.consumeLoops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-deadline.Done():
+		logger.Println("shutdown deadline reached before the queues were released")
+	}
+}
+
 func (r *siteRegistry) initRemoteSite(site db.Site, conn *ws.Conn) {
 
-	remoteSite := newRemoteSite(site, conn, r.queue)
+	remoteSite := newRemoteSite(r.ctx, site, conn, r.queue)
 	r.connectedSites.Store(site.ID, remoteSite)
+	r.track(remoteSite.commandsDone)
 
-	r.queue.startConsumeLoop(getSiteQueueName(site.ID, "events"), func(msg qMessage) error {
+	// the events are consumed while the site is connected: those left are consumed on its next connection
+	r.track(r.queue.startConsumeLoop(remoteSite.ctx, getSiteQueueName(site.ID, "events"), func(msg qMessage) error {
 		var evt sites.Event
 		if err := json.Unmarshal(msg.data, &evt); err != nil {
 			logger.Panicf("failed to parse event from json %v: %v", msg.data, err)
 		}
 
-		return r.db.SaveEvent(string(evt.Level), evt.Time, site.ID, evt)
-	})
+		if err := r.db.SaveEvent(site.ID, evt); err != nil {
+			return err
+		}
+
+		if err := r.queue.broadcast(getSiteQueueName(site.ID, "events.live"), msg.data); err != nil {
+			logger.Printf("failed to broadcast event of site %v: %v", site.ID, err)
+		}
+		return nil
+	}))
+}
+
+// recordEvent saves the event of the site raised by the cloud itself, eg a security event, and
+// broadcasts it to the subscribers of its events
+func (r *siteRegistry) recordEvent(id db.UUID, evt sites.Event) {
+	if err := r.db.SaveEvent(id, evt); err != nil {
+		logger.Printf("failed to save event %v of site %v: %v", evt.Code, id, err)
+	}
+
+	data, err := json.Marshal(evt)
+	if err != nil {
+		logger.Panicf("Unable to jsonify %#v: %v", evt, err)
+	}
+	if err := r.queue.broadcast(getSiteQueueName(id, "events.live"), data); err != nil {
+		logger.Printf("failed to broadcast event of site %v: %v", id, err)
+	}
 }
 
-func (r *siteRegistry) getSite(user db.User, id db.UUID) (db.Site, error) {
+// errNotMember is returned when a user accesses a site of which they are not a member
+var errNotMember = errors.New("Unauthorized")
+
+// getSite returns the site with the role of the user on it, if they are a member
+func (r *siteRegistry) getSite(user db.User, id db.UUID) (db.Site, db.Role, error) {
 
-	s, err := r.db.FetchSiteByID(id)
+	m, err := r.db.FetchSiteMembership(user.ID, id)
 	if err != nil {
-		return db.Site{}, err
+		return db.Site{}, "", err
 	}
 
-	if s.OwnerID != user.ID {
-		return db.Site{}, fmt.Errorf("Unauthorized")
+	if m.Role == "" {
+		return db.Site{}, "", errNotMember
 	}
 
-	return s, nil
+	return m.Site, m.Role, nil
 }
 
 func (r *siteRegistry) sendCommand(id db.UUID, cmd sites.UserCommand) error {
@@ -100,7 +165,55 @@ func (r *siteRegistry) sendCommand(id db.UUID, cmd sites.UserCommand) error {
 	return r.queue.publishEx(queueName, data, expires)
 }
 
-func (r *siteRegistry) getLatestEvents(id db.UUID, max uint) ([]db.Event, error) {
-	return r.db.GetLatestEvents(id, max)
+func (r *siteRegistry) getConnectedSite(id db.UUID) (*remoteSite, bool) {
+	s, ok := r.connectedSites.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return s.(*remoteSite), true
+}
+
+func (r *siteRegistry) countConnectedSites() int {
+	n := 0
+	r.connectedSites.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// siteSummary describes a site in the list of sites of a user
+type siteSummary struct {
+	ID db.UUID
+	// Role is the role of the user on the site
+	Role      db.Role
+	Connected bool
+	// PingRTTMillis is the round-trip time of the last ping of the site, if connected
+	PingRTTMillis float64
+}
+
+func (r *siteRegistry) listSites(user db.User) ([]siteSummary, error) {
+	ms, err := r.db.FetchSitesByMember(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]siteSummary, len(ms))
+	for i, s := range ms {
+		summaries[i] = siteSummary{ID: s.ID, Role: s.Role}
+		if remote, connected := r.getConnectedSite(s.ID); connected {
+			summaries[i].Connected = true
+			summaries[i].PingRTTMillis = float64(remote.latency()) / float64(time.Millisecond)
+		}
+	}
+	return summaries, nil
+}
+
+// subscribeToEvents returns the json-encoded events of the site as they are received, until unsubscribe is called
+func (r *siteRegistry) subscribeToEvents(id db.UUID) (<-chan []byte, func() error) {
+	return r.queue.subscribe(getSiteQueueName(id, "events.live"))
+}
 
+func (r *siteRegistry) getEvents(id db.UUID, filter db.EventFilter) ([]db.Event, error) {
+	return r.db.GetEvents(id, filter)
 }
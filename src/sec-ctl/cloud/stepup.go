@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"sec-ctl/cloud/db"
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/totp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// totpHeader is the header in which the requests which require a step-up send a fresh TOTP code
+const totpHeader = "X-TOTP-Code"
+
+// totpIssuer names the cloud in the authenticator apps
+const totpIssuer = "SecCtl"
+
+var errStepUpRequired = fmt.Errorf("Step-up required: send a fresh TOTP code in %s, or re-authenticate with POST /reauth", totpHeader)
+
+// stepUpCommands are the commands which require a step-up, for the roles set on the site
+var stepUpCommands = map[sites.UserCommandCode]bool{
+	sites.CmdDisarm: true,
+	sites.CmdPanic:  true,
+}
+
+// setupStepUp sets up the routes through which users enroll in TOTP, and re-authenticate their
+// token, to step up for the commands which require it: a stolen token alone does not disarm a site.
+func (rest rest) setupStepUp() {
+	totpRouter := rest.gin.Group("/totp", rest.authUserByToken(), requireScope(db.ScopeAdmin))
+	{
+		totpRouter.GET("", func(c *gin.Context) {
+			user := c.MustGet("User").(db.User)
+
+			enabled, err := rest.db.TOTPEnabled(user.ID)
+			if err != nil {
+				c.JSON(500, &gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(200, &gin.H{"Enabled": enabled})
+		})
+
+		// enrolling requires the password, so that a stolen token cannot enroll its own authenticator
+		totpRouter.POST("", func(c *gin.Context) {
+			user := c.MustGet("User").(db.User)
+
+			var enrollForm struct {
+				Password string `binding:"required"`
+			}
+			if err := c.BindJSON(&enrollForm); err != nil {
+				c.JSON(400, &gin.H{"error": err.Error()})
+				return
+			}
+			if !rest.checkPassword(c, user, enrollForm.Password) {
+				return
+			}
+
+			secret, err := rest.db.EnrollTOTP(user.ID)
+			if err == db.ErrTOTPAlreadyEnabled {
+				c.JSON(409, &gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.JSON(500, &gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(200, &gin.H{"Secret": secret, "URL": totp.URL(totpIssuer, user.Email, secret)})
+		})
+
+		totpRouter.POST("/confirm", func(c *gin.Context) {
+			user := c.MustGet("User").(db.User)
+
+			var confirmForm struct {
+				Code string `binding:"required"`
+			}
+			if err := c.BindJSON(&confirmForm); err != nil {
+				c.JSON(400, &gin.H{"error": err.Error()})
+				return
+			}
+
+			switch err := rest.db.ConfirmTOTP(user.ID, confirmForm.Code); err {
+			case nil:
+				c.JSON(200, &gin.H{"Enabled": true})
+			case db.ErrInvalidTOTP:
+				c.JSON(403, &gin.H{"error": err.Error()})
+			case db.ErrTOTPLocked:
+				c.JSON(429, &gin.H{"error": err.Error()})
+			case db.ErrTOTPNotEnabled:
+				c.JSON(409, &gin.H{"error": "TOTP enrollment not started: POST /totp first"})
+			case db.ErrTOTPAlreadyEnabled:
+				c.JSON(409, &gin.H{"error": err.Error()})
+			default:
+				c.JSON(500, &gin.H{"error": err.Error()})
+			}
+		})
+
+		totpRouter.DELETE("", func(c *gin.Context) {
+			user := c.MustGet("User").(db.User)
+
+			if !rest.checkStepUp(c, "", "Disabling TOTP") {
+				return
+			}
+
+			err := rest.db.DisableTOTP(user.ID)
+			if err == db.ErrTOTPNotEnabled {
+				c.JSON(404, &gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.JSON(500, &gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(200, &gin.H{"Enabled": false})
+		})
+	}
+
+	// re-authenticating requires the password, and a TOTP code once enabled
+	rest.gin.POST("/reauth", rest.authUserByToken(), requireScope(db.ScopeCommand), func(c *gin.Context) {
+		user := c.MustGet("User").(db.User)
+
+		var reauthForm struct {
+			Password string `binding:"required"`
+			TOTPCode string
+		}
+		if err := c.BindJSON(&reauthForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		if !rest.checkPassword(c, user, reauthForm.Password) {
+			return
+		}
+
+		err := rest.db.VerifyTOTP(user.ID, reauthForm.TOTPCode)
+		if err == db.ErrInvalidTOTP {
+			c.JSON(403, &gin.H{"error": err.Error()})
+			return
+		} else if err == db.ErrTOTPLocked {
+			c.JSON(429, &gin.H{"error": err.Error()})
+			return
+		} else if err != nil && err != db.ErrTOTPNotEnabled {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		until, err := rest.db.Reauthenticate(c.MustGet("Token").(string))
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"ReauthenticatedUntil": until})
+	})
+}
+
+// setupSiteStepUp sets up the routes through which the owner of the site sets the roles of the
+// members whose disarm and panic commands require a step-up
+func (rest rest) setupSiteStepUp(sitesRouter *gin.RouterGroup) {
+
+	sitesRouter.GET("/stepUp", requireRole(db.RoleAdmin), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+
+		roles, err := rest.db.FetchStepUpRoles(site.ID)
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"Roles": roles})
+	})
+
+	// lifting the step-up requires one, so that a stolen token cannot lift it
+	sitesRouter.PUT("/stepUp", requireScope(db.ScopeAdmin), requireRole(db.RoleOwner), func(c *gin.Context) {
+		site := c.MustGet("Site").(db.Site)
+
+		var stepUpForm struct {
+			Roles []db.Role
+		}
+		if err := c.BindJSON(&stepUpForm); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+		setAuditPayload(c, "Roles", stepUpForm.Roles)
+		for _, role := range stepUpForm.Roles {
+			if !role.Valid() {
+				c.JSON(400, &gin.H{"error": db.ErrInvalidRole.Error()})
+				return
+			}
+		}
+
+		if !rest.checkStepUp(c, site.ID, "Changing the step-up roles") {
+			return
+		}
+
+		if err := rest.db.SetStepUpRoles(site.ID, stepUpForm.Roles); err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, &gin.H{"Roles": stepUpForm.Roles})
+	})
+}
+
+// checkCommandStepUp checks the step-up of the command, if the site requires one for the role of
+// the member. It responds with an error and returns false if the member did not step up.
+func (rest rest) checkCommandStepUp(c *gin.Context, siteID db.UUID, role db.Role, cmd sites.UserCommand) bool {
+	if !stepUpCommands[cmd.Code] {
+		return true
+	}
+
+	roles, err := rest.db.FetchStepUpRoles(siteID)
+	if err != nil {
+		c.JSON(500, &gin.H{"error": err.Error()})
+		return false
+	}
+	for _, r := range roles {
+		if r == role {
+			return rest.checkStepUp(c, siteID, cmd.String())
+		}
+	}
+	return true
+}
+
+// checkStepUp checks that the user stepped up, with a fresh TOTP code in the totpHeader, or by
+// re-authenticating their token with POST /reauth within db.ReauthTTL. Otherwise it responds with
+// an error, records the failed action as a security event of the site, if any, and returns false.
+func (rest rest) checkStepUp(c *gin.Context, siteID db.UUID, action string) bool {
+	user := c.MustGet("User").(db.User)
+
+	status, err := rest.stepUp(c, user)
+	if err == nil {
+		return true
+	}
+
+	c.JSON(status, &gin.H{"error": err.Error()})
+	if status != 500 && siteID != "" {
+		evt := sites.NewEvent(sites.LevelSecurity, "StepUpFailed").
+			SetDescription(fmt.Sprintf("%s by %s rejected: %v", action, user.Email, err)).
+			SetData("UserID", user.ID.String()).
+			SetData("Email", user.Email).
+			SetData("ClientIP", c.ClientIP())
+		rest.registry.recordEvent(siteID, *evt)
+	}
+	return false
+}
+
+// stepUp returns nil if the user stepped up, or the status and the error to respond with
+func (rest rest) stepUp(c *gin.Context, user db.User) (int, error) {
+	if code := c.GetHeader(totpHeader); code != "" {
+		switch err := rest.db.VerifyTOTP(user.ID, code); err {
+		case nil:
+			return 0, nil
+		case db.ErrInvalidTOTP:
+			return 403, err
+		case db.ErrTOTPLocked:
+			return 429, err
+		case db.ErrTOTPNotEnabled:
+			return 428, errors.New("TOTP is not enabled: enable it with POST /totp, or re-authenticate with POST /reauth")
+		default:
+			return 500, err
+		}
+	}
+
+	recent, err := rest.db.Reauthenticated(c.MustGet("Token").(string))
+	if err != nil {
+		return 500, err
+	} else if recent {
+		return 0, nil
+	}
+	return 428, errStepUpRequired
+}
+
+// checkPassword responds with an error and returns false unless password is that of the user
+func (rest rest) checkPassword(c *gin.Context, user db.User, password string) bool {
+	_, err := rest.db.AuthUser(user.Email, password)
+	if err == sql.ErrNoRows {
+		c.JSON(403, &gin.H{"error": "Invalid password"})
+		return false
+	} else if err != nil {
+		c.JSON(500, &gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"sec-ctl/cloud/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createdToken is a new token, returned once with its description
+type createdToken struct {
+	db.TokenInfo
+	Token string
+}
+
+// setupTokens sets up the routes through which users manage their personal access tokens,
+// eg a read-only token for a dashboard. They require a token of scope admin.
+func (rest rest) setupTokens() {
+	tokensRouter := rest.gin.Group("/tokens", rest.authUserByToken(), requireScope(db.ScopeAdmin))
+	{
+		tokensRouter.GET("", func(c *gin.Context) {
+			user := c.MustGet("User").(db.User)
+
+			tokens, err := rest.db.ListTokens(user.ID)
+			if err != nil {
+				c.JSON(500, &gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(200, tokens)
+		})
+
+		tokensRouter.POST("", func(c *gin.Context) {
+			user := c.MustGet("User").(db.User)
+
+			var tokenForm struct {
+				Name  string   `binding:"required"`
+				Scope db.Scope `binding:"required"`
+				// ExpiresAt is when the token expires. It never does if unset.
+				ExpiresAt time.Time
+			}
+			if err := c.BindJSON(&tokenForm); err != nil {
+				c.JSON(400, &gin.H{"error": err.Error()})
+				return
+			}
+			setAuditPayload(c, "Name", tokenForm.Name)
+			setAuditPayload(c, "Scope", tokenForm.Scope)
+			if !tokenForm.Scope.Valid() {
+				c.JSON(400, &gin.H{"error": db.ErrInvalidScope.Error()})
+				return
+			}
+			if !tokenForm.ExpiresAt.IsZero() && tokenForm.ExpiresAt.Before(time.Now()) {
+				c.JSON(400, &gin.H{"error": "ExpiresAt is in the past"})
+				return
+			}
+
+			info, tok, err := rest.db.CreateToken(user.ID, tokenForm.Name, tokenForm.Scope, tokenForm.ExpiresAt)
+			if err != nil {
+				c.JSON(500, &gin.H{"error": err.Error()})
+				return
+			}
+
+			setAuditPayload(c, "CreatedTokenID", info.ID)
+			c.JSON(200, createdToken{TokenInfo: info, Token: tok})
+		})
+
+		tokensRouter.DELETE("/:id", func(c *gin.Context) {
+			user := c.MustGet("User").(db.User)
+			id := db.UUID(c.Param("id"))
+
+			err := rest.db.RevokeToken(user.ID, id)
+			if err == sql.ErrNoRows {
+				c.JSON(404, &gin.H{"error": "Token not found"})
+				return
+			} else if err != nil {
+				c.JSON(500, &gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(200, &gin.H{"ID": id})
+		})
+	}
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"sync"
-	"time"
+	"context"
 	"sec-ctl/pkg/sites"
 	"sec-ctl/pkg/ws"
+	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
@@ -17,22 +18,43 @@ type cloudConnector struct {
 	connState connState
 	connMgr   *connectionManager
 	site      sites.Site
+	vault     *pinVault
 
 	sendQueue     *workQueue
 	recvQueue     *workQueue
 	writeLimiter  *rate.Limiter
 	connStateLock sync.Cond
+
+	settingsLock sync.Mutex
+	url          string
+	token        string
+	heartbeat    ws.Heartbeat
+
+	closed chan struct{}
 }
 
-func startCloudConnector(url string, token string, site sites.Site) {
+// startCloudConnector connects to the cloud, and relays the events of the site to it, and the commands
+// from it. It stops reconnecting and consuming its queues once ctx is done, until shutdown closes it.
+// The connection pings the cloud as configured by heartbeat, and is re-established once pings go unanswered.
+// The codes attached to the commands are decrypted with vault.
+func startCloudConnector(ctx context.Context, url string, token string, heartbeat ws.Heartbeat, site sites.Site, vault *pinVault) *cloudConnector {
 
 	c := &cloudConnector{
 		site:         site,
+		vault:        vault,
 		writeLimiter: rate.NewLimiter(rate.Limit(1024), 256),
+		url:          url,
+		token:        token,
+		heartbeat:    heartbeat,
+		closed:       make(chan struct{}),
 	}
 
 	c.connMgr = newConnectionManager("cloud", func() (interface{}, error) {
-		return ws.Dial(url, token)
+		c.settingsLock.Lock()
+		url, token, heartbeat := c.url, c.token, c.heartbeat
+		c.settingsLock.Unlock()
+
+		return ws.Dial(url, token, heartbeat)
 	})
 
 	c.sendQueue = newWorkQueue(c.sendMessage)
@@ -41,12 +63,36 @@ func startCloudConnector(url string, token string, site sites.Site) {
 	c.subscribeToTpiEvents()
 
 	go func() {
-		c.connMgr.connect()
-		c.connMgr.startReconnectLoop()
+		c.connMgr.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		c.connMgr.startReconnectLoop(ctx)
 		c.startReadLoop()
-		c.sendQueue.start()
-		c.recvQueue.start()
+		c.sendQueue.start(ctx)
+		c.recvQueue.start(ctx)
 	}()
+
+	return c
+}
+
+// shutdown sends the queued events to the cloud, and closes the connection.
+// Events still queued at the deadline are dropped.
+func (c *cloudConnector) shutdown(deadline context.Context) {
+	if n := c.sendQueue.wait(deadline); n > 0 {
+		logger.Printf("cloud: dropping %v messages to the cloud", n)
+	}
+	close(c.closed)
+	c.connMgr.close()
+}
+
+// reconnect drops the connection to the cloud, and connects again with the supplied settings
+func (c *cloudConnector) reconnect(url string, token string, heartbeat ws.Heartbeat) {
+	c.settingsLock.Lock()
+	c.url, c.token, c.heartbeat = url, token, heartbeat
+	c.settingsLock.Unlock()
+
+	c.connMgr.reconnect()
 }
 
 func (c *cloudConnector) subscribeToTpiEvents() {
@@ -61,6 +107,8 @@ func (c *cloudConnector) subscribeToTpiEvents() {
 				c.enqueueMessage(evt)
 			case chg := <-stateChgCh:
 				c.enqueueMessage(chg)
+			case <-c.closed:
+				return
 			}
 		}
 	}()
@@ -75,15 +123,34 @@ func (c *cloudConnector) startReadLoop() {
 
 			o, err := conn.Read()
 			if err != nil {
-				c.connMgr.signalConnErrAndWaitReconnected(err)
+				// the connection failed, eg the cloud stopped answering the pings: it is replaced
+				conn.Close()
+				if c.connMgr.signalConnErrAndWaitReconnected(err) == errConnClosed {
+					return
+				}
 				logger.Println("cloudConnector: read loop: reconnected, resuming")
 			} else {
+				c.connMgr.messageReceived()
 				c.recvQueue.enqueue(o)
 			}
 		}
 	}()
 }
 
+// telemetry returns the state of the connection to the cloud, and the round-trip time of its pings
+func (c *cloudConnector) telemetry() map[string]interface{} {
+	state, lastRecv := c.connMgr.status()
+	var latency time.Duration
+	if state == connStateConnected {
+		latency = c.connMgr.conn.(*ws.Conn).Latency()
+	}
+	return map[string]interface{}{
+		"State":               state.String(),
+		"LastMessageReceived": formatTime(lastRecv),
+		"PingRTTMillis":       millis(latency),
+	}
+}
+
 func (c *cloudConnector) recvMessage(i interface{}) error {
 	switch o := i.(type) {
 	case sites.UserCommand:
@@ -97,7 +164,11 @@ func (c *cloudConnector) recvMessage(i interface{}) error {
 }
 
 func (c *cloudConnector) recvUserCommand(cmd sites.UserCommand) {
-	if err := c.site.Exec(cmd); err != nil {
+	err := c.vault.decrypt(&cmd)
+	if err == nil {
+		err = c.site.Exec(cmd)
+	}
+	if err != nil {
 
 		e := sites.Event{
 			Level:       sites.LevelError,
@@ -1,18 +1,56 @@
 package main
 
+import (
+	"time"
+
+	"sec-ctl/pkg/ws"
+)
+
 type config struct {
 	SiteID string
 
 	TPIHost     string
-	TPIPort     uint16
-	TPIPassword string
+	TPIPort     uint16 `config:"min=1"`
+	TPIPassword string `config:"secret,required"`
+
+	// TPIKeepAliveDelay is the delay between polls of the panel, which keep the connection alive
+	TPIKeepAliveDelay time.Duration `config:"min=1s"`
+	// TPIStateRefreshDelay is the delay between full status reports requested to the panel
+	TPIStateRefreshDelay time.Duration `config:"min=1s"`
+	// TPIPollTimeout is how long a poll may go unanswered, before the connection is assumed dead and re-established
+	TPIPollTimeout time.Duration `config:"min=1s"`
+
+	// TPICaptureFilename enables recording the raw TPI traffic to this file, for replay in the mock
+	TPICaptureFilename string
+	TPICaptureMaxBytes int64 `config:"min=1"`
+	TPICaptureMaxFiles int   `config:"min=1"`
 
 	RESTBindHost string
-	RESTBindPort uint16
+	RESTBindPort uint16 `config:"min=1"`
+
+	// ConfigWatchInterval is the delay between checks of the config files for changes, 0 to only reload on SIGHUP
+	ConfigWatchInterval time.Duration
+
+	// ShutdownTimeout bounds the graceful shutdown on SIGTERM, which drains the queues to the panel and the cloud
+	ShutdownTimeout time.Duration `config:"min=0s"`
+
+	// PINKeyFilename is the keyfile of the key which decrypts the codes of the members, sent by the cloud.
+	// It defaults to Local.pin-key.pem, next to the config file.
+	PINKeyFilename string
+
+	CloudWSURL   string `config:"required"`
+	CloudToken   string `config:"secret"`
+	CloudBaseURL string `config:"required"`
+
+	// CloudPingInterval is the delay between pings of the cloud, 0 to disable them. A cloud which does not
+	// answer within CloudPingTimeout is assumed gone, and reconnected to.
+	CloudPingInterval time.Duration `config:"min=0s"`
+	CloudPingTimeout  time.Duration `config:"min=1s"`
+}
 
-	CloudWSURL   string
-	CloudToken   string
-	CloudBaseURL string
+// cloudHeartbeat returns the heartbeat of the connection to the cloud
+func cloudHeartbeat(cfg config) ws.Heartbeat {
+	return ws.Heartbeat{Interval: cfg.CloudPingInterval, Timeout: cfg.CloudPingTimeout}
 }
 
 // AppName returns the name of the app to configured
@@ -21,10 +59,19 @@ func (cfg *config) AppName() string {
 }
 
 var defaultConfig = config{
-	TPIPort:      4025,
-	TPIPassword:  "mock123",
-	RESTBindHost: "0.0.0.0",
-	RESTBindPort: 9752,
-	CloudWSURL:   "ws://localhost:9754",
-	CloudBaseURL: "http://localhost:9753",
+	TPIPort:              4025,
+	TPIPassword:          "mock123",
+	TPIKeepAliveDelay:    30 * time.Second,
+	TPIStateRefreshDelay: 300 * time.Second,
+	TPIPollTimeout:       10 * time.Second,
+	TPICaptureMaxBytes:   10 * 1024 * 1024,
+	TPICaptureMaxFiles:   5,
+	RESTBindHost:         "0.0.0.0",
+	RESTBindPort:         9752,
+	ConfigWatchInterval:  5 * time.Second,
+	ShutdownTimeout:      8 * time.Second,
+	CloudWSURL:           "ws://localhost:9754/ws",
+	CloudBaseURL:         "http://localhost:9753",
+	CloudPingInterval:    15 * time.Second,
+	CloudPingTimeout:     10 * time.Second,
 }
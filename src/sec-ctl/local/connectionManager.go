@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"math"
 	"math/rand"
 	"sync"
@@ -13,8 +16,28 @@ const (
 	connStateDisconnected connState = iota
 	connStateConnecting
 	connStateConnected
+	// connStateClosed is final: the connection is closed, and never reconnected
+	connStateClosed
 )
 
+func (s connState) String() string {
+	switch s {
+	case connStateDisconnected:
+		return "Disconnected"
+	case connStateConnecting:
+		return "Connecting"
+	case connStateConnected:
+		return "Connected"
+	case connStateClosed:
+		return "Closed"
+	default:
+		return "Unknown"
+	}
+}
+
+// errConnClosed is returned when waiting for a connection which was closed for good
+var errConnClosed = errors.New("connection closed")
+
 type attemptConnect func() (interface{}, error)
 
 type connectionManager struct {
@@ -23,6 +46,8 @@ type connectionManager struct {
 	connStateLock  *sync.Cond
 	name           string
 	conn           interface{}
+	// lastRecv is when a message was last received on the connection
+	lastRecv time.Time
 }
 
 func newConnectionManager(name string, attemptConnect attemptConnect) *connectionManager {
@@ -34,27 +59,47 @@ func newConnectionManager(name string, attemptConnect attemptConnect) *connectio
 	}
 }
 
-func (mgr *connectionManager) connect() {
-	for n := 0; mgr.connState != connStateConnected; n++ {
+// connect attempts to connect until it succeeds, or ctx is done
+func (mgr *connectionManager) connect(ctx context.Context) {
+	for n := 0; ctx.Err() == nil; n++ {
 
 		conn, err := mgr.attemptConnect()
 
 		if err != nil {
-			mgr.backoff(n)
-		} else {
-			logger.Printf("%s: connected", mgr.name)
-			mgr.connStateLock.L.Lock()
-			defer mgr.connStateLock.L.Unlock()
+			mgr.backoff(ctx, n)
+			continue
+		}
 
-			mgr.conn = conn
-			mgr.connState = connStateConnected
+		mgr.connStateLock.L.Lock()
+		defer mgr.connStateLock.L.Unlock()
 
-			mgr.connStateLock.Broadcast()
+		if mgr.connState == connStateClosed {
+			if closer, ok := conn.(io.Closer); ok {
+				closer.Close()
+			}
+			return
 		}
+
+		logger.Printf("%s: connected", mgr.name)
+		mgr.conn = conn
+		mgr.connState = connStateConnected
+
+		mgr.connStateLock.Broadcast()
+		return
+	}
+}
+
+func (mgr *connectionManager) backoff(ctx context.Context, n int) {
+	backoff := backoffDelay(n)
+	logger.Printf("%s: backoff %v => %v", mgr.name, n, backoff)
+	select {
+	case <-ctx.Done():
+	case <-time.After(backoff):
 	}
 }
 
-func (mgr *connectionManager) backoff(n int) {
+// backoffDelay returns the randomized delay before the attempt following n failed ones
+func backoffDelay(n int) time.Duration {
 	// 0 -> [250ms, 500ms]
 	// 1 -> [500ms, 1000ms]
 	// 2 -> [1000ms, 2000ms]
@@ -62,21 +107,20 @@ func (mgr *connectionManager) backoff(n int) {
 	// 8 ... n -> [64s, 128s]
 	baseDelayMillis := 250.0
 	backoffFactor := math.Pow(2, math.Min(8.0, float64(n)))
-	backoff := time.Duration((backoffFactor+rand.Float64()*backoffFactor)*baseDelayMillis) * time.Millisecond
-	logger.Printf("%s: backoff %v => %v", mgr.name, n, backoff)
-	time.Sleep(backoff)
+	return time.Duration((backoffFactor+rand.Float64()*backoffFactor)*baseDelayMillis) * time.Millisecond
 }
 
-func (mgr *connectionManager) startReconnectLoop() {
+// startReconnectLoop reconnects whenever the connection is lost, until ctx is done
+func (mgr *connectionManager) startReconnectLoop(ctx context.Context) {
 	go func() {
-		for {
-			mgr.waitDisconnected()
-			mgr.connect()
+		for ctx.Err() == nil && mgr.waitDisconnected() {
+			mgr.connect(ctx)
 		}
 	}()
 }
 
-func (mgr *connectionManager) waitDisconnected() {
+// waitDisconnected waits until the connection is lost, and returns false if it was closed instead
+func (mgr *connectionManager) waitDisconnected() bool {
 	mgr.connStateLock.L.Lock()
 	defer mgr.connStateLock.L.Unlock()
 
@@ -84,29 +128,81 @@ func (mgr *connectionManager) waitDisconnected() {
 		mgr.connStateLock.Wait()
 	}
 
+	if mgr.connState == connStateClosed {
+		return false
+	}
 	mgr.connState = connStateConnecting
+	return true
 }
 
-func (mgr *connectionManager) signalConnErrAndWaitReconnected(err error) {
+// signalConnErrAndWaitReconnected reports the connection error, and waits for the connection to be
+// re-established. It returns errConnClosed if it is closed instead.
+func (mgr *connectionManager) signalConnErrAndWaitReconnected(err error) error {
 	mgr.signalConnErr(err)
-	mgr.waitReconnected()
+	return mgr.waitReconnected()
 }
 
 func (mgr *connectionManager) signalConnErr(err error) {
 	mgr.connStateLock.L.Lock()
 	defer mgr.connStateLock.L.Unlock()
-	if mgr.connState != connStateConnecting {
+	if mgr.connState == connStateConnected {
 		mgr.connState = connStateDisconnected
 	}
 	mgr.connStateLock.Broadcast()
 }
 
-func (mgr *connectionManager) waitReconnected() {
+func (mgr *connectionManager) waitReconnected() error {
 	logger.Printf("%s: waitReconnected", mgr.name)
 	mgr.connStateLock.L.Lock()
 	defer mgr.connStateLock.L.Unlock()
 
-	for mgr.connState != connStateConnected {
+	for mgr.connState != connStateConnected && mgr.connState != connStateClosed {
 		mgr.connStateLock.Wait()
 	}
+	if mgr.connState == connStateClosed {
+		return errConnClosed
+	}
+	return nil
+}
+
+// messageReceived records that a message was received on the connection
+func (mgr *connectionManager) messageReceived() {
+	mgr.connStateLock.L.Lock()
+	mgr.lastRecv = time.Now()
+	mgr.connStateLock.L.Unlock()
+}
+
+// status returns the state of the connection, and when a message was last received on it
+func (mgr *connectionManager) status() (connState, time.Time) {
+	mgr.connStateLock.L.Lock()
+	defer mgr.connStateLock.L.Unlock()
+	return mgr.connState, mgr.lastRecv
+}
+
+// close closes the connection for good: it is not reconnected,
+// and those waiting for it to be re-established get errConnClosed
+func (mgr *connectionManager) close() {
+	mgr.connStateLock.L.Lock()
+	conn := mgr.conn
+	mgr.connState = connStateClosed
+	mgr.connStateLock.Broadcast()
+	mgr.connStateLock.L.Unlock()
+
+	if closer, ok := conn.(io.Closer); ok {
+		closer.Close()
+	}
+	logger.Printf("%s: closed", mgr.name)
+}
+
+// reconnect closes the current connection, if any, so that the read loop reconnects,
+// with the current settings of attemptConnect
+func (mgr *connectionManager) reconnect() {
+	mgr.connStateLock.L.Lock()
+	conn := mgr.conn
+	mgr.connStateLock.L.Unlock()
+
+	if closer, ok := conn.(io.Closer); ok {
+		logger.Printf("%s: reconnecting", mgr.name)
+		closer.Close()
+	}
 }
@@ -1,11 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sec-ctl/pkg/client"
 	"sec-ctl/pkg/util"
 )
 
@@ -18,69 +22,118 @@ Congratulations!
 Your client has been successfully registered. To complete it, please go to:
 %s
 
+The link expires on %s. To get a new one, restart with -claim.
+
 
 ########################################################################
 ########################################################################
 `
 
+// firstTime registers the site with the cloud, and saves its id and token to the config file.
+// Registration is retried until it succeeds. Once registered, saving the config is retried
+// rather than registering again, so that the site is not orphaned if the config cannot be written.
 func firstTime(cfg *config) error {
-	rsp, err := http.Post(cfg.CloudBaseURL+"/clients", "application/json", nil)
-	if err != nil {
-		return err
+	cl := client.New(cfg.CloudBaseURL, "")
+
+	var reg client.SiteRegistration
+	for n := 0; ; n++ {
+		var err error
+		if reg, err = cl.CreateSite(context.Background()); err == nil {
+			break
+		}
+		delay := backoffDelay(n)
+		logger.Printf("registration failed: %v. Retrying in %v", err, delay)
+		time.Sleep(delay)
 	}
 
-	defer rsp.Body.Close()
-	data, err := ioutil.ReadAll(rsp.Body)
-	if err != nil {
-		panic(err)
-	}
+	cfg.SiteID = reg.SiteID
+	cfg.CloudToken = reg.Token
 
-	if rsp.StatusCode != 200 {
-		return fmt.Errorf("registration request returned unexpected status %v: body:\n%v", rsp.StatusCode, string(data))
+	for n := 0; ; n++ {
+		err := saveAuthConfig(cfg)
+		if err == nil {
+			break
+		}
+		delay := backoffDelay(n)
+		logger.Printf("registered site %v, but failed to save the config: %v. Retrying in %v", reg.SiteID, err, delay)
+		if n == 0 {
+			logger.Printf("to resume after a restart, %v", resumeInstructions(cfg))
+		}
+		time.Sleep(delay)
 	}
 
-	reg := struct {
-		SiteID   string
-		Token    string
-		SetupURL string
-	}{}
+	printSetupURL(cfg, reg)
 
-	if err := json.Unmarshal(data, &reg); err != nil {
-		return fmt.Errorf("Unable to parse registration response: %v. Body:\n%v", err, string(data))
-	}
-
-	cfg.SiteID = reg.SiteID
-	cfg.CloudToken = reg.Token
+	return nil
+}
 
-	if err = saveAuthConfig(cfg); err != nil {
+// renewClaim gets a new setup URL for the site, once the claim token from the registration expired
+func renewClaim(cfg *config) error {
+	cl := client.New(cfg.CloudBaseURL, cfg.CloudToken)
+	reg, err := cl.RegenerateClaimToken(context.Background(), cfg.SiteID)
+	if client.Is(err, client.ErrConflict) {
+		return fmt.Errorf("site %v is already claimed", cfg.SiteID)
+	} else if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("%s/%s", cfg.CloudBaseURL, reg.SetupURL)
+	printSetupURL(cfg, reg)
+	return nil
+}
 
-	fmt.Printf(completeSetupMsg, url)
+// rotateSiteToken replaces the token of the site, eg after it leaked, and saves the new one. A
+// running instance reloads the config file, and reconnects to the cloud with the new token.
+func rotateSiteToken(cfg *config) error {
+	cl := client.New(cfg.CloudBaseURL, cfg.CloudToken)
+	tok, err := cl.RotateSiteToken(context.Background(), cfg.SiteID)
+	if err != nil {
+		return err
+	}
 
+	cfg.CloudToken = tok
+	if err := saveAuthConfig(cfg); err != nil {
+		return fmt.Errorf("failed to save the new token, the old one is no longer valid "+
+			"(%v): %v", resumeInstructions(cfg), err)
+	}
+	logger.Printf("rotated the token of site %v", cfg.SiteID)
 	return nil
 }
 
-func saveAuthConfig(cfg *config) error {
-
-	authCfg := config{SiteID: cfg.SiteID, CloudToken: cfg.CloudToken}
+func printSetupURL(cfg *config, reg client.SiteRegistration) {
+	url := strings.TrimRight(cfg.CloudBaseURL, "/") + reg.SetupURL
+	fmt.Printf(completeSetupMsg, url, reg.ClaimExpiresAt.Format("2006-01-02 15:04"))
+}
 
-	data, err := json.MarshalIndent(authCfg, "", "  ")
+// saveAuthConfig saves the site id and token to the config file, keeping its other values
+func saveAuthConfig(cfg *config) error {
+	fname, err := util.ConfigFilename(appName)
 	if err != nil {
 		return err
 	}
 
-	fname, err := util.GetDefaultConfigFilename(appName)
-	if err != nil {
-		return err
+	return util.UpdateConfigFile(fname, map[string]interface{}{
+		"SiteID":     cfg.SiteID,
+		"CloudToken": cfg.CloudToken,
+	})
+}
+
+// resumeInstructions saves the site token to a file only readable by the user, next to the config file
+// or else in the temp dir, when the config file cannot be written, and tells how to use it. The token
+// itself is never logged: if it cannot be saved either, it is printed once to the terminal.
+func resumeInstructions(cfg *config) string {
+	fname := fmt.Sprintf("sec-ctl-site-%v.token", cfg.SiteID)
+	dirs := []string{os.TempDir()}
+	if cfgFname, err := util.ConfigFilename(appName); err == nil {
+		dirs = append([]string{filepath.Dir(cfgFname)}, dirs...)
 	}
 
-	err = ioutil.WriteFile(fname, data, os.ModePerm)
-	if err != nil {
-		return err
+	for _, dir := range dirs {
+		tokenFname := filepath.Join(dir, fname)
+		if err := ioutil.WriteFile(tokenFname, []byte(cfg.CloudToken+"\n"), 0600); err == nil {
+			return fmt.Sprintf("set SecCtl.Local.SiteID=%v and SecCtl.Local.CloudToken_FILE=%v", cfg.SiteID, tokenFname)
+		}
 	}
 
-	return nil
+	fmt.Fprintf(os.Stderr, "\nThe token of site %v is: %v\n\n", cfg.SiteID, cfg.CloudToken)
+	return fmt.Sprintf("set SecCtl.Local.SiteID=%v and SecCtl.Local.CloudToken to the token printed above", cfg.SiteID)
 }
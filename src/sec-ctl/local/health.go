@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"sec-ctl/pkg/health"
+)
+
+// newHealthChecker checks that the queues are consumed, for liveness, and that the site is logged
+// into the panel and connected to the cloud, for readiness
+func newHealthChecker(site *localSite, cloud *cloudConnector) *health.Checker {
+	checker := health.NewChecker()
+
+	checker.AddLiveness("tpiQueues", func(ctx context.Context) health.Component {
+		return queuesStatus(site.conn.sendQueue, site.conn.recvQueue)
+	})
+	checker.AddLiveness("cloudQueues", func(ctx context.Context) health.Component {
+		return queuesStatus(cloud.sendQueue, cloud.recvQueue)
+	})
+
+	checker.AddReadiness("tpi", func(ctx context.Context) health.Component {
+		state, _ := site.conn.connMgr.status()
+		details := site.tpiTelemetry()
+		if state != connStateConnected {
+			return health.Down("not connected to the panel", details)
+		} else if !site.isLoggedIn() {
+			return health.Down("not logged into the panel", details)
+		}
+		return health.Up(details)
+	})
+
+	checker.AddReadiness("cloud", func(ctx context.Context) health.Component {
+		state, _ := cloud.connMgr.status()
+		details := cloud.telemetry()
+		if state != connStateConnected {
+			return health.Down("not connected to the cloud", details)
+		}
+		return health.Up(details)
+	})
+
+	return checker
+}
+
+// queuesStatus is down once the queues are no longer consumed, ie on shutdown. Queues which are
+// not started yet, until the first connection, are up.
+func queuesStatus(send *workQueue, recv *workQueue) health.Component {
+	sendStarted, sendStopped, sendPending := send.status()
+	recvStarted, recvStopped, recvPending := recv.status()
+	details := map[string]interface{}{
+		"Started":     sendStarted && recvStarted,
+		"SendPending": sendPending,
+		"RecvPending": recvPending,
+	}
+
+	if sendStopped || recvStopped {
+		return health.Down("queues stopped", details)
+	}
+	return health.Up(details)
+}
+
+// millis returns the duration in milliseconds
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// formatTime formats t as RFC 3339, or returns nil if it is zero
+func formatTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
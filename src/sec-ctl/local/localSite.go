@@ -1,44 +1,61 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
-	"time"
+	"fmt"
 	"sec-ctl/pkg/sites"
 	"sec-ctl/pkg/tpi"
+	"sync"
+	"time"
 )
 
-const keepAliveDelay = 30 * time.Second
-const stateRefreshDelay = 300 * time.Second
 const maxPendingMessages = 4
 
 type localSite struct {
-	loggedIn bool
-	password string
-	id       string
+	id string
+
+	settingsLock      sync.Mutex
+	loggedIn          bool
+	password          string
+	keepAliveDelay    time.Duration
+	stateRefreshDelay time.Duration
+	timersChanged     chan struct{}
 
 	conn           *localSiteConnector
-	partitions     map[string]*sites.Partition
-	zones          map[string]*sites.Zone
+	watchdog       *watchdog
 	eventChs       []chan sites.Event
 	stateChangeChs []chan sites.StateChange
 
+	// stateLock guards the state of the panel, updated from its messages and read by commands
+	stateLock           sync.Mutex
+	partitions          map[string]*sites.Partition
+	zones               map[string]*sites.Zone
 	systemTroubleStatus sites.SystemTroubleStatus
 }
 
-// NewLocalClient creates a new local client, from the supplied local server info
-func newLocalSite(hostname string, port uint16, password string, id string) sites.Site {
+// NewLocalClient creates a new local client, from the TPI settings of cfg
+// If capture is not nil, the raw TPI traffic is recorded to it. The site stops polling the panel
+// once ctx is done, and shutdown then ends the session.
+func newLocalSite(ctx context.Context, cfg config, capture *tpi.CaptureWriter) *localSite {
 
 	c := &localSite{
-		id:             id,
-		password:       password,
-		partitions:     map[string]*sites.Partition{},
-		zones:          map[string]*sites.Zone{},
-		eventChs:       make([]chan sites.Event, 0),
-		stateChangeChs: make([]chan sites.StateChange, 0),
+		id:                cfg.SiteID,
+		password:          cfg.TPIPassword,
+		keepAliveDelay:    cfg.TPIKeepAliveDelay,
+		stateRefreshDelay: cfg.TPIStateRefreshDelay,
+		timersChanged:     make(chan struct{}, 1),
+		partitions:        map[string]*sites.Partition{},
+		zones:             map[string]*sites.Zone{},
+		eventChs:          make([]chan sites.Event, 0),
+		stateChangeChs:    make([]chan sites.StateChange, 0),
 	}
 
-	c.conn = newLocalSiteConnector(hostname, port, c.processMessage)
-	c.startTimersLoop()
+	c.watchdog = newWatchdog(cfg.TPIPollTimeout, c.pollTimedOut)
+	// started once set, as the messages of the panel may be processed before newLocalSiteConnector returns
+	c.conn = newLocalSiteConnector(cfg.TPIHost, cfg.TPIPort, capture, c.watchdog, c.processMessage)
+	c.conn.start(ctx)
+	c.startTimersLoop(ctx)
 
 	return c
 }
@@ -60,6 +77,9 @@ func (c *localSite) GetID() string {
 }
 
 func (c *localSite) GetState() sites.SystemState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
 	return sites.SystemState{
 		ID:            c.id,
 		Partitions:    c.getPartitions(),
@@ -107,6 +127,8 @@ func (c *localSite) Exec(cmd sites.UserCommand) error {
 		msg = tpi.ClientMessage{Code: tpi.ClientCodePartitionDisarmControl, Data: data}
 	case sites.CmdPanic:
 		msg = tpi.ClientMessage{Code: tpi.ClientCodeTriggerPanicAlarm, Data: []byte(cmd.PanicTarget)}
+	case sites.CmdBypassZone, sites.CmdUnbypassZone:
+		return c.toggleZoneBypass(cmd)
 	default:
 		logger.Panicf("Unhandled user command %#v", cmd)
 	}
@@ -115,34 +137,134 @@ func (c *localSite) Exec(cmd sites.UserCommand) error {
 	return nil
 }
 
+// toggleZoneBypass enters the zone bypass menu (*1) on the keypad, toggles the target zone,
+// and exits the menu (#). The panel will then send the updated bypassed zones dump.
+func (c *localSite) toggleZoneBypass(cmd sites.UserCommand) error {
+	zoneNum, err := tpi.ParseZoneID(cmd.ZoneID)
+	if err != nil {
+		return err
+	}
+
+	zoneID := tpi.FormatZoneID(zoneNum)
+	c.stateLock.Lock()
+	z, ok := c.zones[zoneID]
+	bypassed := ok && z.Bypassed
+	c.stateLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("zone %v is unknown: the panel has not reported it", zoneID)
+	}
+	bypass := cmd.Code == sites.CmdBypassZone
+	if bypassed == bypass {
+		if bypass {
+			return fmt.Errorf("zone %v is already bypassed", zoneID)
+		}
+		return fmt.Errorf("zone %v is not bypassed", zoneID)
+	}
+
+	keys := fmt.Sprintf("*1%s%02d#", cmd.PIN, zoneNum)
+	for _, chunk := range tpi.SplitKeystrokes(keys) {
+		data := append([]byte(cmd.PartitionID), []byte(chunk)...)
+		c.enqueueMessage(tpi.ClientMessage{Code: tpi.ClientCodeSendKeystrokeString, Data: data})
+	}
+
+	return nil
+}
+
 func (c *localSite) enqueueMessage(msg tpi.ClientMessage) {
 	c.conn.enqueueMessage(msg)
 }
 
-func (c *localSite) startTimersLoop() {
+// reconnect drops the panel session, and logs in again with the supplied TPI settings
+func (c *localSite) reconnect(hostname string, port uint16, password string, capture *tpi.CaptureWriter) {
+	c.settingsLock.Lock()
+	c.password = password
+	c.settingsLock.Unlock()
+
+	c.conn.reconnect(hostname, port, capture)
+}
+
+// setTimerDelays changes the delays between polls and state refreshes, and how long a poll may go unanswered
+func (c *localSite) setTimerDelays(keepAliveDelay time.Duration, stateRefreshDelay time.Duration, pollTimeout time.Duration) {
+	c.settingsLock.Lock()
+	c.keepAliveDelay, c.stateRefreshDelay = keepAliveDelay, stateRefreshDelay
+	c.settingsLock.Unlock()
+	c.watchdog.setTimeout(pollTimeout)
+
+	select {
+	case c.timersChanged <- struct{}{}:
+	default: // already signaled
+	}
+}
+
+// shutdown sends the queued commands to the panel, and ends the session
+func (c *localSite) shutdown(deadline context.Context) {
+	c.conn.shutdown(deadline)
+}
+
+func (c *localSite) startTimersLoop(ctx context.Context) {
 	go func() {
-		tickKeepAlive := time.Tick(keepAliveDelay)
-		tickStateRefreshDelay := time.Tick(stateRefreshDelay)
-
-		for {
-			select {
-			case <-tickKeepAlive:
-				c.poll()
-			case <-tickStateRefreshDelay:
-				c.requestStateRefresh()
-			}
+		for ctx.Err() == nil {
+			c.runTimers(ctx)
 		}
 	}()
 }
 
+// runTimers polls the panel and refreshes its state, until the delays change or ctx is done
+func (c *localSite) runTimers(ctx context.Context) {
+	c.settingsLock.Lock()
+	tickKeepAlive := time.NewTicker(c.keepAliveDelay)
+	tickStateRefreshDelay := time.NewTicker(c.stateRefreshDelay)
+	c.settingsLock.Unlock()
+
+	defer tickKeepAlive.Stop()
+	defer tickStateRefreshDelay.Stop()
+
+	for {
+		select {
+		case <-tickKeepAlive.C:
+			c.poll()
+		case <-tickStateRefreshDelay.C:
+			c.requestStateRefresh()
+		case <-c.timersChanged:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (c *localSite) poll() {
-	if c.loggedIn {
+	if c.isLoggedIn() {
 		c.enqueueMessage(tpi.ClientMessage{Code: tpi.ClientCodePoll})
 	}
 }
 
+// tpiTelemetry returns the state of the link to the panel, and the round-trip time of the polls
+func (c *localSite) tpiTelemetry() map[string]interface{} {
+	state, lastRecv := c.conn.connMgr.status()
+	stats := c.watchdog.stats()
+	return map[string]interface{}{
+		"State":               state.String(),
+		"LoggedIn":            c.isLoggedIn(),
+		"LastMessageReceived": formatTime(lastRecv),
+		"LastPollAck":         formatTime(stats.LastAck),
+		"PollRTTMillis":       millis(stats.PollRTT),
+		"PollPendingSince":    formatTime(stats.PollPendingSince),
+		"PollTimeouts":        stats.Timeouts,
+	}
+}
+
+// pollTimedOut drops the connection to the panel, which is assumed dead, as a poll went unanswered
+func (c *localSite) pollTimedOut(unanswered time.Duration) {
+	logger.Printf("local sites: poll unanswered for %v: reconnecting", unanswered)
+	desc := fmt.Sprintf("Poll unanswered for %v: reconnecting to the panel", unanswered.Round(time.Millisecond))
+	c.publishEvent(sites.NewEvent(sites.LevelWarn, "TPIPollTimeout").SetDescription(desc))
+	c.conn.connMgr.reconnect()
+}
+
 func (c *localSite) requestStateRefresh() {
-	if c.loggedIn {
+	if c.isLoggedIn() {
 		c.enqueueMessage(tpi.ClientMessage{Code: tpi.ClientCodeStatusReport})
 	}
 }
@@ -151,6 +273,10 @@ func (c *localSite) processMessage(i interface{}) error {
 
 	msg := i.(tpi.ServerMessage)
 
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	var err error
 	switch msg.Code {
 
 	case tpi.ServerCodeLoginRes:
@@ -159,42 +285,45 @@ func (c *localSite) processMessage(i interface{}) error {
 	case tpi.ServerCodeAck: // ignore
 
 	case tpi.ServerCodeSysErr:
-		c.processSystemError(msg)
+		err = c.processSystemError(msg)
 
 	case tpi.ServerCodeKeypadLedState:
-		c.processKeypadLEDState(msg)
+		err = c.processKeypadLEDState(msg)
 	case tpi.ServerCodeKeypadLedFlashState:
-		c.processKeypadLEDFlashState(msg)
+		err = c.processKeypadLEDFlashState(msg)
 
 	case tpi.ServerCodePartitionReady:
-		c.processPartitionState(msg, sites.PartitionStateReady)
+		err = c.processPartitionState(msg, sites.PartitionStateReady)
 	case tpi.ServerCodePartitionNotReady:
-		c.processPartitionState(msg, sites.PartitionStateNotReady)
+		err = c.processPartitionState(msg, sites.PartitionStateNotReady)
 	case tpi.ServerCodePartitionArmed:
-		c.processPartitionState(msg, sites.PartitionStateArmed)
+		err = c.processPartitionState(msg, sites.PartitionStateArmed)
 	case tpi.ServerCodePartitionInAlarm:
-		c.processPartitionState(msg, sites.PartitionStateInAlarm)
+		err = c.processPartitionState(msg, sites.PartitionStateInAlarm)
 	case tpi.ServerCodePartitionDisarmed:
-		c.processPartitionState(msg, sites.PartitionStateDisarmed)
+		err = c.processPartitionState(msg, sites.PartitionStateDisarmed)
 	case tpi.ServerCodePartitionBusy:
-		c.processPartitionState(msg, sites.PartitionStateBusy)
+		err = c.processPartitionState(msg, sites.PartitionStateBusy)
 
 	case tpi.ServerCodeZoneAlarm:
-		c.processZoneState(msg, sites.ZoneStateAlarm)
+		err = c.processZoneState(msg, sites.ZoneStateAlarm)
 	case tpi.ServerCodeZoneAlarmRestore:
-		c.processZoneState(msg, sites.ZoneStateAlarmRestore)
+		err = c.processZoneState(msg, sites.ZoneStateAlarmRestore)
 	case tpi.ServerCodeZoneTemper:
-		c.processZoneState(msg, sites.ZoneStateTemper)
+		err = c.processZoneState(msg, sites.ZoneStateTemper)
 	case tpi.ServerCodeZoneTemperRestore:
-		c.processZoneState(msg, sites.ZoneStateTemperRestore)
+		err = c.processZoneState(msg, sites.ZoneStateTemperRestore)
 	case tpi.ServerCodeZoneFault:
-		c.processZoneState(msg, sites.ZoneStateFault)
+		err = c.processZoneState(msg, sites.ZoneStateFault)
 	case tpi.ServerCodeZoneFaultRestore:
-		c.processZoneState(msg, sites.ZoneStateFaultRestore)
+		err = c.processZoneState(msg, sites.ZoneStateFaultRestore)
 	case tpi.ServerCodeZoneOpen:
-		c.processZoneState(msg, sites.ZoneStateOpen)
+		err = c.processZoneState(msg, sites.ZoneStateOpen)
 	case tpi.ServerCodeZoneRestore:
-		c.processZoneState(msg, sites.ZoneStateRestore)
+		err = c.processZoneState(msg, sites.ZoneStateRestore)
+
+	case tpi.ServerCodeBypassedZonesBitfieldDump:
+		err = c.processBypassedZonesDump(msg)
 
 	case tpi.ServerCodeTroubleLEDOff, tpi.ServerCodeTroubleLEDOn:
 		c.processTroubleLED(msg)
@@ -210,10 +339,10 @@ func (c *localSite) processMessage(i interface{}) error {
 		c.processPartitionEvent(sites.LevelWarn, msg)
 
 	case tpi.ServerCodeUserClosing, tpi.ServerCodeUserOpening:
-		c.processUserEvent(msg)
+		err = c.processUserEvent(msg)
 
 	case tpi.ServerCodeVerboseTroubleStatus:
-		return c.updateVerboseTroubleStatus(msg)
+		err = c.updateVerboseTroubleStatus(msg)
 
 	case tpi.ServerCodePanelBatteryTrouble, tpi.ServerCodePanelACTrouble,
 		tpi.ServerCodeSystemBellTrouble, tpi.ServerCodeFTCTrouble,
@@ -228,6 +357,10 @@ func (c *localSite) processMessage(i interface{}) error {
 		c.publishEvent(newServerEvent(sites.LevelInfo, msg.Code))
 	}
 
+	// a malformed frame, eg truncated, is dropped: it must not stop the processing of the next ones
+	if err != nil {
+		logger.Printf("local sites: dropping invalid message %v: %v", msg, err)
+	}
 	return nil
 }
 
@@ -253,32 +386,60 @@ func (c *localSite) processPartitionEvent(level sites.EventLevel, msg tpi.Server
 	c.publishEvent(newServerEvent(level, msg.Code).SetPartitionID(partID))
 }
 
-func (c *localSite) processUserEvent(msg tpi.ServerMessage) {
+func (c *localSite) processUserEvent(msg tpi.ServerMessage) error {
+	if len(msg.Data) < 2 {
+		return fmt.Errorf("missing partition or user in %q", msg.Data)
+	}
 	partID := string(msg.Data[0])
 	userID := string(msg.Data[1:])
 	c.publishEvent(newServerEvent(sites.LevelInfo, msg.Code).SetPartitionID(partID).SetUserID(userID))
+	return nil
+}
+
+// isLoggedIn tells whether the current session with the panel is logged in
+func (c *localSite) isLoggedIn() bool {
+	c.settingsLock.Lock()
+	defer c.settingsLock.Unlock()
+	return c.loggedIn
+}
+
+func (c *localSite) setLoggedIn(loggedIn bool) {
+	c.settingsLock.Lock()
+	c.loggedIn = loggedIn
+	c.settingsLock.Unlock()
 }
 
 func (c *localSite) processLoginResult(msg tpi.ServerMessage) {
 	loginRes := tpi.LoginRes(msg.Data)
 	if loginRes == tpi.LoginResSuccess { // login success
-		c.loggedIn = true
+		c.setLoggedIn(true)
 		c.requestStateRefresh()
 	} else if loginRes == tpi.LoginResFailure {
 		logger.Panicf("Login attempt failed: password rejected!")
+		c.setLoggedIn(false)
+	} else { // password request, at the start of a new session
+		c.settingsLock.Lock()
 		c.loggedIn = false
-	} else {
+		password := c.password
+		c.settingsLock.Unlock()
+
 		loginMsg := tpi.ClientMessage{
 			Code: tpi.ClientCodeNetworkLogin,
-			Data: []byte(c.password),
+			Data: []byte(password),
 		}
 		c.enqueueMessage(loginMsg)
 	}
 }
 
-func (c *localSite) processPartitionState(msg tpi.ServerMessage, newState sites.PartitionState) {
+func (c *localSite) processPartitionState(msg tpi.ServerMessage, newState sites.PartitionState) error {
+	if len(msg.Data) == 0 {
+		return fmt.Errorf("missing partition")
+	}
 
 	partID := string(msg.Data)
+	if newState == sites.PartitionStateArmed { // partition + arm mode
+		partID = string(msg.Data[:1])
+	}
 
 	p := c.getPartition(partID)
 
@@ -292,6 +453,7 @@ func (c *localSite) processPartitionState(msg tpi.ServerMessage, newState sites.
 		c.publishStateChange(sites.StateChangePartition, p)
 		c.publishEvent(newServerEvent(level, msg.Code).SetPartitionID(partID))
 	}
+	return nil
 }
 
 func (c *localSite) getPartition(partID string) *sites.Partition {
@@ -333,6 +495,14 @@ func (c *localSite) processKeypadLEDState(msg tpi.ServerMessage) error {
 		c.publishStateChange(sites.StateChangePartition, p)
 		c.publishEvent(newServerEvent(sites.LevelInfo, msg.Code).SetPartitionID("1").SetData("state", state))
 	}
+
+	// when the bypass LED is off, no zone is bypassed.
+	// when it is on, the bypassed zones dump tells us which ones are.
+	if state&sites.KeypadLEDStateBypass == 0 {
+		for _, z := range c.zones {
+			c.updateZoneBypass(z, false, msg.Code)
+		}
+	}
 	return nil
 }
 
@@ -381,15 +551,18 @@ func decodeHexByte(data []byte) (byte, error) {
 	return arr[0], nil
 }
 
-func (c *localSite) processZoneState(msg tpi.ServerMessage, newState sites.ZoneState) {
+func (c *localSite) processZoneState(msg tpi.ServerMessage, newState sites.ZoneState) error {
 	var partID string
 	var zoneID string
 	if newState == sites.ZoneStateFault || newState == sites.ZoneStateFaultRestore || newState == sites.ZoneStateOpen || newState == sites.ZoneStateRestore {
 		zoneID = string(msg.Data)
-	} else {
+	} else if len(msg.Data) > 1 {
 		partID = string(msg.Data[:1])
 		zoneID = string(msg.Data[1:])
 	}
+	if zoneID == "" {
+		return fmt.Errorf("missing zone in %q", msg.Data)
+	}
 
 	z := c.getZone(zoneID)
 	if z.State != newState {
@@ -404,6 +577,33 @@ func (c *localSite) processZoneState(msg tpi.ServerMessage, newState sites.ZoneS
 		c.publishStateChange(sites.StateChangeZone, z)
 		c.publishEvent(newServerEvent(level, msg.Code).SetPartitionID(partID).SetZoneID(zoneID))
 	}
+	return nil
+}
+
+func (c *localSite) processBypassedZonesDump(msg tpi.ServerMessage) error {
+	zoneIDs, err := tpi.DecodeZoneBitfield(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	bypassed := map[string]bool{}
+	for _, zoneID := range zoneIDs {
+		bypassed[zoneID] = true
+		c.getZone(zoneID)
+	}
+
+	for _, z := range c.zones {
+		c.updateZoneBypass(z, bypassed[z.ID], msg.Code)
+	}
+	return nil
+}
+
+func (c *localSite) updateZoneBypass(z *sites.Zone, bypassed bool, code tpi.ServerCode) {
+	if z.Bypassed != bypassed {
+		z.Bypassed = bypassed
+		c.publishStateChange(sites.StateChangeZone, z)
+		c.publishEvent(newServerEvent(sites.LevelInfo, code).SetZoneID(z.ID).SetData("bypassed", bypassed))
+	}
 }
 
 func (c *localSite) getZone(zoneID string) *sites.Zone {
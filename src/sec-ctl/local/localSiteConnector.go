@@ -1,54 +1,113 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sec-ctl/pkg/tpi"
+	"sync"
 )
 
 type localSiteConnector struct {
 	sendQueue *workQueue
 	recvQueue *workQueue
 	connMgr   *connectionManager
+	watchdog  *watchdog
+
+	settingsLock sync.Mutex
+	hostname     string
+	port         uint16
+	capture      *tpi.CaptureWriter
 }
 
-// NewLocalClient creates a new local client, from the supplied local server info
-func newLocalSiteConnector(hostname string, port uint16, recvFunc workQueueFunc) *localSiteConnector {
-	c := &localSiteConnector{}
+// NewLocalClient creates a new local client, from the supplied local server info. It connects once
+// started, and the received messages are passed to recvFunc. The watchdog times the polls sent, and their acks.
+func newLocalSiteConnector(hostname string, port uint16, capture *tpi.CaptureWriter, watchdog *watchdog, recvFunc workQueueFunc) *localSiteConnector {
+	c := &localSiteConnector{hostname: hostname, port: port, capture: capture, watchdog: watchdog}
 
 	c.connMgr = newConnectionManager("local sites", func() (interface{}, error) {
+		c.settingsLock.Lock()
+		hostname, port, capture := c.hostname, c.port, c.capture
+		c.settingsLock.Unlock()
+
 		servAddr := fmt.Sprintf("%s:%d", hostname, port)
 		tcpAddr, err := net.ResolveTCPAddr("tcp", servAddr)
 		if err != nil {
 			return nil, err
 		}
 
-		return net.DialTCP("tcp", nil, tcpAddr)
+		conn, err := net.DialTCP("tcp", nil, tcpAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		if capture != nil {
+			return tpi.NewCaptureConn(conn, capture), nil
+		}
+		return conn, nil
 	})
 
 	c.recvQueue = newWorkQueue(recvFunc)
 	c.sendQueue = newWorkQueue(c.sendMessage)
 
+	return c
+}
+
+// start connects to the panel, and processes the messages to and from it. It stops reconnecting and
+// consuming its queues once ctx is done, until shutdown closes it.
+func (c *localSiteConnector) start(ctx context.Context) {
 	go func() {
-		c.connMgr.connect()
-		c.connMgr.startReconnectLoop()
+		c.connMgr.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		c.connMgr.startReconnectLoop(ctx)
 		c.startReadLoop()
-		c.sendQueue.start()
-		c.recvQueue.start()
+		c.sendQueue.start(ctx)
+		c.recvQueue.start(ctx)
 	}()
+}
 
-	return c
+// shutdown sends the queued messages to the panel, and closes the connection, which ends the
+// TPI session, as the protocol has no logout command. Messages still queued at the deadline are dropped.
+func (c *localSiteConnector) shutdown(deadline context.Context) {
+	if n := c.sendQueue.wait(deadline); n > 0 {
+		logger.Printf("local sites: dropping %v messages to the panel", n)
+	}
+	c.watchdog.reset()
+	c.connMgr.close()
+	if n := c.recvQueue.wait(deadline); n > 0 {
+		logger.Printf("local sites: dropping %v messages from the panel", n)
+	}
+}
+
+// reconnect drops the connection to the panel, and connects again with the supplied settings
+func (c *localSiteConnector) reconnect(hostname string, port uint16, capture *tpi.CaptureWriter) {
+	c.settingsLock.Lock()
+	c.hostname, c.port, c.capture = hostname, port, capture
+	c.settingsLock.Unlock()
+
+	c.connMgr.reconnect()
 }
 
 func (c *localSiteConnector) startReadLoop() {
 	go func() {
 		for {
-			conn := c.connMgr.conn.(*net.TCPConn)
+			conn := c.connMgr.conn.(net.Conn)
 			msgs, err := tpi.ReadAvailableServerMessages(conn)
 			if err != nil {
-				c.connMgr.signalConnErrAndWaitReconnected(err)
+				if c.connMgr.signalConnErrAndWaitReconnected(err) == errConnClosed {
+					return
+				}
+				c.watchdog.reset()
 			} else {
+				if len(msgs) > 0 {
+					c.connMgr.messageReceived()
+				}
 				for _, msg := range msgs {
+					if isPollAck(msg) {
+						c.watchdog.pollAcked()
+					}
 					c.recvQueue.enqueue(msg)
 				}
 			}
@@ -62,10 +121,23 @@ func (c *localSiteConnector) enqueueMessage(msg tpi.ClientMessage) {
 
 func (c *localSiteConnector) sendMessage(i interface{}) error {
 	msg := i.(tpi.ClientMessage)
-	conn := c.connMgr.conn.(*net.TCPConn)
+	conn := c.connMgr.conn.(net.Conn)
+	if msg.Code == tpi.ClientCodePoll {
+		// timed from before the write, as its ack may be read before the write returns
+		c.watchdog.pollSent()
+	}
 	err := msg.Write(conn)
 	if err != nil {
 		c.connMgr.signalConnErrAndWaitReconnected(err)
 	}
 	return nil
 }
+
+// isPollAck tells whether the message acknowledges a poll
+func isPollAck(msg tpi.ServerMessage) bool {
+	if msg.Code != tpi.ServerCodeAck {
+		return false
+	}
+	code, err := tpi.DecodeIntCode(msg.Data)
+	return err == nil && tpi.ClientCode(code) == tpi.ClientCodePoll
+}
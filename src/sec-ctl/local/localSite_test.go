@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+	"sec-ctl/pkg/tpimock"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+const testTimeout = 5 * time.Second
+
+// newTestPanel starts a mock panel, injecting faults in its sessions
+func newTestPanel(t *testing.T, faults tpimock.FaultConfig) *tpimock.Server {
+	srv, err := tpimock.NewServer(tpimock.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetDefaultFaults(faults); err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// newTestSite connects a site to the panel, polling it every 20ms, and waits until it logged in.
+// The returned func stops it, the way main does.
+func newTestSite(t *testing.T, srv *tpimock.Server, pollTimeout time.Duration) (*localSite, func()) {
+	host, portStr, err := net.SplitHostPort(srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config{
+		SiteID:               "test",
+		TPIHost:              host,
+		TPIPort:              uint16(port),
+		TPIPassword:          tpimock.DefaultPassword,
+		TPIKeepAliveDelay:    20 * time.Millisecond,
+		TPIStateRefreshDelay: time.Hour,
+		TPIPollTimeout:       pollTimeout,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	site := newLocalSite(ctx, cfg, nil)
+	stop := func() {
+		cancel()
+		deadline, cancelDeadline := context.WithTimeout(context.Background(), time.Second)
+		defer cancelDeadline()
+		site.shutdown(deadline)
+	}
+
+	if err := srv.WaitForLogin(testTimeout); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	waitFor(t, "site logged in", site.isLoggedIn)
+	return site, stop
+}
+
+// waitFor waits until cond is true, and fails the test if it is not within testTimeout
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	for start := time.Now(); time.Since(start) < testTimeout; time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %v", desc)
+}
+
+func findZone(site *localSite, zoneID string) (sites.Zone, bool) {
+	for _, z := range site.GetState().Zones {
+		if z.ID == zoneID {
+			return z, true
+		}
+	}
+	return sites.Zone{}, false
+}
+
+func TestLocalSiteFollowsPanelState(t *testing.T) {
+	srv := newTestPanel(t, tpimock.FaultConfig{})
+	defer srv.Close()
+	site, stop := newTestSite(t, srv, time.Second)
+	defer stop()
+
+	waitFor(t, "panel state", func() bool {
+		state := site.GetState()
+		return len(state.Zones) == 4 && len(state.Partitions) == 2
+	})
+	for _, p := range site.GetState().Partitions {
+		assert.Equal(t, sites.PartitionStateReady, p.State, p.ID)
+	}
+
+	assert.NoError(t, srv.SimulateZone("002", tpimock.ZoneActionOpen, false))
+	waitFor(t, "zone 002 open", func() bool {
+		z, _ := findZone(site, "002")
+		return z.State == sites.ZoneStateOpen
+	})
+}
+
+func TestLocalSiteBypassZone(t *testing.T) {
+	srv := newTestPanel(t, tpimock.FaultConfig{})
+	defer srv.Close()
+	site, stop := newTestSite(t, srv, time.Second)
+	defer stop()
+
+	waitFor(t, "zone 001", func() bool {
+		_, ok := findZone(site, "001")
+		return ok
+	})
+
+	cmd := sites.UserCommand{Code: sites.CmdBypassZone, PartitionID: "1", PIN: tpimock.DefaultUserPIN, ZoneID: "009"}
+	assert.Error(t, site.Exec(cmd), "the panel has not reported zone 009")
+	_, ok := findZone(site, "009")
+	assert.False(t, ok)
+
+	cmd.ZoneID = "001"
+	assert.NoError(t, site.Exec(cmd))
+	waitFor(t, "zone 001 bypassed", func() bool {
+		z, _ := findZone(site, "001")
+		return z.Bypassed
+	})
+	assert.Error(t, site.Exec(cmd), "zone 001 is already bypassed")
+
+	cmd.Code = sites.CmdUnbypassZone
+	assert.NoError(t, site.Exec(cmd))
+	waitFor(t, "zone 001 not bypassed", func() bool {
+		z, _ := findZone(site, "001")
+		return !z.Bypassed
+	})
+}
+
+func TestLocalSiteDropsMalformedMessages(t *testing.T) {
+	site := &localSite{partitions: map[string]*sites.Partition{}, zones: map[string]*sites.Zone{}}
+
+	malformed := []tpi.ServerMessage{
+		{Code: tpi.ServerCodePartitionArmed},
+		{Code: tpi.ServerCodePartitionReady, Data: []byte{}},
+		{Code: tpi.ServerCodeZoneAlarm, Data: []byte("1")},
+		{Code: tpi.ServerCodeZoneOpen},
+		{Code: tpi.ServerCodeUserClosing, Data: []byte("1")},
+		{Code: tpi.ServerCodeBypassedZonesBitfieldDump, Data: []byte("zz")},
+		{Code: tpi.ServerCodeVerboseTroubleStatus},
+		{Code: tpi.ServerCodeKeypadLedState, Data: []byte("x")},
+	}
+	for _, msg := range malformed {
+		assert.NoError(t, site.processMessage(msg), msg.Code.String())
+	}
+	state := site.GetState()
+	assert.Equal(t, 0, len(state.Partitions))
+	assert.Equal(t, 0, len(state.Zones))
+
+	assert.NoError(t, site.processMessage(tpi.ServerMessage{Code: tpi.ServerCodePartitionArmed, Data: []byte("12")}))
+	assert.NoError(t, site.processMessage(tpi.ServerMessage{Code: tpi.ServerCodeZoneAlarm, Data: []byte("1003")}))
+	state = site.GetState()
+	if assert.Equal(t, 1, len(state.Partitions)) && assert.Equal(t, 1, len(state.Zones)) {
+		assert.Equal(t, "1", state.Partitions[0].ID)
+		assert.Equal(t, sites.PartitionStateArmed, state.Partitions[0].State)
+		assert.Equal(t, "003", state.Zones[0].ID)
+		assert.Equal(t, sites.ZoneStateAlarm, state.Zones[0].State)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
 	"sec-ctl/pkg/util"
+	"syscall"
 )
 
 const appName = "Local"
@@ -11,6 +14,9 @@ const appName = "Local"
 var logger = log.New(os.Stderr, "[local] ", log.LstdFlags|log.Lshortfile)
 
 func main() {
+	claim := flag.Bool("claim", false, "get a new setup URL to claim the site, once the one printed at registration expired, and exit")
+	rotateToken := flag.Bool("rotateToken", false, "replace the token of the site with a new one, save it to the config file, and exit")
+	flag.Parse()
 
 	cfg := config{}
 	if err := util.LoadConfig(&cfg, &defaultConfig); err != nil {
@@ -23,9 +29,51 @@ func main() {
 		}
 	}
 
-	site := newLocalSite(cfg.TPIHost, cfg.TPIPort, cfg.TPIPassword, cfg.SiteID)
+	if *claim {
+		if err := renewClaim(&cfg); err != nil {
+			logger.Fatalln(err)
+		}
+		return
+	}
+
+	if *rotateToken {
+		if err := rotateSiteToken(&cfg); err != nil {
+			logger.Fatalln(err)
+		}
+		return
+	}
+
+	capture, err := openCapture(cfg)
+	if err != nil {
+		logger.Panicln(err)
+	}
+
+	// on SIGTERM, eg docker stop, stop taking requests, drain the queues, and close the connections
+	ctx, stop := util.WithSignals(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	deadline, cancel := util.WithShutdownDeadline(ctx, cfg.ShutdownTimeout)
+	defer cancel()
 
-	startCloudConnector(cfg.CloudWSURL, cfg.CloudToken, site)
+	site := newLocalSite(ctx, cfg, capture)
+
+	vault, err := loadPINVault(cfg)
+	if err != nil {
+		logger.Panicln(err)
+	}
+	go publishPINKey(ctx, cfg, vault)
+
+	cloud := startCloudConnector(ctx, cfg.CloudWSURL, cfg.CloudToken, cloudHeartbeat(cfg), site, vault)
+
+	startReloader(ctx, cfg, site, cloud, capture)
+
+	checker := newHealthChecker(site, cloud)
+
+	if err := runRESTAPI(ctx, deadline, site, cloud, checker, cfg.RESTBindHost, cfg.RESTBindPort); err != nil {
+		logger.Panicln(err)
+	}
 
-	runRESTAPI(site, cfg.RESTBindHost, cfg.RESTBindPort)
+	logger.Println("shutting down")
+	site.shutdown(deadline)
+	cloud.shutdown(deadline)
+	logger.Println("shut down")
 }
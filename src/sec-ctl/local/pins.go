@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"sec-ctl/pkg/client"
+	"sec-ctl/pkg/pinvault"
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/util"
+)
+
+// pinVault decrypts the codes which the cloud attaches to the commands of the members, encrypted
+// with the public key published by publishPINKey
+type pinVault struct {
+	siteID string
+	key    *rsa.PrivateKey
+}
+
+// loadPINVault reads the key of the site from its keyfile, which is created the first time
+func loadPINVault(cfg config) (*pinVault, error) {
+	fname := cfg.PINKeyFilename
+	if fname == "" {
+		cfgFname, err := util.ConfigFilename(appName)
+		if err != nil {
+			return nil, err
+		}
+		fname = filepath.Join(filepath.Dir(cfgFname), appName+".pin-key.pem")
+	}
+
+	key, err := pinvault.LoadOrCreateKey(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &pinVault{siteID: cfg.SiteID, key: key}, nil
+}
+
+// decrypt sets the code of the command from the encrypted code of the member who sent it
+func (v *pinVault) decrypt(cmd *sites.UserCommand) error {
+	if len(cmd.EncryptedPIN) == 0 {
+		return nil
+	}
+
+	pin, err := pinvault.Decrypt(v.key, v.siteID, cmd.MemberID, cmd.EncryptedPIN)
+	if err != nil {
+		return fmt.Errorf("%v of member %v: they must store it again, eg with secctl pin", err, cmd.MemberID)
+	}
+	cmd.PIN = pin
+	cmd.EncryptedPIN = nil
+	return nil
+}
+
+// publishPINKey publishes the public key of the vault to the cloud, retrying until it succeeds or
+// ctx is done, as the members cannot store their code until then
+func publishPINKey(ctx context.Context, cfg config, v *pinVault) {
+	pub, err := pinvault.MarshalPublicKey(&v.key.PublicKey)
+	if err != nil {
+		logger.Panicln(err)
+	}
+
+	cl := client.New(cfg.CloudBaseURL, cfg.CloudToken)
+	for n := 0; ; n++ {
+		changed, err := cl.SetPINKey(ctx, cfg.SiteID, pub)
+		if err == nil {
+			if changed {
+				logger.Println("published a new PIN key: the members must store their code again")
+			}
+			return
+		}
+
+		delay := backoffDelay(n)
+		logger.Printf("failed to publish the PIN key: %v. Retrying in %v", err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+	"sec-ctl/pkg/util"
+)
+
+// the fields of each component, which is re-established when one of them changes
+var (
+	tpiConnFields    = []string{"TPIHost", "TPIPort", "TPIPassword"}
+	tpiTimerFields   = []string{"TPIKeepAliveDelay", "TPIStateRefreshDelay", "TPIPollTimeout"}
+	tpiCaptureFields = []string{"TPICaptureFilename", "TPICaptureMaxBytes", "TPICaptureMaxFiles"}
+	cloudFields      = []string{"CloudWSURL", "CloudToken", "CloudPingInterval", "CloudPingTimeout"}
+	// restartFields cannot change while running: their new values only apply after a restart
+	restartFields = []string{"SiteID", "RESTBindHost", "RESTBindPort", "PINKeyFilename", "CloudBaseURL", "ShutdownTimeout"}
+)
+
+// reloader applies the changes of the config to the running components,
+// on SIGHUP, or when a config file changes, until ctx is done
+type reloader struct {
+	cfg     config
+	site    *localSite
+	cloud   *cloudConnector
+	capture *tpi.CaptureWriter
+}
+
+func startReloader(ctx context.Context, cfg config, site *localSite, cloud *cloudConnector, capture *tpi.CaptureWriter) {
+	r := &reloader{cfg: cfg, site: site, cloud: cloud, capture: capture}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sighup)
+
+		fnames, err := util.WatchedConfigFiles(appName)
+		if err != nil {
+			logger.Printf("unable to watch the config files: %v", err)
+		}
+		stamps := statFiles(fnames)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+				logger.Println("SIGHUP received: reloading config")
+				r.reload()
+			case <-watchTick(r.cfg.ConfigWatchInterval):
+				if newStamps := statFiles(fnames); !reflect.DeepEqual(stamps, newStamps) {
+					stamps = newStamps
+					logger.Println("config file changed: reloading config")
+					r.reload()
+				}
+			}
+		}
+	}()
+}
+
+// watchTick returns a channel receiving after the interval, or never if it is 0
+func watchTick(interval time.Duration) <-chan time.Time {
+	if interval <= 0 {
+		return nil
+	}
+	return time.After(interval)
+}
+
+// fileStamp identifies a version of a file. A missing file has a zero stamp.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(fnames []string) []fileStamp {
+	stamps := make([]fileStamp, len(fnames))
+	for i, fname := range fnames {
+		if info, err := os.Stat(fname); err == nil {
+			stamps[i] = fileStamp{info.ModTime(), info.Size()}
+		}
+	}
+	return stamps
+}
+
+// reload loads the config again, re-establishes the components whose settings changed,
+// and reports the outcome as an event
+func (r *reloader) reload() {
+	newCfg := config{}
+	if err := util.ReloadConfig(&newCfg, &defaultConfig); err != nil {
+		logger.Printf("config reload failed: %v", err)
+		r.publish(sites.LevelError, "ConfigReloadFailed", err.Error(), nil, nil)
+		return
+	}
+
+	changed := diffConfig(r.cfg, newCfg)
+	if len(changed) == 0 {
+		logger.Println("config reloaded: no change")
+		return
+	}
+
+	var ignored []string
+	for _, fld := range restartFields {
+		if contains(changed, fld) {
+			ignored = append(ignored, fld)
+		}
+	}
+
+	capture := r.capture
+	if changedAny(changed, tpiCaptureFields) {
+		var err error
+		if capture, err = openCapture(newCfg); err != nil {
+			logger.Printf("config reload failed: %v", err)
+			r.publish(sites.LevelError, "ConfigReloadFailed", err.Error(), nil, nil)
+			return
+		}
+	}
+
+	if changedAny(changed, tpiConnFields) || changedAny(changed, tpiCaptureFields) {
+		r.site.reconnect(newCfg.TPIHost, newCfg.TPIPort, newCfg.TPIPassword, capture)
+	}
+	if changedAny(changed, tpiTimerFields) {
+		r.site.setTimerDelays(newCfg.TPIKeepAliveDelay, newCfg.TPIStateRefreshDelay, newCfg.TPIPollTimeout)
+	}
+	if changedAny(changed, cloudFields) {
+		r.cloud.reconnect(newCfg.CloudWSURL, newCfg.CloudToken, cloudHeartbeat(newCfg))
+	}
+
+	// the connection to the panel uses the new writer by now: the old one can be closed
+	if capture != r.capture && r.capture != nil {
+		if err := r.capture.Close(); err != nil {
+			logger.Printf("unable to close the previous capture file: %v", err)
+		}
+	}
+
+	r.cfg = newCfg
+	r.capture = capture
+
+	applied := make([]string, 0, len(changed))
+	for _, fld := range changed {
+		if !contains(ignored, fld) {
+			applied = append(applied, fld)
+		}
+	}
+
+	level := sites.LevelInfo
+	var descs []string
+	if len(applied) > 0 {
+		descs = append(descs, fmt.Sprintf("applied %v", strings.Join(applied, ", ")))
+	}
+	if len(ignored) > 0 {
+		level = sites.LevelWarn
+		descs = append(descs, fmt.Sprintf("restart required for %v", strings.Join(ignored, ", ")))
+	}
+	desc := strings.Join(descs, "; ")
+	logger.Printf("config reloaded: %v", desc)
+	r.publish(level, "ConfigReloaded", desc, applied, ignored)
+}
+
+func (r *reloader) publish(level sites.EventLevel, code string, desc string, applied []string, ignored []string) {
+	evt := sites.NewEvent(level, code).SetDescription(desc)
+	if applied != nil {
+		evt.Data["Applied"] = applied
+	}
+	if ignored != nil {
+		evt.Data["RestartRequired"] = ignored
+	}
+	r.site.publishEvent(evt)
+}
+
+// openCapture opens the TPI capture file of cfg, or returns nil if capture is disabled
+func openCapture(cfg config) (*tpi.CaptureWriter, error) {
+	if cfg.TPICaptureFilename == "" {
+		return nil, nil
+	}
+	capture, err := tpi.NewCaptureWriter(cfg.TPICaptureFilename, cfg.TPICaptureMaxBytes, cfg.TPICaptureMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Capturing TPI traffic to %v", cfg.TPICaptureFilename)
+	return capture, nil
+}
+
+// diffConfig returns the names of the fields which differ between the configs
+func diffConfig(old config, new config) []string {
+	oldVal, newVal := reflect.ValueOf(old), reflect.ValueOf(new)
+	var changed []string
+	for i := 0; i < oldVal.NumField(); i++ {
+		if !reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			changed = append(changed, oldVal.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+func changedAny(changed []string, fields []string) bool {
+	for _, fld := range fields {
+		if contains(changed, fld) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
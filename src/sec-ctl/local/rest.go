@@ -1,24 +1,35 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"sec-ctl/pkg/health"
 	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/util"
 
 	"github.com/gin-gonic/gin"
 )
 
 //type authenticate func(clientID string, secret string) (sites.Site, bool)
 
-// run starts the api with supplied tpi, and binding to supplied prt
-func runRESTAPI(site sites.Site, bindHost string, bindPort uint16) error {
+// run starts the api with supplied tpi, and binding to supplied prt, until ctx is done.
+// It then waits until deadline for the active requests.
+func runRESTAPI(ctx context.Context, deadline context.Context, site *localSite, cloud *cloudConnector, checker *health.Checker, bindHost string, bindPort uint16) error {
 	g := gin.Default()
-	setupRoutes(site, g)
+	setupRoutes(site, cloud, checker, g)
 	bindAddr := fmt.Sprintf("%s:%d", bindHost, bindPort)
-	return g.Run(bindAddr)
+	return util.ListenAndServe(ctx, deadline, bindAddr, g)
 }
 
-func setupRoutes(site sites.Site, g *gin.Engine) {
+func setupRoutes(site *localSite, cloud *cloudConnector, checker *health.Checker, g *gin.Engine) {
+
+	g.GET("/healthz", gin.WrapH(health.Handler(checker.Liveness)))
+	g.GET("/readyz", gin.WrapH(health.Handler(checker.Readiness)))
+
+	g.GET("/telemetry", func(c *gin.Context) {
+		c.JSON(200, &gin.H{"TPI": site.tpiTelemetry(), "Cloud": cloud.telemetry()})
+	})
 
 	g.GET("/", func(c *gin.Context) {
 		c.JSON(200, site.GetState())
@@ -44,8 +55,13 @@ func setupRoutes(site sites.Site, g *gin.Engine) {
 
 		eventCh := site.SubscribeToEvents()
 		c.Stream(func(w io.Writer) bool {
-			c.SSEvent("event", <-eventCh)
-			return true
+			select {
+			case evt := <-eventCh:
+				c.SSEvent("event", evt)
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
 		})
 	})
 
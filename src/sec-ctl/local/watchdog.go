@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// watchdog detects a dead link to the panel, like a half-open TCP connection which looks connected,
+// from polls left unanswered, and measures the round-trip time of those answered
+type watchdog struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	// onTimeout is called when a poll is not acked within timeout
+	onTimeout func(unanswered time.Duration)
+
+	// pollSentAt is when the poll awaiting its ack was sent, or zero if there is none
+	pollSentAt time.Time
+	timer      *time.Timer
+	lastAck    time.Time
+	rtt        time.Duration
+	timeouts   int
+}
+
+// watchdogStats are the measurements of the watchdog
+type watchdogStats struct {
+	// PollRTT is the round-trip time of the last poll answered
+	PollRTT time.Duration
+	// LastAck is when the last poll was answered
+	LastAck time.Time
+	// PollPendingSince is when the poll awaiting its ack was sent
+	PollPendingSince time.Time
+	// Timeouts is the number of polls left unanswered, each forcing a reconnection
+	Timeouts int
+}
+
+func newWatchdog(timeout time.Duration, onTimeout func(unanswered time.Duration)) *watchdog {
+	return &watchdog{timeout: timeout, onTimeout: onTimeout}
+}
+
+// pollSent starts timing the poll, unless a previous one is still awaiting its ack
+func (w *watchdog) pollSent() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.pollSentAt.IsZero() {
+		return
+	}
+
+	sentAt := time.Now()
+	w.pollSentAt = sentAt
+	w.timer = time.AfterFunc(w.timeout, func() { w.expire(sentAt) })
+}
+
+// pollAcked stops timing the pending poll, and records its round-trip time
+func (w *watchdog) pollAcked() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.pollSentAt.IsZero() {
+		return
+	}
+	w.lastAck = time.Now()
+	w.rtt = w.lastAck.Sub(w.pollSentAt)
+	w.clear()
+}
+
+// reset forgets the pending poll, once the connection was re-established
+func (w *watchdog) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.clear()
+}
+
+func (w *watchdog) clear() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = nil
+	w.pollSentAt = time.Time{}
+}
+
+// expire reports the poll sent at sentAt as unanswered, unless it was acked or reset meanwhile
+func (w *watchdog) expire(sentAt time.Time) {
+	w.lock.Lock()
+	if !w.pollSentAt.Equal(sentAt) {
+		w.lock.Unlock()
+		return
+	}
+	unanswered := time.Since(w.pollSentAt)
+	w.timeouts++
+	w.clear()
+	w.lock.Unlock()
+
+	w.onTimeout(unanswered)
+}
+
+// setTimeout changes the timeout of the next polls
+func (w *watchdog) setTimeout(timeout time.Duration) {
+	w.lock.Lock()
+	w.timeout = timeout
+	w.lock.Unlock()
+}
+
+func (w *watchdog) stats() watchdogStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return watchdogStats{
+		PollRTT:          w.rtt,
+		LastAck:          w.lastAck,
+		PollPendingSince: w.pollSentAt,
+		Timeouts:         w.timeouts,
+	}
+}
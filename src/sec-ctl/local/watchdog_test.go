@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"sec-ctl/pkg/tpimock"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+const testPollTimeout = 50 * time.Millisecond
+
+func TestWatchdogMeasuresRoundTripTime(t *testing.T) {
+	w := newWatchdog(time.Minute, func(time.Duration) { t.Error("unexpected timeout") })
+
+	w.pollSent()
+	assert.False(t, w.stats().PollPendingSince.IsZero())
+	time.Sleep(20 * time.Millisecond)
+	w.pollAcked()
+
+	stats := w.stats()
+	assert.True(t, stats.PollRTT >= 20*time.Millisecond, "rtt %v", stats.PollRTT)
+	assert.True(t, stats.PollRTT < time.Second, "rtt %v", stats.PollRTT)
+	assert.False(t, stats.LastAck.IsZero())
+	assert.True(t, stats.PollPendingSince.IsZero())
+	assert.Equal(t, 0, stats.Timeouts)
+
+	// an ack without a pending poll is ignored
+	w.pollAcked()
+	assert.Equal(t, stats, w.stats())
+}
+
+func TestWatchdogTimesOutUnansweredPoll(t *testing.T) {
+	timeouts := make(chan time.Duration, 10)
+	w := newWatchdog(testPollTimeout, func(unanswered time.Duration) { timeouts <- unanswered })
+
+	w.pollSent()
+	time.Sleep(testPollTimeout / 2)
+	// a poll sent while one is pending does not restart the timer
+	w.pollSent()
+
+	select {
+	case unanswered := <-timeouts:
+		assert.True(t, unanswered >= testPollTimeout, "unanswered %v", unanswered)
+	case <-time.After(time.Second):
+		t.Fatal("poll did not time out")
+	}
+
+	stats := w.stats()
+	assert.Equal(t, 1, stats.Timeouts)
+	assert.True(t, stats.PollPendingSince.IsZero())
+	assert.Equal(t, time.Duration(0), stats.PollRTT)
+
+	time.Sleep(2 * testPollTimeout)
+	assert.Equal(t, 0, len(timeouts))
+}
+
+func TestWatchdogDoesNotTimeOutAckedOrResetPoll(t *testing.T) {
+	timeouts := make(chan time.Duration, 10)
+	w := newWatchdog(testPollTimeout, func(unanswered time.Duration) { timeouts <- unanswered })
+
+	w.pollSent()
+	w.pollAcked()
+	w.pollSent()
+	w.reset()
+
+	time.Sleep(2 * testPollTimeout)
+	assert.Equal(t, 0, len(timeouts))
+	assert.Equal(t, 0, w.stats().Timeouts)
+}
+
+func TestWatchdogSetTimeout(t *testing.T) {
+	timeouts := make(chan time.Duration, 10)
+	w := newWatchdog(time.Minute, func(unanswered time.Duration) { timeouts <- unanswered })
+	w.setTimeout(testPollTimeout)
+
+	w.pollSent()
+	select {
+	case <-timeouts:
+	case <-time.After(time.Second):
+		t.Fatal("poll did not time out")
+	}
+}
+
+func TestMissedPollAckForcesReconnect(t *testing.T) {
+	srv := newTestPanel(t, tpimock.FaultConfig{DropAckRate: 1})
+	defer srv.Close()
+	site, stop := newTestSite(t, srv, testPollTimeout)
+	defer stop()
+
+	firstSession := srv.Sessions()[0].ID
+	waitFor(t, "reconnection", func() bool {
+		sessions := srv.Sessions()
+		return len(sessions) == 1 && sessions[0].ID != firstSession && sessions[0].LoggedIn
+	})
+	assert.True(t, site.watchdog.stats().Timeouts >= 1)
+}
+
+func TestAckedPollKeepsConnection(t *testing.T) {
+	srv := newTestPanel(t, tpimock.FaultConfig{})
+	defer srv.Close()
+	site, stop := newTestSite(t, srv, time.Second)
+	defer stop()
+
+	session := srv.Sessions()[0].ID
+	var lastAck time.Time
+	for i := 0; i < 3; i++ {
+		waitFor(t, "poll ack", func() bool { return site.watchdog.stats().LastAck.After(lastAck) })
+		stats := site.watchdog.stats()
+		assert.True(t, stats.PollRTT > 0 && stats.PollRTT < time.Second, "rtt %v", stats.PollRTT)
+		lastAck = stats.LastAck
+	}
+
+	assert.Equal(t, 0, site.watchdog.stats().Timeouts)
+	sessions := srv.Sessions()
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, session, sessions[0].ID)
+}
@@ -1,25 +1,26 @@
 package main
 
 import (
+	"context"
 	"sync"
 )
 
 type workQueueFunc func(o interface{}) error
 
 type workQueue struct {
-	in chan interface{}
-
-	quit chan struct{}
+	// done is closed once the queue is stopped and drained
+	done chan struct{}
 
 	tasks    []interface{}
 	taskLock *sync.Cond
 	worker   workQueueFunc
+	started  bool
+	stopped  bool
 }
 
 func newWorkQueue(worker workQueueFunc) *workQueue {
 	return &workQueue{
-		in:       make(chan interface{}, 128),
-		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
 		tasks:    make([]interface{}, 0, 128),
 		taskLock: sync.NewCond(&sync.Mutex{}),
 		worker:   worker,
@@ -33,26 +34,89 @@ func (q *workQueue) enqueue(o interface{}) {
 	q.taskLock.Signal()
 }
 
-func (q *workQueue) start() {
+// start consumes the tasks until ctx is done. The tasks queued by then are still consumed,
+// and done is closed once they are.
+func (q *workQueue) start(ctx context.Context) {
+	q.taskLock.L.Lock()
+	q.started = true
+	q.taskLock.L.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		q.taskLock.L.Lock()
+		q.stopped = true
+		q.taskLock.Signal()
+		q.taskLock.L.Unlock()
+	}()
+
 	go q.consumeLoop()
 }
 
+// wait waits until the queue is drained, or ctx is done, and returns the number of tasks left.
+// A queue which was never started, because its connection never came up, is not waited for.
+func (q *workQueue) wait(ctx context.Context) int {
+	q.taskLock.L.Lock()
+	if !q.started {
+		defer q.taskLock.L.Unlock()
+		return len(q.tasks)
+	}
+	q.taskLock.L.Unlock()
+
+	select {
+	case <-q.done:
+		return 0
+	case <-ctx.Done():
+		q.taskLock.L.Lock()
+		defer q.taskLock.L.Unlock()
+		return len(q.tasks)
+	}
+}
+
+// status tells whether the queue was started, whether it stopped consuming since, and the number of
+// tasks pending
+func (q *workQueue) status() (started bool, stopped bool, pending int) {
+	q.taskLock.L.Lock()
+	started, pending = q.started, len(q.tasks)
+	q.taskLock.L.Unlock()
+
+	select {
+	case <-q.done:
+		return started, true, pending
+	default:
+		return started, false, pending
+	}
+}
+
 func (q *workQueue) consumeLoop() {
+	defer close(q.done)
+
 	q.drain()
 	for {
 		q.taskLock.L.Lock()
-		for len(q.tasks) == 0 {
+		for len(q.tasks) == 0 && !q.stopped {
 			q.taskLock.Wait()
 		}
+		stopped := q.stopped
 		q.taskLock.L.Unlock()
+
 		q.drain()
+		if stopped {
+			return
+		}
 	}
 }
 
 func (q *workQueue) drain() {
 
-	for len(q.tasks) > 0 {
+	for {
+		q.taskLock.L.Lock()
+		if len(q.tasks) == 0 {
+			q.taskLock.L.Unlock()
+			return
+		}
 		task := q.tasks[0]
+		q.taskLock.L.Unlock()
+
 		if err := q.worker(task); err != nil {
 			q.handleTaskError(err)
 		} else {
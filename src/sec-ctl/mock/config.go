@@ -1,11 +1,16 @@
 package main
 
+import "time"
+
 type config struct {
 	BindHost      string
-	TPIBindPort   uint16
-	RESTBindPort  uint16
-	Password      string
+	TPIBindPort   uint16 `config:"min=1"`
+	RESTBindPort  uint16 `config:"min=1"`
+	Password      string `config:"secret,required"`
 	StateFilename string
+
+	// ShutdownTimeout bounds the graceful shutdown on SIGTERM
+	ShutdownTimeout time.Duration `config:"min=0s"`
 }
 
 func (cfg *config) AppName() string {
@@ -18,4 +23,6 @@ var defaultConfig = config{
 	RESTBindPort:  9751,
 	Password:      "mock123",
 	StateFilename: "mock-state.json",
+
+	ShutdownTimeout: 8 * time.Second,
 }
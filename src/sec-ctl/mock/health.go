@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	"sec-ctl/pkg/health"
+	"sec-ctl/pkg/tpimock"
+)
+
+// newHealthChecker checks that the mock server accepts TPI clients. It is ready as soon as it is live:
+// it has no dependency.
+func newHealthChecker(srv *tpimock.Server) *health.Checker {
+	checker := health.NewChecker()
+
+	checker.AddLiveness("tpiServer", func(ctx context.Context) health.Component {
+		sessions := srv.Sessions()
+		loggedIn := 0
+		for _, s := range sessions {
+			if s.LoggedIn {
+				loggedIn++
+			}
+		}
+		details := map[string]interface{}{
+			"Addr":             srv.Addr,
+			"Sessions":         len(sessions),
+			"LoggedInSessions": loggedIn,
+		}
+		if !srv.Listening() {
+			return health.Down("not accepting clients", details)
+		}
+		return health.Up(details)
+	})
+
+	return checker
+}
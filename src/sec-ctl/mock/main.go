@@ -1,21 +1,55 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
 	"sec-ctl/pkg/util"
+	"syscall"
 )
 
 var logger = log.New(os.Stderr, "[mock] ", log.LstdFlags|log.Lshortfile)
 
 func main() {
+	scenarioFilename := flag.String("scenario", "", "run the scenario file headless, and exit with a non-zero status if any expectation fails")
+	replayFilename := flag.String("replay", "", "replay the TPI capture file to the first client to connect, and exit")
+	replaySpeed := flag.Float64("replaySpeed", 1, "replay speed factor: 1 keeps the original timing, 0 replays without delay")
+	flag.Parse()
+
 	cfg := config{}
 	err := util.LoadConfig(&cfg, &defaultConfig)
 	if err != nil {
 		log.Panicln(err)
 	}
 
-	if err = Run(cfg.BindHost, cfg.TPIBindPort, cfg.RESTBindPort, cfg.Password, cfg.StateFilename); err != nil {
+	// on SIGTERM, eg docker stop, close the client sessions and the api
+	ctx, stop := util.WithSignals(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	deadline, cancel := util.WithShutdownDeadline(ctx, cfg.ShutdownTimeout)
+	defer cancel()
+
+	if *replayFilename != "" {
+		if err := RunReplay(ctx, cfg.BindHost, cfg.TPIBindPort, *replayFilename, *replaySpeed); err != nil {
+			logger.Println(err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *scenarioFilename != "" {
+		failures, err := RunScenario(cfg.BindHost, cfg.TPIBindPort, cfg.Password, cfg.StateFilename, *scenarioFilename)
+		if err != nil {
+			logger.Println(err)
+			os.Exit(2)
+		}
+		if failures > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err = Run(ctx, deadline, cfg.BindHost, cfg.TPIBindPort, cfg.RESTBindPort, cfg.Password, cfg.StateFilename); err != nil {
 		log.Panicln(err)
 	}
 }
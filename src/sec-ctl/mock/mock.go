@@ -1,71 +1,52 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"sec-ctl/pkg/health"
 	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpimock"
+	"sec-ctl/pkg/util"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
-// Run creates a new mock server
-func Run(bindHost string, tpiBindPort uint16, restBindPort uint16, password string, stateFilename string) error {
+// Run creates a new mock server, and runs it until ctx is done. The api then waits until deadline
+// for the active requests.
+func Run(ctx context.Context, deadline context.Context, bindHost string, tpiBindPort uint16, restBindPort uint16, password string, stateFilename string) error {
 
-	state, err := newState(password, stateFilename)
+	srv, err := tpimock.NewServer(tpimock.Options{
+		Addr:          fmt.Sprintf("%s:%d", bindHost, tpiBindPort),
+		Password:      password,
+		StateFilename: stateFilename,
+	})
 	if err != nil {
 		return err
 	}
+	defer srv.Close()
 
-	ctrl := newController(state)
-
-	errCh := make(chan error)
-
-	startMockTPI(ctrl, bindHost, tpiBindPort, errCh)
-	startRESTAPI(ctrl, bindHost, restBindPort, errCh)
-
-	for {
-		select {
-		case err := <-errCh:
-			logger.Panicln(err)
-		}
-	}
+	return runRESTAPI(ctx, deadline, srv, bindHost, restBindPort)
 }
 
-func startMockTPI(ctrl *controller, bindHost string, bindPort uint16, errCh chan error) {
-	addr := fmt.Sprintf("%s:%d", bindHost, bindPort)
-	logger.Println("binding:", addr)
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		errCh <- fmt.Errorf("Error listening: %v", err)
-		return
-	}
-
-	go func() {
-		defer l.Close()
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				errCh <- err
-			}
-			go handleClientSession(ctrl, conn)
-		}
-	}()
-
-}
-
-func startRESTAPI(ctrl *controller, bindHost string, bindPort uint16, errCh chan error) {
+func runRESTAPI(ctx context.Context, deadline context.Context, srv *tpimock.Server, bindHost string, bindPort uint16) error {
 	r := gin.Default()
-	setupRoutes(r, ctrl)
-	go func() {
-		if err := r.Run(fmt.Sprintf("%s:%d", bindHost, bindPort)); err != nil {
-			errCh <- err
-		}
-	}()
+	setupRoutes(r, srv)
+	return util.ListenAndServe(ctx, deadline, fmt.Sprintf("%s:%d", bindHost, bindPort), r)
 }
 
-func setupRoutes(r *gin.Engine, ctrl *controller) {
+func setupRoutes(r *gin.Engine, srv *tpimock.Server) {
+	checker := newHealthChecker(srv)
+	r.GET("/healthz", gin.WrapH(health.Handler(checker.Liveness)))
+	r.GET("/readyz", gin.WrapH(health.Handler(checker.Readiness)))
+
 	r.GET("/state", func(c *gin.Context) {
-		c.JSON(200, ctrl.state)
+		data, err := srv.StateJSON()
+		if err != nil {
+			c.JSON(500, &gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(200, "application/json; charset=utf-8", data)
 
 	})
 
@@ -79,9 +60,10 @@ func setupRoutes(r *gin.Engine, ctrl *controller) {
 
 		if err := c.BindJSON(&data); err != nil {
 			c.JSON(400, &gin.H{"error": err.Error()})
+			return
 		}
 
-		if err := ctrl.triggerAlarm(data.Type, data.PartitionID, data.ZoneID); err != nil {
+		if err := srv.TriggerAlarm(data.Type, data.PartitionID, data.ZoneID); err != nil {
 			c.JSON(400, &gin.H{"error": err.Error()})
 		} else {
 			c.JSON(204, nil)
@@ -101,13 +83,123 @@ func setupRoutes(r *gin.Engine, ctrl *controller) {
 			return
 		}
 
-		if err := ctrl.restoreAlarm(data.Type, data.PartitionID); err != nil {
+		if err := srv.RestoreAlarm(data.Type, data.PartitionID); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+		}
+
+	})
+
+	//simulate zone changes: open, close, fault, tamper.
+	//fault and tamper are restored with ?restore=true
+	r.POST("/sim/zones/:id/:action", func(c *gin.Context) {
+		restore := c.Query("restore") == "true"
+		if err := srv.SimulateZone(c.Param("id"), tpimock.ZoneAction(c.Param("action")), restore); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+		} else {
+			c.JSON(204, nil)
+		}
+	})
+
+	//simulate system troubles and their restoral
+	r.POST("/sim/trouble", func(c *gin.Context) {
+		data := struct {
+			Type    tpimock.TroubleType `json:"type" binding:"required"`
+			Restore bool                `json:"restore"`
+		}{}
+
+		if err := c.BindJSON(&data); err != nil {
 			c.JSON(400, &gin.H{"error": err.Error()})
+			return
 		}
 
+		if err := srv.SimulateTrouble(data.Type, data.Restore); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+		} else {
+			c.JSON(204, nil)
+		}
 	})
 
-	//POST sim trouble
-	//POST sim trouble restore
+	//simulate keypad LED and LED flash bitmasks
+	r.POST("/sim/leds", func(c *gin.Context) {
+		data := struct {
+			State      sites.KeypadLEDState      `json:"state"`
+			FlashState sites.KeypadLEDFlashState `json:"flashState"`
+		}{}
 
+		if err := c.BindJSON(&data); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := srv.SimulateLEDs(data.State, data.FlashState); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+		} else {
+			c.JSON(204, nil)
+		}
+	})
+
+	//simulate thermostat temperature broadcasts
+	r.POST("/sim/temperature", func(c *gin.Context) {
+		data := struct {
+			Thermostat int `json:"thermostat" binding:"required"`
+			Indoor     int `json:"indoor"`
+			Outdoor    int `json:"outdoor"`
+		}{}
+
+		if err := c.BindJSON(&data); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := srv.SimulateTemperature(data.Thermostat, data.Indoor, data.Outdoor); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+		} else {
+			c.JSON(204, nil)
+		}
+	})
+
+	//list client sessions, with their faults
+	r.GET("/sessions", func(c *gin.Context) {
+		c.JSON(200, srv.Sessions())
+	})
+
+	//faults injected in new sessions
+	r.GET("/faults", func(c *gin.Context) {
+		c.JSON(200, srv.DefaultFaults())
+	})
+
+	r.PUT("/faults", func(c *gin.Context) {
+		var cfg tpimock.FaultConfig
+		if err := c.BindJSON(&cfg); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := srv.SetDefaultFaults(cfg); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+		} else {
+			c.JSON(204, nil)
+		}
+	})
+
+	//faults injected in an existing session; the response holds the seed in use
+	r.PUT("/sessions/:id/faults", func(c *gin.Context) {
+		sessionID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		var cfg tpimock.FaultConfig
+		if err := c.BindJSON(&cfg); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+			return
+		}
+
+		if cfg, err = srv.SetSessionFaults(sessionID, cfg); err != nil {
+			c.JSON(400, &gin.H{"error": err.Error()})
+		} else {
+			c.JSON(200, cfg)
+		}
+	})
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"sec-ctl/pkg/tpi"
+	"sec-ctl/pkg/tpimock"
+)
+
+// RunReplay feeds a TPI capture back to the first client to connect, and returns once it has been replayed,
+// or ctx is done
+func RunReplay(ctx context.Context, bindHost string, tpiBindPort uint16, captureFilename string, speed float64) error {
+
+	f, err := os.Open(captureFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	recs, err := tpi.ReadCapture(f)
+	if err != nil {
+		return err
+	}
+
+	srv, err := tpimock.NewReplayServer(tpimock.ReplayOptions{
+		Addr:    fmt.Sprintf("%s:%d", bindHost, tpiBindPort),
+		Records: recs,
+		Speed:   speed,
+	})
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	select {
+	case <-srv.Done():
+	case <-ctx.Done():
+	}
+
+	return nil
+}
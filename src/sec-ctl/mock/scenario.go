@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+	"sec-ctl/pkg/tpimock"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultClientWait = 30 * time.Second
+const defaultExpectWithin = 5 * time.Second
+
+// scenario is a timeline of simulated panel changes and expectations on what the client sends.
+// It is loaded from a YAML (or JSON) file, eg:
+//
+//	name: entry delay
+//	initialState: entry-delay.json
+//	steps:
+//	  - at: 0s
+//	    expect: {command: "030", data: "1"}
+//	  - at: 20s
+//	    zone: {id: "001", action: open}
+//	  - at: 25s
+//	    expect: {command: "040", within: 30s}
+//
+// Steps are run in order, each one starting at `at` after the client logged in.
+type scenario struct {
+	Name         string
+	InitialState string        `yaml:"initialState"`
+	ClientWait   time.Duration `yaml:"clientWait"`
+	Steps        []scenarioStep
+}
+
+// scenarioStep holds exactly one action or expectation
+type scenarioStep struct {
+	At           time.Duration
+	Zone         *zoneStep            `yaml:"zone"`
+	Alarm        *alarmStep           `yaml:"alarm"`
+	RestoreAlarm *alarmStep           `yaml:"restoreAlarm"`
+	Trouble      *troubleStep         `yaml:"trouble"`
+	LEDs         *ledsStep            `yaml:"leds"`
+	Temperature  *temperatureStep     `yaml:"temperature"`
+	Faults       *tpimock.FaultConfig `yaml:"faults"`
+	Expect       *expectStep          `yaml:"expect"`
+	ExpectNone   *expectStep          `yaml:"expectNone"`
+}
+
+type zoneStep struct {
+	ID      string
+	Action  tpimock.ZoneAction
+	Restore bool
+}
+
+type alarmStep struct {
+	Type        sites.AlarmType
+	PartitionID string `yaml:"partitionID"`
+	ZoneID      string `yaml:"zoneID"`
+}
+
+type troubleStep struct {
+	Type    tpimock.TroubleType
+	Restore bool
+}
+
+type ledsStep struct {
+	State      sites.KeypadLEDState
+	FlashState sites.KeypadLEDFlashState `yaml:"flashState"`
+}
+
+type temperatureStep struct {
+	Thermostat int
+	Indoor     int
+	Outdoor    int
+}
+
+// expectStep matches a client message by code, and optionally data
+type expectStep struct {
+	Command string
+	Data    *string
+	Within  time.Duration
+}
+
+func (e expectStep) String() string {
+	if e.Data != nil {
+		return fmt.Sprintf("command %v with data '%v'", e.Command, *e.Data)
+	}
+	return fmt.Sprintf("command %v", e.Command)
+}
+
+func loadScenario(fname string) (*scenario, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &scenario{ClientWait: defaultClientWait}
+	if err := yaml.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("Unable to parse scenario %v: %v", fname, err)
+	}
+
+	if sc.InitialState != "" && !path.IsAbs(sc.InitialState) {
+		sc.InitialState = path.Join(path.Dir(fname), sc.InitialState)
+	}
+
+	return sc, nil
+}
+
+// RunScenario runs the scenario file headless against the first client to log in,
+// and returns the number of failed expectations
+func RunScenario(bindHost string, tpiBindPort uint16, password string, stateFilename string, scenarioFilename string) (int, error) {
+
+	sc, err := loadScenario(scenarioFilename)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := tpimock.Options{
+		Addr:     fmt.Sprintf("%s:%d", bindHost, tpiBindPort),
+		Password: password,
+	}
+	if sc.InitialState != "" {
+		// keep the state in memory, so that running the scenario does not alter it
+		if opts.InitialState, err = ioutil.ReadFile(sc.InitialState); err != nil {
+			return 0, err
+		}
+	} else {
+		opts.StateFilename = stateFilename
+	}
+
+	srv, err := tpimock.NewServer(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer srv.Close()
+
+	logger.Printf("scenario %v: waiting up to %v for client login", sc.Name, sc.ClientWait)
+	if err := srv.WaitForLogin(sc.ClientWait); err != nil {
+		return 0, err
+	}
+
+	failures := sc.run(srv)
+
+	if failures > 0 {
+		logger.Printf("scenario %v: FAILED (%d failed expectations)", sc.Name, failures)
+	} else {
+		logger.Printf("scenario %v: PASSED", sc.Name)
+	}
+
+	return failures, nil
+}
+
+func (sc *scenario) run(srv *tpimock.Server) int {
+	start := time.Now()
+	failures := 0
+	// the server was started for the scenario, so its whole transcript is matched: the client
+	// may have sent the first expected message before WaitForLogin returned
+	next := 0
+
+	for i, step := range sc.Steps {
+		time.Sleep(time.Until(start.Add(step.At)))
+
+		desc := fmt.Sprintf("step %d (t+%v)", i+1, step.At)
+
+		switch {
+		case step.Expect != nil:
+			idx := srv.WaitForMessage(next, step.Expect.within(), step.Expect.match)
+			if idx < 0 {
+				logger.Printf("%s: FAIL: expected client %v within %v", desc, step.Expect, step.Expect.within())
+				failures++
+			} else {
+				logger.Printf("%s: OK: client sent %v", desc, step.Expect)
+				next = idx + 1
+			}
+
+		case step.ExpectNone != nil:
+			idx := srv.WaitForMessage(next, step.ExpectNone.within(), step.ExpectNone.match)
+			if idx >= 0 {
+				logger.Printf("%s: FAIL: unexpected client %v", desc, step.ExpectNone)
+				failures++
+			} else {
+				logger.Printf("%s: OK: client did not send %v", desc, step.ExpectNone)
+			}
+
+		default:
+			if err := step.exec(srv); err != nil {
+				logger.Printf("%s: FAIL: %v", desc, err)
+				failures++
+			} else {
+				logger.Printf("%s: OK", desc)
+			}
+		}
+	}
+
+	return failures
+}
+
+func (step scenarioStep) exec(srv *tpimock.Server) error {
+	switch {
+	case step.Zone != nil:
+		return srv.SimulateZone(step.Zone.ID, step.Zone.Action, step.Zone.Restore)
+	case step.Alarm != nil:
+		return srv.TriggerAlarm(step.Alarm.Type, step.Alarm.PartitionID, step.Alarm.ZoneID)
+	case step.RestoreAlarm != nil:
+		return srv.RestoreAlarm(step.RestoreAlarm.Type, step.RestoreAlarm.PartitionID)
+	case step.Trouble != nil:
+		return srv.SimulateTrouble(step.Trouble.Type, step.Trouble.Restore)
+	case step.LEDs != nil:
+		return srv.SimulateLEDs(step.LEDs.State, step.LEDs.FlashState)
+	case step.Temperature != nil:
+		t := step.Temperature
+		return srv.SimulateTemperature(t.Thermostat, t.Indoor, t.Outdoor)
+	case step.Faults != nil:
+		return srv.SetAllFaults(*step.Faults)
+	}
+	return fmt.Errorf("empty step")
+}
+
+func (e expectStep) within() time.Duration {
+	if e.Within == 0 {
+		return defaultExpectWithin
+	}
+	return e.Within
+}
+
+func (e expectStep) match(entry tpimock.TranscriptEntry) bool {
+	code, err := tpi.DecodeIntCode([]byte(e.Command))
+	if err != nil || tpi.ClientCode(code) != entry.Message.Code {
+		return false
+	}
+	return e.Data == nil || bytes.Equal([]byte(*e.Data), entry.Message.Data)
+}
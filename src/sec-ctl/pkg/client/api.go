@@ -0,0 +1,641 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"sec-ctl/pkg/sites"
+)
+
+// User is a user of the cloud
+type User struct {
+	ID    string
+	Email string
+}
+
+// SiteSummary describes a site in the list of sites of a user
+type SiteSummary struct {
+	ID string
+	// Role is the role of the user on the site
+	Role      Role
+	Connected bool
+	// PingRTTMillis is the round-trip time of the last ping of the site, if connected
+	PingRTTMillis float64
+}
+
+// SiteRegistration holds the credentials of a new site
+type SiteRegistration struct {
+	SiteID string
+	// Token authenticates the local daemon of the site
+	Token string
+	// SetupURL is the path of the claim page of the site
+	SetupURL string
+	// ClaimExpiresAt is when the claim token of the SetupURL expires
+	ClaimExpiresAt time.Time
+}
+
+// Scope is what a user token allows, each scope allowing what the previous ones do
+type Scope string
+
+const (
+	// ScopeReadOnly allows reading the sites, their state and their events
+	ScopeReadOnly Scope = "read-only"
+	// ScopeCommand also allows sending commands to the sites
+	ScopeCommand Scope = "command"
+	// ScopeAdmin also allows claiming sites and managing tokens
+	ScopeAdmin Scope = "admin"
+)
+
+// TokenInfo describes a token of the user
+type TokenInfo struct {
+	ID        string
+	Name      string
+	Scope     Scope
+	CreatedAt time.Time
+	// ExpiresAt is nil if the token does not expire
+	ExpiresAt *time.Time
+}
+
+// Role is what a member may do on a site, each role allowing what the previous ones do
+type Role string
+
+const (
+	// RoleViewOnly allows reading the state and the events of the site
+	RoleViewOnly Role = "view-only"
+	// RoleArmOnly also allows arming the partitions, and triggering panic alarms
+	RoleArmOnly Role = "arm-only"
+	// RoleAdmin also allows every other command, and managing the members with a lower role
+	RoleAdmin Role = "admin"
+	// RoleOwner is the role of the user who claimed the site, which also allows managing the admins
+	RoleOwner Role = "owner"
+)
+
+// Member is a user with a role on a site
+type Member struct {
+	UserID string
+	Email  string
+	Role   Role
+	// HasPIN is whether the member stored their code for the site
+	HasPIN bool
+}
+
+// Invitation invites a user, by email, to become a member of a site
+type Invitation struct {
+	ID        string
+	SiteID    string
+	Email     string
+	Role      Role
+	InvitedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// EventFilter restricts the events returned by Events. Zero fields are ignored.
+type EventFilter struct {
+	Level       sites.EventLevel
+	Code        string
+	Since       time.Time
+	Until       time.Time
+	PartitionID string
+	ZoneID      string
+	// Search only returns the events whose description matches all its words
+	Search string
+	// Before only returns the events older than the event with this id: pass the ID of the last
+	// event of a page to get the next one
+	Before int64
+	// Limit is the maximum number of events. Defaults to 100 on the server.
+	Limit uint
+}
+
+func (f EventFilter) query() url.Values {
+	q := url.Values{}
+	if f.Level != "" {
+		q.Set("level", string(f.Level))
+	}
+	if f.Code != "" {
+		q.Set("code", f.Code)
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		q.Set("until", f.Until.Format(time.RFC3339))
+	}
+	if f.PartitionID != "" {
+		q.Set("partition", f.PartitionID)
+	}
+	if f.ZoneID != "" {
+		q.Set("zone", f.ZoneID)
+	}
+	if f.Search != "" {
+		q.Set("q", f.Search)
+	}
+	if f.Before > 0 {
+		q.Set("before", strconv.FormatInt(f.Before, 10))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.FormatUint(uint64(f.Limit), 10))
+	}
+	return q
+}
+
+// AuditEntry records an action on the cloud, by a user or the local daemon of a site
+type AuditEntry struct {
+	ID   int64
+	Time time.Time
+	// ActorType is user, site, or anonymous, eg for a failed login
+	ActorType  string
+	ActorID    string
+	ActorEmail string
+	TokenID    string
+	IP         string
+	SiteID     string
+	// Action is what was done, eg login or site.command
+	Action string
+	// Payload describes the action, without its secrets
+	Payload json.RawMessage
+	Status  int
+	// Outcome is success or failure, with Error
+	Outcome string
+	Error   string
+}
+
+// AuditFilter restricts the entries returned by AuditLog. Zero fields are ignored.
+type AuditFilter struct {
+	ActorID string
+	Action  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	// Before only returns the entries older than the entry with this id: pass the ID of the last
+	// entry of a page to get the next one
+	Before int64
+	// Limit is the maximum number of entries. Defaults to 100 on the server.
+	Limit uint
+}
+
+func (f AuditFilter) query() url.Values {
+	q := url.Values{}
+	if f.ActorID != "" {
+		q.Set("actor", f.ActorID)
+	}
+	if f.Action != "" {
+		q.Set("action", f.Action)
+	}
+	if f.Outcome != "" {
+		q.Set("outcome", f.Outcome)
+	}
+	if !f.Since.IsZero() {
+		q.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		q.Set("until", f.Until.Format(time.RFC3339))
+	}
+	if f.Before > 0 {
+		q.Set("before", strconv.FormatInt(f.Before, 10))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.FormatUint(uint64(f.Limit), 10))
+	}
+	return q
+}
+
+type authResponse struct {
+	User  User   `json:"user"`
+	Token string `json:"token"`
+}
+
+// Signup creates a user, and returns it with its auth token
+func (c *Client) Signup(ctx context.Context, email string, password string) (User, string, error) {
+	var rsp authResponse
+	body := map[string]string{"Email": email, "Password": password}
+	if err := c.do(ctx, "POST", "/signup", nil, body, &rsp); err != nil {
+		return User{}, "", err
+	}
+	return rsp.User, rsp.Token, nil
+}
+
+// Login authenticates a user, and returns it with a new auth token
+func (c *Client) Login(ctx context.Context, email string, password string) (User, string, error) {
+	var rsp authResponse
+	body := map[string]string{"Email": email, "Password": password}
+	if err := c.do(ctx, "POST", "/login", nil, body, &rsp); err != nil {
+		return User{}, "", err
+	}
+	return rsp.User, rsp.Token, nil
+}
+
+// ListTokens returns the tokens of the user which did not expire, most recent first
+func (c *Client) ListTokens(ctx context.Context) ([]TokenInfo, error) {
+	var tokens []TokenInfo
+	if err := c.do(ctx, "GET", "/tokens", nil, nil, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CreateToken creates a personal access token, and returns it with its description. The token does not
+// expire if expiresAt is zero. The client must be authenticated with a token of scope admin.
+func (c *Client) CreateToken(ctx context.Context, name string, scope Scope, expiresAt time.Time) (TokenInfo, string, error) {
+	var rsp struct {
+		TokenInfo
+		Token string
+	}
+	body := map[string]interface{}{"Name": name, "Scope": scope}
+	if !expiresAt.IsZero() {
+		body["ExpiresAt"] = expiresAt
+	}
+	if err := c.do(ctx, "POST", "/tokens", nil, body, &rsp); err != nil {
+		return TokenInfo{}, "", err
+	}
+	return rsp.TokenInfo, rsp.Token, nil
+}
+
+// RevokeToken deletes the token of the user with the id
+func (c *Client) RevokeToken(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", "/tokens/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// TOTPEnrollment is a TOTP secret to add to an authenticator app, eg from a QR code of its URL
+type TOTPEnrollment struct {
+	Secret string
+	URL    string
+}
+
+// TOTPEnabled returns whether the user enabled TOTP
+func (c *Client) TOTPEnabled(ctx context.Context) (bool, error) {
+	var rsp struct {
+		Enabled bool
+	}
+	if err := c.do(ctx, "GET", "/totp", nil, nil, &rsp); err != nil {
+		return false, err
+	}
+	return rsp.Enabled, nil
+}
+
+// EnrollTOTP generates a TOTP secret for the user, which ConfirmTOTP enables
+func (c *Client) EnrollTOTP(ctx context.Context, password string) (TOTPEnrollment, error) {
+	var enrollment TOTPEnrollment
+	body := map[string]string{"Password": password}
+	if err := c.do(ctx, "POST", "/totp", nil, body, &enrollment); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return enrollment, nil
+}
+
+// ConfirmTOTP enables the TOTP secret of the user with a code of their authenticator app
+func (c *Client) ConfirmTOTP(ctx context.Context, code string) error {
+	body := map[string]string{"Code": code}
+	return c.do(ctx, "POST", "/totp/confirm", nil, body, nil)
+}
+
+// DisableTOTP disables the TOTP of the user. It requires a step-up: see ErrStepUpRequired.
+func (c *Client) DisableTOTP(ctx context.Context) error {
+	return c.do(ctx, "DELETE", "/totp", nil, nil, nil)
+}
+
+// Reauthenticate re-authenticates the token of the client with the password of the user, and a
+// TOTP code if they enabled it, to step up for the requests which require it. It returns until
+// when the re-authentication is valid.
+func (c *Client) Reauthenticate(ctx context.Context, password string, totpCode string) (time.Time, error) {
+	var rsp struct {
+		ReauthenticatedUntil time.Time
+	}
+	body := map[string]string{"Password": password, "TOTPCode": totpCode}
+	if err := c.do(ctx, "POST", "/reauth", nil, body, &rsp); err != nil {
+		return time.Time{}, err
+	}
+	return rsp.ReauthenticatedUntil, nil
+}
+
+// ListSites returns the sites of the user
+func (c *Client) ListSites(ctx context.Context) ([]SiteSummary, error) {
+	var summaries []SiteSummary
+	if err := c.do(ctx, "GET", "/sites", nil, nil, &summaries); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// CreateSite registers a new site, to be claimed by a user with ClaimSite
+func (c *Client) CreateSite(ctx context.Context) (SiteRegistration, error) {
+	var reg SiteRegistration
+	if err := c.do(ctx, "POST", "/sites", nil, nil, &reg); err != nil {
+		return SiteRegistration{}, err
+	}
+	return reg, nil
+}
+
+// RegenerateClaimToken replaces the claim token of an unclaimed site, once expired.
+// The client must be authenticated with the token of the site, and the returned registration has no Token.
+func (c *Client) RegenerateClaimToken(ctx context.Context, siteID string) (SiteRegistration, error) {
+	var reg SiteRegistration
+	if err := c.do(ctx, "POST", sitePath(siteID, "/claimToken"), nil, nil, &reg); err != nil {
+		return SiteRegistration{}, err
+	}
+	return reg, nil
+}
+
+// RotateSiteToken replaces the token of the site with a new one, and returns it. The client must be
+// authenticated with the current token of the site, which is no longer valid once this returns.
+func (c *Client) RotateSiteToken(ctx context.Context, siteID string) (string, error) {
+	var reg SiteRegistration
+	if err := c.do(ctx, "POST", sitePath(siteID, "/token"), nil, nil, &reg); err != nil {
+		return "", err
+	}
+	return reg.Token, nil
+}
+
+// ClaimSite makes the user the owner of the site
+func (c *Client) ClaimSite(ctx context.Context, siteID string, claimToken string) error {
+	body := map[string]string{"ClaimToken": claimToken}
+	return c.do(ctx, "POST", sitePath(siteID, "/claim"), nil, body, nil)
+}
+
+// SetPINKey publishes the public key with which the members encrypt their code for the site. The client
+// must be authenticated with the token of the site. It returns whether the key changed, in which case
+// the cloud deleted the codes encrypted with the previous one.
+func (c *Client) SetPINKey(ctx context.Context, siteID string, publicKey string) (bool, error) {
+	var rsp struct {
+		Changed bool
+	}
+	body := map[string]string{"PublicKey": publicKey}
+	if err := c.do(ctx, "PUT", sitePath(siteID, "/pinKey"), nil, body, &rsp); err != nil {
+		return false, err
+	}
+	return rsp.Changed, nil
+}
+
+// PINKey returns the public key with which to encrypt the code of the user for the site, and their
+// member id, to encrypt it for. It fails with ErrNotFound until the local daemon published its key.
+func (c *Client) PINKey(ctx context.Context, siteID string) (string, string, error) {
+	var rsp struct {
+		MemberID  string
+		PublicKey string
+	}
+	if err := c.do(ctx, "GET", sitePath(siteID, "/pinKey"), nil, nil, &rsp); err != nil {
+		return "", "", err
+	}
+	return rsp.PublicKey, rsp.MemberID, nil
+}
+
+// SetPIN stores the code of the user for the site, encrypted with pinvault.Encrypt
+func (c *Client) SetPIN(ctx context.Context, siteID string, encryptedPIN []byte) error {
+	body := map[string][]byte{"EncryptedPIN": encryptedPIN}
+	return c.do(ctx, "PUT", sitePath(siteID, "/pin"), nil, body, nil)
+}
+
+// DeletePIN deletes the stored code of the user for the site
+func (c *Client) DeletePIN(ctx context.Context, siteID string) error {
+	return c.do(ctx, "DELETE", sitePath(siteID, "/pin"), nil, nil, nil)
+}
+
+// StepUpRoles returns the roles of the members of the site whose disarm and panic commands require
+// a step-up
+func (c *Client) StepUpRoles(ctx context.Context, siteID string) ([]Role, error) {
+	var rsp struct {
+		Roles []Role
+	}
+	if err := c.do(ctx, "GET", sitePath(siteID, "/stepUp"), nil, nil, &rsp); err != nil {
+		return nil, err
+	}
+	return rsp.Roles, nil
+}
+
+// SetStepUpRoles sets the roles of the members of the site whose disarm and panic commands require
+// a step-up. The client must be authenticated as the owner of the site, and step up.
+func (c *Client) SetStepUpRoles(ctx context.Context, siteID string, roles []Role) error {
+	body := map[string][]Role{"Roles": roles}
+	return c.do(ctx, "PUT", sitePath(siteID, "/stepUp"), nil, body, nil)
+}
+
+// ListMembers returns the members of the site. The client must be authenticated as an admin of the site.
+func (c *Client) ListMembers(ctx context.Context, siteID string) ([]Member, error) {
+	var members []Member
+	if err := c.do(ctx, "GET", sitePath(siteID, "/members"), nil, nil, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SetMemberRole changes the role of the member of the site
+func (c *Client) SetMemberRole(ctx context.Context, siteID string, userID string, role Role) error {
+	body := map[string]Role{"Role": role}
+	return c.do(ctx, "PUT", sitePath(siteID, "/members/"+url.PathEscape(userID)), nil, body, nil)
+}
+
+// RemoveMember removes the user from the members of the site. Members may remove themselves.
+func (c *Client) RemoveMember(ctx context.Context, siteID string, userID string) error {
+	return c.do(ctx, "DELETE", sitePath(siteID, "/members/"+url.PathEscape(userID)), nil, nil, nil)
+}
+
+// ListInvitations returns the pending invitations of the site
+func (c *Client) ListInvitations(ctx context.Context, siteID string) ([]Invitation, error) {
+	var invs []Invitation
+	if err := c.do(ctx, "GET", sitePath(siteID, "/invitations"), nil, nil, &invs); err != nil {
+		return nil, err
+	}
+	return invs, nil
+}
+
+// InviteMember invites the email to become a member of the site with the role. It returns the
+// invitation, and whether the cloud emailed its token to the invited user. Only if not, it returns
+// the token, to pass on to them.
+func (c *Client) InviteMember(ctx context.Context, siteID string, email string, role Role) (Invitation, string, bool, error) {
+	var rsp struct {
+		Invitation
+		Token   string
+		Emailed bool
+	}
+	body := map[string]interface{}{"Email": email, "Role": role}
+	if err := c.do(ctx, "POST", sitePath(siteID, "/invitations"), nil, body, &rsp); err != nil {
+		return Invitation{}, "", false, err
+	}
+	return rsp.Invitation, rsp.Token, rsp.Emailed, nil
+}
+
+// RevokeInvitation deletes the pending invitation of the site
+func (c *Client) RevokeInvitation(ctx context.Context, siteID string, invitationID string) error {
+	return c.do(ctx, "DELETE", sitePath(siteID, "/invitations/"+url.PathEscape(invitationID)), nil, nil, nil)
+}
+
+// AcceptInvitation makes the user a member of the site of the invitation, and returns the site id
+// with their role. The invitation must have been sent to the email of the user.
+func (c *Client) AcceptInvitation(ctx context.Context, token string) (string, Role, error) {
+	var rsp struct {
+		SiteID string
+		Role   Role
+	}
+	body := map[string]string{"Token": token}
+	if err := c.do(ctx, "POST", "/invitations/accept", nil, body, &rsp); err != nil {
+		return "", "", err
+	}
+	return rsp.SiteID, rsp.Role, nil
+}
+
+// State returns the current state of the site. It fails with ErrUnavailable if the site is not connected.
+func (c *Client) State(ctx context.Context, siteID string) (sites.SystemState, error) {
+	var state sites.SystemState
+	if err := c.do(ctx, "GET", sitePath(siteID, "/"), nil, nil, &state); err != nil {
+		return sites.SystemState{}, err
+	}
+	return state, nil
+}
+
+// SendCommand sends the command to the site. It is not retried, as the panel would execute it twice.
+// The cloud attaches the code stored with SetPIN to the commands which need it: cmd must not have a PIN.
+func (c *Client) SendCommand(ctx context.Context, siteID string, cmd sites.UserCommand) error {
+	if err := cmd.ValidateRequest(); err != nil {
+		return err
+	}
+	if cmd.PIN != "" || len(cmd.EncryptedPIN) > 0 {
+		return fmt.Errorf("client: codes are not sent with the commands: store yours with SetPIN")
+	}
+	return c.do(ctx, "POST", sitePath(siteID, "/commands"), nil, cmd, nil)
+}
+
+// AuditLog returns the latest entries of the audit log of the site matching the filter, most
+// recent first. The client must be authenticated as the owner of the site, or, if siteID is
+// empty, as an admin of the cloud, to read the whole audit log.
+func (c *Client) AuditLog(ctx context.Context, siteID string, filter AuditFilter) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	if err := c.do(ctx, "GET", auditPath(siteID), filter.query(), nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ExportAuditLog writes all the entries of the audit log matching the filter to w, as NDJSON: one
+// json entry per line, most recent first. The limit of the filter is ignored.
+func (c *Client) ExportAuditLog(ctx context.Context, siteID string, filter AuditFilter, w io.Writer) error {
+	q := filter.query()
+	q.Set("format", "ndjson")
+	req, err := c.newRequest(ctx, "GET", auditPath(siteID), q, nil)
+	if err != nil {
+		return err
+	}
+
+	// the export may be long: do not apply the timeout of the http client
+	httpClient := *c.HTTPClient
+	httpClient.Timeout = 0
+	rsp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return newAPIError(rsp.StatusCode, data)
+	}
+
+	_, err = io.Copy(w, rsp.Body)
+	return err
+}
+
+func auditPath(siteID string) string {
+	if siteID == "" {
+		return "/audit"
+	}
+	return sitePath(siteID, "/audit")
+}
+
+// StoredEvent is an event as stored by the cloud, with its id
+type StoredEvent struct {
+	ID int64
+	sites.Event
+}
+
+// storedEvent is an event as stored by the cloud, the event itself being json-encoded in Data
+type storedEvent struct {
+	ID   int64
+	Data string
+}
+
+// Events returns the latest events of the site matching the filter, most recent first
+func (c *Client) Events(ctx context.Context, siteID string, filter EventFilter) ([]StoredEvent, error) {
+	var stored []storedEvent
+	if err := c.do(ctx, "GET", sitePath(siteID, "/events"), filter.query(), nil, &stored); err != nil {
+		return nil, err
+	}
+
+	evts := make([]StoredEvent, len(stored))
+	for i, e := range stored {
+		evts[i].ID = e.ID
+		if err := json.Unmarshal([]byte(e.Data), &evts[i].Event); err != nil {
+			return nil, fmt.Errorf("secctl api: invalid event %v: %v", e.Data, err)
+		}
+	}
+	return evts, nil
+}
+
+// StreamEvents calls fn with every event of the site as the cloud receives it, until ctx is done,
+// fn returns an error, or the stream fails. It returns the error of fn, or of the stream.
+func (c *Client) StreamEvents(ctx context.Context, siteID string, fn func(sites.Event) error) error {
+	req, err := c.newRequest(ctx, "GET", sitePath(siteID, "/events/stream"), nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// the stream stays open: do not apply the timeout of the http client
+	httpClient := *c.HTTPClient
+	httpClient.Timeout = 0
+	rsp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return newAPIError(rsp.StatusCode, data)
+	}
+
+	err = ReadEventStream(rsp.Body, fn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ReadEventStream reads server-sent events, as streamed by the cloud and the local daemon,
+// and calls fn with each of them until fn returns an error or the stream ends
+func ReadEventStream(r io.Reader, fn func(sites.Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// a blank line ends the event
+			if len(data) > 0 {
+				var evt sites.Event
+				if err := json.Unmarshal(data, &evt); err != nil {
+					return fmt.Errorf("secctl api: invalid event %s: %v", data, err)
+				}
+				if err := fn(evt); err != nil {
+					return err
+				}
+			}
+			data = nil
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(line[len("data:"):])...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("secctl api: event stream closed by the server")
+}
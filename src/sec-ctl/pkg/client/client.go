@@ -0,0 +1,154 @@
+// Package client is a client of the SecCtl cloud REST API.
+//
+//	c := client.New("https://cloud.example.com", token)
+//	state, err := c.State(ctx, siteID)
+//	if client.Is(err, client.ErrUnavailable) {
+//		// the site is not connected
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultMaxRetries is the number of times idempotent calls are retried by default
+const DefaultMaxRetries = 3
+
+const retryBaseDelay = 250 * time.Millisecond
+const defaultTimeout = 30 * time.Second
+
+// Client calls the cloud REST API. Its fields must not be changed once it is in use.
+type Client struct {
+	// BaseURL is the URL of the cloud api, eg http://localhost:9753
+	BaseURL string
+	// Token authenticates the user, as returned by Signup or Login
+	Token string
+	// HTTPClient sends the requests. Its timeout does not apply to StreamEvents.
+	HTTPClient *http.Client
+	// MaxRetries is the number of times idempotent calls are retried on network errors and
+	// unavailability. Calls that change state, like SendCommand, are never retried.
+	MaxRetries int
+	// TOTPCode is a fresh TOTP code of the user, sent with the requests to step up for those which
+	// require it, like SendCommand for a disarm. Each code is only accepted once.
+	TOTPCode string
+}
+
+// New returns a client of the cloud api at baseURL, authenticated with token
+func New(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: defaultTimeout},
+		MaxRetries: DefaultMaxRetries,
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, query url.Values, body interface{}) (*http.Request, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.TOTPCode != "" {
+		req.Header.Set("X-TOTP-Code", c.TOTPCode)
+	}
+	return req, nil
+}
+
+// do sends the request, retrying it if idempotent, and decodes the json response into out, unless nil
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	idempotent := method == "GET" || method == "PUT" || method == "DELETE"
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.doOnce(ctx, method, path, query, body, out)
+		if err == nil || !idempotent || attempt >= c.MaxRetries || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryBaseDelay << uint(attempt)):
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+
+	if rsp.StatusCode >= 300 {
+		return newAPIError(rsp.StatusCode, data)
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("secctl api: unable to parse response of %v %v: %v", method, path, err)
+	}
+	return nil
+}
+
+// retryable tells whether the call may succeed if tried again
+func retryable(err error) bool {
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr.Is(ErrUnavailable)
+	}
+	// the context is done: retrying is pointless
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err != context.Canceled && urlErr.Err != context.DeadlineExceeded
+	}
+	return false
+}
+
+func sitePath(siteID string, rest string) string {
+	return "/sites/" + url.PathEscape(siteID) + rest
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"sec-ctl/pkg/sites"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func newTestClient(handler http.HandlerFunc) (*Client, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	return New(srv.URL, "tok123"), srv
+}
+
+func TestStateRetriesWhenUnavailable(t *testing.T) {
+	var calls int32
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/sites/s1/", r.URL.Path)
+		assert.Equal(t, "Bearer tok123", r.Header.Get("Authorization"))
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(503)
+			fmt.Fprint(w, `{"error": "Site is not connected"}`)
+			return
+		}
+		fmt.Fprint(w, `{"ID": "s1", "Partitions": [{"ID": "1", "State": "Ready"}]}`)
+	})
+	defer srv.Close()
+
+	state, err := c.State(context.Background(), "s1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, []sites.Partition{{ID: "1", State: sites.PartitionStateReady}}, state.Partitions)
+
+	c.MaxRetries = 0
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.State(context.Background(), "s1")
+	assert.True(t, Is(err, ErrUnavailable))
+	assert.Equal(t, "Site is not connected", err.(*APIError).Message)
+}
+
+func TestSendCommandIsNotRetried(t *testing.T) {
+	var calls int32
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(503)
+	})
+	defer srv.Close()
+
+	err := c.SendCommand(context.Background(), "s1", sites.UserCommand{Code: sites.CmdArmAway, PartitionID: "1"})
+	assert.True(t, Is(err, ErrUnavailable))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	err = c.SendCommand(context.Background(), "s1", sites.UserCommand{Code: sites.CmdPanic, PartitionID: "1"})
+	assert.EqualError(t, err, "PanicTarget is required")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestErrorMapping(t *testing.T) {
+	for status, target := range map[int]error{401: ErrUnauthorized, 403: ErrForbidden, 404: ErrNotFound, 400: ErrBadRequest, 429: ErrTooManyAttempts} {
+		c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		_, err := c.ListSites(context.Background())
+		assert.True(t, Is(err, target), "status %d: %v", status, err)
+		assert.False(t, Is(err, ErrUnavailable))
+		srv.Close()
+	}
+}
+
+func TestEvents(t *testing.T) {
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/sites/s1/events", r.URL.Path)
+		assert.Equal(t, "ALARM", r.URL.Query().Get("level"))
+		assert.Equal(t, "2026-01-02T03:04:05Z", r.URL.Query().Get("since"))
+		assert.Equal(t, "10", r.URL.Query().Get("limit"))
+		assert.Equal(t, "fire alarm", r.URL.Query().Get("q"))
+		assert.Equal(t, "42", r.URL.Query().Get("before"))
+		fmt.Fprint(w, `[{"ID": 41, "Level": "ALARM", "Code": "PartitionInAlarm", "Time": "2026-01-02T03:05:00Z", "Data": "{\"Level\": \"ALARM\", \"Code\": \"PartitionInAlarm\", \"PartitionID\": \"1\"}"}]`)
+	})
+	defer srv.Close()
+
+	filter := EventFilter{Level: sites.LevelAlarm, Since: since, Search: "fire alarm", Before: 42, Limit: 10}
+	evts, err := c.Events(context.Background(), "s1", filter)
+	assert.NoError(t, err)
+	if assert.Len(t, evts, 1) {
+		assert.Equal(t, int64(41), evts[0].ID)
+		assert.Equal(t, "PartitionInAlarm", evts[0].Code)
+		assert.Equal(t, "1", evts[0].PartitionID)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/sites/s1/events/stream", r.URL.Path)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event:event\ndata:{\"Level\": \"INFO\", \"Code\": \"ZoneOpen\", \"ZoneID\": \"001\"}\n\n")
+		fmt.Fprint(w, "event:event\ndata:{\"Level\": \"INFO\", \"Code\": \"ZoneRestore\", \"ZoneID\": \"001\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	codes := []string{}
+	err := c.StreamEvents(ctx, "s1", func(evt sites.Event) error {
+		codes = append(codes, evt.Code)
+		if len(codes) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"ZoneOpen", "ZoneRestore"}, codes)
+}
+
+func TestRotateSiteToken(t *testing.T) {
+	var calls int32
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/sites/s1/token", r.URL.Path)
+		assert.Equal(t, "Bearer tok123", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"SiteID": "s1", "Token": "tok456"}`)
+	})
+	defer srv.Close()
+
+	tok, err := c.RotateSiteToken(context.Background(), "s1")
+	assert.NoError(t, err)
+	assert.Equal(t, "tok456", tok)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCreateToken(t *testing.T) {
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/tokens", r.URL.Path)
+
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"Name": "dashboard", "Scope": "read-only"}, body)
+
+		fmt.Fprint(w, `{"ID": "t1", "Name": "dashboard", "Scope": "read-only", "ExpiresAt": null, "Token": "tok456"}`)
+	})
+	defer srv.Close()
+
+	info, tok, err := c.CreateToken(context.Background(), "dashboard", ScopeReadOnly, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "tok456", tok)
+	assert.Equal(t, TokenInfo{ID: "t1", Name: "dashboard", Scope: ScopeReadOnly}, info)
+}
+
+func TestSetPIN(t *testing.T) {
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/sites/s1/pin", r.URL.Path)
+		assert.Equal(t, "PUT", r.Method)
+		var body struct {
+			EncryptedPIN []byte
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, []byte{1, 2, 3}, body.EncryptedPIN)
+		fmt.Fprint(w, `{"SiteID": "s1"}`)
+	})
+	defer srv.Close()
+
+	assert.NoError(t, c.SetPIN(context.Background(), "s1", []byte{1, 2, 3}))
+
+	// the codes are never sent with the commands
+	err := c.SendCommand(context.Background(), "s1", sites.UserCommand{Code: sites.CmdDisarm, PartitionID: "1", PIN: "1234"})
+	assert.Error(t, err)
+}
+
+func TestStepUp(t *testing.T) {
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-TOTP-Code") != "123456" {
+			w.WriteHeader(428)
+			fmt.Fprint(w, `{"error": "Step-up required"}`)
+			return
+		}
+		w.WriteHeader(202)
+		fmt.Fprint(w, `"Command sent"`)
+	})
+	defer srv.Close()
+
+	cmd := sites.UserCommand{Code: sites.CmdDisarm, PartitionID: "1"}
+	err := c.SendCommand(context.Background(), "s1", cmd)
+	assert.True(t, Is(err, ErrStepUpRequired))
+	assert.False(t, Is(err, ErrForbidden))
+
+	c.TOTPCode = "123456"
+	assert.NoError(t, c.SendCommand(context.Background(), "s1", cmd))
+}
+
+func TestAuditLog(t *testing.T) {
+	c, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/sites/s1/audit", r.URL.Path)
+		assert.Equal(t, "site.command", r.URL.Query().Get("action"))
+		assert.Equal(t, "42", r.URL.Query().Get("before"))
+		if r.URL.Query().Get("format") == "ndjson" {
+			fmt.Fprint(w, "{\"ID\": 41}\n{\"ID\": 40}\n")
+			return
+		}
+		fmt.Fprint(w, `[{"ID": 41, "Action": "site.command", "Payload": {"Command": {"Code": "Disarm"}}, "Outcome": "success"}]`)
+	})
+	defer srv.Close()
+
+	filter := AuditFilter{Action: "site.command", Before: 42}
+	entries, err := c.AuditLog(context.Background(), "s1", filter)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(entries)) {
+		assert.Equal(t, int64(41), entries[0].ID)
+		assert.JSONEq(t, `{"Command": {"Code": "Disarm"}}`, string(entries[0].Payload))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, c.ExportAuditLog(context.Background(), "s1", filter, &buf))
+	assert.Equal(t, "{\"ID\": 41}\n{\"ID\": 40}\n", buf.String())
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrUnauthorized is returned when the token is missing or invalid, or the credentials are wrong
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned when the user is not a member of the site, or when their role on it
+	// or the scope of their token does not allow the request
+	ErrForbidden = errors.New("forbidden")
+	// ErrNotFound is returned when the site does not exist, or has not published its PIN key yet
+	ErrNotFound = errors.New("not found")
+	// ErrBadRequest is returned when the api rejects the request, eg an invalid command
+	ErrBadRequest = errors.New("bad request")
+	// ErrConflict is returned when the site is already claimed, or the user already a member
+	ErrConflict = errors.New("conflict")
+	// ErrExpired is returned when the claim token or the invitation expired
+	ErrExpired = errors.New("expired")
+	// ErrStepUpRequired is returned when the request, eg a disarm, requires a fresh TOTP code in
+	// Client.TOTPCode, or a re-authentication with Reauthenticate
+	ErrStepUpRequired = errors.New("step-up required")
+	// ErrTooManyAttempts is returned when too many invalid TOTP codes were sent: TOTP is locked
+	// for a while
+	ErrTooManyAttempts = errors.New("too many attempts")
+	// ErrUnavailable is returned when the site is not connected to the cloud, or the cloud is unavailable
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// APIError is returned when the api responds with an error status.
+// It matches one of the Err* values with Is, depending on the status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("secctl api: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("secctl api: status %d: %s", e.StatusCode, e.Message)
+}
+
+// Is maps the status of the error to the Err* values
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == 401
+	case ErrForbidden:
+		return e.StatusCode == 403
+	case ErrNotFound:
+		return e.StatusCode == 404
+	case ErrBadRequest:
+		return e.StatusCode == 400
+	case ErrConflict:
+		return e.StatusCode == 409
+	case ErrExpired:
+		return e.StatusCode == 410
+	case ErrStepUpRequired:
+		return e.StatusCode == 428
+	case ErrTooManyAttempts:
+		return e.StatusCode == 429
+	case ErrUnavailable:
+		return e.StatusCode == 502 || e.StatusCode == 503 || e.StatusCode == 504
+	default:
+		return false
+	}
+}
+
+// Is returns whether err is target, or an APIError whose status matches target, eg
+// client.Is(err, client.ErrUnavailable)
+func Is(err, target error) bool {
+	if err == target {
+		return true
+	}
+	if apiErr, ok := err.(*APIError); ok {
+		return apiErr.Is(target)
+	}
+	return false
+}
+
+func newAPIError(status int, body []byte) *APIError {
+	var rsp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &rsp); err == nil && rsp.Error != "" {
+		return &APIError{StatusCode: status, Message: rsp.Error}
+	}
+	return &APIError{StatusCode: status, Message: strings.TrimSpace(string(body))}
+}
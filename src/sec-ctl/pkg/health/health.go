@@ -0,0 +1,148 @@
+// Package health reports the status of the components of a service, for its /healthz and /readyz endpoints
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status is the status of a component, or of the whole service
+type Status string
+
+const (
+	StatusUp   Status = "Up"
+	StatusDown Status = "Down"
+)
+
+// checkTimeout bounds each check: a component which does not answer by then is down
+const checkTimeout = 2 * time.Second
+
+// Component is the status of a component, with details like the state of its connection
+type Component struct {
+	Status  Status
+	Error   string                 `json:",omitempty"`
+	Details map[string]interface{} `json:",omitempty"`
+}
+
+// Up returns a healthy component with details
+func Up(details map[string]interface{}) Component {
+	return Component{Status: StatusUp, Details: details}
+}
+
+// Down returns a failed component, with the reason it failed, and details
+func Down(reason string, details map[string]interface{}) Component {
+	return Component{Status: StatusDown, Error: reason, Details: details}
+}
+
+// Check reports the status of a component. It should return once ctx is done.
+type Check func(ctx context.Context) Component
+
+// Report is the status of the checked components. The service is down if any of them is.
+type Report struct {
+	Status     Status
+	Components map[string]Component
+}
+
+// HTTPStatus returns the http status of the report: 200 if up, 503 if down
+func (r Report) HTTPStatus() int {
+	if r.Status == StatusUp {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the checks of the components of a service. The liveness checks tell whether the
+// service runs, and should be restarted otherwise. The readiness checks, along with the liveness ones,
+// tell whether it is able to serve, eg connected to its dependencies.
+type Checker struct {
+	lock      sync.Mutex
+	liveness  []namedCheck
+	readiness []namedCheck
+}
+
+// NewChecker returns a checker without any check
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// AddLiveness adds a check of both the liveness and the readiness of the service
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.liveness = append(c.liveness, namedCheck{name, check})
+}
+
+// AddReadiness adds a check of the readiness of the service only
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readiness = append(c.readiness, namedCheck{name, check})
+}
+
+// Liveness runs the liveness checks
+func (c *Checker) Liveness(ctx context.Context) Report {
+	c.lock.Lock()
+	checks := append([]namedCheck{}, c.liveness...)
+	c.lock.Unlock()
+	return run(ctx, checks)
+}
+
+// Readiness runs the liveness and readiness checks
+func (c *Checker) Readiness(ctx context.Context) Report {
+	c.lock.Lock()
+	checks := append(append([]namedCheck{}, c.liveness...), c.readiness...)
+	c.lock.Unlock()
+	return run(ctx, checks)
+}
+
+// run runs the checks concurrently, and reports those which did not return in time as down
+func run(ctx context.Context, checks []namedCheck) Report {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	results := make([]chan Component, len(checks))
+	for i, c := range checks {
+		results[i] = make(chan Component, 1)
+		go func(c namedCheck, result chan<- Component) {
+			result <- c.check(ctx)
+		}(c, results[i])
+	}
+
+	report := Report{Status: StatusUp, Components: make(map[string]Component, len(checks))}
+	for i, c := range checks {
+		var comp Component
+		select {
+		case comp = <-results[i]:
+		case <-ctx.Done():
+			select {
+			case comp = <-results[i]: // returned just in time
+			default:
+				comp = Down("check timed out", nil)
+			}
+		}
+		if comp.Status != StatusUp {
+			report.Status = StatusDown
+		}
+		report.Components[c.name] = comp
+	}
+	return report
+}
+
+// Handler serves the report as json, with status 503 if the service is down
+func Handler(check func(ctx context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := check(r.Context())
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(report.HTTPStatus())
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,73 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func up(ctx context.Context) Component {
+	return Up(map[string]interface{}{"State": "Connected"})
+}
+
+func down(ctx context.Context) Component {
+	return Down("not logged in", nil)
+}
+
+func TestLivenessOnlyRunsLivenessChecks(t *testing.T) {
+	c := NewChecker()
+	c.AddLiveness("queues", up)
+	c.AddReadiness("tpi", down)
+
+	live := c.Liveness(context.Background())
+	assert.Equal(t, StatusUp, live.Status)
+	assert.Equal(t, 200, live.HTTPStatus())
+	assert.Len(t, live.Components, 1)
+	assert.Contains(t, live.Components, "queues")
+
+	ready := c.Readiness(context.Background())
+	assert.Equal(t, StatusDown, ready.Status)
+	assert.Equal(t, 503, ready.HTTPStatus())
+	assert.Len(t, ready.Components, 2)
+	assert.Equal(t, "not logged in", ready.Components["tpi"].Error)
+}
+
+func TestCheckTimingOutIsDown(t *testing.T) {
+	c := NewChecker()
+	c.AddReadiness("db", func(ctx context.Context) Component {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond) // returns late
+		return Up(nil)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report := c.Readiness(ctx)
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Equal(t, "check timed out", report.Components["db"].Error)
+}
+
+func TestHandler(t *testing.T) {
+	c := NewChecker()
+	c.AddLiveness("queues", up)
+	c.AddReadiness("tpi", down)
+
+	w := httptest.NewRecorder()
+	Handler(c.Readiness).ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	var report Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Equal(t, StatusUp, report.Components["queues"].Status)
+	assert.Equal(t, "Connected", report.Components["queues"].Details["State"])
+
+	w = httptest.NewRecorder()
+	Handler(c.Liveness).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+}
@@ -0,0 +1,134 @@
+// Package pinvault encrypts the panel user codes of the site members, so that only the local daemon
+// of the site can read them. The daemon holds the private key in a keyfile, and publishes the public
+// key through the cloud; the members encrypt their code with it, and the cloud stores the ciphertext,
+// which it attaches to the commands of the member, without ever seeing the code.
+package pinvault
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keySize is the size in bits of the generated keys
+const keySize = 2048
+
+// maxPINLength bounds the codes, which the panel accepts with 4 to 8 digits
+const maxPINLength = 8
+
+// ErrDecrypt is returned when a code cannot be decrypted: it was encrypted for another site or member,
+// or with another key
+var ErrDecrypt = errors.New("pinvault: unable to decrypt the code")
+
+// LoadOrCreateKey reads the private key of the keyfile, or generates one and writes it to the keyfile
+// if it does not exist, readable only by the current user
+func LoadOrCreateKey(fname string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return createKey(fname)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, fmt.Errorf("pinvault: %v is not a PEM-encoded RSA private key", fname)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func createKey(fname string) (*rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	// O_EXCL: never overwrite a key, which would make the stored codes unreadable
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// MarshalPublicKey encodes the public key to PEM, to publish it
+func MarshalPublicKey(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// ParsePublicKey decodes a public key encoded by MarshalPublicKey
+func ParsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("pinvault: not a PEM-encoded public key")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("pinvault: not an RSA public key")
+	}
+	return rsaPub, nil
+}
+
+// Encrypt encrypts the code of the member of the site. The ciphertext only decrypts for them, so that
+// it cannot be replayed on behalf of another member.
+func Encrypt(pub *rsa.PublicKey, siteID string, memberID string, pin string) ([]byte, error) {
+	if err := validatePIN(pin); err != nil {
+		return nil, err
+	}
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, []byte(pin), label(siteID, memberID))
+}
+
+// Decrypt decrypts the code of the member of the site
+func Decrypt(key *rsa.PrivateKey, siteID string, memberID string, ciphertext []byte) (string, error) {
+	pin, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, ciphertext, label(siteID, memberID))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(pin), nil
+}
+
+// label binds the ciphertext to the site and the member, whose ids are normalized without hyphens
+func label(siteID string, memberID string) []byte {
+	return []byte("sec-ctl pin " + strings.Replace(siteID, "-", "", -1) + " " + strings.Replace(memberID, "-", "", -1))
+}
+
+func validatePIN(pin string) error {
+	if len(pin) < 4 || len(pin) > maxPINLength {
+		return fmt.Errorf("pinvault: the code must have 4 to %d digits", maxPINLength)
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return errors.New("pinvault: the code must only have digits")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package pinvault
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pinvault")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "keys", "pin-key.pem")
+
+	key, err := LoadOrCreateKey(fname)
+	if !assert.NoError(t, err) {
+		return
+	}
+	info, err := os.Stat(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the public key goes through the cloud as PEM
+	data, err := MarshalPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	pub, err := ParsePublicKey(data)
+	assert.NoError(t, err)
+
+	ciphertext, err := Encrypt(pub, "site1", "abcd-ef", "1234")
+	assert.NoError(t, err)
+
+	// the key is read back from the keyfile, and the ids are normalized
+	key, err = LoadOrCreateKey(fname)
+	assert.NoError(t, err)
+	pin, err := Decrypt(key, "site1", "abcdef", ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", pin)
+
+	// the code of a member does not decrypt for another one
+	_, err = Decrypt(key, "site1", "other", ciphertext)
+	assert.Equal(t, ErrDecrypt, err)
+}
+
+func TestEncryptValidatesPIN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pinvault")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := LoadOrCreateKey(filepath.Join(dir, "pin-key.pem"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, pin := range []string{"", "123", "123456789", "12a4"} {
+		_, err := Encrypt(&key.PublicKey, "site1", "member1", pin)
+		assert.Error(t, err, pin)
+	}
+}
@@ -16,9 +16,11 @@ const (
 	LevelTrouble     EventLevel = "TROUBLE"
 	LevelAlarm       EventLevel = "ALARM"
 	LevelStateChange EventLevel = "STATE_CHANGE"
+	// LevelSecurity is the level of the security events raised by the cloud, eg rejected step-ups
+	LevelSecurity EventLevel = "SECURITY"
 )
 
-//Event represents a TPI event
+// Event represents a TPI event
 type Event struct {
 	Level       EventLevel
 	Code        string
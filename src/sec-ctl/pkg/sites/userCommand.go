@@ -11,6 +11,8 @@ const (
 	CmdArmWithZeroEntryDelay UserCommandCode = "ArmWithZeroEntryDelay"
 	CmdDisarm                UserCommandCode = "Disarm"
 	CmdPanic                 UserCommandCode = "Panic"
+	CmdBypassZone            UserCommandCode = "BypassZone"
+	CmdUnbypassZone          UserCommandCode = "UnbypassZone"
 )
 
 const (
@@ -24,21 +26,75 @@ type UserCommand struct {
 	PartitionID string          `binding:"required"`
 	PIN         string
 	PanicTarget string
+	ZoneID      string
+	// MemberID is the site member who sent the command through the cloud, and EncryptedPIN their
+	// code, encrypted with pinvault for the local daemon, which sets PIN from it
+	MemberID     string
+	EncryptedPIN []byte
+}
+
+// String describes the command, without its codes, so that they are not logged
+func (cmd UserCommand) String() string {
+	s := fmt.Sprintf("%s partition=%s", cmd.Code, cmd.PartitionID)
+	if cmd.ZoneID != "" {
+		s += " zone=" + cmd.ZoneID
+	}
+	if cmd.PanicTarget != "" {
+		s += " panicTarget=" + cmd.PanicTarget
+	}
+	if cmd.MemberID != "" {
+		s += " member=" + cmd.MemberID
+	}
+	return s
+}
+
+// Redacted returns the command without its codes, eg to record it
+func (cmd UserCommand) Redacted() UserCommand {
+	if cmd.PIN != "" {
+		cmd.PIN = "REDACTED"
+	}
+	cmd.EncryptedPIN = nil
+	return cmd
+}
+
+// GoString is String, so that the codes are not logged with %#v either
+func (cmd UserCommand) GoString() string {
+	return cmd.String()
+}
+
+// NeedsPIN returns whether the command requires the user code of the sender
+func (cmd UserCommand) NeedsPIN() bool {
+	return cmd.Code == CmdArmWithPIN || cmd.Code == CmdDisarm
 }
 
 func (cmd UserCommand) Validate() error {
 
-	if cmd.Code != CmdArmAway && cmd.Code != CmdArmStay && cmd.Code != CmdArmWithPIN && cmd.Code != CmdArmWithZeroEntryDelay && cmd.Code != CmdDisarm && cmd.Code != CmdPanic {
-		return fmt.Errorf("Invalid command code")
+	if err := cmd.ValidateRequest(); err != nil {
+		return err
 	}
 
-	if (cmd.Code == CmdArmWithPIN || cmd.Code == CmdDisarm) && cmd.PIN == "" {
+	if cmd.NeedsPIN() && cmd.PIN == "" && len(cmd.EncryptedPIN) == 0 {
 		return fmt.Errorf("PIN is required")
 	}
 
+	return nil
+}
+
+// ValidateRequest validates the command sent to the cloud, which attaches the encrypted code of the sender
+func (cmd UserCommand) ValidateRequest() error {
+
+	if cmd.Code != CmdArmAway && cmd.Code != CmdArmStay && cmd.Code != CmdArmWithPIN && cmd.Code != CmdArmWithZeroEntryDelay && cmd.Code != CmdDisarm && cmd.Code != CmdPanic &&
+		cmd.Code != CmdBypassZone && cmd.Code != CmdUnbypassZone {
+		return fmt.Errorf("Invalid command code")
+	}
+
 	if cmd.Code == CmdPanic && cmd.PanicTarget == "" {
 		return fmt.Errorf("PanicTarget is required")
 	}
 
+	if (cmd.Code == CmdBypassZone || cmd.Code == CmdUnbypassZone) && cmd.ZoneID == "" {
+		return fmt.Errorf("ZoneID is required")
+	}
+
 	return nil
 }
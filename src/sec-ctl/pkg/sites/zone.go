@@ -16,8 +16,9 @@ const (
 )
 
 type Zone struct {
-	ID    string
-	State ZoneState
+	ID       string
+	State    ZoneState
+	Bypassed bool
 }
 
 func NewZone(id string) *Zone {
@@ -27,5 +28,5 @@ func NewZone(id string) *Zone {
 }
 
 func (z *Zone) String() string {
-	return fmt.Sprintf("Zone{ID:%v, State:%v}", z.ID, z.State)
+	return fmt.Sprintf("Zone{ID:%v, State:%v, Bypassed:%v}", z.ID, z.State, z.Bypassed)
 }
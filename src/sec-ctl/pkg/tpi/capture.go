@@ -0,0 +1,224 @@
+package tpi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureDirection is the direction of captured TPI traffic
+type CaptureDirection string
+
+const (
+	// CaptureDirectionIn is traffic sent by the server to the client
+	CaptureDirectionIn CaptureDirection = "in"
+	// CaptureDirectionOut is traffic sent by the client to the server
+	CaptureDirectionOut CaptureDirection = "out"
+)
+
+// CaptureRecord is a chunk of raw TPI traffic, as read from or written to the connection
+type CaptureRecord struct {
+	Time      time.Time        `json:"time"`
+	Direction CaptureDirection `json:"dir"`
+	Data      string           `json:"data"`
+}
+
+// CaptureWriter records raw TPI traffic to a capture file, one json record per line.
+// When the file would grow past MaxBytes, it is renamed to <filename>.1, shifting the previous
+// rotated files to <filename>.2 and so on, and at most MaxFiles rotated files are kept.
+type CaptureWriter struct {
+	Filename string
+	MaxBytes int64
+	MaxFiles int
+
+	lock *sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewCaptureWriter opens filename for appending captured traffic
+func NewCaptureWriter(filename string, maxBytes int64, maxFiles int) (*CaptureWriter, error) {
+	w := &CaptureWriter{
+		Filename: filename,
+		MaxBytes: maxBytes,
+		MaxFiles: maxFiles,
+		lock:     &sync.Mutex{},
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *CaptureWriter) open() error {
+	f, err := os.OpenFile(w.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// Record appends the data to the capture. The passwords and user codes sent to the panel are redacted.
+func (w *CaptureWriter) Record(dir CaptureDirection, data []byte) error {
+	rec := CaptureRecord{Time: time.Now(), Direction: dir, Data: string(redactSecrets(dir, data))}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return fmt.Errorf("capture %v is closed", w.Filename)
+	}
+
+	if w.MaxBytes > 0 && w.size > 0 && w.size+int64(len(line)) > w.MaxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *CaptureWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	if w.MaxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.Filename, w.MaxFiles))
+		for i := w.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.Filename, i), fmt.Sprintf("%s.%d", w.Filename, i+1))
+		}
+		if err := os.Rename(w.Filename, w.Filename+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(w.Filename); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+// Close closes the capture file
+func (w *CaptureWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// redactedClientCodes are the client messages carrying a secret: the password of login requests,
+// and the user code of arm, disarm and code send requests, and of keystrokes, which may contain one.
+// Each maps to the length of the data kept before the secret, ie the partition.
+var redactedClientCodes = map[ClientCode]int{
+	ClientCodeNetworkLogin:                0,
+	ClientCodePartitionArmControlWithCode: 1,
+	ClientCodePartitionDisarmControl:      1,
+	ClientCodeSendKeystrokeString:         1,
+	ClientCodeCodeSend:                    0,
+}
+
+// redactSecrets masks the secret of the client messages carrying one, along with their checksum,
+// which is derived from it. Clients write one message at a time, so the message is always
+// at the start of the data.
+func redactSecrets(dir CaptureDirection, data []byte) []byte {
+	if dir != CaptureDirectionOut || len(data) < 3 {
+		return data
+	}
+	code, err := DecodeIntCode(data[:3])
+	if err != nil {
+		return data
+	}
+	kept, ok := redactedClientCodes[ClientCode(code)]
+	if !ok || len(data) <= 3+kept {
+		return data
+	}
+	redacted := append([]byte{}, data[:3+kept]...)
+	return append(redacted, []byte("<redacted>")...)
+}
+
+// captureConn is a connection recording all its traffic to a CaptureWriter
+type captureConn struct {
+	net.Conn
+	w *CaptureWriter
+}
+
+// NewCaptureConn returns a connection that records the traffic of conn to w
+func NewCaptureConn(conn net.Conn, w *CaptureWriter) net.Conn {
+	return &captureConn{Conn: conn, w: w}
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(CaptureDirectionIn, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(CaptureDirectionOut, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) record(dir CaptureDirection, data []byte) {
+	// a failing capture must not break the connection
+	if err := c.w.Record(dir, data); err != nil {
+		log.Printf("failed to capture tpi traffic: %v", err)
+	}
+}
+
+// ReadCapture reads all the records of a capture file
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	recs := make([]CaptureRecord, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("invalid capture record at line %d: %v", n, err)
+		}
+		recs = append(recs, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
@@ -0,0 +1,76 @@
+package tpi
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func TestCaptureRedactsSecrets(t *testing.T) {
+	tests := []struct {
+		code     ClientCode
+		data     string
+		secret   string
+		recorded string
+	}{
+		{ClientCodeNetworkLogin, "user", "user", "005<redacted>"},
+		{ClientCodePartitionArmControlWithCode, "11234", "1234", "0331<redacted>"},
+		{ClientCodePartitionDisarmControl, "2123456", "123456", "0402<redacted>"},
+		{ClientCodeCodeSend, "123400", "1234", "200<redacted>"},
+		{ClientCodeSendKeystrokeString, "1*11234", "1234", "0711<redacted>"},
+		{ClientCodeSendKeystrokeString, "15609#", "56", "0711<redacted>"},
+	}
+
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := path.Join(dir, "capture.jsonl")
+	w, err := NewCaptureWriter(fname, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		data := message{Code: int(test.code), Data: []byte(test.data)}.encode()
+		assert.NoError(t, w.Record(CaptureDirectionOut, data))
+	}
+	assert.NoError(t, w.Close())
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := ReadCapture(f)
+	assert.NoError(t, err)
+	if !assert.Equal(t, len(tests), len(recs)) {
+		return
+	}
+
+	for i, test := range tests {
+		assert.Equal(t, test.recorded, recs[i].Data, test.code.String())
+		assert.NotContains(t, recs[i].Data, test.secret, test.code.String())
+	}
+}
+
+func TestCaptureKeepsOtherTraffic(t *testing.T) {
+	tests := []struct {
+		dir  CaptureDirection
+		data []byte
+	}{
+		{CaptureDirectionOut, message{Code: int(ClientCodePoll)}.encode()},
+		{CaptureDirectionOut, message{Code: int(ClientCodePartitionArmControlAway), Data: []byte("1")}.encode()},
+		{CaptureDirectionOut, message{Code: int(ClientCodePartitionDisarmControl), Data: []byte("1")}.encode()[:4]},
+		{CaptureDirectionIn, ServerMessage{Code: ServerCodeCodeRequired, Data: []byte("1")}.Encode()},
+		{CaptureDirectionIn, ServerMessage{Code: ServerCodeZoneOpen, Data: []byte("005")}.Encode()},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, string(test.data), string(redactSecrets(test.dir, test.data)))
+	}
+}
@@ -36,7 +36,7 @@ func (i ClientCode) String() string {
 	return fmt.Sprintf("ClientCode(%d)", i)
 }
 
-const _ServerCode_name = "ServerCodeAckServerCodeCmdErrServerCodeSysErrServerCodeLoginResServerCodeKeypadLedStateServerCodeKeypadLedFlashStateServerCodeSystemTimeServerCodeRingDetectServerCodeIndoorTemperatureServerCodeOutdoorTemperatureServerCodeZoneAlarmServerCodeZoneAlarmRestoreServerCodeZoneTemperServerCodeZoneTemperRestoreServerCodeZoneFaultServerCodeZoneFaultRestoreServerCodeZoneOpenServerCodeZoneRestoreServerCodeZoneTimerTickServerCodeDuressAlarmServerCodeFireAlarmServerCodeFireAlarmRestoreServerCodeAuxillaryAlarmServerCodeAuxillaryAlarmRestoreServerCodePanicAlarmServerCodePanicAlarmRestoreServerCodeSmokeOrAuxAlarmServerCodeSmokeOrAuxAlarmRestoreServerCodePartitionReadyServerCodePartitionNotReadyServerCodePartitionArmedServerCodePartitionReadyForceArmingEnabledServerCodePartitionInAlarmServerCodePartitionDisarmedServerCodeExitDelayInProgressServerCodeEntryDelayInProgressServerCodeKeypadLockOutServerCodePartitionArmingFailedServerCodePGMOutputInProgressServerCodeChimeEnabledServerCodeChimeDisabledServerCodeInvalidAccessCodeServerCodeFunctionNotAvailableServerCodeArmingFailedServerCodePartitionBusyServerCodeSystemArmingInProgressServerCodeSystemInInstallersModeServerCodeUserClosingServerCodeSpecialClosingServerCodePartialClosingServerCodeUserOpeningServerCodeSpecialOpeningServerCodePanelBatteryTroubleServerCodePanelBatteryTroubleRestoreServerCodePanelACTroubleServerCodePanelACRestoreServerCodeSystemBellTroubleServerCodeSystemBellTroubleRestoralServerCodeFTCTroubleServerCodeBufferNearFullServerCodeGeneralSystemTamperServerCodeGeneralSystemTamperRestoreServerCodeTroubleLEDOnServerCodeTroubleLEDOffServerCodeFireTroubleAlarmServerCodeFireTroubleAlarmRestoreServerCodeVerboseTroubleStatusServerCodeCodeRequiredServerCodeCommandOutputPressedServerCodeMasterCodeRequiredServerCodeInstallersCodeRequired"
+const _ServerCode_name = "ServerCodeAckServerCodeCmdErrServerCodeSysErrServerCodeLoginResServerCodeKeypadLedStateServerCodeKeypadLedFlashStateServerCodeSystemTimeServerCodeRingDetectServerCodeIndoorTemperatureServerCodeOutdoorTemperatureServerCodeZoneAlarmServerCodeZoneAlarmRestoreServerCodeZoneTemperServerCodeZoneTemperRestoreServerCodeZoneFaultServerCodeZoneFaultRestoreServerCodeZoneOpenServerCodeZoneRestoreServerCodeZoneTimerTickServerCodeBypassedZonesBitfieldDumpServerCodeDuressAlarmServerCodeFireAlarmServerCodeFireAlarmRestoreServerCodeAuxillaryAlarmServerCodeAuxillaryAlarmRestoreServerCodePanicAlarmServerCodePanicAlarmRestoreServerCodeSmokeOrAuxAlarmServerCodeSmokeOrAuxAlarmRestoreServerCodePartitionReadyServerCodePartitionNotReadyServerCodePartitionArmedServerCodePartitionReadyForceArmingEnabledServerCodePartitionInAlarmServerCodePartitionDisarmedServerCodeExitDelayInProgressServerCodeEntryDelayInProgressServerCodeKeypadLockOutServerCodePartitionArmingFailedServerCodePGMOutputInProgressServerCodeChimeEnabledServerCodeChimeDisabledServerCodeInvalidAccessCodeServerCodeFunctionNotAvailableServerCodeArmingFailedServerCodePartitionBusyServerCodeSystemArmingInProgressServerCodeSystemInInstallersModeServerCodeUserClosingServerCodeSpecialClosingServerCodePartialClosingServerCodeUserOpeningServerCodeSpecialOpeningServerCodePanelBatteryTroubleServerCodePanelBatteryTroubleRestoreServerCodePanelACTroubleServerCodePanelACRestoreServerCodeSystemBellTroubleServerCodeSystemBellTroubleRestoralServerCodeFTCTroubleServerCodeBufferNearFullServerCodeGeneralSystemTamperServerCodeGeneralSystemTamperRestoreServerCodeTroubleLEDOnServerCodeTroubleLEDOffServerCodeFireTroubleAlarmServerCodeFireTroubleAlarmRestoreServerCodeVerboseTroubleStatusServerCodeCodeRequiredServerCodeCommandOutputPressedServerCodeMasterCodeRequiredServerCodeInstallersCodeRequired"
 
 var _ServerCode_map = map[ServerCode]string{
 	500: _ServerCode_name[0:13],
@@ -58,58 +58,59 @@ var _ServerCode_map = map[ServerCode]string{
 	609: _ServerCode_name[348:366],
 	610: _ServerCode_name[366:387],
 	615: _ServerCode_name[387:410],
-	620: _ServerCode_name[410:431],
-	621: _ServerCode_name[431:450],
-	622: _ServerCode_name[450:476],
-	623: _ServerCode_name[476:500],
-	624: _ServerCode_name[500:531],
-	625: _ServerCode_name[531:551],
-	626: _ServerCode_name[551:578],
-	631: _ServerCode_name[578:603],
-	632: _ServerCode_name[603:635],
-	650: _ServerCode_name[635:659],
-	651: _ServerCode_name[659:686],
-	652: _ServerCode_name[686:710],
-	653: _ServerCode_name[710:752],
-	654: _ServerCode_name[752:778],
-	655: _ServerCode_name[778:805],
-	656: _ServerCode_name[805:834],
-	657: _ServerCode_name[834:864],
-	658: _ServerCode_name[864:887],
-	659: _ServerCode_name[887:918],
-	660: _ServerCode_name[918:947],
-	663: _ServerCode_name[947:969],
-	664: _ServerCode_name[969:992],
-	670: _ServerCode_name[992:1019],
-	671: _ServerCode_name[1019:1049],
-	672: _ServerCode_name[1049:1071],
-	673: _ServerCode_name[1071:1094],
-	674: _ServerCode_name[1094:1126],
-	680: _ServerCode_name[1126:1158],
-	700: _ServerCode_name[1158:1179],
-	701: _ServerCode_name[1179:1203],
-	702: _ServerCode_name[1203:1227],
-	750: _ServerCode_name[1227:1248],
-	751: _ServerCode_name[1248:1272],
-	800: _ServerCode_name[1272:1301],
-	801: _ServerCode_name[1301:1337],
-	802: _ServerCode_name[1337:1361],
-	803: _ServerCode_name[1361:1385],
-	806: _ServerCode_name[1385:1412],
-	807: _ServerCode_name[1412:1447],
-	814: _ServerCode_name[1447:1467],
-	816: _ServerCode_name[1467:1491],
-	829: _ServerCode_name[1491:1520],
-	830: _ServerCode_name[1520:1556],
-	840: _ServerCode_name[1556:1578],
-	841: _ServerCode_name[1578:1601],
-	842: _ServerCode_name[1601:1627],
-	843: _ServerCode_name[1627:1660],
-	849: _ServerCode_name[1660:1690],
-	900: _ServerCode_name[1690:1712],
-	912: _ServerCode_name[1712:1742],
-	921: _ServerCode_name[1742:1770],
-	922: _ServerCode_name[1770:1802],
+	616: _ServerCode_name[410:445],
+	620: _ServerCode_name[445:466],
+	621: _ServerCode_name[466:485],
+	622: _ServerCode_name[485:511],
+	623: _ServerCode_name[511:535],
+	624: _ServerCode_name[535:566],
+	625: _ServerCode_name[566:586],
+	626: _ServerCode_name[586:613],
+	631: _ServerCode_name[613:638],
+	632: _ServerCode_name[638:670],
+	650: _ServerCode_name[670:694],
+	651: _ServerCode_name[694:721],
+	652: _ServerCode_name[721:745],
+	653: _ServerCode_name[745:787],
+	654: _ServerCode_name[787:813],
+	655: _ServerCode_name[813:840],
+	656: _ServerCode_name[840:869],
+	657: _ServerCode_name[869:899],
+	658: _ServerCode_name[899:922],
+	659: _ServerCode_name[922:953],
+	660: _ServerCode_name[953:982],
+	663: _ServerCode_name[982:1004],
+	664: _ServerCode_name[1004:1027],
+	670: _ServerCode_name[1027:1054],
+	671: _ServerCode_name[1054:1084],
+	672: _ServerCode_name[1084:1106],
+	673: _ServerCode_name[1106:1129],
+	674: _ServerCode_name[1129:1161],
+	680: _ServerCode_name[1161:1193],
+	700: _ServerCode_name[1193:1214],
+	701: _ServerCode_name[1214:1238],
+	702: _ServerCode_name[1238:1262],
+	750: _ServerCode_name[1262:1283],
+	751: _ServerCode_name[1283:1307],
+	800: _ServerCode_name[1307:1336],
+	801: _ServerCode_name[1336:1372],
+	802: _ServerCode_name[1372:1396],
+	803: _ServerCode_name[1396:1420],
+	806: _ServerCode_name[1420:1447],
+	807: _ServerCode_name[1447:1482],
+	814: _ServerCode_name[1482:1502],
+	816: _ServerCode_name[1502:1526],
+	829: _ServerCode_name[1526:1555],
+	830: _ServerCode_name[1555:1591],
+	840: _ServerCode_name[1591:1613],
+	841: _ServerCode_name[1613:1636],
+	842: _ServerCode_name[1636:1662],
+	843: _ServerCode_name[1662:1695],
+	849: _ServerCode_name[1695:1725],
+	900: _ServerCode_name[1725:1747],
+	912: _ServerCode_name[1747:1777],
+	921: _ServerCode_name[1777:1805],
+	922: _ServerCode_name[1805:1837],
 }
 
 func (i ServerCode) String() string {
@@ -92,6 +92,8 @@ const (
 	ServerCodeZoneRestore ServerCode = 610
 	// ServerCodeZoneTimerTick is the server code for ZoneTimerTick
 	ServerCodeZoneTimerTick ServerCode = 615
+	// ServerCodeBypassedZonesBitfieldDump is the server code for BypassedZonesBitfieldDump
+	ServerCodeBypassedZonesBitfieldDump ServerCode = 616
 	// ServerCodeDuressAlarm is the server code for DuressAlarm
 	ServerCodeDuressAlarm ServerCode = 620
 	// ServerCodeFireAlarm is the server code for FireAlarm
@@ -229,6 +231,7 @@ var serverCodeDescriptions = map[ServerCode]string{
 	ServerCodeZoneOpen:                         "Zone Open",
 	ServerCodeZoneRestore:                      "Zone Restore",
 	ServerCodeZoneTimerTick:                    "Zone Timer Dump",
+	ServerCodeBypassedZonesBitfieldDump:        "Bypassed Zones Bitfield Dump",
 	ServerCodeDuressAlarm:                      "Duress Alarm",
 	ServerCodeFireAlarm:                        "Fire Alarm",
 	ServerCodeFireAlarmRestore:                 "Fire Alarm Restore",
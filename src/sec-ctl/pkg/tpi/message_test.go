@@ -0,0 +1,82 @@
+package tpi_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"sec-ctl/pkg/tpi"
+	"sec-ctl/pkg/tpimock"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+// panelConn reads the messages of the panel, keeping those not expected yet
+type panelConn struct {
+	net.Conn
+	t       *testing.T
+	pending []tpi.ServerMessage
+}
+
+// expect reads the messages of the panel until one matches, and returns it
+func (c *panelConn) expect(desc string, match func(tpi.ServerMessage) bool) tpi.ServerMessage {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		for len(c.pending) > 0 {
+			msg := c.pending[0]
+			c.pending = c.pending[1:]
+			if match(msg) {
+				return msg
+			}
+		}
+		msgs, err := tpi.ReadAvailableServerMessages(c.Conn)
+		if err != nil {
+			c.t.Fatalf("waiting for %v: %v", desc, err)
+		}
+		c.pending = msgs
+	}
+}
+
+func (c *panelConn) expectCode(code tpi.ServerCode) tpi.ServerMessage {
+	return c.expect(code.String(), func(msg tpi.ServerMessage) bool { return msg.Code == code })
+}
+
+func (c *panelConn) expectAck(code tpi.ClientCode) {
+	c.expect("ack of "+code.String(), func(msg tpi.ServerMessage) bool {
+		acked, err := tpi.DecodeIntCode(msg.Data)
+		return msg.Code == tpi.ServerCodeAck && err == nil && tpi.ClientCode(acked) == code
+	})
+}
+
+func TestMessagesWithPanel(t *testing.T) {
+	srv, err := tpimock.NewServer(tpimock.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	conn := &panelConn{Conn: nc, t: t}
+
+	res := conn.expectCode(tpi.ServerCodeLoginRes)
+	assert.Equal(t, tpi.LoginResLoginRequest, tpi.LoginRes(res.Data))
+
+	login := tpi.ClientMessage{Code: tpi.ClientCodeNetworkLogin, Data: []byte(tpimock.DefaultPassword)}
+	assert.NoError(t, login.Write(conn))
+	res = conn.expectCode(tpi.ServerCodeLoginRes)
+	assert.Equal(t, tpi.LoginResSuccess, tpi.LoginRes(res.Data))
+
+	assert.NoError(t, tpi.ClientMessage{Code: tpi.ClientCodePoll}.Write(conn))
+	conn.expectAck(tpi.ClientCodePoll)
+
+	assert.NoError(t, tpi.ClientMessage{Code: tpi.ClientCodeStatusReport}.Write(conn))
+	dump := conn.expectCode(tpi.ServerCodeBypassedZonesBitfieldDump)
+	zoneIDs, err := tpi.DecodeZoneBitfield(dump.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, zoneIDs)
+	conn.expectAck(tpi.ClientCodeStatusReport)
+}
@@ -15,6 +15,11 @@ func (m ServerMessage) Write(w io.Writer) error {
 	return writeMessage(message{Code: int(m.Code), Data: m.Data}, w)
 }
 
+// Encode returns the message as it is sent on the wire, checksum and terminator included
+func (m ServerMessage) Encode() []byte {
+	return message{Code: int(m.Code), Data: m.Data}.encode()
+}
+
 func (m ServerMessage) String() string {
 	return fmt.Sprintf("ServerMessage{code: %s(%d), data: '%s'}", m.Code.Name(), m.Code, m.Data)
 }
@@ -0,0 +1,74 @@
+package tpi
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxZones is the number of zones that fit in a zone bitfield
+const MaxZones = 64
+
+// MaxKeystrokes is the maximum number of keystrokes that can be sent in a single SendKeystrokeString command
+const MaxKeystrokes = 6
+
+// FormatZoneID formats a zone number the way the TPI does, ie as 3 digits
+func FormatZoneID(zoneNum int) string {
+	return fmt.Sprintf("%03d", zoneNum)
+}
+
+// ParseZoneID parses a zone id into a zone number
+func ParseZoneID(zoneID string) (int, error) {
+	zoneNum, err := strconv.Atoi(zoneID)
+	if err != nil || zoneNum < 1 || zoneNum > MaxZones {
+		return 0, fmt.Errorf("invalid zone id %v", zoneID)
+	}
+	return zoneNum, nil
+}
+
+// DecodeZoneBitfield decodes a hex-encoded zone bitfield, as sent in zone dumps,
+// into the list of ids of the zones whose bit is set
+func DecodeZoneBitfield(data []byte) ([]string, error) {
+	bits := make([]byte, hex.DecodedLen(len(data)))
+	if _, err := hex.Decode(bits, data); err != nil {
+		return nil, fmt.Errorf("invalid zone bitfield %s: %v", data, err)
+	}
+
+	zoneIDs := make([]string, 0)
+	for i, b := range bits {
+		for j := uint(0); j < 8; j++ {
+			if b&(1<<j) != 0 {
+				zoneIDs = append(zoneIDs, FormatZoneID(i*8+int(j)+1))
+			}
+		}
+	}
+	return zoneIDs, nil
+}
+
+// EncodeZoneBitfield encodes the supplied zone ids into a hex-encoded zone bitfield
+func EncodeZoneBitfield(zoneIDs []string) ([]byte, error) {
+	bits := make([]byte, MaxZones/8)
+	for _, zoneID := range zoneIDs {
+		zoneNum, err := ParseZoneID(zoneID)
+		if err != nil {
+			return nil, err
+		}
+		bits[(zoneNum-1)/8] |= 1 << uint((zoneNum-1)%8)
+	}
+	return []byte(strings.ToUpper(hex.EncodeToString(bits))), nil
+}
+
+// SplitKeystrokes splits a keystroke string into chunks small enough
+// to be sent with the SendKeystrokeString command
+func SplitKeystrokes(keys string) []string {
+	chunks := make([]string, 0, len(keys)/MaxKeystrokes+1)
+	for len(keys) > MaxKeystrokes {
+		chunks = append(chunks, keys[:MaxKeystrokes])
+		keys = keys[MaxKeystrokes:]
+	}
+	if len(keys) > 0 {
+		chunks = append(chunks, keys)
+	}
+	return chunks
+}
@@ -0,0 +1,104 @@
+package tpi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func TestZoneBitfieldRoundTrip(t *testing.T) {
+	tests := []struct {
+		zoneIDs  []string
+		bitfield string
+	}{
+		{[]string{}, "0000000000000000"},
+		{[]string{"001"}, "0100000000000000"},
+		{[]string{"008"}, "8000000000000000"},
+		{[]string{"009"}, "0001000000000000"},
+		{[]string{"001", "002", "003", "004", "005", "006", "007", "008"}, "FF00000000000000"},
+		{[]string{"007", "016", "033"}, "4080000001000000"},
+		{[]string{"057", "064"}, "0000000000000081"},
+	}
+
+	for _, test := range tests {
+		bitfield, err := EncodeZoneBitfield(test.zoneIDs)
+		assert.NoError(t, err, "%v", test.zoneIDs)
+		assert.Equal(t, test.bitfield, string(bitfield), "%v", test.zoneIDs)
+
+		zoneIDs, err := DecodeZoneBitfield(bitfield)
+		assert.NoError(t, err, "%s", bitfield)
+		assert.Equal(t, test.zoneIDs, zoneIDs, "%s", bitfield)
+	}
+}
+
+func TestDecodeZoneBitfieldAcceptsLowercase(t *testing.T) {
+	zoneIDs, err := DecodeZoneBitfield([]byte("00000000000000c0"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"063", "064"}, zoneIDs)
+}
+
+func TestDecodeZoneBitfieldRejectsInvalidHex(t *testing.T) {
+	for _, data := range []string{"0", "0g00000000000000"} {
+		_, err := DecodeZoneBitfield([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestEncodeZoneBitfieldRejectsZonesOutOfRange(t *testing.T) {
+	for _, zoneID := range []string{"000", "065", "100", "-1", "abc"} {
+		_, err := EncodeZoneBitfield([]string{"001", zoneID})
+		assert.Error(t, err, zoneID)
+	}
+}
+
+func TestParseZoneID(t *testing.T) {
+	tests := []struct {
+		zoneID  string
+		zoneNum int
+		valid   bool
+	}{
+		{"001", 1, true},
+		{"8", 8, true},
+		{"009", 9, true},
+		{"064", 64, true},
+		{"000", 0, false},
+		{"065", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		zoneNum, err := ParseZoneID(test.zoneID)
+		assert.Equal(t, test.valid, err == nil, test.zoneID)
+		assert.Equal(t, test.zoneNum, zoneNum, test.zoneID)
+	}
+}
+
+func TestSplitKeystrokes(t *testing.T) {
+	tests := []struct {
+		pin    string
+		zone   int
+		chunks []string
+	}{
+		// *1 + 4-digit PIN + 2-digit zone + # is 9 keys
+		{"1234", 5, []string{"*11234", "05#"}},
+		{"1234", 12, []string{"*11234", "12#"}},
+		{"1234", 64, []string{"*11234", "64#"}},
+		// *1 + 6-digit PIN + 2-digit zone + # is 11 keys
+		{"123456", 9, []string{"*11234", "5609#"}},
+		// *1 + 8-digit PIN + 2-digit zone + # is 13 keys
+		{"12345678", 33, []string{"*11234", "567833", "#"}},
+	}
+
+	for _, test := range tests {
+		keys := fmt.Sprintf("*1%s%02d#", test.pin, test.zone)
+		chunks := SplitKeystrokes(keys)
+		assert.Equal(t, test.chunks, chunks, keys)
+		for _, chunk := range chunks {
+			assert.True(t, len(chunk) <= MaxKeystrokes, chunk)
+		}
+	}
+
+	assert.Equal(t, []string{}, SplitKeystrokes(""))
+	assert.Equal(t, []string{"*1234#"}, SplitKeystrokes("*1234#"))
+}
@@ -0,0 +1,122 @@
+package tpimock
+
+import (
+	"fmt"
+	"reflect"
+
+	"sec-ctl/pkg/sites"
+)
+
+// StateEntity represents the kinds of entities of the mocked system
+type StateEntity string
+
+const (
+	StateEntityPartition     StateEntity = "Partition"
+	StateEntityZone          StateEntity = "Zone"
+	StateEntityAlarm         StateEntity = "Alarm"
+	StateEntityTroubleStatus StateEntity = "TroubleStatus"
+	StateEntityTrouble       StateEntity = "Trouble"
+	StateEntityArmMode       StateEntity = "ArmMode"
+	StateEntityTemperature   StateEntity = "Temperature"
+)
+
+// StateChange describes a change to an entity of the mocked system.
+// Before is nil for a created entity, and After is nil for a removed one.
+type StateChange struct {
+	Entity StateEntity
+	ID     string
+	Before interface{}
+	After  interface{}
+}
+
+func (c StateChange) String() string {
+	return fmt.Sprintf("%v %v: %+v -> %+v", c.Entity, c.ID, c.Before, c.After)
+}
+
+// diffSystemData returns the changes between the entities of before and after
+func diffSystemData(before *systemData, after *systemData) []StateChange {
+	changes := make([]StateChange, 0)
+
+	add := func(entity StateEntity, id string, b interface{}, a interface{}) {
+		if !reflect.DeepEqual(b, a) {
+			changes = append(changes, StateChange{Entity: entity, ID: id, Before: b, After: a})
+		}
+	}
+
+	partitions := func(data *systemData) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, p := range data.Partitions {
+			m[p.ID] = p
+		}
+		return m
+	}
+	diffEntities(StateEntityPartition, partitions(before), partitions(after), add)
+
+	zones := func(data *systemData) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, z := range data.Zones {
+			m[z.ID] = z
+		}
+		return m
+	}
+	diffEntities(StateEntityZone, zones(before), zones(after), add)
+
+	alarms := func(data *systemData) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, a := range data.Alarms {
+			m[alarmID(a)] = a
+		}
+		return m
+	}
+	diffEntities(StateEntityAlarm, alarms(before), alarms(after), add)
+
+	add(StateEntityTroubleStatus, "", before.TroubleStatus, after.TroubleStatus)
+
+	troubles := func(data *systemData) map[string]interface{} {
+		m := map[string]interface{}{}
+		for t, active := range data.Troubles {
+			m[string(t)] = active
+		}
+		return m
+	}
+	diffEntities(StateEntityTrouble, troubles(before), troubles(after), add)
+
+	armModes := func(data *systemData) map[string]interface{} {
+		m := map[string]interface{}{}
+		for partID, mode := range data.ArmModes {
+			m[partID] = mode
+		}
+		return m
+	}
+	diffEntities(StateEntityArmMode, armModes(before), armModes(after), add)
+
+	temps := func(data *systemData) map[string]interface{} {
+		m := map[string]interface{}{}
+		for thermostat, t := range data.Temperatures {
+			m[thermostat] = t
+		}
+		return m
+	}
+	diffEntities(StateEntityTemperature, temps(before), temps(after), add)
+
+	return changes
+}
+
+// diffEntities calls add for every entity id found in either before or after
+func diffEntities(entity StateEntity, before map[string]interface{}, after map[string]interface{},
+	add func(StateEntity, string, interface{}, interface{})) {
+
+	for id, b := range before {
+		add(entity, id, b, after[id])
+	}
+	for id, a := range after {
+		if _, ok := before[id]; !ok {
+			add(entity, id, nil, a)
+		}
+	}
+}
+
+// alarmID identifies an alarm by its type, partition and trigger time
+func alarmID(a sites.Alarm) string {
+	return fmt.Sprintf("%v/%v/%v", a.AlarmType, a.PartitionID, a.Triggered.UnixNano())
+}
@@ -1,19 +1,34 @@
-package main
+package tpimock
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
+
 	"sec-ctl/pkg/sites"
 	"sec-ctl/pkg/tpi"
 )
 
-const defaultArmDelay = time.Second * 15
-
 type controller struct {
 	state       *state
 	sessions    []*clientSession
 	sessionLock *sync.Mutex
+	lastSession int
+	faults      FaultConfig
+	keypads     map[string]*keypad
+	keypadLock  *sync.Mutex
+	timers      map[string]*partitionTimers
+	timerLock   *sync.Mutex
+	transcript  *transcript
+	loggedIn    chan struct{}
+	loginOnce   *sync.Once
+}
+
+// keypad holds the keystrokes entered on a partition keypad
+type keypad struct {
+	inBypassMenu bool
+	keys         string
 }
 
 func newController(s *state) *controller {
@@ -21,6 +36,13 @@ func newController(s *state) *controller {
 		state:       s,
 		sessions:    make([]*clientSession, 0),
 		sessionLock: &sync.Mutex{},
+		keypads:     map[string]*keypad{},
+		keypadLock:  &sync.Mutex{},
+		timers:      map[string]*partitionTimers{},
+		timerLock:   &sync.Mutex{},
+		transcript:  newTranscript(),
+		loggedIn:    make(chan struct{}),
+		loginOnce:   &sync.Once{},
 	}
 }
 
@@ -28,6 +50,10 @@ func newController(s *state) *controller {
 func (ctrl *controller) sessionStarted(session *clientSession) {
 	ctrl.sessionLock.Lock()
 	defer ctrl.sessionLock.Unlock()
+
+	ctrl.lastSession++
+	session.id = ctrl.lastSession
+	session.faults = newFaultInjector(ctrl.faults)
 	ctrl.sessions = append(ctrl.sessions, session)
 }
 
@@ -45,15 +71,63 @@ func (ctrl *controller) sessionEnded(session *clientSession) {
 	panic(fmt.Errorf("session not found in session list: %v", session))
 }
 
+// sessionLoginResult records the outcome of a session's login request
+func (ctrl *controller) sessionLoginResult(session *clientSession, loggedIn bool) {
+	ctrl.sessionLock.Lock()
+	session.loggedIn = loggedIn
+	ctrl.sessionLock.Unlock()
+
+	if loggedIn {
+		ctrl.loginOnce.Do(func() { close(ctrl.loggedIn) })
+	}
+}
+
+// waitForLoggedInClient waits until a client has logged in, or the timeout expires
+func (ctrl *controller) waitForLoggedInClient(timeout time.Duration) error {
+	select {
+	case <-ctrl.loggedIn:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no client logged in after %v", timeout)
+	}
+}
+
 // broadcastMessagesToClients sends the specified message to all connected clients
 func (ctrl *controller) broadcastMessagesToClients(msgs ...tpi.ServerMessage) {
+	ctrl.sessionLock.Lock()
+	sessions := make([]*clientSession, len(ctrl.sessions))
+	copy(sessions, ctrl.sessions)
+	ctrl.sessionLock.Unlock()
+
 	for _, msg := range msgs {
-		for _, s := range ctrl.sessions {
-			s.writeCh <- msg
+		for _, s := range sessions {
+			s.send(msg)
 		}
 	}
 }
 
+// close ends all client sessions and stops the partition timers
+func (ctrl *controller) close() {
+	ctrl.sessionLock.Lock()
+	for _, s := range ctrl.sessions {
+		s.conn.Close()
+	}
+	ctrl.sessionLock.Unlock()
+
+	ctrl.timerLock.Lock()
+	partIDs := make([]string, 0, len(ctrl.timers))
+	for partID := range ctrl.timers {
+		partIDs = append(partIDs, partID)
+	}
+	ctrl.timerLock.Unlock()
+
+	for _, partID := range partIDs {
+		ctrl.cancelTimers(partID)
+	}
+
+	ctrl.state.close()
+}
+
 // processLoginRequest verifies the password,
 // and return success/failure accordingly
 func (ctrl *controller) processLoginRequest(msg tpi.ClientMessage) (bool, []tpi.ServerMessage, error) {
@@ -74,20 +148,21 @@ func (ctrl *controller) processLoginRequest(msg tpi.ClientMessage) (bool, []tpi.
 
 func (ctrl *controller) processStatusReport(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
 
-	s := ctrl.state
+	s := ctrl.state.view()
 
 	replies := make([]tpi.ServerMessage, 0)
 
 	for _, z := range s.Zones {
-		status := zoneStateToServerCode(z.State)
-		m := tpi.ServerMessage{Code: status, Data: []byte(z.ID)}
-		replies = append(replies, m)
+		replies = append(replies, zoneStateMessage(s, z))
 	}
 
 	for _, p := range s.Partitions {
 		status := partitionStateToServerCode(p.State)
-		m := tpi.ServerMessage{Code: status, Data: []byte(p.ID)}
-		replies = append(replies, m)
+		data := []byte(p.ID)
+		if p.State == sites.PartitionStateArmed {
+			data = append(data, byte('0'+s.ArmModes[p.ID]))
+		}
+		replies = append(replies, tpi.ServerMessage{Code: status, Data: data})
 	}
 
 	for _, p := range s.Partitions {
@@ -105,14 +180,40 @@ func (ctrl *controller) processStatusReport(msg tpi.ClientMessage) ([]tpi.Server
 	}
 
 	if s.TroubleStatus != 0 {
-		data := tpi.EncodeIntCode(int(s.TroubleStatus))
-		m := tpi.ServerMessage{Code: tpi.ServerCodeVerboseTroubleStatus, Data: data}
+		m := troubleStatusMessage(s.TroubleStatus)
 		replies = append(replies, m)
 	}
 
+	bypassDump, err := bypassedZonesDump(s)
+	if err != nil {
+		return nil, err
+	}
+	replies = append(replies, bypassDump)
+
 	return replies, nil
 }
 
+func bypassedZonesDump(s *systemData) (tpi.ServerMessage, error) {
+	data, err := tpi.EncodeZoneBitfield(s.bypassedZoneIDs())
+	if err != nil {
+		return tpi.ServerMessage{}, err
+	}
+	return tpi.ServerMessage{Code: tpi.ServerCodeBypassedZonesBitfieldDump, Data: data}, nil
+}
+
+// zoneStateMessage returns the message notifying the state of the zone.
+// Open, restore and fault messages only carry the zone id,
+// other messages are prefixed with the partition id.
+func zoneStateMessage(s *systemData, z sites.Zone) tpi.ServerMessage {
+	code := zoneStateToServerCode(z.State)
+	data := []byte(z.ID)
+	if code != tpi.ServerCodeZoneOpen && code != tpi.ServerCodeZoneRestore &&
+		code != tpi.ServerCodeZoneFault && code != tpi.ServerCodeZoneFaultRestore {
+		data = []byte(s.getZoneConfig(z.ID).PartitionID + z.ID)
+	}
+	return tpi.ServerMessage{Code: code, Data: data}
+}
+
 func zoneStateToServerCode(state sites.ZoneState) tpi.ServerCode {
 	switch state {
 	case sites.ZoneStateAlarm:
@@ -156,16 +257,14 @@ func partitionStateToServerCode(state sites.PartitionState) tpi.ServerCode {
 }
 
 // triggerAlarm triggers an alarm of specfied type on specified partition and zone:
-//  - if applicable change the state of the target zone and partition
-//  - broadcast messages to connected clients
-//  - update the state to record this alarm
+//   - if applicable change the state of the target zone and partition
+//   - broadcast messages to connected clients
+//   - update the state to record this alarm
 //
 // The system will stay in alarm state until a corresponding call
 // to restoreAlarm is made
 func (ctrl *controller) triggerAlarm(t sites.AlarmType, partID string, zoneID string) error {
 
-	s := ctrl.state
-
 	a := sites.Alarm{
 		AlarmType:   t,
 		PartitionID: partID,
@@ -173,11 +272,6 @@ func (ctrl *controller) triggerAlarm(t sites.AlarmType, partID string, zoneID st
 		Triggered:   time.Now(),
 	}
 
-	//prevent dupes
-	if a2, _ := s.findUnrestoredAlarm(a); a2.AlarmType != "" {
-		return fmt.Errorf("alarm already triggered")
-	}
-
 	if a.AlarmType == sites.AlarmTypePartition {
 		if a.PartitionID == "" || a.ZoneID == "" {
 			return fmt.Errorf("partitionID and zoneID are required for alarm of type %v", a.AlarmType)
@@ -188,12 +282,13 @@ func (ctrl *controller) triggerAlarm(t sites.AlarmType, partID string, zoneID st
 		}
 	}
 
-	if err := s.processAlarm(a); err != nil {
+	msgs, err := ctrl.processAlarm(a)
+	if err != nil {
 		return err
 	}
 
-	msgs, err := ctrl.processAlarm(a)
-	if err != nil {
+	//fails on dupes
+	if err := ctrl.state.processAlarm(a); err != nil {
 		return err
 	}
 
@@ -240,9 +335,9 @@ func (ctrl *controller) processAlarm(a sites.Alarm) ([]tpi.ServerMessage, error)
 }
 
 // restoreAlarm marks the specified alarm as restored:
-//  - if applicable, reset the state of the target partition and zone
-//  - broadcast relevant messages to clients
-//  - the target alarm is marked as restored
+//   - if applicable, reset the state of the target partition and zone
+//   - broadcast relevant messages to clients
+//   - the target alarm is marked as restored
 //
 // Note that the alarm is not immediately removed from the state.
 // Instead it will be removed later by a cleanup goroutine.
@@ -250,19 +345,16 @@ func (ctrl *controller) processAlarm(a sites.Alarm) ([]tpi.ServerMessage, error)
 // were not connected at the precise moment it occurred.
 func (ctrl *controller) restoreAlarm(t sites.AlarmType, partID string) error {
 
-	s := ctrl.state
-
-	a, err := s.findUnrestoredAlarm(sites.Alarm{AlarmType: t, PartitionID: partID})
+	a, err := ctrl.state.processAlarmRestore(t, partID, time.Now())
 	if err != nil {
 		return err
 	}
 
-	if err = s.processAlarmRestore(a); err != nil {
+	msgs, err := ctrl.processAlarmRestore(a)
+	if err != nil {
 		return err
 	}
 
-	msgs, err := ctrl.processAlarmRestore(a)
-
 	for _, msg := range msgs {
 		ctrl.broadcastMessagesToClients(msg)
 	}
@@ -276,7 +368,10 @@ func (ctrl *controller) processAlarmRestore(a sites.Alarm) ([]tpi.ServerMessage,
 	switch a.AlarmType {
 	case sites.AlarmTypePartition:
 
-		part, _ := ctrl.state.findPartition(a.PartitionID)
+		part, err := ctrl.state.view().partition(a.PartitionID)
+		if err != nil {
+			return nil, err
+		}
 		var troubleLedCode tpi.ServerCode
 		if part.TroubleStateLED {
 			troubleLedCode = tpi.ServerCodeTroubleLEDOn
@@ -314,199 +409,99 @@ func (ctrl *controller) processAlarmRestore(a sites.Alarm) ([]tpi.ServerMessage,
 	return msgs, nil
 }
 
-// processPartitionAlarmRestore resets the alarm state from the target zone and partition,
-// and return the relevant messages to send to the clients.
-func (ctrl *controller) processPartitionAlarmRestore(a *sites.Alarm) ([]tpi.ServerMessage, error) {
-	s := ctrl.state
-
-	part, err := s.findPartition(a.PartitionID)
-	if err != nil {
-		return nil, err
+// processKeystrokes emulates the partition keypad. Only the zone bypass menu is supported:
+// `*1`, followed by an optional user code, followed by 2-digit zone numbers, and `#` to exit.
+// The bypass state of the entered zones is toggled upon exit.
+func (ctrl *controller) processKeystrokes(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
+	if len(msg.Data) < 2 {
+		errCode := "25"
+		return []tpi.ServerMessage{tpi.ServerMessage{Code: tpi.ServerCodeSysErr, Data: []byte(errCode)}}, nil
 	}
 
-	part.State = sites.PartitionStateReady
-	part.TroubleStateLED = part.KeypadLEDState != 0 && part.KeypadLEDFlashState != 0
-
-	zone, err := s.findZone(a.ZoneID)
+	partID := string(msg.Data[0])
+	part, err := ctrl.state.view().partition(partID)
 	if err != nil {
 		return nil, err
 	}
-	zone.State = sites.ZoneStateRestore
 
-	var troubleLedCode tpi.ServerCode
-	if part.TroubleStateLED {
-		troubleLedCode = tpi.ServerCodeTroubleLEDOn
-	} else {
-		troubleLedCode = tpi.ServerCodeTroubleLEDOff
-	}
+	ctrl.keypadLock.Lock()
+	defer ctrl.keypadLock.Unlock()
 
-	msgs := []tpi.ServerMessage{
-		tpi.ServerMessage{
-			Code: tpi.ServerCodePartitionReady,
-			Data: []byte(a.PartitionID),
-		},
-		tpi.ServerMessage{
-			Code: tpi.ServerCodeZoneRestore,
-			Data: []byte(a.PartitionID + a.ZoneID),
-		},
-		tpi.ServerMessage{
-			Code: troubleLedCode,
-			Data: []byte(a.PartitionID),
-		},
-	}
-
-	return msgs, nil
-}
-
-// processPartitionLessAlarmRestore returns the relevent message that is sent
-// to the clients when the specifed alarm occurs
-func (ctrl *controller) processPartitionLessAlarmRestore(a *sites.Alarm) ([]tpi.ServerMessage, error) {
-	//simple case: just map the alarm type to the server code
-	var code tpi.ServerCode
-	switch a.AlarmType {
-	case sites.AlarmTypeDuress:
-		code = 0
-	case sites.AlarmTypeFire:
-		code = tpi.ServerCodeFireAlarmRestore
-	case sites.AlarmTypeAux:
-		code = tpi.ServerCodeAuxillaryAlarmRestore
-	case sites.AlarmTypeSmokeOrAux:
-		code = tpi.ServerCodeSmokeOrAuxAlarmRestore
-	case sites.AlarmTypePanic:
-		code = tpi.ServerCodePanicAlarmRestore
-	default:
-		return nil, fmt.Errorf("Invalid alarm type %v", a.AlarmType)
-	}
-
-	if code == 0 {
-		return []tpi.ServerMessage{}, nil
-	}
-
-	return []tpi.ServerMessage{tpi.ServerMessage{Code: code}}, nil
-}
-
-func (ctrl *controller) processArmControlAway(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
-	partID := string(msg.Data)
-	return ctrl.requestArm(tpi.ArmModeAway, partID, "", defaultArmDelay)
-}
-
-func (ctrl *controller) processArmControlStay(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
-	partID := string(msg.Data)
-	return ctrl.requestArm(tpi.ArmModeStay, partID, "", defaultArmDelay)
-}
-
-func (ctrl *controller) processArmControlWithCode(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
-	partID := string(msg.Data[0])
-	pin := string(msg.Data[1:])
-
-	userID, ok := ctrl.state.Users[pin]
+	kp, ok := ctrl.keypads[partID]
 	if !ok {
-		ctrl.broadcastMessagesToClients(tpi.ServerMessage{Code: tpi.ServerCodeInvalidAccessCode})
-		return []tpi.ServerMessage{}, nil
-	}
-
-	return ctrl.requestArm(tpi.ArmModeAway, partID, userID, defaultArmDelay)
-}
-
-func (ctrl *controller) processArmControlZeroEntryDelay(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
-	partID := string(msg.Data)
-
-	return ctrl.requestArm(tpi.ArmModeAway, partID, "", 0)
-}
-
-func (ctrl *controller) requestArm(mode tpi.ArmMode, partID string, userID string, delay time.Duration) ([]tpi.ServerMessage, error) {
-	s := ctrl.state
-
-	part, err := s.findPartition(partID)
-	if err != nil {
-		return nil, err
+		kp = &keypad{}
+		ctrl.keypads[partID] = kp
+	}
+
+	for _, key := range string(msg.Data[1:]) {
+		kp.keys += string(key)
+		if !kp.inBypassMenu {
+			if strings.HasSuffix(kp.keys, "*1") {
+				kp.inBypassMenu = true
+				kp.keys = ""
+			}
+		} else if key == '#' {
+			zoneIDs := ctrl.parseBypassKeys(strings.TrimSuffix(kp.keys, "#"))
+			kp.inBypassMenu = false
+			kp.keys = ""
+			if err := ctrl.exitBypassMenu(*part, zoneIDs); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if part.State != sites.PartitionStateReady {
-		errCode := "24"
-		reply := tpi.ServerMessage{Code: tpi.ServerCodeSysErr, Data: []byte(errCode)}
-		return []tpi.ServerMessage{reply}, nil
+	if !kp.inBypassMenu {
+		kp.keys = ""
 	}
 
-	ctrl.arm(mode, part, userID, delay)
-
 	return []tpi.ServerMessage{}, nil
 }
 
-func (ctrl *controller) arm(mode tpi.ArmMode, part sites.Partition, userID string, delay time.Duration) {
-
-	ctrl.beginArm(part, userID, delay)
-
-	go func() {
-		select {
-		case <-time.After(delay):
-			ctrl.completeArm(part, userID, mode)
-		}
-	}()
-}
-
-func (ctrl *controller) beginArm(part sites.Partition, userID string, delay time.Duration) {
-	msgs := make([]tpi.ServerMessage, 0)
-	if delay > 0 {
-		msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodeExitDelayInProgress})
-
-		if userID != "" {
-			msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodeSystemArmingInProgress})
+// parseBypassKeys converts the keys entered in the bypass menu to zone ids,
+// skipping the user code if one was entered
+func (ctrl *controller) parseBypassKeys(keys string) []string {
+	if len(keys) >= 4 && len(keys)%2 == 0 {
+		if _, ok := ctrl.state.view().Users[keys[:4]]; ok {
+			keys = keys[4:]
 		}
 	}
 
-	ctrl.broadcastMessagesToClients(msgs...)
-}
-
-func (ctrl *controller) completeArm(part sites.Partition, userID string, mode tpi.ArmMode) {
-	msgs := make([]tpi.ServerMessage, 0)
-
-	if userID != "" {
-		data := []byte(part.ID + userID)
-		msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodeUserClosing, Data: data})
+	zoneIDs := make([]string, 0, len(keys)/2)
+	for i := 0; i+2 <= len(keys); i += 2 {
+		zoneIDs = append(zoneIDs, "0"+keys[i:i+2])
 	}
-
-	data := append(tpi.EncodeIntCode(int(mode)), []byte(part.ID)...)
-	msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodePartitionArmed, Data: data})
-
-	ctrl.state.armPartition(part)
-
-	ctrl.broadcastMessagesToClients(msgs...)
+	return zoneIDs
 }
 
-func (ctrl *controller) processDisarm(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
-
-	logger.Println("processing disarm", msg)
-	s := ctrl.state
-
-	partID := string(msg.Data[0])
-	part, err := s.findPartition(partID)
-	if err != nil {
-		return nil, err
+func (ctrl *controller) exitBypassMenu(part sites.Partition, zoneIDs []string) error {
+	if part.State == sites.PartitionStateArmed || part.State == sites.PartitionStateInAlarm {
+		logger.Printf("partition %v is %v, ignoring bypass of zones %v", part.ID, part.State, zoneIDs)
+		return nil
 	}
 
-	if part.State != sites.PartitionStateArmed {
-		errCode := "23"
-		reply := tpi.ServerMessage{Code: tpi.ServerCodeSysErr, Data: []byte(errCode)}
-		return []tpi.ServerMessage{reply}, nil
+	if err := ctrl.state.toggleZonesBypass(zoneIDs); err != nil {
+		return err
 	}
 
-	pin := string(msg.Data[1:])
-	userID, ok := s.Users[pin]
-	if !ok {
-		ctrl.broadcastMessagesToClients(tpi.ServerMessage{Code: tpi.ServerCodeInvalidAccessCode})
-		return []tpi.ServerMessage{}, nil
+	if err := ctrl.refreshReadiness(part.ID); err != nil {
+		return err
 	}
 
-	if err = s.disarmPartition(part); err != nil {
-		return nil, err
+	s := ctrl.state.view()
+	dump, err := bypassedZonesDump(s)
+	if err != nil {
+		return err
 	}
 
-	ctrl.broadcastMessagesToClients(
-		tpi.ServerMessage{Code: tpi.ServerCodeUserOpening, Data: []byte(part.ID + userID)},
-		tpi.ServerMessage{Code: tpi.ServerCodePartitionDisarmed, Data: []byte(part.ID)},
-		tpi.ServerMessage{Code: tpi.ServerCodePartitionReady, Data: []byte(part.ID)},
-	)
+	var ledState sites.KeypadLEDState
+	if ctrl.isReadyToArm(part) {
+		ledState |= sites.KeypadLEDStateReady
+	}
+	if len(s.bypassedZoneIDs()) > 0 {
+		ledState |= sites.KeypadLEDStateBypass
+	}
+	led := tpi.ServerMessage{Code: tpi.ServerCodeKeypadLedState, Data: encodeHexByte(byte(ledState))}
 
-	return []tpi.ServerMessage{}, nil
+	ctrl.broadcastMessagesToClients(led, dump)
+	return nil
 }
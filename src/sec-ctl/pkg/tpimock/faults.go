@@ -0,0 +1,248 @@
+package tpimock
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"sec-ctl/pkg/tpi"
+)
+
+// how long a coalesced message waits for the next one
+const coalesceWindow = 50 * time.Millisecond
+
+// pause between the two halves of a split message
+const splitDelay = 20 * time.Millisecond
+
+// system error code sent when the keybus is busy
+const errCodeKeybusBusy = "18"
+
+// FaultConfig configures the faults injected in a client session.
+// Rates are probabilities between 0 and 1, evaluated for each message.
+// A zero seed picks a random one; the seed actually used is reported back,
+// so that a run can be reproduced.
+type FaultConfig struct {
+	Seed            int64   `json:"seed" yaml:"seed"`
+	LatencyMs       int     `json:"latencyMs" yaml:"latencyMs"`
+	LatencyJitterMs int     `json:"latencyJitterMs" yaml:"latencyJitterMs"`
+	DisconnectRate  float64 `json:"disconnectRate" yaml:"disconnectRate"`
+	BadChecksumRate float64 `json:"badChecksumRate" yaml:"badChecksumRate"`
+	SplitRate       float64 `json:"splitRate" yaml:"splitRate"`
+	CoalesceRate    float64 `json:"coalesceRate" yaml:"coalesceRate"`
+	DropAckRate     float64 `json:"dropAckRate" yaml:"dropAckRate"`
+	KeybusBusyRate  float64 `json:"keybusBusyRate" yaml:"keybusBusyRate"`
+	LoginTimeout    bool    `json:"loginTimeout" yaml:"loginTimeout"`
+}
+
+func (cfg FaultConfig) validate() error {
+	if cfg.LatencyMs < 0 || cfg.LatencyJitterMs < 0 {
+		return fmt.Errorf("Invalid latency %v+-%vms", cfg.LatencyMs, cfg.LatencyJitterMs)
+	}
+
+	rates := map[string]float64{
+		"disconnectRate":  cfg.DisconnectRate,
+		"badChecksumRate": cfg.BadChecksumRate,
+		"splitRate":       cfg.SplitRate,
+		"coalesceRate":    cfg.CoalesceRate,
+		"dropAckRate":     cfg.DropAckRate,
+		"keybusBusyRate":  cfg.KeybusBusyRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("Invalid %v %v: must be between 0 and 1", name, rate)
+		}
+	}
+	return nil
+}
+
+// faultInjector decides which faults to inject in a session,
+// drawing from a seeded random source
+type faultInjector struct {
+	lock *sync.Mutex
+	cfg  FaultConfig
+	rnd  *rand.Rand
+}
+
+func newFaultInjector(cfg FaultConfig) *faultInjector {
+	f := &faultInjector{lock: &sync.Mutex{}}
+	f.setConfig(cfg)
+	return f
+}
+
+// setConfig replaces the fault configuration, and reseeds the random source
+func (f *faultInjector) setConfig(cfg FaultConfig) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	f.cfg = cfg
+	f.rnd = rand.New(rand.NewSource(cfg.Seed))
+}
+
+func (f *faultInjector) config() FaultConfig {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.cfg
+}
+
+// roll returns true with the probability selected from the config
+func (f *faultInjector) roll(rate func(cfg FaultConfig) float64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	r := rate(f.cfg)
+	return r > 0 && f.rnd.Float64() < r
+}
+
+func (f *faultInjector) latency() time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ms := f.cfg.LatencyMs
+	if f.cfg.LatencyJitterMs > 0 {
+		ms += f.rnd.Intn(2*f.cfg.LatencyJitterMs+1) - f.cfg.LatencyJitterMs
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (f *faultInjector) shouldDisconnect() bool {
+	return f.roll(func(cfg FaultConfig) float64 { return cfg.DisconnectRate })
+}
+
+func (f *faultInjector) shouldCoalesce() bool {
+	return f.roll(func(cfg FaultConfig) float64 { return cfg.CoalesceRate })
+}
+
+func (f *faultInjector) shouldDropAck() bool {
+	return f.roll(func(cfg FaultConfig) float64 { return cfg.DropAckRate })
+}
+
+func (f *faultInjector) shouldReplyBusy() bool {
+	return f.roll(func(cfg FaultConfig) float64 { return cfg.KeybusBusyRate })
+}
+
+func (f *faultInjector) shouldTimeoutLogin() bool {
+	return f.config().LoginTimeout
+}
+
+// encode encodes the message, possibly with a bad checksum
+func (f *faultInjector) encode(msg tpi.ServerMessage) []byte {
+	data := msg.Encode()
+	if !f.roll(func(cfg FaultConfig) float64 { return cfg.BadChecksumRate }) {
+		return data
+	}
+
+	// checksum is the 2 hex digits before the CRLF terminator
+	n := len(data)
+	checksum, err := strconv.ParseUint(string(data[n-4:n-2]), 16, 8)
+	if err != nil {
+		logger.Panicf("unable to parse checksum of %s: %v", data, err)
+	}
+	copy(data[n-4:n-2], fmt.Sprintf("%02X", checksum^0xFF))
+	logger.Println("fault: bad checksum:", msg)
+	return data
+}
+
+// split returns the chunks in which the data should be written
+func (f *faultInjector) split(data []byte) [][]byte {
+	if len(data) < 2 || !f.roll(func(cfg FaultConfig) float64 { return cfg.SplitRate }) {
+		return [][]byte{data}
+	}
+
+	f.lock.Lock()
+	i := 1 + f.rnd.Intn(len(data)-1)
+	f.lock.Unlock()
+
+	return [][]byte{data[:i], data[i:]}
+}
+
+// setDefaultFaults sets the faults injected in sessions started from now on
+func (ctrl *controller) setDefaultFaults(cfg FaultConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	ctrl.sessionLock.Lock()
+	defer ctrl.sessionLock.Unlock()
+	ctrl.faults = cfg
+	return nil
+}
+
+func (ctrl *controller) getDefaultFaults() FaultConfig {
+	ctrl.sessionLock.Lock()
+	defer ctrl.sessionLock.Unlock()
+	return ctrl.faults
+}
+
+// setSessionFaults sets the faults injected in the specified session
+func (ctrl *controller) setSessionFaults(sessionID int, cfg FaultConfig) (FaultConfig, error) {
+	if err := cfg.validate(); err != nil {
+		return FaultConfig{}, err
+	}
+
+	s := ctrl.findSession(sessionID)
+	if s == nil {
+		return FaultConfig{}, fmt.Errorf("Session %v not found", sessionID)
+	}
+
+	s.faults.setConfig(cfg)
+	logger.Printf("client session %d faults: %+v", s.id, s.faults.config())
+	return s.faults.config(), nil
+}
+
+// setAllFaults sets the faults injected in all sessions, current and future
+func (ctrl *controller) setAllFaults(cfg FaultConfig) error {
+	if err := ctrl.setDefaultFaults(cfg); err != nil {
+		return err
+	}
+
+	for _, s := range ctrl.listSessions() {
+		if _, err := ctrl.setSessionFaults(s.ID, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SessionInfo describes a client session
+type SessionInfo struct {
+	ID         int         `json:"id" yaml:"id"`
+	RemoteAddr string      `json:"remoteAddr" yaml:"remoteAddr"`
+	LoggedIn   bool        `json:"loggedIn" yaml:"loggedIn"`
+	Faults     FaultConfig `json:"faults" yaml:"faults"`
+}
+
+func (ctrl *controller) listSessions() []SessionInfo {
+	ctrl.sessionLock.Lock()
+	defer ctrl.sessionLock.Unlock()
+
+	infos := make([]SessionInfo, len(ctrl.sessions))
+	for i, s := range ctrl.sessions {
+		infos[i] = SessionInfo{
+			ID:         s.id,
+			RemoteAddr: s.conn.RemoteAddr().String(),
+			LoggedIn:   s.loggedIn,
+			Faults:     s.faults.config(),
+		}
+	}
+	return infos
+}
+
+func (ctrl *controller) findSession(sessionID int) *clientSession {
+	ctrl.sessionLock.Lock()
+	defer ctrl.sessionLock.Unlock()
+
+	for _, s := range ctrl.sessions {
+		if s.id == sessionID {
+			return s
+		}
+	}
+	return nil
+}
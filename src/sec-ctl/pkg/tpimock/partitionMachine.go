@@ -0,0 +1,355 @@
+package tpimock
+
+import (
+	"time"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+)
+
+// partitionTimers holds the pending exit and entry delays of a partition
+type partitionTimers struct {
+	exit  *time.Timer
+	entry *time.Timer
+}
+
+func (ctrl *controller) processArmControlAway(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
+	partID := string(msg.Data)
+	return ctrl.requestArm(tpi.ArmModeAway, partID, "")
+}
+
+func (ctrl *controller) processArmControlStay(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
+	partID := string(msg.Data)
+	return ctrl.requestArm(tpi.ArmModeStay, partID, "")
+}
+
+func (ctrl *controller) processArmControlWithCode(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
+	partID := string(msg.Data[0])
+	pin := string(msg.Data[1:])
+
+	userID, ok := ctrl.state.view().Users[pin]
+	if !ok {
+		ctrl.broadcastMessagesToClients(tpi.ServerMessage{Code: tpi.ServerCodeInvalidAccessCode})
+		return []tpi.ServerMessage{}, nil
+	}
+
+	return ctrl.requestArm(tpi.ArmModeAway, partID, userID)
+}
+
+func (ctrl *controller) processArmControlZeroEntryDelay(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
+	partID := string(msg.Data)
+
+	return ctrl.requestArm(tpi.ArmModeZeroEntryAway, partID, "")
+}
+
+func (ctrl *controller) requestArm(mode tpi.ArmMode, partID string, userID string) ([]tpi.ServerMessage, error) {
+	s := ctrl.state.view()
+
+	part, err := s.partition(partID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ctrl.isReadyToArm(*part) || ctrl.isExitDelayInProgress(partID) {
+		errCode := "24"
+		reply := tpi.ServerMessage{Code: tpi.ServerCodeSysErr, Data: []byte(errCode)}
+		return []tpi.ServerMessage{reply}, nil
+	}
+
+	delay := time.Duration(s.getPartitionConfig(partID).ExitDelay) * time.Second
+	ctrl.arm(mode, *part, userID, delay)
+
+	return []tpi.ServerMessage{}, nil
+}
+
+// isReadyToArm returns whether the partition can be armed:
+// it must either be ready, or all its violated zones must be bypassed
+func (ctrl *controller) isReadyToArm(part sites.Partition) bool {
+	if part.State == sites.PartitionStateReady {
+		return true
+	}
+	if part.State != sites.PartitionStateNotReady {
+		return false
+	}
+
+	return ctrl.hasNoViolatedZones(part.ID)
+}
+
+// hasNoViolatedZones returns true if all the violated zones of the partition are bypassed
+func (ctrl *controller) hasNoViolatedZones(partID string) bool {
+	for _, z := range ctrl.state.view().partitionZones(partID) {
+		if isZoneViolated(z) && !z.Bypassed {
+			return false
+		}
+	}
+	return true
+}
+
+func isZoneViolated(z sites.Zone) bool {
+	switch z.State {
+	case sites.ZoneStateOpen, sites.ZoneStateFault, sites.ZoneStateTemper, sites.ZoneStateAlarm:
+		return true
+	}
+	return false
+}
+
+// arm starts the exit delay, and arms the partition once it expires,
+// unless the partition was disarmed in the meantime
+func (ctrl *controller) arm(mode tpi.ArmMode, part sites.Partition, userID string, delay time.Duration) {
+
+	ctrl.beginArm(part, userID, delay)
+
+	ctrl.timerLock.Lock()
+	defer ctrl.timerLock.Unlock()
+
+	timers := ctrl.getTimers(part.ID)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		ctrl.timerLock.Lock()
+		if timers.exit != timer { // cancelled
+			ctrl.timerLock.Unlock()
+			return
+		}
+		timers.exit = nil
+		ctrl.timerLock.Unlock()
+
+		ctrl.completeArm(part, userID, mode)
+	})
+	timers.exit = timer
+}
+
+func (ctrl *controller) beginArm(part sites.Partition, userID string, delay time.Duration) {
+	msgs := make([]tpi.ServerMessage, 0)
+	if delay > 0 {
+		msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodeExitDelayInProgress, Data: []byte(part.ID)})
+
+		if userID != "" {
+			msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodeSystemArmingInProgress, Data: []byte(part.ID)})
+		}
+	}
+
+	ctrl.broadcastMessagesToClients(msgs...)
+}
+
+func (ctrl *controller) completeArm(part sites.Partition, userID string, mode tpi.ArmMode) {
+	msgs := make([]tpi.ServerMessage, 0)
+
+	if userID != "" {
+		data := []byte(part.ID + userID)
+		msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodeUserClosing, Data: data})
+	}
+
+	data := append([]byte(part.ID), byte('0'+mode))
+	msgs = append(msgs, tpi.ServerMessage{Code: tpi.ServerCodePartitionArmed, Data: data})
+
+	if err := ctrl.state.armPartition(part.ID, mode); err != nil {
+		logger.Println("failed to arm partition", part.ID, err)
+		return
+	}
+
+	ctrl.broadcastMessagesToClients(msgs...)
+}
+
+func (ctrl *controller) processDisarm(msg tpi.ClientMessage) ([]tpi.ServerMessage, error) {
+
+	logger.Println("processing disarm", msg)
+	s := ctrl.state.view()
+
+	partID := string(msg.Data[0])
+	part, err := s.partition(partID)
+	if err != nil {
+		return nil, err
+	}
+
+	inAlarm := part.State == sites.PartitionStateInAlarm
+	if part.State != sites.PartitionStateArmed && !inAlarm && !ctrl.isExitDelayInProgress(partID) {
+		errCode := "23"
+		reply := tpi.ServerMessage{Code: tpi.ServerCodeSysErr, Data: []byte(errCode)}
+		return []tpi.ServerMessage{reply}, nil
+	}
+
+	pin := string(msg.Data[1:])
+	userID, ok := s.Users[pin]
+	if !ok {
+		ctrl.broadcastMessagesToClients(tpi.ServerMessage{Code: tpi.ServerCodeInvalidAccessCode})
+		return []tpi.ServerMessage{}, nil
+	}
+
+	ctrl.cancelTimers(partID)
+
+	if inAlarm {
+		if err := ctrl.restoreAlarm(sites.AlarmTypePartition, partID); err != nil {
+			logger.Println("unable to restore alarm on disarm:", err)
+		}
+	}
+
+	readyState, readyCode := ctrl.readiness(partID)
+	if err = ctrl.state.disarmPartition(partID, readyState); err != nil {
+		return nil, err
+	}
+
+	ctrl.broadcastMessagesToClients(
+		tpi.ServerMessage{Code: tpi.ServerCodeUserOpening, Data: []byte(part.ID + userID)},
+		tpi.ServerMessage{Code: tpi.ServerCodePartitionDisarmed, Data: []byte(part.ID)},
+		tpi.ServerMessage{Code: readyCode, Data: []byte(part.ID)},
+	)
+
+	return []tpi.ServerMessage{}, nil
+}
+
+// readiness returns the state a disarmed partition should be in given the state of its zones
+func (ctrl *controller) readiness(partID string) (sites.PartitionState, tpi.ServerCode) {
+	if ctrl.hasNoViolatedZones(partID) {
+		return sites.PartitionStateReady, tpi.ServerCodePartitionReady
+	}
+	return sites.PartitionStateNotReady, tpi.ServerCodePartitionNotReady
+}
+
+// refreshReadiness updates a disarmed partition to Ready or NotReady, and notifies the clients if it changed
+func (ctrl *controller) refreshReadiness(partID string) error {
+	part, err := ctrl.state.view().partition(partID)
+	if err != nil {
+		return err
+	}
+
+	if part.State != sites.PartitionStateReady && part.State != sites.PartitionStateNotReady {
+		return nil
+	}
+
+	readyState, readyCode := ctrl.readiness(partID)
+	if readyState == part.State {
+		return nil
+	}
+
+	if err := ctrl.state.setPartitionState(partID, readyState); err != nil {
+		return err
+	}
+
+	ctrl.broadcastMessagesToClients(tpi.ServerMessage{Code: readyCode, Data: []byte(partID)})
+	return nil
+}
+
+// updateZone changes the state of a zone, notifies the clients,
+// then lets the zone's partition react to the change
+func (ctrl *controller) updateZone(zoneID string, zoneState sites.ZoneState) error {
+
+	if err := ctrl.state.setZoneState(zoneID, zoneState); err != nil {
+		return err
+	}
+
+	s := ctrl.state.view()
+	zone, err := s.zone(zoneID)
+	if err != nil {
+		return err
+	}
+
+	cfg := s.getZoneConfig(zoneID)
+	ctrl.broadcastMessagesToClients(zoneStateMessage(s, *zone))
+
+	part, err := s.partition(cfg.PartitionID)
+	if err != nil {
+		return err
+	}
+
+	if part.State == sites.PartitionStateArmed {
+		if isZoneViolated(*zone) && !zone.Bypassed {
+			return ctrl.zoneViolatedWhileArmed(*part, *zone, cfg)
+		}
+		return nil
+	}
+
+	return ctrl.refreshReadiness(part.ID)
+}
+
+// zoneViolatedWhileArmed starts the entry delay or triggers the alarm, depending on the zone type
+// and the arm mode of the partition
+func (ctrl *controller) zoneViolatedWhileArmed(part sites.Partition, zone sites.Zone, cfg zoneConfig) error {
+	s := ctrl.state.view()
+	mode := s.ArmModes[part.ID]
+	stay := mode == tpi.ArmModeStay || mode == tpi.ArmModeZeroEntryStay
+	zeroEntry := mode == tpi.ArmModeZeroEntryAway || mode == tpi.ArmModeZeroEntryStay
+
+	if cfg.Type == zoneTypeInterior && stay {
+		logger.Printf("ignoring interior zone %v in stay mode", zone.ID)
+		return nil
+	}
+
+	if ctrl.isEntryDelayInProgress(part.ID) {
+		if cfg.Type == zoneTypeInstant {
+			ctrl.cancelTimers(part.ID)
+			return ctrl.triggerAlarm(sites.AlarmTypePartition, part.ID, zone.ID)
+		}
+		return nil
+	}
+
+	entryDelay := time.Duration(s.getPartitionConfig(part.ID).EntryDelay) * time.Second
+	if cfg.Type == zoneTypeDelay && !zeroEntry && entryDelay > 0 {
+		ctrl.startEntryDelay(part, zone, entryDelay)
+		return nil
+	}
+
+	return ctrl.triggerAlarm(sites.AlarmTypePartition, part.ID, zone.ID)
+}
+
+// startEntryDelay notifies the clients of the entry delay, and triggers the alarm
+// once it expires, unless the partition was disarmed in the meantime
+func (ctrl *controller) startEntryDelay(part sites.Partition, zone sites.Zone, delay time.Duration) {
+	ctrl.broadcastMessagesToClients(tpi.ServerMessage{Code: tpi.ServerCodeEntryDelayInProgress, Data: []byte(part.ID)})
+
+	ctrl.timerLock.Lock()
+	defer ctrl.timerLock.Unlock()
+
+	timers := ctrl.getTimers(part.ID)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		ctrl.timerLock.Lock()
+		if timers.entry != timer { // cancelled
+			ctrl.timerLock.Unlock()
+			return
+		}
+		timers.entry = nil
+		ctrl.timerLock.Unlock()
+
+		if err := ctrl.triggerAlarm(sites.AlarmTypePartition, part.ID, zone.ID); err != nil {
+			logger.Println("failed to trigger alarm after entry delay:", err)
+		}
+	})
+	timers.entry = timer
+}
+
+func (ctrl *controller) getTimers(partID string) *partitionTimers {
+	timers, ok := ctrl.timers[partID]
+	if !ok {
+		timers = &partitionTimers{}
+		ctrl.timers[partID] = timers
+	}
+	return timers
+}
+
+func (ctrl *controller) isExitDelayInProgress(partID string) bool {
+	ctrl.timerLock.Lock()
+	defer ctrl.timerLock.Unlock()
+	return ctrl.getTimers(partID).exit != nil
+}
+
+func (ctrl *controller) isEntryDelayInProgress(partID string) bool {
+	ctrl.timerLock.Lock()
+	defer ctrl.timerLock.Unlock()
+	return ctrl.getTimers(partID).entry != nil
+}
+
+// cancelTimers cancels pending exit and entry delays
+func (ctrl *controller) cancelTimers(partID string) {
+	ctrl.timerLock.Lock()
+	defer ctrl.timerLock.Unlock()
+
+	timers := ctrl.getTimers(partID)
+	if timers.exit != nil {
+		timers.exit.Stop()
+		timers.exit = nil
+	}
+	if timers.entry != nil {
+		timers.entry.Stop()
+		timers.entry = nil
+	}
+}
@@ -0,0 +1,130 @@
+package tpimock
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"sec-ctl/pkg/tpi"
+)
+
+// ReplayOptions configures a ReplayServer
+type ReplayOptions struct {
+	// Addr is the address to listen on. Defaults to an ephemeral port on the loopback interface.
+	Addr string
+	// Records is the captured traffic to replay. Only the traffic sent by the server is replayed.
+	Records []tpi.CaptureRecord
+	// Speed scales the original timing of the capture: 1 replays it in real time, 10 ten times faster.
+	// 0 replays it without any delay.
+	Speed float64
+}
+
+// ReplayServer feeds captured server traffic back to the first client that connects,
+// ignoring whatever the client sends, to reproduce field issues offline
+type ReplayServer struct {
+	// Addr is the address clients connect to, as host:port
+	Addr string
+
+	opts      ReplayOptions
+	listener  net.Listener
+	done      chan struct{}
+	conns     []net.Conn
+	lock      *sync.Mutex
+	closeOnce *sync.Once
+}
+
+// NewReplayServer creates a replay server and starts listening for clients
+func NewReplayServer(opts ReplayOptions) (*ReplayServer, error) {
+	if opts.Addr == "" {
+		opts.Addr = "127.0.0.1:0"
+	}
+
+	listener, err := net.Listen("tcp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &ReplayServer{
+		Addr:      listener.Addr().String(),
+		opts:      opts,
+		listener:  listener,
+		done:      make(chan struct{}),
+		conns:     make([]net.Conn, 0),
+		lock:      &sync.Mutex{},
+		closeOnce: &sync.Once{},
+	}
+
+	logger.Printf("Replaying %d records on %v", len(opts.Records), srv.Addr)
+	go srv.acceptLoop()
+
+	return srv, nil
+}
+
+// Done is closed once the capture has been replayed to a client
+func (srv *ReplayServer) Done() <-chan struct{} {
+	return srv.done
+}
+
+func (srv *ReplayServer) acceptLoop() {
+	for n := 0; ; n++ {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			logger.Println("accept error:", err)
+			return
+		}
+
+		srv.lock.Lock()
+		srv.conns = append(srv.conns, conn)
+		srv.lock.Unlock()
+
+		go io.Copy(ioutil.Discard, conn)
+
+		// a reconnecting client must not get the capture twice
+		if n == 0 {
+			go srv.replay(conn)
+		} else {
+			logger.Printf("%v: capture already replayed, ignoring client", conn.RemoteAddr())
+		}
+	}
+}
+
+func (srv *ReplayServer) replay(conn net.Conn) {
+	defer close(srv.done)
+
+	logger.Printf("%v: replay started", conn.RemoteAddr())
+
+	var prev time.Time
+	for _, rec := range srv.opts.Records {
+		if rec.Direction != tpi.CaptureDirectionIn {
+			continue
+		}
+
+		if !prev.IsZero() && srv.opts.Speed > 0 {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(prev)) / srv.opts.Speed))
+		}
+		prev = rec.Time
+
+		if _, err := conn.Write([]byte(rec.Data)); err != nil {
+			logger.Printf("%v: replay aborted: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	logger.Printf("%v: replay done", conn.RemoteAddr())
+}
+
+// Close stops listening, and closes all client connections
+func (srv *ReplayServer) Close() error {
+	var err error
+	srv.closeOnce.Do(func() {
+		err = srv.listener.Close()
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		for _, conn := range srv.conns {
+			conn.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,88 @@
+package tpimock_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"sec-ctl/pkg/tpi"
+	"sec-ctl/pkg/tpimock"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tpimock")
+	must(t, assert.NoError(t, err))
+	defer os.RemoveAll(dir)
+
+	// capture a session against the mock
+	fname := path.Join(dir, "capture.jsonl")
+	capture, err := tpi.NewCaptureWriter(fname, 0, 0)
+	must(t, assert.NoError(t, err))
+
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr)
+	must(t, assert.NoError(t, err))
+	c := newTestClient(t, tpi.NewCaptureConn(conn, capture))
+	c.login(tpimock.DefaultPassword)
+	must(t, assert.NoError(t, srv.SimulateZone("001", tpimock.ZoneActionOpen, false)))
+	c.expect(tpi.ServerCodeZoneOpen)
+	conn.Close()
+	must(t, assert.NoError(t, capture.Close()))
+
+	f, err := os.Open(fname)
+	must(t, assert.NoError(t, err))
+	defer f.Close()
+	recs, err := tpi.ReadCapture(f)
+	must(t, assert.NoError(t, err))
+
+	for _, rec := range recs {
+		if rec.Direction == tpi.CaptureDirectionOut && strings.HasPrefix(rec.Data, "005") {
+			assert.NotContains(t, rec.Data, tpimock.DefaultPassword, "password must be redacted")
+		}
+	}
+
+	// replay it to a new client
+	replay, err := tpimock.NewReplayServer(tpimock.ReplayOptions{Records: recs, Speed: 10})
+	must(t, assert.NoError(t, err))
+	defer replay.Close()
+
+	conn, err = net.Dial("tcp", replay.Addr)
+	must(t, assert.NoError(t, err))
+	c = newTestClient(t, conn)
+	assert.Equal(t, "3", string(c.expect(tpi.ServerCodeLoginRes).Data))
+	c.send(tpi.ClientCodeNetworkLogin, "ignored")
+	assert.Equal(t, "1", string(c.expect(tpi.ServerCodeLoginRes).Data))
+	assert.Equal(t, "001", string(c.expect(tpi.ServerCodeZoneOpen).Data))
+	<-replay.Done()
+}
+
+func TestCaptureRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tpimock")
+	must(t, assert.NoError(t, err))
+	defer os.RemoveAll(dir)
+
+	fname := path.Join(dir, "capture.jsonl")
+	capture, err := tpi.NewCaptureWriter(fname, 200, 2)
+	must(t, assert.NoError(t, err))
+
+	for i := 0; i < 10; i++ {
+		must(t, assert.NoError(t, capture.Record(tpi.CaptureDirectionIn, tpi.ServerMessage{Code: tpi.ServerCodeZoneOpen, Data: []byte("001")}.Encode())))
+	}
+	must(t, assert.NoError(t, capture.Close()))
+
+	for _, name := range []string{fname, fname + ".1", fname + ".2"} {
+		info, err := os.Stat(name)
+		if assert.NoError(t, err) {
+			assert.True(t, info.Size() <= 200, "%v is %d bytes", name, info.Size())
+		}
+	}
+	_, err = os.Stat(fname + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,249 @@
+// Package tpimock implements a mock Envisalink TPI server, simulating a DSC panel.
+//
+// It can be embedded in tests, the same way as httptest.NewServer:
+//
+//	srv, err := tpimock.NewServer(tpimock.Options{})
+//	...
+//	defer srv.Close()
+//	// connect a client to srv.Addr, log in with tpimock.DefaultPassword
+//	srv.SimulateZone("001", tpimock.ZoneActionOpen, false)
+package tpimock
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"sec-ctl/pkg/sites"
+)
+
+var logger = log.New(os.Stderr, "[tpimock] ", log.LstdFlags|log.Lshortfile)
+
+// DefaultPassword is the password clients log in with, unless specified in the options
+const DefaultPassword = "mock123"
+
+// DefaultUserPIN is the user code accepted by the default state
+const DefaultUserPIN = "1234"
+
+// DefaultState is the state the server starts with, unless specified in the options:
+// 2 ready partitions, and 4 closed zones
+var DefaultState = []byte(`{
+  "Users": {"1234": "0001"},
+  "ZoneConfigs": {
+    "001": {"PartitionID": "1", "Type": "Delay"},
+    "002": {"PartitionID": "1", "Type": "Instant"},
+    "003": {"PartitionID": "1", "Type": "Interior"},
+    "004": {"PartitionID": "2", "Type": "Delay"}
+  },
+  "Partitions": [
+    {"ID": "1", "State": "Ready"},
+    {"ID": "2", "State": "Ready"}
+  ],
+  "Zones": [
+    {"ID": "001", "State": "Restore"},
+    {"ID": "002", "State": "Restore"},
+    {"ID": "003", "State": "Restore"},
+    {"ID": "004", "State": "Restore"}
+  ],
+  "Alarms": []
+}`)
+
+// Options configures a Server
+type Options struct {
+	// Addr is the address to listen on. Defaults to an ephemeral port on the loopback interface.
+	Addr string
+	// Password is the password clients must log in with. Defaults to DefaultPassword.
+	Password string
+	// StateFilename is the json file the state is loaded from, and saved to on every change.
+	// If empty, the state is kept in memory.
+	StateFilename string
+	// InitialState is the json state to start from, when StateFilename is empty. Defaults to DefaultState.
+	InitialState []byte
+}
+
+// Server is a mock TPI server listening for clients
+type Server struct {
+	// Addr is the address clients connect to, as host:port
+	Addr string
+
+	ctrl      *controller
+	listener  net.Listener
+	closeOnce *sync.Once
+	// acceptDone is closed once the server stopped accepting clients
+	acceptDone chan struct{}
+}
+
+// NewServer creates a server and starts listening for clients
+func NewServer(opts Options) (*Server, error) {
+	if opts.Addr == "" {
+		opts.Addr = "127.0.0.1:0"
+	}
+	if opts.Password == "" {
+		opts.Password = DefaultPassword
+	}
+	if opts.InitialState == nil {
+		opts.InitialState = DefaultState
+	}
+
+	var s *state
+	var err error
+	if opts.StateFilename != "" {
+		s, err = newState(opts.Password, opts.StateFilename)
+	} else {
+		s, err = newStateFromJSON(opts.Password, "", opts.InitialState)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", opts.Addr)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	logger.Println("listening:", l.Addr())
+
+	srv := &Server{
+		Addr:       l.Addr().String(),
+		ctrl:       newController(s),
+		listener:   l,
+		closeOnce:  &sync.Once{},
+		acceptDone: make(chan struct{}),
+	}
+
+	go srv.acceptLoop()
+
+	return srv, nil
+}
+
+func (srv *Server) acceptLoop() {
+	defer close(srv.acceptDone)
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			logger.Println("accept error:", err)
+			return
+		}
+		go handleClientSession(srv.ctrl, conn)
+	}
+}
+
+// Listening tells whether the server still accepts clients
+func (srv *Server) Listening() bool {
+	select {
+	case <-srv.acceptDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// Close stops listening, and ends all client sessions
+func (srv *Server) Close() error {
+	var err error
+	srv.closeOnce.Do(func() {
+		err = srv.listener.Close()
+		<-srv.acceptDone
+		srv.ctrl.close()
+	})
+	return err
+}
+
+// StateJSON returns the json representation of the mocked system state
+func (srv *Server) StateJSON() ([]byte, error) {
+	return srv.ctrl.state.toJSON()
+}
+
+// OnStateChange registers a function called with every change to the mocked system state,
+// from the goroutine that made the change
+func (srv *Server) OnStateChange(fn func(StateChange)) {
+	srv.ctrl.state.onChange(fn)
+}
+
+// SystemState returns a copy of the partitions, zones, trouble status and alarms of the mocked system
+func (srv *Server) SystemState() sites.SystemState {
+	data, err := srv.StateJSON()
+	if err != nil {
+		logger.Panicln(err)
+	}
+
+	var s sites.SystemState
+	if err := json.Unmarshal(data, &s); err != nil {
+		logger.Panicln(err)
+	}
+	return s
+}
+
+// TriggerAlarm triggers an alarm of specified type on specified partition and zone
+func (srv *Server) TriggerAlarm(t sites.AlarmType, partID string, zoneID string) error {
+	return srv.ctrl.triggerAlarm(t, partID, zoneID)
+}
+
+// RestoreAlarm restores an alarm triggered with TriggerAlarm
+func (srv *Server) RestoreAlarm(t sites.AlarmType, partID string) error {
+	return srv.ctrl.restoreAlarm(t, partID)
+}
+
+// SimulateZone applies the action to the zone. Fault and tamper can be restored.
+func (srv *Server) SimulateZone(zoneID string, action ZoneAction, restore bool) error {
+	return srv.ctrl.simulateZone(zoneID, action, restore)
+}
+
+// SimulateTrouble raises or restores a system trouble
+func (srv *Server) SimulateTrouble(t TroubleType, restore bool) error {
+	return srv.ctrl.simulateTrouble(t, restore)
+}
+
+// SimulateLEDs sets the keypad LED and LED flash states of the first partition
+func (srv *Server) SimulateLEDs(ledState sites.KeypadLEDState, flashState sites.KeypadLEDFlashState) error {
+	return srv.ctrl.simulateLEDs(ledState, flashState)
+}
+
+// SimulateTemperature broadcasts the indoor and outdoor temperatures of a thermostat (1-4)
+func (srv *Server) SimulateTemperature(thermostat int, indoor int, outdoor int) error {
+	return srv.ctrl.simulateTemperature(thermostat, temperatures{Indoor: indoor, Outdoor: outdoor})
+}
+
+// Sessions lists the connected client sessions
+func (srv *Server) Sessions() []SessionInfo {
+	return srv.ctrl.listSessions()
+}
+
+// DefaultFaults returns the faults injected in new sessions
+func (srv *Server) DefaultFaults() FaultConfig {
+	return srv.ctrl.getDefaultFaults()
+}
+
+// SetDefaultFaults sets the faults injected in new sessions
+func (srv *Server) SetDefaultFaults(cfg FaultConfig) error {
+	return srv.ctrl.setDefaultFaults(cfg)
+}
+
+// SetSessionFaults sets the faults injected in a connected session, and returns them along with the seed in use
+func (srv *Server) SetSessionFaults(sessionID int, cfg FaultConfig) (FaultConfig, error) {
+	return srv.ctrl.setSessionFaults(sessionID, cfg)
+}
+
+// SetAllFaults sets the faults injected in all sessions, connected and new
+func (srv *Server) SetAllFaults(cfg FaultConfig) error {
+	return srv.ctrl.setAllFaults(cfg)
+}
+
+// Transcript returns the messages received from clients so far
+func (srv *Server) Transcript() []TranscriptEntry {
+	return srv.ctrl.transcript.getEntries()
+}
+
+// WaitForMessage waits until a client message at or after transcript index `from` matches,
+// and returns its index. It returns -1 if no message matched within the timeout.
+func (srv *Server) WaitForMessage(from int, timeout time.Duration, match func(TranscriptEntry) bool) int {
+	return srv.ctrl.transcript.waitFor(from, time.Now().Add(timeout), match)
+}
+
+// WaitForLogin waits until a client has logged in
+func (srv *Server) WaitForLogin(timeout time.Duration) error {
+	return srv.ctrl.waitForLoggedInClient(timeout)
+}
@@ -0,0 +1,187 @@
+package tpimock_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+	"sec-ctl/pkg/tpimock"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+const testTimeout = 5 * time.Second
+
+// must stops the test if the assertion failed
+func must(t *testing.T, ok bool) {
+	if !ok {
+		t.FailNow()
+	}
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	msgs chan tpi.ServerMessage
+}
+
+func dial(t *testing.T, srv *tpimock.Server) *testClient {
+	conn, err := net.Dial("tcp", srv.Addr)
+	must(t, assert.NoError(t, err))
+	return newTestClient(t, conn)
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	c := &testClient{t: t, conn: conn, msgs: make(chan tpi.ServerMessage, 100)}
+	go func() {
+		defer close(c.msgs)
+		for {
+			msgs, err := tpi.ReadAvailableServerMessages(conn)
+			if err != nil {
+				return
+			}
+			for _, m := range msgs {
+				c.msgs <- m
+			}
+		}
+	}()
+	return c
+}
+
+func (c *testClient) send(code tpi.ClientCode, data string) {
+	must(c.t, assert.NoError(c.t, tpi.ClientMessage{Code: code, Data: []byte(data)}.Write(c.conn)))
+}
+
+// expect reads messages until one matches the code, and returns it
+func (c *testClient) expect(code tpi.ServerCode) tpi.ServerMessage {
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			must(c.t, assert.True(c.t, ok, "connection closed while waiting for %v", code))
+			if m.Code == code {
+				return m
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %v", code)
+		}
+	}
+}
+
+func (c *testClient) login(password string) tpi.ServerMessage {
+	c.expect(tpi.ServerCodeLoginRes)
+	c.send(tpi.ClientCodeNetworkLogin, password)
+	return c.expect(tpi.ServerCodeLoginRes)
+}
+
+func newTestServer(t *testing.T) *tpimock.Server {
+	srv, err := tpimock.NewServer(tpimock.Options{})
+	must(t, assert.NoError(t, err))
+	return srv
+}
+
+func TestLogin(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	c := dial(t, srv)
+	res := c.login("wrong")
+	assert.Equal(t, string(tpi.LoginResFailure), string(res.Data))
+
+	c.send(tpi.ClientCodeNetworkLogin, tpimock.DefaultPassword)
+	res = c.expect(tpi.ServerCodeLoginRes)
+	assert.Equal(t, string(tpi.LoginResSuccess), string(res.Data))
+	assert.NoError(t, srv.WaitForLogin(testTimeout))
+}
+
+func TestListening(t *testing.T) {
+	srv := newTestServer(t)
+	assert.True(t, srv.Listening())
+	srv.Close()
+	assert.False(t, srv.Listening())
+}
+
+func TestSimulateZone(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	c := dial(t, srv)
+	c.login(tpimock.DefaultPassword)
+
+	must(t, assert.NoError(t, srv.SimulateZone("001", tpimock.ZoneActionOpen, false)))
+	assert.Equal(t, "001", string(c.expect(tpi.ServerCodeZoneOpen).Data))
+	assert.Equal(t, "1", string(c.expect(tpi.ServerCodePartitionNotReady).Data))
+
+	state := srv.SystemState()
+	assert.Equal(t, sites.ZoneStateOpen, state.Zones[0].State)
+
+	must(t, assert.Error(t, srv.SimulateZone("001", tpimock.ZoneAction("explode"), false)))
+}
+
+func TestArmAndEntryDelayAlarm(t *testing.T) {
+	srv, err := tpimock.NewServer(tpimock.Options{InitialState: []byte(`{
+		"Users": {"1234": "0001"},
+		"PartitionConfigs": {"1": {"EntryDelay": 1, "ExitDelay": 1}},
+		"Partitions": [{"ID": "1", "State": "Ready"}],
+		"Zones": [{"ID": "001", "State": "Restore"}],
+		"Alarms": []
+	}`)})
+	must(t, assert.NoError(t, err))
+	defer srv.Close()
+
+	c := dial(t, srv)
+	c.login(tpimock.DefaultPassword)
+
+	c.send(tpi.ClientCodePartitionArmControlAway, "1")
+	c.expect(tpi.ServerCodeExitDelayInProgress)
+	assert.Equal(t, "10", string(c.expect(tpi.ServerCodePartitionArmed).Data))
+
+	must(t, assert.NoError(t, srv.SimulateZone("001", tpimock.ZoneActionOpen, false)))
+	c.expect(tpi.ServerCodeEntryDelayInProgress)
+	c.expect(tpi.ServerCodePartitionInAlarm)
+
+	c.send(tpi.ClientCodePartitionDisarmControl, "1"+tpimock.DefaultUserPIN)
+	c.expect(tpi.ServerCodePartitionDisarmed)
+}
+
+func TestTranscript(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	c := dial(t, srv)
+	c.login(tpimock.DefaultPassword)
+	c.send(tpi.ClientCodeStatusReport, "")
+
+	isStatusReport := func(e tpimock.TranscriptEntry) bool { return e.Message.Code == tpi.ClientCodeStatusReport }
+	idx := srv.WaitForMessage(0, testTimeout, isStatusReport)
+	must(t, assert.True(t, idx > 0))
+
+	entries := srv.Transcript()
+	assert.Equal(t, tpi.ClientCodeNetworkLogin, entries[0].Message.Code)
+	assert.Equal(t, tpi.ClientCodeStatusReport, entries[idx].Message.Code)
+
+	assert.Equal(t, -1, srv.WaitForMessage(idx+1, 100*time.Millisecond, isStatusReport))
+}
+
+func TestFaults(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+
+	c := dial(t, srv)
+	c.login(tpimock.DefaultPassword)
+
+	sessions := srv.Sessions()
+	must(t, assert.Len(t, sessions, 1))
+
+	_, err := srv.SetSessionFaults(sessions[0].ID, tpimock.FaultConfig{KeybusBusyRate: 2})
+	must(t, assert.Error(t, err))
+
+	cfg, err := srv.SetSessionFaults(sessions[0].ID, tpimock.FaultConfig{KeybusBusyRate: 1})
+	must(t, assert.NoError(t, err))
+	assert.NotZero(t, cfg.Seed)
+
+	c.send(tpi.ClientCodePoll, "")
+	assert.Equal(t, "18", string(c.expect(tpi.ServerCodeSysErr).Data))
+}
@@ -1,16 +1,20 @@
-package main
+package tpimock
 
 import (
 	"net"
 	"sec-ctl/pkg/tpi"
+	"time"
 )
 
 type clientSession struct {
+	id               int
+	faults           *faultInjector
 	controller       *controller
 	conn             net.Conn
 	readCh           chan tpi.ClientMessage
 	writeCh          chan tpi.ServerMessage
-	loggedIn         bool
+	done             chan struct{}
+	loggedIn         bool // written under controller.sessionLock
 	numLoginRequests int
 }
 
@@ -22,17 +26,19 @@ func handleClientSession(ctrl *controller, conn net.Conn) {
 		conn:       conn,
 		readCh:     make(chan tpi.ClientMessage),
 		writeCh:    make(chan tpi.ServerMessage),
+		done:       make(chan struct{}),
 		loggedIn:   false,
 	}
 
 	ctrl.sessionStarted(session)
+	logger.Printf("client session %d started, faults: %+v", session.id, session.faults.config())
 
 	session.startReadLoop()
 	session.startWriteLoop()
 	session.startProcessingLoop()
 
 	// request client login
-	session.writeCh <- tpi.ServerMessage{Code: tpi.ServerCodeLoginRes, Data: []byte(tpi.LoginResLoginRequest)}
+	session.send(tpi.ServerMessage{Code: tpi.ServerCodeLoginRes, Data: []byte(tpi.LoginResLoginRequest)})
 }
 
 func (s *clientSession) startReadLoop() {
@@ -55,6 +61,7 @@ func (s *clientSession) startReadLoop() {
 
 		//notify state of session end
 		s.controller.sessionEnded(s)
+		close(s.done)
 		logger.Println("client session ended")
 
 	}()
@@ -66,22 +73,58 @@ func (s *clientSession) startWriteLoop() {
 		for {
 			select {
 			case m := <-s.writeCh:
-				logger.Println("write:", m)
-				err := m.Write(s.conn)
-				if err != nil {
-					logger.Println("write error:", err)
-				}
+				s.write(m)
+			case <-s.done:
+				return
 			}
 		}
 	}()
 }
 
+// write writes the message, subject to the session faults
+func (s *clientSession) write(m tpi.ServerMessage) {
+	if d := s.faults.latency(); d > 0 {
+		time.Sleep(d)
+	}
+
+	if s.faults.shouldDisconnect() {
+		logger.Println("fault: disconnecting before write:", m)
+		s.conn.Close()
+		return
+	}
+
+	logger.Println("write:", m)
+	data := s.faults.encode(m)
+
+	if s.faults.shouldCoalesce() {
+		select {
+		case next := <-s.writeCh:
+			logger.Println("fault: coalesced write:", next)
+			data = append(data, s.faults.encode(next)...)
+		case <-time.After(coalesceWindow):
+		}
+	}
+
+	for i, chunk := range s.faults.split(data) {
+		if i > 0 {
+			logger.Printf("fault: split write: '%s' | '%s'", data[:len(data)-len(chunk)], chunk)
+			time.Sleep(splitDelay)
+		}
+		if _, err := s.conn.Write(chunk); err != nil {
+			logger.Println("write error:", err)
+			return
+		}
+	}
+}
+
 func (s *clientSession) startProcessingLoop() {
 	go func() {
 		for {
 			select {
 			case msg := <-s.readCh:
 				s.processClientMessage(msg)
+			case <-s.done:
+				return
 			}
 		}
 	}()
@@ -92,9 +135,16 @@ func (s *clientSession) processClientMessage(msg tpi.ClientMessage) error {
 	var err error
 
 	ctrl := s.controller
+	ctrl.transcript.record(msg)
 
 	if msg.Code != tpi.ClientCodeNetworkLogin && !s.loggedIn {
 		replies = []tpi.ServerMessage{tpi.ServerMessage{Code: tpi.ServerCodeLoginRes, Data: []byte(tpi.LoginResLoginRequest)}}
+	} else if msg.Code == tpi.ClientCodeNetworkLogin && s.faults.shouldTimeoutLogin() {
+		logger.Println("fault: ignoring login request")
+		return nil
+	} else if msg.Code != tpi.ClientCodeNetworkLogin && s.faults.shouldReplyBusy() {
+		logger.Println("fault: keybus busy:", msg)
+		replies = []tpi.ServerMessage{tpi.ServerMessage{Code: tpi.ServerCodeSysErr, Data: []byte(errCodeKeybusBusy)}}
 	} else {
 		switch msg.Code {
 		case tpi.ClientCodePoll: // noop, will just ack
@@ -102,7 +152,7 @@ func (s *clientSession) processClientMessage(msg tpi.ClientMessage) error {
 			var loggedIn bool
 			loggedIn, replies, err = ctrl.processLoginRequest(msg)
 			if err == nil {
-				s.loggedIn = loggedIn
+				ctrl.sessionLoginResult(s, loggedIn)
 			}
 
 		case tpi.ClientCodeStatusReport:
@@ -117,6 +167,8 @@ func (s *clientSession) processClientMessage(msg tpi.ClientMessage) error {
 			replies, err = ctrl.processArmControlZeroEntryDelay(msg)
 		case tpi.ClientCodePartitionDisarmControl:
 			replies, err = ctrl.processDisarm(msg)
+		case tpi.ClientCodeSendKeystrokeString:
+			replies, err = ctrl.processKeystrokes(msg)
 		default:
 			logger.Println("WARN: Unhandled client message:", msg)
 		}
@@ -148,12 +200,24 @@ func (s *clientSession) throttleLoggedOutClient(msgs []tpi.ServerMessage) {
 
 func (s *clientSession) reply(msg tpi.ClientMessage, replies ...tpi.ServerMessage) error {
 	for _, reply := range replies {
-		s.writeCh <- reply
+		s.send(reply)
+	}
+	if s.faults.shouldDropAck() {
+		logger.Println("fault: dropping ack:", msg)
+		return nil
 	}
-	s.writeCh <- tpi.ServerMessage{
+	s.send(tpi.ServerMessage{
 		Code: tpi.ServerCodeAck,
 		Data: tpi.EncodeIntCode(int(msg.Code)),
-	}
+	})
 
 	return nil
 }
+
+// send queues the message for writing, unless the session has ended
+func (s *clientSession) send(msg tpi.ServerMessage) {
+	select {
+	case s.writeCh <- msg:
+	case <-s.done:
+	}
+}
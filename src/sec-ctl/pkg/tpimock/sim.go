@@ -0,0 +1,190 @@
+package tpimock
+
+import (
+	"fmt"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+)
+
+// TroubleType represents the system troubles that can be simulated
+type TroubleType string
+
+const (
+	TroubleTypeBattery        TroubleType = "Battery"
+	TroubleTypeAC             TroubleType = "AC"
+	TroubleTypeBell           TroubleType = "Bell"
+	TroubleTypeFTC            TroubleType = "FTC"
+	TroubleTypeBufferNearFull TroubleType = "BufferNearFull"
+	TroubleTypeTamper         TroubleType = "Tamper"
+	TroubleTypeFire           TroubleType = "Fire"
+)
+
+// troubleCodes maps each trouble type to its trouble and restore codes.
+// A zero restore code means the trouble has no restore message.
+var troubleCodes = map[TroubleType][2]tpi.ServerCode{
+	TroubleTypeBattery:        {tpi.ServerCodePanelBatteryTrouble, tpi.ServerCodePanelBatteryTroubleRestore},
+	TroubleTypeAC:             {tpi.ServerCodePanelACTrouble, tpi.ServerCodePanelACRestore},
+	TroubleTypeBell:           {tpi.ServerCodeSystemBellTrouble, tpi.ServerCodeSystemBellTroubleRestoral},
+	TroubleTypeFTC:            {tpi.ServerCodeFTCTrouble, 0},
+	TroubleTypeBufferNearFull: {tpi.ServerCodeBufferNearFull, 0},
+	TroubleTypeTamper:         {tpi.ServerCodeGeneralSystemTamper, tpi.ServerCodeGeneralSystemTamperRestore},
+	TroubleTypeFire:           {tpi.ServerCodeFireTroubleAlarm, tpi.ServerCodeFireTroubleAlarmRestore},
+}
+
+// troubleStatusFlags maps each trouble type to the verbose trouble status flag it raises
+var troubleStatusFlags = map[TroubleType]sites.SystemTroubleStatus{
+	TroubleTypeBattery: sites.SystemTroubleStatusServiceRequired,
+	TroubleTypeAC:      sites.SystemTroubleStatusACPowerLost,
+	TroubleTypeBell:    sites.SystemTroubleStatusServiceRequired,
+	TroubleTypeFTC:     sites.SystemTroubleStatusFailureToCommunicate,
+	TroubleTypeTamper:  sites.SystemTroubleStatusSensorOrZoneTemper,
+}
+
+// ZoneAction represents the zone changes that can be simulated
+type ZoneAction string
+
+const (
+	ZoneActionOpen   ZoneAction = "open"
+	ZoneActionClose  ZoneAction = "close"
+	ZoneActionFault  ZoneAction = "fault"
+	ZoneActionTamper ZoneAction = "tamper"
+)
+
+// simulateZone applies the action to the zone. Fault and tamper can be restored.
+func (ctrl *controller) simulateZone(zoneID string, action ZoneAction, restore bool) error {
+	var zoneState sites.ZoneState
+
+	switch action {
+	case ZoneActionOpen:
+		zoneState = sites.ZoneStateOpen
+	case ZoneActionClose:
+		zoneState = sites.ZoneStateRestore
+	case ZoneActionFault:
+		zoneState = sites.ZoneStateFault
+		if restore {
+			zoneState = sites.ZoneStateFaultRestore
+		}
+	case ZoneActionTamper:
+		zoneState = sites.ZoneStateTemper
+		if restore {
+			zoneState = sites.ZoneStateTemperRestore
+		}
+	default:
+		return fmt.Errorf("Invalid zone action %v", action)
+	}
+
+	if err := ctrl.updateZone(zoneID, zoneState); err != nil {
+		return err
+	}
+
+	return ctrl.refreshTroubleStatus()
+}
+
+// simulateTrouble raises or restores a system trouble
+func (ctrl *controller) simulateTrouble(t TroubleType, restore bool) error {
+	codes, ok := troubleCodes[t]
+	if !ok {
+		return fmt.Errorf("Invalid trouble type %v", t)
+	}
+
+	if err := ctrl.state.setTrouble(t, !restore); err != nil {
+		return err
+	}
+
+	code := codes[0]
+	if restore {
+		code = codes[1]
+	}
+	if code != 0 {
+		ctrl.broadcastMessagesToClients(tpi.ServerMessage{Code: code})
+	}
+
+	return ctrl.refreshTroubleStatus()
+}
+
+// refreshTroubleStatus recomputes the verbose trouble status from the active troubles and the zones,
+// and notifies the clients of the new status and trouble LED states if they changed
+func (ctrl *controller) refreshTroubleStatus() error {
+	s := ctrl.state.view()
+
+	var status sites.SystemTroubleStatus
+	for t := range s.Troubles {
+		status |= troubleStatusFlags[t]
+	}
+	for _, z := range s.Zones {
+		switch z.State {
+		case sites.ZoneStateFault:
+			status |= sites.SystemTroubleStatusSensorOrZoneFault
+		case sites.ZoneStateTemper:
+			status |= sites.SystemTroubleStatusSensorOrZoneTemper
+		}
+	}
+
+	if status == s.TroubleStatus {
+		return nil
+	}
+
+	if err := ctrl.state.setTroubleStatus(status); err != nil {
+		return err
+	}
+
+	msgs := []tpi.ServerMessage{troubleStatusMessage(status)}
+
+	for _, p := range s.Partitions {
+		on := status != 0
+		if p.TroubleStateLED == on {
+			continue
+		}
+		if err := ctrl.state.setPartitionTroubleLED(p.ID, on); err != nil {
+			return err
+		}
+		code := tpi.ServerCodeTroubleLEDOff
+		if on {
+			code = tpi.ServerCodeTroubleLEDOn
+		}
+		msgs = append(msgs, tpi.ServerMessage{Code: code, Data: []byte(p.ID)})
+	}
+
+	ctrl.broadcastMessagesToClients(msgs...)
+	return nil
+}
+
+func troubleStatusMessage(status sites.SystemTroubleStatus) tpi.ServerMessage {
+	return tpi.ServerMessage{Code: tpi.ServerCodeVerboseTroubleStatus, Data: encodeHexByte(byte(status))}
+}
+
+// simulateLEDs sets the keypad LED and LED flash states.
+// The TPI only reports the keypad LEDs of the first partition.
+func (ctrl *controller) simulateLEDs(ledState sites.KeypadLEDState, flashState sites.KeypadLEDFlashState) error {
+	if err := ctrl.state.setPartitionKeypadLEDs(defaultPartitionID, ledState, flashState); err != nil {
+		return err
+	}
+
+	ctrl.broadcastMessagesToClients(
+		tpi.ServerMessage{Code: tpi.ServerCodeKeypadLedState, Data: encodeHexByte(byte(ledState))},
+		tpi.ServerMessage{Code: tpi.ServerCodeKeypadLedFlashState, Data: encodeHexByte(byte(flashState))},
+	)
+	return nil
+}
+
+// simulateTemperature broadcasts the indoor and outdoor temperatures of a thermostat
+func (ctrl *controller) simulateTemperature(thermostat int, temps temperatures) error {
+	if thermostat < 1 || thermostat > 4 {
+		return fmt.Errorf("Invalid thermostat %v", thermostat)
+	}
+
+	if err := ctrl.state.setTemperatures(fmt.Sprintf("%d", thermostat), temps); err != nil {
+		return err
+	}
+
+	ctrl.broadcastMessagesToClients(
+		tpi.ServerMessage{Code: tpi.ServerCodeIndoorTemperature, Data: []byte(fmt.Sprintf("%d%03d", thermostat, temps.Indoor))},
+		tpi.ServerMessage{Code: tpi.ServerCodeOutdoorTemperature, Data: []byte(fmt.Sprintf("%d%03d", thermostat, temps.Outdoor))},
+	)
+	return nil
+}
+
+func encodeHexByte(b byte) []byte {
+	return []byte(fmt.Sprintf("%02X", b))
+}
@@ -0,0 +1,580 @@
+package tpimock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+)
+
+const eventExpireDelay = time.Second * 60
+const eventCleanupInterval = time.Second * 15
+const defaultEntryDelay = 30
+const defaultExitDelay = 15
+const defaultPartitionID = "1"
+
+var errNoChange = errors.New("no change")
+
+// state holds the data of the mocked system.
+// It is deserialized from json at startup,
+// and serialized to json every time it changes, unless it is kept in memory.
+//
+// The data is only changed through transactions (see update), which work on a copy of the data.
+// The copy replaces the current data if the transaction succeeds, and listeners are notified
+// of the changed entities.
+type state struct {
+	stateFname string
+	lock       *sync.Mutex
+	password   string
+	quit       chan struct{}
+	data       *systemData
+	listeners  []func(StateChange)
+}
+
+// systemData holds the entities of the mocked system
+type systemData struct {
+	Users            map[string]string          // PIN -> ID
+	PartitionConfigs map[string]partitionConfig // partition ID -> config
+	ZoneConfigs      map[string]zoneConfig      // zone ID -> config
+	ArmModes         map[string]tpi.ArmMode     // partition ID -> mode of armed partitions
+	Troubles         map[TroubleType]bool       // active system troubles
+	Temperatures     map[string]temperatures    // thermostat -> temperatures
+	sites.SystemState
+	// Partitions    []sites.Partition
+	// Zones         []sites.Zone
+	// TroubleStatus tpi.SystemTroubleStatus
+	// Alarms        []sites.Alarm
+}
+
+// partitionConfig holds the delays of a partition, in seconds
+type partitionConfig struct {
+	EntryDelay int
+	ExitDelay  int
+}
+
+// zoneType determines how a zone reacts to being violated while its partition is armed
+type zoneType string
+
+const (
+	// zoneTypeDelay zones start the entry delay
+	zoneTypeDelay zoneType = "Delay"
+	// zoneTypeInstant zones trigger the alarm immediately
+	zoneTypeInstant zoneType = "Instant"
+	// zoneTypeInterior zones are ignored in stay mode, follow the entry delay if it is in progress,
+	// and trigger the alarm immediately otherwise
+	zoneTypeInterior zoneType = "Interior"
+)
+
+// zoneConfig holds the partition and type of a zone
+type zoneConfig struct {
+	PartitionID string
+	Type        zoneType
+}
+
+// temperatures holds the temperatures reported by a thermostat
+type temperatures struct {
+	Indoor  int
+	Outdoor int
+}
+
+// creates a new state object from stateFilename
+func newState(password string, stateFilename string) (*state, error) {
+
+	if !path.IsAbs(stateFilename) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("stateFilename is not abs:", stateFilename, ". prepending cwd", cwd)
+		stateFilename = path.Clean(path.Join(cwd, stateFilename))
+	}
+
+	data, err := ioutil.ReadFile(stateFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStateFromJSON(password, stateFilename, data)
+}
+
+// creates a new state object from its json representation.
+// If stateFilename is empty, the state is only kept in memory.
+func newStateFromJSON(password string, stateFilename string, data []byte) (*state, error) {
+
+	state := &state{
+		stateFname: stateFilename,
+		password:   password,
+		lock:       &sync.Mutex{},
+		quit:       make(chan struct{}),
+		data:       &systemData{},
+		listeners:  make([]func(StateChange), 0),
+	}
+
+	if err := json.Unmarshal(data, state.data); err != nil {
+		return nil, err
+	}
+
+	state.startAlarmCleanupTimer()
+
+	state.dumpToLogs()
+
+	return state, nil
+}
+
+// dumpToLogs writes the jsonified state to the logs
+func (state *state) dumpToLogs() {
+	json, err := state.toJSON()
+	if err != nil {
+		panic(err)
+	}
+	logger.Printf("--\nstate:\n%v\n--\n", string(json))
+}
+
+// toJSON returns the jsonified current data
+func (state *state) toJSON() ([]byte, error) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.data.toJSON()
+}
+
+func (data *systemData) toJSON() ([]byte, error) {
+	return json.MarshalIndent(data, "", "  ")
+}
+
+// save dumps the jsonified data at `stateFname`
+func (state *state) save(data *systemData) error {
+	if state.stateFname == "" {
+		return nil
+	}
+
+	jsonData, err := data.toJSON()
+	if err != nil {
+		return err
+	}
+
+	// write next to the state file, so that the rename is atomic
+	tmpName := fmt.Sprintf("tmp-tpi-mock-%v%v.json", rand.Int31(), time.Now().Unix())
+	tmpPath := path.Join(path.Dir(state.stateFname), tmpName)
+	err = ioutil.WriteFile(tmpPath, jsonData, os.ModePerm)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, state.stateFname)
+}
+
+// startAlarmCleanupTimer calls cleanupAlarms every `eventCleanupInterval`
+func (state *state) startAlarmCleanupTimer() {
+
+	run := func() {
+		if err := state.cleanupAlarms(time.Now()); err != nil {
+			logger.Panicln(err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(eventCleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-state.quit:
+				return
+			}
+		}
+	}()
+
+	run()
+}
+
+// close stops the alarm cleanup timer
+func (state *state) close() {
+	close(state.quit)
+}
+
+// cleanupAlarms removes alarms from the alarm if they have been restored
+// for longer than `eventExpireDelay` before `now`.
+func (state *state) cleanupAlarms(now time.Time) error {
+	return state.update(func(tx *systemData) error {
+		alarms := make([]sites.Alarm, 0, len(tx.Alarms))
+		for _, a := range tx.Alarms {
+			if !a.Restored.IsZero() && a.Restored.Add(eventExpireDelay).Before(now) {
+				logger.Printf("Alarm %v has expired, removing\n", a)
+				continue
+			}
+			alarms = append(alarms, a)
+		}
+
+		if len(alarms) == len(tx.Alarms) {
+			return errNoChange
+		}
+		tx.Alarms = alarms
+		return nil
+	})
+}
+
+// onChange registers a function called with every change to the entities of the system.
+// It is called after the change is committed, from the goroutine that made the change.
+func (state *state) onChange(listener func(StateChange)) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.listeners = append(state.listeners, listener)
+}
+
+// update runs the updater in a transaction:
+// the updater is called with a copy of the data, holding the state lock.
+// If it returns an error, the copy is discarded. Otherwise, it is saved,
+// replaces the current data, and the listeners are notified of the changes.
+// The updater can return errNoChange to discard the copy without error.
+func (state *state) update(updater func(tx *systemData) error) error {
+	state.lock.Lock()
+
+	tx := state.data.clone()
+	err := updater(tx)
+
+	if err == errNoChange {
+		state.lock.Unlock()
+		return nil
+	} else if err != nil {
+		state.lock.Unlock()
+		return err
+	}
+
+	changes := diffSystemData(state.data, tx)
+	if len(changes) == 0 {
+		state.lock.Unlock()
+		return nil
+	}
+
+	if err := state.save(tx); err != nil {
+		state.lock.Unlock()
+		return err
+	}
+
+	state.data = tx
+	listeners := state.listeners
+	state.lock.Unlock()
+
+	for _, c := range changes {
+		logger.Println("state change:", c)
+		for _, l := range listeners {
+			l(c)
+		}
+	}
+
+	return nil
+}
+
+// view returns a copy of the current data, that can be read without holding the state lock
+func (state *state) view() *systemData {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.data.clone()
+}
+
+// clone returns a deep copy of the data
+func (data *systemData) clone() *systemData {
+	c := *data
+
+	c.Users = make(map[string]string, len(data.Users))
+	for k, v := range data.Users {
+		c.Users[k] = v
+	}
+	c.PartitionConfigs = make(map[string]partitionConfig, len(data.PartitionConfigs))
+	for k, v := range data.PartitionConfigs {
+		c.PartitionConfigs[k] = v
+	}
+	c.ZoneConfigs = make(map[string]zoneConfig, len(data.ZoneConfigs))
+	for k, v := range data.ZoneConfigs {
+		c.ZoneConfigs[k] = v
+	}
+	c.ArmModes = make(map[string]tpi.ArmMode, len(data.ArmModes))
+	for k, v := range data.ArmModes {
+		c.ArmModes[k] = v
+	}
+	c.Troubles = make(map[TroubleType]bool, len(data.Troubles))
+	for k, v := range data.Troubles {
+		c.Troubles[k] = v
+	}
+	c.Temperatures = make(map[string]temperatures, len(data.Temperatures))
+	for k, v := range data.Temperatures {
+		c.Temperatures[k] = v
+	}
+
+	c.Partitions = append([]sites.Partition{}, data.Partitions...)
+	c.Zones = append([]sites.Zone{}, data.Zones...)
+	c.Alarms = append([]sites.Alarm{}, data.Alarms...)
+
+	return &c
+}
+
+// partition finds a partition by id.
+// When called in a transaction, changes to the returned partition are committed with the transaction.
+func (data *systemData) partition(partID string) (*sites.Partition, error) {
+	for i := range data.Partitions {
+		if data.Partitions[i].ID == partID {
+			return &data.Partitions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("partition %v not found", partID)
+}
+
+// zone finds a zone by id.
+// When called in a transaction, changes to the returned zone are committed with the transaction.
+func (data *systemData) zone(zoneID string) (*sites.Zone, error) {
+	for i := range data.Zones {
+		if data.Zones[i].ID == zoneID {
+			return &data.Zones[i], nil
+		}
+	}
+	return nil, fmt.Errorf("zone %v not found", zoneID)
+}
+
+// unrestoredAlarm finds an unrestored alarm by type and partition.
+// When called in a transaction, changes to the returned alarm are committed with the transaction.
+func (data *systemData) unrestoredAlarm(t sites.AlarmType, partID string) (*sites.Alarm, error) {
+	for i, a := range data.Alarms {
+		if a.AlarmType == t && a.PartitionID == partID && a.Restored.IsZero() {
+			return &data.Alarms[i], nil
+		}
+	}
+	return nil, fmt.Errorf("alarm (%v,%v) not found", t, partID)
+}
+
+// bypassedZoneIDs returns the ids of all bypassed zones
+func (data *systemData) bypassedZoneIDs() []string {
+	zoneIDs := make([]string, 0)
+	for _, z := range data.Zones {
+		if z.Bypassed {
+			zoneIDs = append(zoneIDs, z.ID)
+		}
+	}
+	return zoneIDs
+}
+
+// getPartitionConfig returns the config of the partition, falling back to default delays
+func (data *systemData) getPartitionConfig(partID string) partitionConfig {
+	cfg, ok := data.PartitionConfigs[partID]
+	if !ok {
+		cfg = partitionConfig{EntryDelay: defaultEntryDelay, ExitDelay: defaultExitDelay}
+	}
+	return cfg
+}
+
+// getZoneConfig returns the config of the zone. By default, zones are delay zones of the first partition.
+func (data *systemData) getZoneConfig(zoneID string) zoneConfig {
+	cfg, ok := data.ZoneConfigs[zoneID]
+	if !ok {
+		cfg = zoneConfig{PartitionID: defaultPartitionID, Type: zoneTypeDelay}
+	}
+	if cfg.PartitionID == "" {
+		cfg.PartitionID = defaultPartitionID
+	}
+	if cfg.Type == "" {
+		cfg.Type = zoneTypeDelay
+	}
+	return cfg
+}
+
+// partitionZones returns the zones assigned to the partition
+func (data *systemData) partitionZones(partID string) []sites.Zone {
+	zones := make([]sites.Zone, 0)
+	for _, z := range data.Zones {
+		if data.getZoneConfig(z.ID).PartitionID == partID {
+			zones = append(zones, z)
+		}
+	}
+	return zones
+}
+
+// processAlarm records the alarm and, for partition alarms,
+// puts the target zone and partition in alarm state
+func (state *state) processAlarm(a sites.Alarm) error {
+	return state.update(func(tx *systemData) error {
+
+		if _, err := tx.unrestoredAlarm(a.AlarmType, a.PartitionID); err == nil {
+			return fmt.Errorf("alarm already triggered")
+		}
+
+		if a.AlarmType == sites.AlarmTypePartition {
+			part, err := tx.partition(a.PartitionID)
+			if err != nil {
+				return err
+			}
+			zone, err := tx.zone(a.ZoneID)
+			if err != nil {
+				return err
+			}
+
+			part.State = sites.PartitionStateInAlarm
+			part.TroubleStateLED = true
+			zone.State = sites.ZoneStateAlarm
+		}
+
+		tx.Alarms = append(tx.Alarms, a)
+		return nil
+	})
+}
+
+// processAlarmRestore marks the unrestored alarm of the type and partition as restored and,
+// for partition alarms, puts the partition back in ready state and restores the zone.
+// It returns the restored alarm.
+func (state *state) processAlarmRestore(t sites.AlarmType, partID string, restored time.Time) (sites.Alarm, error) {
+	var restoredAlarm sites.Alarm
+
+	err := state.update(func(tx *systemData) error {
+		a, err := tx.unrestoredAlarm(t, partID)
+		if err != nil {
+			return err
+		}
+		a.Restored = restored
+
+		if a.AlarmType == sites.AlarmTypePartition {
+			part, err := tx.partition(a.PartitionID)
+			if err != nil {
+				return err
+			}
+			zone, err := tx.zone(a.ZoneID)
+			if err != nil {
+				return err
+			}
+			part.State = sites.PartitionStateReady
+			part.TroubleStateLED = part.KeypadLEDState != 0 && part.KeypadLEDFlashState != 0
+			delete(tx.ArmModes, part.ID)
+			zone.State = sites.ZoneStateRestore
+		}
+
+		restoredAlarm = *a
+		return nil
+	})
+
+	return restoredAlarm, err
+}
+
+// armPartition puts the partition in armed state, and records the arm mode
+func (state *state) armPartition(partID string, mode tpi.ArmMode) error {
+	return state.update(func(tx *systemData) error {
+		part, err := tx.partition(partID)
+		if err != nil {
+			return err
+		}
+		part.State = sites.PartitionStateArmed
+		tx.ArmModes[partID] = mode
+		return nil
+	})
+}
+
+// disarmPartition puts the partition in the specified disarmed state, and clears its arm mode
+func (state *state) disarmPartition(partID string, partState sites.PartitionState) error {
+	return state.update(func(tx *systemData) error {
+		part, err := tx.partition(partID)
+		if err != nil {
+			return err
+		}
+		part.State = partState
+		delete(tx.ArmModes, partID)
+		return nil
+	})
+}
+
+// toggleZonesBypass flips the bypass flag of the specified zones
+func (state *state) toggleZonesBypass(zoneIDs []string) error {
+	return state.update(func(tx *systemData) error {
+		for _, zoneID := range zoneIDs {
+			zone, err := tx.zone(zoneID)
+			if err != nil {
+				return err
+			}
+			zone.Bypassed = !zone.Bypassed
+		}
+		return nil
+	})
+}
+
+// setPartitionState updates the state of a partition
+func (state *state) setPartitionState(partID string, partState sites.PartitionState) error {
+	return state.update(func(tx *systemData) error {
+		part, err := tx.partition(partID)
+		if err != nil {
+			return err
+		}
+		part.State = partState
+		return nil
+	})
+}
+
+// setZoneState updates the state of a zone
+func (state *state) setZoneState(zoneID string, zoneState sites.ZoneState) error {
+	return state.update(func(tx *systemData) error {
+		zone, err := tx.zone(zoneID)
+		if err != nil {
+			return err
+		}
+		zone.State = zoneState
+		return nil
+	})
+}
+
+// setTrouble marks a system trouble as active or restored
+func (state *state) setTrouble(t TroubleType, active bool) error {
+	return state.update(func(tx *systemData) error {
+		if active {
+			tx.Troubles[t] = true
+		} else {
+			delete(tx.Troubles, t)
+		}
+		return nil
+	})
+}
+
+// setTroubleStatus updates the system trouble status
+func (state *state) setTroubleStatus(status sites.SystemTroubleStatus) error {
+	return state.update(func(tx *systemData) error {
+		tx.TroubleStatus = status
+		return nil
+	})
+}
+
+// setPartitionTroubleLED updates the trouble LED of a partition
+func (state *state) setPartitionTroubleLED(partID string, on bool) error {
+	return state.update(func(tx *systemData) error {
+		part, err := tx.partition(partID)
+		if err != nil {
+			return err
+		}
+		part.TroubleStateLED = on
+		return nil
+	})
+}
+
+// setPartitionKeypadLEDs updates the keypad LED and LED flash states of a partition
+func (state *state) setPartitionKeypadLEDs(partID string, ledState sites.KeypadLEDState, flashState sites.KeypadLEDFlashState) error {
+	return state.update(func(tx *systemData) error {
+		part, err := tx.partition(partID)
+		if err != nil {
+			return err
+		}
+		part.KeypadLEDState = ledState
+		part.KeypadLEDFlashState = flashState
+		return nil
+	})
+}
+
+// setTemperatures records the temperatures reported by a thermostat
+func (state *state) setTemperatures(thermostat string, temps temperatures) error {
+	return state.update(func(tx *systemData) error {
+		tx.Temperatures[thermostat] = temps
+		return nil
+	})
+}
@@ -0,0 +1,220 @@
+package tpimock
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"sec-ctl/pkg/sites"
+	"sec-ctl/pkg/tpi"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func newTestState(t *testing.T) *state {
+	s, err := newStateFromJSON(DefaultPassword, "", DefaultState)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return s
+}
+
+func viewPartition(t *testing.T, s *state, partID string) sites.Partition {
+	part, err := s.view().partition(partID)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return *part
+}
+
+func viewZone(t *testing.T, s *state, zoneID string) sites.Zone {
+	zone, err := s.view().zone(zoneID)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return *zone
+}
+
+func TestStateArmDisarm(t *testing.T) {
+	s := newTestState(t)
+	defer s.close()
+
+	assert.NoError(t, s.armPartition("1", tpi.ArmModeStay))
+	assert.Equal(t, sites.PartitionStateArmed, viewPartition(t, s, "1").State)
+	assert.Equal(t, tpi.ArmModeStay, s.view().ArmModes["1"])
+
+	assert.NoError(t, s.disarmPartition("1", sites.PartitionStateNotReady))
+	assert.Equal(t, sites.PartitionStateNotReady, viewPartition(t, s, "1").State)
+	_, armed := s.view().ArmModes["1"]
+	assert.False(t, armed)
+
+	assert.Error(t, s.armPartition("9", tpi.ArmModeAway))
+}
+
+func TestStateAlarmTriggerAndRestore(t *testing.T) {
+	s := newTestState(t)
+	defer s.close()
+
+	a := sites.Alarm{AlarmType: sites.AlarmTypePartition, PartitionID: "1", ZoneID: "002", Triggered: time.Now()}
+	assert.NoError(t, s.processAlarm(a))
+
+	part := viewPartition(t, s, "1")
+	assert.Equal(t, sites.PartitionStateInAlarm, part.State)
+	assert.True(t, part.TroubleStateLED)
+	assert.Equal(t, sites.ZoneStateAlarm, viewZone(t, s, "002").State)
+	assert.Len(t, s.view().Alarms, 1)
+
+	assert.Error(t, s.processAlarm(a), "duplicate alarm")
+	assert.Len(t, s.view().Alarms, 1)
+
+	restored := time.Now()
+	restoredAlarm, err := s.processAlarmRestore(sites.AlarmTypePartition, "1", restored)
+	assert.NoError(t, err)
+	assert.Equal(t, restored, restoredAlarm.Restored)
+	assert.Equal(t, restored, s.view().Alarms[0].Restored)
+	assert.Equal(t, sites.PartitionStateReady, viewPartition(t, s, "1").State)
+	assert.Equal(t, sites.ZoneStateRestore, viewZone(t, s, "002").State)
+
+	_, err = s.processAlarmRestore(sites.AlarmTypePartition, "1", restored)
+	assert.Error(t, err, "already restored")
+}
+
+func TestStateAlarmCleanup(t *testing.T) {
+	s := newTestState(t)
+	defer s.close()
+
+	assert.NoError(t, s.processAlarm(sites.Alarm{AlarmType: sites.AlarmTypeFire, Triggered: time.Now()}))
+	assert.NoError(t, s.processAlarm(sites.Alarm{AlarmType: sites.AlarmTypePanic, Triggered: time.Now()}))
+	restored := time.Now()
+	_, err := s.processAlarmRestore(sites.AlarmTypeFire, "", restored)
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.cleanupAlarms(restored.Add(eventExpireDelay/2)))
+	assert.Len(t, s.view().Alarms, 2)
+
+	assert.NoError(t, s.cleanupAlarms(restored.Add(eventExpireDelay*2)))
+	alarms := s.view().Alarms
+	assert.Len(t, alarms, 1)
+	assert.Equal(t, sites.AlarmTypePanic, alarms[0].AlarmType)
+}
+
+func TestStateZoneTransitions(t *testing.T) {
+	s := newTestState(t)
+	defer s.close()
+
+	assert.NoError(t, s.setZoneState("001", sites.ZoneStateOpen))
+	assert.Equal(t, sites.ZoneStateOpen, viewZone(t, s, "001").State)
+
+	assert.NoError(t, s.toggleZonesBypass([]string{"001", "003"}))
+	assert.Equal(t, []string{"001", "003"}, s.view().bypassedZoneIDs())
+
+	assert.NoError(t, s.toggleZonesBypass([]string{"003"}))
+	assert.Equal(t, []string{"001"}, s.view().bypassedZoneIDs())
+
+	assert.Error(t, s.setZoneState("099", sites.ZoneStateOpen))
+}
+
+func TestStateTransactionRollback(t *testing.T) {
+	s := newTestState(t)
+	defer s.close()
+
+	// 001 is toggled before 099 fails: the whole update must be discarded
+	assert.Error(t, s.toggleZonesBypass([]string{"001", "099"}))
+	assert.False(t, viewZone(t, s, "001").Bypassed)
+
+	// a partition alarm on an unknown zone must not leave the partition in alarm
+	a := sites.Alarm{AlarmType: sites.AlarmTypePartition, PartitionID: "1", ZoneID: "099", Triggered: time.Now()}
+	assert.Error(t, s.processAlarm(a))
+	assert.Equal(t, sites.PartitionStateReady, viewPartition(t, s, "1").State)
+	assert.Len(t, s.view().Alarms, 0)
+}
+
+func TestStateChangeNotifications(t *testing.T) {
+	s := newTestState(t)
+	defer s.close()
+
+	changes := make([]StateChange, 0)
+	s.onChange(func(c StateChange) { changes = append(changes, c) })
+
+	assert.NoError(t, s.setZoneState("001", sites.ZoneStateOpen))
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, StateEntityZone, changes[0].Entity)
+		assert.Equal(t, "001", changes[0].ID)
+		assert.Equal(t, sites.ZoneStateRestore, changes[0].Before.(sites.Zone).State)
+		assert.Equal(t, sites.ZoneStateOpen, changes[0].After.(sites.Zone).State)
+	}
+
+	// no change, no notification
+	assert.NoError(t, s.setZoneState("001", sites.ZoneStateOpen))
+	assert.Len(t, changes, 1)
+
+	changes = changes[:0]
+	assert.NoError(t, s.armPartition("2", tpi.ArmModeAway))
+	entities := map[StateEntity]bool{}
+	for _, c := range changes {
+		entities[c.Entity] = true
+	}
+	assert.Equal(t, map[StateEntity]bool{StateEntityPartition: true, StateEntityArmMode: true}, entities)
+}
+
+func TestStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tpimock")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	fname := path.Join(dir, "state.json")
+	if !assert.NoError(t, ioutil.WriteFile(fname, DefaultState, 0600)) {
+		t.FailNow()
+	}
+
+	s, err := newState(DefaultPassword, fname)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, s.armPartition("1", tpi.ArmModeAway))
+	assert.NoError(t, s.processAlarm(sites.Alarm{AlarmType: sites.AlarmTypeFire, Triggered: time.Now()}))
+	_, err = s.processAlarmRestore(sites.AlarmTypeFire, "", time.Now())
+	assert.NoError(t, err)
+	s.close()
+
+	reloaded, err := newState(DefaultPassword, fname)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer reloaded.close()
+
+	assert.Equal(t, sites.PartitionStateArmed, viewPartition(t, reloaded, "1").State)
+	assert.Equal(t, tpi.ArmModeAway, reloaded.view().ArmModes["1"])
+	if assert.Len(t, reloaded.view().Alarms, 1) {
+		assert.False(t, reloaded.view().Alarms[0].Restored.IsZero())
+	}
+}
+
+func TestStatusReportReflectsHistory(t *testing.T) {
+	s := newTestState(t)
+	ctrl := newController(s)
+	defer ctrl.close()
+
+	assert.NoError(t, s.armPartition("1", tpi.ArmModeStay))
+	assert.NoError(t, s.toggleZonesBypass([]string{"002"}))
+	assert.NoError(t, ctrl.triggerAlarm(sites.AlarmTypePartition, "2", "004"))
+
+	replies, err := ctrl.processStatusReport(tpi.ClientMessage{Code: tpi.ClientCodeStatusReport})
+	assert.NoError(t, err)
+
+	assert.Contains(t, replies, tpi.ServerMessage{Code: tpi.ServerCodePartitionArmed, Data: []byte("11")})
+	assert.Contains(t, replies, tpi.ServerMessage{Code: tpi.ServerCodePartitionInAlarm, Data: []byte("2")})
+	assert.Contains(t, replies, tpi.ServerMessage{Code: tpi.ServerCodeZoneAlarm, Data: []byte("2004")})
+	assert.Contains(t, replies, tpi.ServerMessage{Code: tpi.ServerCodeBypassedZonesBitfieldDump, Data: []byte("0200000000000000")})
+
+	assert.NoError(t, ctrl.restoreAlarm(sites.AlarmTypePartition, "2"))
+
+	replies, err = ctrl.processStatusReport(tpi.ClientMessage{Code: tpi.ClientCodeStatusReport})
+	assert.NoError(t, err)
+	assert.Contains(t, replies, tpi.ServerMessage{Code: tpi.ServerCodePartitionReady, Data: []byte("2")})
+	assert.Contains(t, replies, tpi.ServerMessage{Code: tpi.ServerCodeZoneRestore, Data: []byte("004")})
+}
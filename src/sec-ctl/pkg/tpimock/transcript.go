@@ -0,0 +1,74 @@
+package tpimock
+
+import (
+	"sync"
+	"time"
+
+	"sec-ctl/pkg/tpi"
+)
+
+// TranscriptEntry is a client message, along with the time it was received
+type TranscriptEntry struct {
+	Time    time.Time
+	Message tpi.ClientMessage
+}
+
+// transcript records the messages sent by the clients
+type transcript struct {
+	lock    *sync.Mutex
+	entries []TranscriptEntry
+	changed chan struct{}
+}
+
+func newTranscript() *transcript {
+	return &transcript{
+		lock:    &sync.Mutex{},
+		entries: make([]TranscriptEntry, 0),
+		changed: make(chan struct{}),
+	}
+}
+
+// record appends the message to the transcript, and wakes up waiters
+func (t *transcript) record(msg tpi.ClientMessage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.entries = append(t.entries, TranscriptEntry{Time: time.Now(), Message: msg})
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// getEntries returns a copy of the recorded entries
+func (t *transcript) getEntries() []TranscriptEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	entries := make([]TranscriptEntry, len(t.entries))
+	copy(entries, t.entries)
+	return entries
+}
+
+// waitFor waits until an entry at or after index `from` matches, and returns its index.
+// It returns -1 if no entry matched before the deadline.
+func (t *transcript) waitFor(from int, deadline time.Time, match func(TranscriptEntry) bool) int {
+	for {
+		t.lock.Lock()
+		for i := from; i < len(t.entries); i++ {
+			if match(t.entries[i]) {
+				t.lock.Unlock()
+				return i
+			}
+		}
+		if len(t.entries) > from {
+			from = len(t.entries)
+		}
+		changed := t.changed
+		t.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-time.After(time.Until(deadline)):
+			return -1
+		}
+	}
+}
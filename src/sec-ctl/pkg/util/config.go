@@ -9,17 +9,32 @@ requirements:
 - handle different configurations for dev, test, prod, staging...
 - store config to strongly typed object
 
+layers, from lowest to highest precedence:
+
+- the defaults of the app
+- the config file: -config, or <App>.json (or .yaml, .yml) in $XDG_CONFIG_HOME/sec-ctl, ~/.config/sec-ctl by default
+- the profile file selected by SecCtl.Profile, eg <App>.prod.json, next to the config file
+- the environment variables SecCtl.<App>.<Field>, eg SecCtl.Local.TPIPort=4025
+- the command-line flags -set <Field>=<value>, eg -set TPIPort=4025
+
+an env var suffixed with _FILE is read from the file it names, eg SecCtl.Local.TPIPassword_FILE=/run/secrets/tpi.
+fields are checked with the tags of configTag, and those tagged secret are redacted when the config is printed.
+
 */
 
 import (
+	"encoding"
 	"encoding/gob"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const envKeyPrefix = "SecCtl."
@@ -28,27 +43,77 @@ type config interface {
 	AppName() string
 }
 
-// LoadConfig loads the supplied configuration object from defaults and environment variables
+// LoadConfig loads the supplied configuration object from defaults, config files, environment variables
+// and command-line flags. The command line is parsed, unless the app did it already.
 func LoadConfig(cfg, defaults config) error {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
 
-	if err := loadConfigFromDefaults(cfg, defaults); err != nil {
+	fnames, err := loadConfig(cfg, defaults, *configFilenameFlag, os.Getenv(profileEnvKey), configSetFlags)
+	if err != nil {
 		return err
 	}
 
-	if err := loadConfigFromEnv(cfg); err != nil {
+	dumpConfig(os.Stdout, cfg, fnames)
+
+	return nil
+}
+
+// ReloadConfig loads cfg again from all the layers, with the command-line flags of the startup,
+// eg once the config file changed. cfg should be a new object, as it is partially loaded on error.
+func ReloadConfig(cfg, defaults config) error {
+	fnames, err := loadConfig(cfg, defaults, *configFilenameFlag, os.Getenv(profileEnvKey), configSetFlags)
+	if err != nil {
 		return err
 	}
 
-	dumpConfig(os.Stdout, cfg)
+	dumpConfig(os.Stdout, cfg, fnames)
 
 	return nil
 }
 
-func dumpConfig(w io.Writer, cfg config) {
+// loadConfig loads cfg from all the layers, and returns the config files it loaded
+func loadConfig(cfg, defaults config, explicitFilename string, profile string, sets []string) ([]string, error) {
 
-	w.Write([]byte("Loaded config:\n  "))
+	if err := loadConfigFromDefaults(cfg, defaults); err != nil {
+		return nil, err
+	}
 
-	if dat, err := json.MarshalIndent(cfg, "  ", "  "); err != nil {
+	fnames, err := configFiles(cfg.AppName(), explicitFilename, profile)
+	if err != nil {
+		return nil, err
+	}
+	for _, fname := range fnames {
+		if err := loadConfigFromFile(cfg, fname); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := loadConfigFromEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := loadConfigFromFlags(cfg, sets); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return fnames, nil
+}
+
+func dumpConfig(w io.Writer, cfg config, fnames []string) {
+
+	if len(fnames) > 0 {
+		fmt.Fprintf(w, "Loaded config from %v:\n  ", strings.Join(fnames, ", "))
+	} else {
+		w.Write([]byte("Loaded config:\n  "))
+	}
+
+	if dat, err := json.MarshalIndent(redactedConfig(cfg), "  ", "  "); err != nil {
 		panic(err)
 	} else if _, err := w.Write(dat); err != nil {
 		panic(err)
@@ -80,13 +145,28 @@ func deepCopy(dst, src interface{}) error {
 	return dec.Decode(dst)
 }
 
+// fileEnvKeySuffix marks an env var holding the path of a file with the value, eg a docker secret
+const fileEnvKeySuffix = "_FILE"
+
 func loadConfigFromEnv(cfg config) error {
 	env := env2map()
 	pfx := envKeyPrefix + cfg.AppName() + "."
 
 	for k, v := range env {
 		if strings.HasPrefix(k, pfx) {
-			keyPath := strings.Split(k[len(pfx):], ".")
+			key := k[len(pfx):]
+			if strings.HasSuffix(key, fileEnvKeySuffix) {
+				key = strings.TrimSuffix(key, fileEnvKeySuffix)
+				if _, ok := env[pfx+key]; ok {
+					return fmt.Errorf("Both %v and %v are set", pfx+key, k)
+				}
+				var err error
+				if v, err = readSecretFile(v); err != nil {
+					return fmt.Errorf("Unable to read %v: %v", k, err)
+				}
+			}
+
+			keyPath := strings.Split(key, ".")
 			if err := loadEnvVar(cfg, keyPath, v); err != nil {
 				return err
 			}
@@ -96,12 +176,36 @@ func loadConfigFromEnv(cfg config) error {
 	return nil
 }
 
+// readSecretFile returns the content of the file, without the trailing newline editors add
+func readSecretFile(fname string) (string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// loadConfigFromFlags applies the -set key=value flags, whose keys are env key paths without the prefix
+func loadConfigFromFlags(cfg config, sets []string) error {
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Invalid -set %v: expected key=value", set)
+		}
+		if err := loadEnvVar(cfg, strings.Split(kv[0], "."), kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func env2map() map[string]string {
 
 	env := map[string]string{}
 
 	for _, e := range os.Environ() {
-		kv := strings.Split(e, "=")
+		// values may hold '=', eg base64 tokens
+		kv := strings.SplitN(e, "=", 2)
 		k := kv[0]
 		v := kv[1]
 		env[k] = v
@@ -132,16 +236,89 @@ func loadEnvVar(dstPtr interface{}, keyPath []string, val string) error {
 	}
 
 	// last step is to convert val from string to destination type
-	converted, err := parseVal(val, fldVal.Type().Kind())
+	converted, err := parseValue(val, fldVal.Type())
 	if err != nil {
-		return err
+		return fmt.Errorf("Invalid value for key path %v: %v", keyPath, err)
 	}
 
-	fldVal.Set(reflect.ValueOf(converted))
+	fldVal.Set(converted)
 
 	return nil
 }
 
+var durationType = reflect.TypeOf(time.Duration(0))
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// parseValue converts val to typ. On top of the kinds of parseVal, it handles durations (eg 30s),
+// encoding.TextUnmarshaler types, comma-separated slices (eg a,b,c) and maps (eg a=1,b=2).
+func parseValue(val string, typ reflect.Type) (reflect.Value, error) {
+
+	if reflect.PtrTo(typ).Implements(textUnmarshalerType) {
+		ptr := reflect.New(typ)
+		if err := ptr.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(val)); err != nil {
+			return reflect.Value{}, err
+		}
+		return ptr.Elem(), nil
+	}
+
+	switch {
+	case typ == durationType:
+		d, err := time.ParseDuration(val)
+		return reflect.ValueOf(d), err
+
+	case typ.Kind() == reflect.Slice:
+		items := splitList(val)
+		slice := reflect.MakeSlice(typ, len(items), len(items))
+		for i, item := range items {
+			v, err := parseValue(item, typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			slice.Index(i).Set(v)
+		}
+		return slice, nil
+
+	case typ.Kind() == reflect.Map:
+		m := reflect.MakeMap(typ)
+		for _, item := range splitList(val) {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				return reflect.Value{}, fmt.Errorf("Expected key=value, got %v", item)
+			}
+			k, err := parseValue(strings.TrimSpace(kv[0]), typ.Key())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v, err := parseValue(strings.TrimSpace(kv[1]), typ.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			m.SetMapIndex(k, v)
+		}
+		return m, nil
+
+	default:
+		converted, err := parseVal(val, typ.Kind())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		// named types, eg type Level string
+		return reflect.ValueOf(converted).Convert(typ), nil
+	}
+}
+
+// splitList splits the comma-separated val, the empty string being the empty list
+func splitList(val string) []string {
+	if strings.TrimSpace(val) == "" {
+		return nil
+	}
+	items := strings.Split(val, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
 func parseVal(val string, kind reflect.Kind) (interface{}, error) {
 	switch kind {
 	case reflect.String:
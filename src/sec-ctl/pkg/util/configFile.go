@@ -0,0 +1,381 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const configDirName = "sec-ctl"
+
+// profileEnvKey is the env var selecting the profile, eg dev, test or prod
+const profileEnvKey = envKeyPrefix + "Profile"
+
+// configExts are the supported config file extensions, in lookup order
+var configExts = []string{".json", ".yaml", ".yml"}
+
+var configFilenameFlag = flag.String("config", "", "path of the config file, instead of the one in the user config dir")
+var configSetFlags keyValueFlags
+
+func init() {
+	flag.Var(&configSetFlags, "set", "override a config value, eg -set TPIPort=4025. Can be repeated")
+}
+
+// keyValueFlags collects the repeated -set flags
+type keyValueFlags []string
+
+func (f *keyValueFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *keyValueFlags) Set(val string) error {
+	if !strings.Contains(val, "=") {
+		return fmt.Errorf("expected key=value, got %q", val)
+	}
+	*f = append(*f, val)
+	return nil
+}
+
+// GetDefaultConfigFilename returns the path of the config file of the app in the XDG config dir,
+// eg ~/.config/sec-ctl/Local.json. An existing yaml file is preferred to a missing json one.
+func GetDefaultConfigFilename(appName string) (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+
+	if fname, err := findConfigFile(dir, appName); err != nil {
+		return "", err
+	} else if fname != "" {
+		return fname, nil
+	}
+	return filepath.Join(dir, appName+configExts[0]), nil
+}
+
+// ConfigFilename returns the config file of the app: the one given with -config, or the default one
+func ConfigFilename(appName string) (string, error) {
+	if *configFilenameFlag != "" {
+		return *configFilenameFlag, nil
+	}
+	return GetDefaultConfigFilename(appName)
+}
+
+// WatchedConfigFiles returns the config files of the app to watch for changes: the config file,
+// even if it does not exist yet, and the profile file, if any
+func WatchedConfigFiles(appName string) ([]string, error) {
+	fname, err := ConfigFilename(appName)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded, err := configFiles(appName, *configFilenameFlag, os.Getenv(profileEnvKey))
+	if err != nil {
+		return nil, err
+	}
+
+	fnames := []string{fname}
+	for _, f := range loaded {
+		if f != fname {
+			fnames = append(fnames, f)
+		}
+	}
+	return fnames, nil
+}
+
+func configDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, configDirName), nil
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", fmt.Errorf("unable to find the config dir: neither XDG_CONFIG_HOME nor HOME is set")
+	}
+	return filepath.Join(home, ".config", configDirName), nil
+}
+
+// findConfigFile returns the first existing file of dir named base with a supported extension, or ""
+func findConfigFile(dir string, base string) (string, error) {
+	for _, ext := range configExts {
+		fname := filepath.Join(dir, base+ext)
+		if _, err := os.Stat(fname); err == nil {
+			return fname, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// configFiles returns the config files to load, in order: the main file, then the profile file.
+// The main file is optional, unless given explicitly, while the file of a selected profile is required.
+func configFiles(appName string, explicitFilename string, profile string) ([]string, error) {
+	var fname string
+	if explicitFilename != "" {
+		if _, err := os.Stat(explicitFilename); err != nil {
+			return nil, err
+		}
+		fname = explicitFilename
+	} else {
+		dflt, err := GetDefaultConfigFilename(appName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(dflt); err == nil {
+			fname = dflt
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	var fnames []string
+	if fname != "" {
+		fnames = append(fnames, fname)
+	}
+
+	if profile != "" {
+		var dir, base string
+		if explicitFilename != "" {
+			dir = filepath.Dir(explicitFilename)
+			base = strings.TrimSuffix(filepath.Base(explicitFilename), filepath.Ext(explicitFilename))
+		} else {
+			var err error
+			if dir, err = configDir(); err != nil {
+				return nil, err
+			}
+			base = appName
+		}
+
+		profileFname, err := findConfigFile(dir, base+"."+profile)
+		if err != nil {
+			return nil, err
+		} else if profileFname == "" {
+			return nil, fmt.Errorf("no config file for profile %v: expected %v",
+				profile, filepath.Join(dir, base+"."+profile+configExts[0]))
+		}
+		fnames = append(fnames, profileFname)
+	}
+
+	return fnames, nil
+}
+
+// loadConfigFromFile overrides the fields of cfg present in the file. Unknown fields are rejected
+// by parseFileDurations.
+func loadConfigFromFile(cfg config, fname string) error {
+	data, err := readConfigFileAsJSON(fname)
+	if err != nil {
+		return err
+	} else if data == nil {
+		return nil
+	}
+
+	// durations are written as strings, eg "30s", which json does not decode
+	var obj interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", fname, err)
+	}
+	if obj, err = parseFileDurations(obj, reflect.TypeOf(cfg).Elem()); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", fname, err)
+	}
+	if data, err = json.Marshal(obj); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", fname, err)
+	}
+	return nil
+}
+
+// parseFileDurations replaces the duration strings in obj, as decoded from json, by their value
+// in nanoseconds, following the fields of typ. It rejects the keys matching no field.
+func parseFileDurations(obj interface{}, typ reflect.Type) (interface{}, error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch o := obj.(type) {
+	case string:
+		if typ == durationType {
+			d, err := time.ParseDuration(o)
+			if err != nil {
+				return nil, err
+			}
+			return int64(d), nil
+		}
+	case []interface{}:
+		if typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+			for i := range o {
+				v, err := parseFileDurations(o[i], typ.Elem())
+				if err != nil {
+					return nil, err
+				}
+				o[i] = v
+			}
+		}
+	case map[string]interface{}:
+		for k := range o {
+			var fldType reflect.Type
+			if typ.Kind() == reflect.Map {
+				fldType = typ.Elem()
+			} else if typ.Kind() == reflect.Struct && !isOpaque(typ) {
+				f, ok := fileField(typ, k)
+				if !ok {
+					return nil, fmt.Errorf("unknown field %q", k)
+				}
+				fldType = f.Type
+			}
+			if fldType == nil {
+				continue
+			}
+			v, err := parseFileDurations(o[k], fldType)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", k, err)
+			}
+			o[k] = v
+		}
+	}
+	return obj, nil
+}
+
+// fileField returns the field of typ which json decodes the key to: by its json tag, or its name
+// regardless of case
+func fileField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" && strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	f, ok := typ.FieldByNameFunc(func(name string) bool { return strings.EqualFold(name, key) })
+	if !ok || f.PkgPath != "" || f.Tag.Get("json") == "-" {
+		return reflect.StructField{}, false
+	}
+	return f, true
+}
+
+// readConfigFileAsJSON reads the json or yaml file, and returns it as json, or nil if empty
+func readConfigFileAsJSON(fname string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	if !isYAML(fname) {
+		return data, nil
+	}
+
+	var obj interface{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid config file %v: %v", fname, err)
+	}
+	return json.Marshal(yamlToJSON(obj))
+}
+
+func isYAML(fname string) bool {
+	ext := strings.ToLower(filepath.Ext(fname))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// yamlToJSON converts the maps decoded by yaml, which have interface{} keys, to maps encodable as json
+func yamlToJSON(obj interface{}) interface{} {
+	switch o := obj.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(o))
+		for k, v := range o {
+			m[fmt.Sprint(k)] = yamlToJSON(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range o {
+			o[i] = yamlToJSON(v)
+		}
+		return o
+	default:
+		return o
+	}
+}
+
+// UpdateConfigFile sets the top-level values in the json or yaml config file, keeping its other values.
+// The file and its directory are created if missing. The file is rewritten in place, rather than
+// replaced, so that it may be a docker volume.
+func UpdateConfigFile(fname string, values map[string]interface{}) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if isYAML(fname) {
+		data, err = updateYAML(data, values)
+	} else {
+		data, err = updateJSON(data, values)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to update config file %v: %v", fname, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return err
+	}
+	// the config may hold secrets: only the user may read a new file
+	return ioutil.WriteFile(fname, data, 0600)
+}
+
+func updateJSON(data []byte, values map[string]interface{}) ([]byte, error) {
+	obj := map[string]interface{}{}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range values {
+		obj[k] = v
+	}
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func updateYAML(data []byte, values map[string]interface{}) ([]byte, error) {
+	// a MapSlice keeps the order of the existing keys
+	var obj yaml.MapSlice
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		found := false
+		for i := range obj {
+			if fmt.Sprint(obj[i].Key) == k {
+				obj[i].Value = values[k]
+				found = true
+			}
+		}
+		if !found {
+			obj = append(obj, yaml.MapItem{Key: k, Value: values[k]})
+		}
+	}
+	return yaml.Marshal(obj)
+}
@@ -0,0 +1,320 @@
+package util
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configTag is the struct tag of config fields, with comma-separated options:
+//
+//	secret       the value is redacted when the config is printed
+//	required     the value must not be zero
+//	min=N,max=N  bounds of numbers and durations, or of the length of strings, slices and maps
+//	oneof=a b c  the value must be one of the space-separated values
+//
+// eg `config:"required,min=1"`, `config:"secret"`, `config:"oneof=debug info warn"`
+const configTag = "config"
+
+const redacted = "[redacted]"
+
+// FieldError is an invalid config field
+type FieldError struct {
+	// Field is the key path of the field, eg ST1.I1
+	Field string
+	Msg   string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + " " + e.Msg
+}
+
+// ValidationErrors lists all the invalid fields of a config
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return "Invalid config: " + strings.Join(msgs, "; ")
+}
+
+// ValidateConfig checks the fields of cfg against their tags, and returns all the invalid ones
+// as ValidationErrors, or nil
+func ValidateConfig(cfg config) error {
+	var errs ValidationErrors
+	validateValue(reflect.ValueOf(cfg).Elem(), "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateValue(v reflect.Value, path string, errs *ValidationErrors) {
+	switch v.Kind() {
+	case reflect.Struct:
+		if isOpaque(v.Type()) {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			fldPath := joinKeyPath(path, f.Name)
+			validateField(v.Field(i), fldPath, f.Tag.Get(configTag), errs)
+			validateValue(v.Field(i), fldPath, errs)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), fmt.Sprintf("%v[%d]", path, i), errs)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			validateValue(v.MapIndex(k), fmt.Sprintf("%v[%v]", path, k), errs)
+		}
+	}
+}
+
+func validateField(v reflect.Value, path string, tag string, errs *ValidationErrors) {
+	if tag == "" {
+		return
+	}
+
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Field: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	for _, opt := range strings.Split(tag, ",") {
+		name, arg := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			name, arg = opt[:i], opt[i+1:]
+		}
+
+		switch name {
+		case "secret":
+		case "required":
+			if isZero(v) {
+				fail("is required")
+			}
+		case "min", "max":
+			cmp, err := compareBound(v, arg)
+			if err != nil {
+				fail("has an invalid %v tag: %v", name, err)
+			} else if name == "min" && cmp < 0 {
+				fail("must be at least %v, got %v", arg, describeValue(v))
+			} else if name == "max" && cmp > 0 {
+				fail("must be at most %v, got %v", arg, describeValue(v))
+			}
+		case "oneof":
+			choices := strings.Fields(arg)
+			val := fmt.Sprint(v.Interface())
+			found := false
+			for _, c := range choices {
+				found = found || c == val
+			}
+			if !found {
+				fail("must be one of %v, got %q", strings.Join(choices, ", "), val)
+			}
+		default:
+			fail("has an unknown %v option %q", configTag, name)
+		}
+	}
+}
+
+// compareBound returns -1, 0 or 1 as the value, or its length, is lower, equal or greater than bound
+func compareBound(v reflect.Value, bound string) (int, error) {
+	if v.Type() == durationType {
+		b, err := time.ParseDuration(bound)
+		if err != nil {
+			return 0, err
+		}
+		return compareInts(v.Int(), int64(b)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b, err := strconv.ParseInt(bound, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return compareInts(v.Int(), b), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b, err := strconv.ParseUint(bound, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case v.Uint() < b:
+			return -1, nil
+		case v.Uint() > b:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		b, err := strconv.ParseFloat(bound, 64)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case v.Float() < b:
+			return -1, nil
+		case v.Float() > b:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	case reflect.String, reflect.Slice, reflect.Map:
+		b, err := strconv.ParseInt(bound, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return compareInts(int64(v.Len()), b), nil
+	default:
+		return 0, fmt.Errorf("unsupported kind %v", v.Kind())
+	}
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func describeValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return fmt.Sprintf("length %d", v.Len())
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+func joinKeyPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// isZero returns whether v is the zero value of its type
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// isOpaque tells whether the struct type encodes itself, like time.Time, rather than field by field
+func isOpaque(typ reflect.Type) bool {
+	return typ.Implements(jsonMarshalerType) || typ.Implements(textMarshalerType) ||
+		reflect.PtrTo(typ).Implements(textUnmarshalerType)
+}
+
+// redactedConfig returns cfg as it is printed: in field order, with the secret fields redacted
+// and the durations readable
+func redactedConfig(cfg config) interface{} {
+	return redactValue(reflect.ValueOf(cfg).Elem(), false)
+}
+
+func redactValue(v reflect.Value, secret bool) interface{} {
+	if secret {
+		if isZero(v) {
+			return v.Interface()
+		}
+		return redacted
+	}
+
+	if v.Type() == durationType {
+		return v.Interface().(time.Duration).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if isOpaque(v.Type()) {
+			return v.Interface()
+		}
+		var fields orderedFields
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			isSecret := hasTagOption(f.Tag.Get(configTag), "secret")
+			fields = append(fields, orderedField{f.Name, redactValue(v.Field(i), isSecret)})
+		}
+		return fields
+	case reflect.Slice:
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = redactValue(v.Index(i), false)
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return v.Interface()
+		}
+		m := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			m[fmt.Sprint(k.Interface())] = redactValue(v.MapIndex(k), false)
+		}
+		return m
+	default:
+		return v.Interface()
+	}
+}
+
+func hasTagOption(tag string, name string) bool {
+	for _, opt := range strings.Split(tag, ",") {
+		if opt == name || strings.HasPrefix(opt, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+type orderedField struct {
+	key string
+	val interface{}
+}
+
+// orderedFields encodes to a json object with the keys in order, unlike a map
+type orderedFields []orderedField
+
+func (fields orderedFields) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(f.val)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -1,10 +1,15 @@
 package util
 
 import (
+	"bytes"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/vincentcr/testify/assert"
 )
@@ -295,3 +300,316 @@ func TestParseValRejectsInvalid(t *testing.T) {
 	}
 
 }
+
+// withConfigDir points XDG_CONFIG_HOME to a temp dir, and returns the sec-ctl config dir in it,
+// and a func restoring XDG_CONFIG_HOME and removing the temp dir
+func withConfigDir(t *testing.T) (string, func()) {
+	home, err := ioutil.TempDir("", "conftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := os.Getenv("XDG_CONFIG_HOME")
+	os.Setenv("XDG_CONFIG_HOME", home)
+	cleanup := func() {
+		os.Setenv("XDG_CONFIG_HOME", prev)
+		os.RemoveAll(home)
+	}
+
+	dir := filepath.Join(home, configDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return dir, cleanup
+}
+
+func writeFile(t *testing.T, fname string, data string) {
+	if err := ioutil.WriteFile(fname, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetDefaultConfigFilename(t *testing.T) {
+	dir, cleanup := withConfigDir(t)
+	defer cleanup()
+
+	fname, err := GetDefaultConfigFilename("Local")
+	if err != nil {
+		t.Fatalf("GetDefaultConfigFilename errored out: %v", err)
+	}
+	assert.Equal(t, filepath.Join(dir, "Local.json"), fname)
+
+	writeFile(t, filepath.Join(dir, "Local.yml"), "SiteID: abc\n")
+	fname, err = GetDefaultConfigFilename("Local")
+	if err != nil {
+		t.Fatalf("GetDefaultConfigFilename errored out: %v", err)
+	}
+	assert.Equal(t, filepath.Join(dir, "Local.yml"), fname)
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	clearEnv()
+	dir, cleanup := withConfigDir(t)
+	defer cleanup()
+	defaults := mkSimple()
+	cfg := confTestSimple{}
+
+	writeFile(t, filepath.Join(dir, "ConfTestSimple.json"), `{"I1": 2, "S1": "file", "S2": "file", "F2": 1.5}`)
+	writeFile(t, filepath.Join(dir, "ConfTestSimple.prod.yaml"), "s1: profile\ni1: 3\n")
+	os.Setenv(envKeyPrefix+"ConfTestSimple.I1", "4")
+
+	fnames, err := loadConfig(&cfg, &defaults, "", "prod", []string{"F2=2.5"})
+	if err != nil {
+		t.Fatalf("loadConfig errored out: %v", err)
+	}
+
+	assert.Equal(t, []string{filepath.Join(dir, "ConfTestSimple.json"), filepath.Join(dir, "ConfTestSimple.prod.yaml")}, fnames)
+	assert.Equal(t, confTestSimple{I1: 4, S1: "profile", S2: "file", F1: 123.0, F2: 2.5}, cfg)
+}
+
+func TestLoadConfigExplicitFile(t *testing.T) {
+	clearEnv()
+	dir, cleanup := withConfigDir(t)
+	defer cleanup()
+	defaults := mkComplex()
+	cfg := confTestComplex{}
+
+	// the default file is ignored when one is given
+	writeFile(t, filepath.Join(dir, "ConfTestComplex.json"), `{"I1": 2}`)
+	fname := filepath.Join(dir, "other.yaml")
+	writeFile(t, fname, "S1: other\nST1:\n  S2: nested\nA3: [a, b]\n")
+	writeFile(t, filepath.Join(dir, "other.dev.json"), `{"S1": "dev"}`)
+
+	if _, err := loadConfig(&cfg, &defaults, fname, "dev", []string{"ST1.I1=7"}); err != nil {
+		t.Fatalf("loadConfig errored out: %v", err)
+	}
+
+	defaults.S1 = "dev"
+	defaults.ST1.S2 = "nested"
+	defaults.ST1.I1 = 7
+	defaults.A3 = []string{"a", "b"}
+	assert.Equal(t, defaults, cfg)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	clearEnv()
+	dir, cleanup := withConfigDir(t)
+	defer cleanup()
+	defaults := mkSimple()
+
+	type testCase struct {
+		name     string
+		file     string
+		explicit string
+		profile  string
+		sets     []string
+		expected string
+	}
+
+	testCases := []testCase{
+		testCase{name: "missing explicit file", explicit: filepath.Join(dir, "missing.json"), expected: "missing.json"},
+		testCase{name: "missing profile", profile: "staging", expected: "ConfTestSimple.staging.json"},
+		testCase{name: "unknown field", file: `{"FOO": 1}`, expected: "FOO"},
+		testCase{name: "invalid json", file: `{"I1": `, expected: "ConfTestSimple.json"},
+		testCase{name: "invalid flag key", sets: []string{"FOO=1"}, expected: "FOO"},
+		testCase{name: "invalid flag value", sets: []string{"I1=abc"}, expected: "abc"},
+	}
+
+	for _, tc := range testCases {
+		os.Remove(filepath.Join(dir, "ConfTestSimple.json"))
+		if tc.file != "" {
+			writeFile(t, filepath.Join(dir, "ConfTestSimple.json"), tc.file)
+		}
+
+		cfg := confTestSimple{}
+		_, err := loadConfig(&cfg, &defaults, tc.explicit, tc.profile, tc.sets)
+		if err == nil {
+			t.Fatalf("%v: expected loadConfig to fail", tc.name)
+		} else if !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%v: expected loadConfig error to contain %q: instead got: %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestUpdateConfigFile(t *testing.T) {
+	dir, cleanup := withConfigDir(t)
+	defer cleanup()
+
+	// a new file is created
+	fname := filepath.Join(dir, "sub", "Local.json")
+	if err := UpdateConfigFile(fname, map[string]interface{}{"SiteID": "abc"}); err != nil {
+		t.Fatalf("UpdateConfigFile errored out: %v", err)
+	}
+	data, _ := ioutil.ReadFile(fname)
+	assert.JSONEq(t, `{"SiteID": "abc"}`, string(data))
+
+	// the other values of an existing file are kept
+	writeFile(t, fname, `{"TPIHost": "mock", "SiteID": "old"}`)
+	if err := UpdateConfigFile(fname, map[string]interface{}{"SiteID": "abc", "CloudToken": "tok"}); err != nil {
+		t.Fatalf("UpdateConfigFile errored out: %v", err)
+	}
+	data, _ = ioutil.ReadFile(fname)
+	assert.JSONEq(t, `{"TPIHost": "mock", "SiteID": "abc", "CloudToken": "tok"}`, string(data))
+
+	// so are the order and values of a yaml file
+	fname = filepath.Join(dir, "Local.yaml")
+	writeFile(t, fname, "TPIHost: mock\nSiteID: old\nTPIPort: 4025\n")
+	if err := UpdateConfigFile(fname, map[string]interface{}{"SiteID": "abc", "CloudToken": "tok"}); err != nil {
+		t.Fatalf("UpdateConfigFile errored out: %v", err)
+	}
+	data, _ = ioutil.ReadFile(fname)
+	assert.Equal(t, "TPIHost: mock\nSiteID: abc\nTPIPort: 4025\nCloudToken: tok\n", string(data))
+}
+
+type confTestLevel string
+
+type confTestTagged struct {
+	Host     string        `config:"required"`
+	Port     uint16        `config:"min=1,max=9999"`
+	Password string        `config:"secret,required"`
+	Token    string        `config:"secret"`
+	Level    confTestLevel `config:"oneof=debug info"`
+	Timeout  time.Duration `config:"min=1s,max=1m"`
+	Tags     []string      `config:"max=2"`
+	Limits   map[string]int
+	Addr     net.IP
+	Nested   struct {
+		Ratio float64 `config:"min=0,max=1"`
+	}
+}
+
+func (cfg *confTestTagged) AppName() string {
+	return testKeyPfx + "Tagged"
+}
+
+func mkTagged() confTestTagged {
+	return confTestTagged{Host: "localhost", Port: 80, Password: "pass", Level: "info", Timeout: 10 * time.Second}
+}
+
+func TestLoadConfigRicherTypes(t *testing.T) {
+	clearEnv()
+	dir, cleanup := withConfigDir(t)
+	defer cleanup()
+	defaults := mkTagged()
+	cfg := confTestTagged{}
+
+	writeFile(t, filepath.Join(dir, "ConfTestTagged.yaml"), "timeout: 20s\nlimits:\n  a: 1\n")
+	os.Setenv(envKeyPrefix+"ConfTestTagged.Tags", "a, b")
+	os.Setenv(envKeyPrefix+"ConfTestTagged.Level", "debug")
+	os.Setenv(envKeyPrefix+"ConfTestTagged.Addr", "10.0.0.1")
+
+	if _, err := loadConfig(&cfg, &defaults, "", "", []string{"Limits=b=2,c=3"}); err != nil {
+		t.Fatalf("loadConfig errored out: %v", err)
+	}
+
+	expected := mkTagged()
+	expected.Timeout = 20 * time.Second
+	expected.Tags = []string{"a", "b"}
+	expected.Level = "debug"
+	expected.Addr = net.ParseIP("10.0.0.1")
+	expected.Limits = map[string]int{"b": 2, "c": 3}
+	assert.Equal(t, expected, cfg)
+}
+
+func TestLoadConfigFromSecretFile(t *testing.T) {
+	clearEnv()
+	dir, cleanup := withConfigDir(t)
+	defer cleanup()
+	defaults := mkTagged()
+	cfg := confTestTagged{}
+
+	fname := filepath.Join(dir, "password")
+	writeFile(t, fname, "s3cret\n")
+	os.Setenv(envKeyPrefix+"ConfTestTagged.Password_FILE", fname)
+
+	if _, err := loadConfig(&cfg, &defaults, "", "", nil); err != nil {
+		t.Fatalf("loadConfig errored out: %v", err)
+	}
+	assert.Equal(t, "s3cret", cfg.Password)
+
+	// the value cannot be set twice
+	os.Setenv(envKeyPrefix+"ConfTestTagged.Password", "other")
+	if _, err := loadConfig(&cfg, &defaults, "", "", nil); err == nil {
+		t.Fatalf("Expected loadConfig to fail with both Password and Password_FILE")
+	}
+}
+
+func TestValidateConfigAggregatesErrors(t *testing.T) {
+	cfg := mkTagged()
+	cfg.Host = ""
+	cfg.Port = 0
+	cfg.Level = "trace"
+	cfg.Timeout = time.Hour
+	cfg.Tags = []string{"a", "b", "c"}
+	cfg.Nested.Ratio = 1.5
+
+	err := ValidateConfig(&cfg)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	assert.Equal(t, []string{"Host", "Port", "Level", "Timeout", "Tags", "Nested.Ratio"}, fields)
+	assert.Contains(t, err.Error(), "Level must be one of debug, info")
+
+	assert.Nil(t, ValidateConfig(&confTestSimple{}))
+	valid := mkTagged()
+	assert.Nil(t, ValidateConfig(&valid))
+}
+
+func TestDumpConfigRedactsSecrets(t *testing.T) {
+	cfg := mkTagged()
+	cfg.Token = ""
+
+	var buf bytes.Buffer
+	dumpConfig(&buf, &cfg, nil)
+	out := buf.String()
+
+	assert.NotContains(t, out, "pass")
+	assert.Contains(t, out, `"Password": "[redacted]"`)
+	// empty secrets are shown as such, so that a missing one is obvious
+	assert.Contains(t, out, `"Token": ""`)
+	assert.Contains(t, out, `"Timeout": "10s"`)
+	// fields keep their order
+	assert.True(t, strings.Index(out, "Host") < strings.Index(out, "Port"))
+}
+
+func TestParseValue(t *testing.T) {
+	type testCase struct {
+		expected interface{}
+		input    string
+	}
+
+	testCases := []testCase{
+		testCase{"abc", "abc"},
+		testCase{uint16(4025), "4025"},
+		testCase{confTestLevel("info"), "info"},
+		testCase{90 * time.Second, "1m30s"},
+		testCase{[]int{1, -2, 3}, "1,-2, 3"},
+		testCase{[]string{}, ""},
+		testCase{[]time.Duration{time.Second, time.Minute}, "1s,1m"},
+		testCase{map[string]uint8{"a": 1, "b": 2}, "a=1,b=2"},
+		testCase{net.ParseIP("::1"), "::1"},
+	}
+
+	for _, tc := range testCases {
+		v, err := parseValue(tc.input, reflect.TypeOf(tc.expected))
+		if err != nil {
+			t.Fatalf("parseValue failed for %q: %v", tc.input, err)
+		}
+		assert.Equal(t, tc.expected, v.Interface(), "parseValue(%q)", tc.input)
+	}
+
+	for _, input := range []string{"10", "a=1,b", "a=x"} {
+		if _, err := parseValue(input, reflect.TypeOf(map[string]int{})); err == nil {
+			t.Fatalf("Expected parseValue to fail on %q", input)
+		}
+	}
+	if _, err := parseValue("10", durationType); err == nil {
+		t.Fatalf("Expected parseValue to fail on a duration without unit")
+	}
+}
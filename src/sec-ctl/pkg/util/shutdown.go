@@ -0,0 +1,88 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// WithSignals returns a context done when one of the signals is received, or stop is called.
+// The signals are only caught once: a second one, eg ctrl-c while shutting down, is not.
+func WithSignals(ctx context.Context, sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, stop := context.WithCancel(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+		stop()
+	}()
+	return ctx, stop
+}
+
+// WithShutdownDeadline returns a context done timeout after ctx is, which bounds the graceful
+// shutdown that starts when ctx is done
+func WithShutdownDeadline(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	deadline, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-deadline.Done():
+			return
+		}
+		select {
+		case <-time.After(timeout):
+			cancel()
+		case <-deadline.Done():
+		}
+	}()
+	return deadline, cancel
+}
+
+// ListenAndServe serves handler on addr until ctx is done, then shuts the server down,
+// waiting until deadline is done for the active requests to complete. The context of the
+// requests is done with ctx, so that long-lived requests, like event streams, end.
+func ListenAndServe(ctx context.Context, deadline context.Context, addr string, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: withContext(ctx, handler),
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	if err := srv.Shutdown(deadline); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+// withContext returns a handler whose requests have a context also done when ctx is
+func withContext(ctx context.Context, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-reqCtx.Done():
+			}
+		}()
+		handler.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+func TestWithSignals(t *testing.T) {
+	ctx, stop := WithSignals(context.Background(), syscall.SIGUSR1)
+	defer stop()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done on signal")
+	}
+}
+
+func TestRequestsAreDoneWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	srv := httptest.NewServer(withContext(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a long-lived request, like an event stream
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(done)
+	})))
+	defer srv.Close()
+
+	rsp, err := http.Get(srv.URL)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request context not done with ctx")
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"encoding/gob"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"sec-ctl/pkg/sites"
 
@@ -23,27 +27,51 @@ func init() {
 	gob.Register(sites.Alarm{})
 }
 
+// Heartbeat configures the pings of a connection, which detect a dead peer, and measure the latency.
+// A zero Interval disables them.
+type Heartbeat struct {
+	// Interval is the delay between pings
+	Interval time.Duration
+	// Timeout is how long the peer may take to answer a ping, or to accept a write. The connection is dead
+	// once no ping was answered for Interval + Timeout.
+	Timeout time.Duration
+}
+
 // Conn is a wrapper type of the websocket connection
 type Conn struct {
-	ws *websocket.Conn
+	ws        *websocket.Conn
+	heartbeat Heartbeat
+
+	lock       sync.Mutex
+	pingSentAt time.Time
+	latency    time.Duration
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(ws *websocket.Conn, heartbeat Heartbeat) *Conn {
+	conn := &Conn{ws: ws, heartbeat: heartbeat, closed: make(chan struct{})}
+	conn.startHeartbeat()
+	return conn
 }
 
 // Dial opens a connection to the specified server, using the specified auth token
-func Dial(url string, token string) (*Conn, error) {
+func Dial(url string, token string, heartbeat Heartbeat) (*Conn, error) {
 	var dialer *websocket.Dialer
 	authVal := fmt.Sprintf("Bearer %v", token)
-	authHead := http.Header{"Authorisation": []string{authVal}}
+	authHead := http.Header{"Authorization": []string{authVal}}
 
 	conn, _, err := dialer.Dial(url, authHead)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{ws: conn}, nil
+	return newConn(conn, heartbeat), nil
 }
 
 // UpgradeRequest upgrades an http request connection to a websocket connection
-func UpgradeRequest(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+func UpgradeRequest(w http.ResponseWriter, r *http.Request, heartbeat Heartbeat) (*Conn, error) {
 	var wsupgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -54,7 +82,7 @@ func UpgradeRequest(w http.ResponseWriter, r *http.Request) (*Conn, error) {
 		return nil, err
 	}
 
-	return &Conn{conn}, nil
+	return newConn(conn, heartbeat), nil
 }
 
 type ControlMessageCode byte
@@ -67,6 +95,9 @@ const (
 )
 
 func (conn *Conn) Write(data interface{}) error {
+	if conn.heartbeat.Interval > 0 {
+		conn.ws.SetWriteDeadline(time.Now().Add(conn.heartbeat.Timeout))
+	}
 	w, err := conn.ws.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		return err
@@ -100,7 +131,79 @@ func (conn *Conn) Read() (interface{}, error) {
 	return res, nil
 }
 
-// Close closes the connection
+const closeTimeout = time.Second
+
+// Close tells the peer that the connection is closing, and closes it
 func (conn *Conn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	// the peer may be gone already: the connection is closed regardless
+	conn.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
 	return conn.ws.Close()
 }
+
+// Latency returns the round-trip time of the last ping answered, or 0 if none was
+func (conn *Conn) Latency() time.Duration {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.latency
+}
+
+// startHeartbeat pings the peer every interval until the connection is closed. Reading from the
+// connection fails once the peer has not answered a ping for the interval plus the timeout. Only pongs
+// count: the messages and pings of the peer do not tell whether it receives ours.
+func (conn *Conn) startHeartbeat() {
+	if conn.heartbeat.Interval <= 0 {
+		return
+	}
+
+	conn.extendReadDeadline()
+	conn.ws.SetPongHandler(conn.handlePong)
+
+	go func() {
+		ticker := time.NewTicker(conn.heartbeat.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.ping(); err != nil {
+					return
+				}
+			case <-conn.closed:
+				return
+			}
+		}
+	}()
+}
+
+func (conn *Conn) ping() error {
+	now := time.Now()
+	conn.lock.Lock()
+	conn.pingSentAt = now
+	conn.lock.Unlock()
+
+	payload := strconv.FormatInt(now.UnixNano(), 10)
+	err := conn.ws.WriteControl(websocket.PingMessage, []byte(payload), now.Add(conn.heartbeat.Timeout))
+	if e, ok := err.(net.Error); ok && e.Temporary() {
+		return nil
+	}
+	return err
+}
+
+// handlePong measures the latency, if the pong answers the last ping sent
+func (conn *Conn) handlePong(payload string) error {
+	conn.extendReadDeadline()
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if payload == strconv.FormatInt(conn.pingSentAt.UnixNano(), 10) {
+		conn.latency = time.Since(conn.pingSentAt)
+	}
+	return nil
+}
+
+func (conn *Conn) extendReadDeadline() {
+	if conn.heartbeat.Interval > 0 {
+		conn.ws.SetReadDeadline(time.Now().Add(conn.heartbeat.Interval + conn.heartbeat.Timeout))
+	}
+}
@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sec-ctl/pkg/sites"
+
+	"github.com/vincentcr/testify/assert"
+)
+
+var testHeartbeat = Heartbeat{Interval: 20 * time.Millisecond, Timeout: 50 * time.Millisecond}
+
+// newTestServer upgrades the requests, and hands the connections to serve
+func newTestServer(t *testing.T, serve func(conn *Conn)) (*httptest.Server, string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := UpgradeRequest(w, r, testHeartbeat)
+		if !assert.NoError(t, err) {
+			return
+		}
+		serve(conn)
+	}))
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestHeartbeatMeasuresLatency(t *testing.T) {
+	srv, url := newTestServer(t, func(conn *Conn) {
+		defer conn.Close()
+		for {
+			if _, err := conn.Read(); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	conn, err := Dial(url, "tok", testHeartbeat)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// the connection stays up while idle, as the pongs extend the read deadline
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read()
+		readErr <- err
+	}()
+
+	select {
+	case err := <-readErr:
+		t.Fatalf("read failed while the peer answers the pings: %v", err)
+	case <-time.After(5 * testHeartbeat.Interval):
+	}
+	assert.True(t, conn.Latency() > 0)
+	assert.NoError(t, conn.Write(sites.Event{Code: "Test"}))
+}
+
+func TestHeartbeatDetectsDeadPeer(t *testing.T) {
+	release := make(chan struct{})
+	srv, url := newTestServer(t, func(conn *Conn) {
+		// never reads, so never answers the pings, like a peer gone without closing the connection
+		<-release
+		conn.Close()
+	})
+	defer srv.Close()
+	defer close(release)
+
+	conn, err := Dial(url, "tok", Heartbeat{Interval: 20 * time.Millisecond, Timeout: 50 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read()
+		readErr <- err
+	}()
+
+	select {
+	case err := <-readErr:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("dead peer not detected")
+	}
+	assert.Equal(t, time.Duration(0), conn.Latency())
+}
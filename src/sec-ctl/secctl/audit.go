@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"sec-ctl/pkg/client"
+)
+
+// runAudit lists the audit log of the site, or of the whole cloud with -all
+func runAudit(c *cli, args []string) error {
+	fs := newFlagSet("audit", "[-all] [-actor ID] [-action ACTION] [-outcome success|failure] [-since TIME] [-until TIME] [-before ID] [-limit N] [-ndjson]")
+	all := fs.Bool("all", false, "the audit log of all the sites and users: cloud admins only")
+	actor := fs.String("actor", "", "only the actions of this user or site")
+	action := fs.String("action", "", "only this action, eg site.command or login")
+	outcome := fs.String("outcome", "", "only the actions with this outcome: success or failure")
+	since := fs.String("since", "", "only actions since this time: RFC 3339, or a duration ago like 2h")
+	until := fs.String("until", "", "only actions before this time: RFC 3339, or a duration ago like 2h")
+	before := fs.Int64("before", 0, "only entries older than this entry id, to page through the log")
+	limit := fs.Uint("limit", 100, "maximum number of entries, ignored with -ndjson")
+	ndjson := fs.Bool("ndjson", false, "export all the matching entries as one json entry per line")
+	fs.Parse(args)
+
+	if c.localURL != "" {
+		return fmt.Errorf("the local daemon does not keep an audit log")
+	}
+
+	var id string
+	var err error
+	if *all {
+		if c.cfg.Token == "" {
+			return fmt.Errorf("not logged in: run `secctl login`")
+		}
+	} else if id, err = c.cloudSiteID(); err != nil {
+		return err
+	}
+
+	filter := client.AuditFilter{
+		ActorID: *actor,
+		Action:  *action,
+		Outcome: *outcome,
+		Before:  *before,
+		Limit:   *limit,
+	}
+	if *since != "" {
+		if filter.Since, err = parseTime(*since); err != nil {
+			return fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = parseTime(*until); err != nil {
+			return fmt.Errorf("invalid until: %v", err)
+		}
+	}
+
+	if *ndjson {
+		return c.cloud().ExportAuditLog(context.Background(), id, filter, c.out)
+	}
+
+	entries, err := c.cloud().AuditLog(context.Background(), id, filter)
+	if err != nil {
+		return err
+	}
+
+	return c.print(entries, func(w io.Writer) {
+		t := newTable(w, "ID", "TIME", "ACTOR", "ACTION", "SITE", "OUTCOME", "ERROR")
+		for _, e := range entries {
+			actor := e.ActorEmail
+			if actor == "" {
+				actor = e.ActorType + " " + orDash(e.ActorID)
+			}
+			t.row(e.ID, e.Time.Local().Format("2006-01-02 15:04:05"), actor, e.Action, orDash(e.SiteID), e.Outcome, orDash(e.Error))
+		}
+		t.flush()
+	})
+}
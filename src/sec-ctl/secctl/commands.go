@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"sec-ctl/pkg/client"
+	"sec-ctl/pkg/sites"
+)
+
+// cli holds the global options of a secctl run
+type cli struct {
+	cfg      config
+	jsonOut  bool
+	localURL string
+	totpCode string
+	out      io.Writer
+}
+
+func (c *cli) cloud() *client.Client {
+	cl := client.New(c.cfg.CloudBaseURL, c.cfg.Token)
+	cl.TOTPCode = c.totpCode
+	return cl
+}
+
+// cloudSiteID returns the id of the selected site, if logged in to the cloud
+func (c *cli) cloudSiteID() (string, error) {
+	if c.cfg.Token == "" {
+		return "", fmt.Errorf("not logged in: run `secctl login`")
+	}
+	if c.cfg.SiteID == "" {
+		return "", fmt.Errorf("no site selected: pass -site, or run `secctl use <site id>`")
+	}
+	return c.cfg.SiteID, nil
+}
+
+// site returns the api to reach the selected site through
+func (c *cli) site() (siteAPI, error) {
+	if c.localURL != "" {
+		return newLocalSite(c.localURL), nil
+	}
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return nil, fmt.Errorf("%v, or use -local", err)
+	}
+	return cloudSite{client: c.cloud(), id: id}, nil
+}
+
+func newFlagSet(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: secctl %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runLogin(c *cli, args []string) error {
+	fs := newFlagSet("login", "-email EMAIL [-password PASSWORD]")
+	email := fs.String("email", "", "email of the account")
+	password := fs.String("password", "", "password of the account, prompted for if not set")
+	fs.Parse(args)
+
+	if *email == "" {
+		fs.Usage()
+		return fmt.Errorf("email is required")
+	}
+
+	if *password == "" {
+		var err error
+		if *password, err = prompt("Password: "); err != nil {
+			return err
+		}
+	}
+
+	_, token, err := c.cloud().Login(context.Background(), *email, *password)
+	if err != nil {
+		return err
+	}
+
+	c.cfg.Token = token
+	if err := saveConfig(c.cfg); err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"Email": *email}, func(w io.Writer) {
+		fmt.Fprintf(w, "Logged in as %s\n", *email)
+	})
+}
+
+func runLogout(c *cli, args []string) error {
+	newFlagSet("logout", "").Parse(args)
+
+	c.cfg.Token = ""
+	return saveConfig(c.cfg)
+}
+
+func runSites(c *cli, args []string) error {
+	newFlagSet("sites", "").Parse(args)
+
+	summaries, err := c.cloud().ListSites(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return c.print(summaries, func(w io.Writer) {
+		t := newTable(w, "ID", "ROLE", "CONNECTED", "PING", "DEFAULT")
+		for _, s := range summaries {
+			ping := "-"
+			if s.Connected {
+				ping = fmt.Sprintf("%.1fms", s.PingRTTMillis)
+			}
+			t.row(s.ID, s.Role, yesNo(s.Connected), ping, yesNo(s.ID == c.cfg.SiteID))
+		}
+		t.flush()
+	})
+}
+
+func runUse(c *cli, args []string) error {
+	fs := newFlagSet("use", "<site id>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("site id is required")
+	}
+
+	c.cfg.SiteID = fs.Arg(0)
+	return saveConfig(c.cfg)
+}
+
+func runState(c *cli, args []string) error {
+	newFlagSet("state", "").Parse(args)
+
+	site, err := c.site()
+	if err != nil {
+		return err
+	}
+
+	state, err := site.State(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return c.print(state, func(w io.Writer) { printState(w, state) })
+}
+
+func runArm(c *cli, args []string) error {
+	fs := newFlagSet("arm", "[-partition ID] [-mode away|stay|zero-delay|code] [-pin PIN]")
+	partID := fs.String("partition", "1", "partition to arm")
+	mode := fs.String("mode", "away", "arm mode: away, stay, zero-delay, or code to arm with your user code")
+	pin := fs.String("pin", "", "arm with this user code, instead of the mode (with -local only)")
+	fs.Parse(args)
+
+	cmd := sites.UserCommand{PartitionID: *partID}
+	switch {
+	case *pin != "" || *mode == "code":
+		cmd.Code = sites.CmdArmWithPIN
+	case *mode == "away":
+		cmd.Code = sites.CmdArmAway
+	case *mode == "stay":
+		cmd.Code = sites.CmdArmStay
+	case *mode == "zero-delay":
+		cmd.Code = sites.CmdArmWithZeroEntryDelay
+	default:
+		fs.Usage()
+		return fmt.Errorf("invalid arm mode %q", *mode)
+	}
+
+	if cmd.NeedsPIN() {
+		var err error
+		if cmd.PIN, err = c.commandPIN(*pin); err != nil {
+			return err
+		}
+	}
+
+	return c.exec(cmd)
+}
+
+func runDisarm(c *cli, args []string) error {
+	fs := newFlagSet("disarm", "[-partition ID] [-pin PIN]")
+	partID := fs.String("partition", "1", "partition to disarm")
+	pin := fs.String("pin", "", "user code, prompted for if not set (with -local only)")
+	fs.Parse(args)
+
+	pinCode, err := c.commandPIN(*pin)
+	if err != nil {
+		return err
+	}
+
+	return c.exec(sites.UserCommand{Code: sites.CmdDisarm, PartitionID: *partID, PIN: pinCode})
+}
+
+// commandPIN returns the user code to send with a command which needs one. The local daemon takes it
+// with the command, prompted for if not set, while the cloud attaches the code stored with `secctl pin`.
+func (c *cli) commandPIN(pin string) (string, error) {
+	if c.localURL == "" {
+		if pin != "" {
+			return "", fmt.Errorf("codes are not sent through the cloud: store yours with `secctl pin`, or use -local")
+		}
+		return "", nil
+	}
+
+	if pin == "" {
+		return prompt("PIN: ")
+	}
+	return pin, nil
+}
+
+var panicTargets = map[string]string{
+	"fire":      sites.PanicTargetFire,
+	"ambulance": sites.PanicTargetAmbulance,
+	"police":    sites.PanicTargetPolice,
+}
+
+func runPanic(c *cli, args []string) error {
+	fs := newFlagSet("panic", "-target fire|ambulance|police [-partition ID]")
+	partID := fs.String("partition", "1", "partition to trigger the alarm on")
+	target := fs.String("target", "", "fire, ambulance or police")
+	fs.Parse(args)
+
+	panicTarget, ok := panicTargets[*target]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("invalid panic target %q", *target)
+	}
+
+	return c.exec(sites.UserCommand{Code: sites.CmdPanic, PartitionID: *partID, PanicTarget: panicTarget})
+}
+
+func (c *cli) exec(cmd sites.UserCommand) error {
+	site, err := c.site()
+	if err != nil {
+		return err
+	}
+
+	if err := site.SendCommand(context.Background(), cmd); client.Is(err, client.ErrStepUpRequired) {
+		return fmt.Errorf("%v: pass -totp CODE, or run `secctl reauth` first", err)
+	} else if err != nil {
+		return err
+	}
+
+	return c.print(cmd, func(w io.Writer) {
+		fmt.Fprintf(w, "%s sent to partition %s\n", cmd.Code, cmd.PartitionID)
+	})
+}
+
+func runEvents(c *cli, args []string) error {
+	fs := newFlagSet("events", "[-level LEVEL] [-code CODE] [-since TIME] [-until TIME] [-partition ID] [-zone ID] [-search WORDS] [-before ID] [-limit N]")
+	level := fs.String("level", "", "only events of this level, eg ALARM or TROUBLE")
+	code := fs.String("code", "", "only events with this code, eg ZoneOpen")
+	since := fs.String("since", "", "only events since this time: RFC 3339, or a duration ago like 2h")
+	until := fs.String("until", "", "only events before this time: RFC 3339, or a duration ago like 2h")
+	partID := fs.String("partition", "", "only events of this partition")
+	zoneID := fs.String("zone", "", "only events of this zone")
+	search := fs.String("search", "", "only events whose description matches these words")
+	before := fs.Int64("before", 0, "only events older than this event id, to page through the history")
+	limit := fs.Uint("limit", 100, "maximum number of events")
+	fs.Parse(args)
+
+	if c.localURL != "" {
+		return fmt.Errorf("the local daemon does not keep an event history, use `secctl tail`")
+	}
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	filter := client.EventFilter{
+		Level:       sites.EventLevel(strings.ToUpper(*level)),
+		Code:        *code,
+		PartitionID: *partID,
+		ZoneID:      *zoneID,
+		Search:      *search,
+		Before:      *before,
+		Limit:       *limit,
+	}
+	if *since != "" {
+		if filter.Since, err = parseTime(*since); err != nil {
+			return fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = parseTime(*until); err != nil {
+			return fmt.Errorf("invalid until: %v", err)
+		}
+	}
+
+	evts, err := c.cloud().Events(context.Background(), id, filter)
+	if err != nil {
+		return err
+	}
+
+	return c.print(evts, func(w io.Writer) {
+		// oldest first, like a log
+		for i := len(evts) - 1; i >= 0; i-- {
+			fmt.Fprintln(w, evts[i])
+		}
+		if len(evts) > 0 && uint(len(evts)) == *limit {
+			fmt.Fprintf(w, "\nFor older events, add -before %d\n", evts[len(evts)-1].ID)
+		}
+	})
+}
+
+func runTail(c *cli, args []string) error {
+	newFlagSet("tail", "").Parse(args)
+
+	site, err := c.site()
+	if err != nil {
+		return err
+	}
+
+	return site.StreamEvents(context.Background(), func(evt sites.Event) error {
+		if c.jsonOut {
+			// one event per line
+			return json.NewEncoder(c.out).Encode(evt)
+		}
+		_, err := fmt.Fprintln(c.out, evt)
+		return err
+	})
+}
+
+func runRegister(c *cli, args []string) error {
+	newFlagSet("register", "").Parse(args)
+
+	reg, err := c.cloud().CreateSite(context.Background())
+	if err != nil {
+		return err
+	}
+	reg.SetupURL = strings.TrimRight(c.cfg.CloudBaseURL, "/") + reg.SetupURL
+
+	return c.print(reg, func(w io.Writer) {
+		fmt.Fprintf(w, "Site ID:   %s\n", reg.SiteID)
+		fmt.Fprintf(w, "Token:     %s\n", reg.Token)
+		fmt.Fprintf(w, "Setup URL: %s\n", reg.SetupURL)
+		fmt.Fprintf(w, "Claim by:  %s\n", reg.ClaimExpiresAt.Local().Format("2006-01-02 15:04"))
+		fmt.Fprintln(w, "\nConfigure the local daemon with the site id and token, and claim the site from the setup URL.")
+	})
+}
+
+func runClaim(c *cli, args []string) error {
+	fs := newFlagSet("claim", "-claim-token TOKEN")
+	claimToken := fs.String("claim-token", "", "claim token of the site, from its setup URL")
+	fs.Parse(args)
+
+	if *claimToken == "" {
+		fs.Usage()
+		return fmt.Errorf("claim token is required")
+	}
+	if c.cfg.SiteID == "" {
+		return fmt.Errorf("site id is required: pass -site")
+	}
+
+	if err := c.cloud().ClaimSite(context.Background(), c.cfg.SiteID, *claimToken); err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"SiteID": c.cfg.SiteID}, func(w io.Writer) {
+		fmt.Fprintf(w, "Claimed site %s\n", c.cfg.SiteID)
+	})
+}
+
+// runTokens lists the tokens of the user, or creates or revokes one
+func runTokens(c *cli, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return runCreateToken(c, args[1:])
+		case "revoke":
+			return runRevokeToken(c, args[1:])
+		}
+	}
+
+	newFlagSet("tokens", "[create|revoke]").Parse(args)
+
+	tokens, err := c.cloud().ListTokens(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return c.print(tokens, func(w io.Writer) {
+		t := newTable(w, "ID", "NAME", "SCOPE", "CREATED", "EXPIRES")
+		for _, tok := range tokens {
+			expires := "never"
+			if tok.ExpiresAt != nil {
+				expires = tok.ExpiresAt.Local().Format("2006-01-02 15:04")
+			}
+			t.row(tok.ID, tok.Name, tok.Scope, tok.CreatedAt.Local().Format("2006-01-02 15:04"), expires)
+		}
+		t.flush()
+	})
+}
+
+func runCreateToken(c *cli, args []string) error {
+	fs := newFlagSet("tokens create", "-name NAME [-scope read-only|command|admin] [-expires DURATION]")
+	name := fs.String("name", "", "name of the token, eg what uses it")
+	scope := fs.String("scope", string(client.ScopeReadOnly), "read-only, command or admin")
+	expires := fs.Duration("expires", 0, "expire the token after this duration, eg 720h. It never expires if unset")
+	fs.Parse(args)
+
+	if *name == "" {
+		fs.Usage()
+		return fmt.Errorf("name is required")
+	}
+
+	var expiresAt time.Time
+	if *expires > 0 {
+		expiresAt = time.Now().Add(*expires)
+	}
+
+	info, tok, err := c.cloud().CreateToken(context.Background(), *name, client.Scope(*scope), expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return c.print(map[string]interface{}{"TokenInfo": info, "Token": tok}, func(w io.Writer) {
+		fmt.Fprintf(w, "Token ID: %s\n", info.ID)
+		fmt.Fprintf(w, "Token:    %s\n", tok)
+		fmt.Fprintln(w, "\nThe token is only shown once: store it now.")
+	})
+}
+
+func runRevokeToken(c *cli, args []string) error {
+	fs := newFlagSet("tokens revoke", "<token id>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("token id is required")
+	}
+
+	if err := c.cloud().RevokeToken(context.Background(), fs.Arg(0)); err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"ID": fs.Arg(0)}, func(w io.Writer) {
+		fmt.Fprintf(w, "Revoked token %s\n", fs.Arg(0))
+	})
+}
+
+// parseTime parses an RFC 3339 time, or a duration relative to now
+func parseTime(val string) (time.Time, error) {
+	if d, err := time.ParseDuration(val); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+// prompt reads a line from stdin
+func prompt(label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// config is stored in the user config dir, and holds the token saved by `secctl login`
+type config struct {
+	CloudBaseURL string
+	Token        string
+	SiteID       string
+}
+
+var defaultConfig = config{
+	CloudBaseURL: "http://localhost:9753",
+}
+
+func configFilename() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", fmt.Errorf("unable to find the config dir: neither XDG_CONFIG_HOME nor HOME is set")
+		}
+		dir = path.Join(home, ".config")
+	}
+	return path.Join(dir, "sec-ctl", "CLI.json"), nil
+}
+
+func loadConfig() (config, error) {
+	cfg := defaultConfig
+
+	fname, err := configFilename()
+	if err != nil {
+		return cfg, err
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func saveConfig(cfg config) error {
+	fname, err := configFilename()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(fname), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the file holds the auth token: keep it private
+	return ioutil.WriteFile(fname, data, 0600)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const usage = `secctl is the command-line client of the SecCtl cloud and local daemon.
+
+Usage:
+  secctl [-json] [-cloud URL] [-local URL] [-site ID] [-totp CODE] <command> [command flags]
+
+Commands:
+`
+
+// command is a secctl sub-command
+type command struct {
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"login":    {"log in to the cloud, and store the token", runLogin},
+	"logout":   {"forget the stored token", runLogout},
+	"sites":    {"list your sites", runSites},
+	"use":      {"set the default site: use <site id>", runUse},
+	"state":    {"show the partitions and zones of the site", runState},
+	"arm":      {"arm a partition", runArm},
+	"disarm":   {"disarm a partition", runDisarm},
+	"panic":    {"trigger a fire, ambulance or police panic alarm", runPanic},
+	"events":   {"list the event history of the site", runEvents},
+	"tail":     {"follow the events of the site live", runTail},
+	"register": {"register a new site, as the local daemon does on its first start", runRegister},
+	"claim":    {"claim a registered site with its claim token", runClaim},
+	"members":  {"list the members of the site, or change their role or remove them: members [role|remove]", runMembers},
+	"invites":  {"list the pending invitations of the site, or create or revoke one: invites [create|revoke]", runInvites},
+	"accept":   {"accept an invitation to become a member of a site: accept <token>", runAccept},
+	"pin":      {"store your user code for the site, encrypted for its local daemon, or remove it with -remove", runPIN},
+	"totp":     {"show whether TOTP is enabled, or enroll, confirm or disable it: totp [enroll|confirm|disable]", runTOTP},
+	"reauth":   {"re-authenticate, to step up for the commands which require it, eg disarm", runReauth},
+	"stepup":   {"show the roles whose disarm and panic require a step-up, or set them: stepup [set]", runStepUp},
+	"audit":    {"list the audit log of the site, or of the whole cloud with -all", runAudit},
+	"tokens":   {"list your personal access tokens, or create or revoke one: tokens [create|revoke]", runTokens},
+}
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, usage)
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+
+	fmt.Fprint(os.Stderr, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+	fmt.Fprint(os.Stderr, "\nRun `secctl <command> -h` for the flags of a command.\n")
+}
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to load config:", err)
+		os.Exit(1)
+	}
+
+	c := &cli{cfg: cfg, out: os.Stdout}
+	flag.BoolVar(&c.jsonOut, "json", false, "print json output, for scripting")
+	flag.StringVar(&c.cfg.CloudBaseURL, "cloud", cfg.CloudBaseURL, "base URL of the cloud api")
+	flag.StringVar(&c.localURL, "local", "", "base URL of a local daemon to talk to directly, instead of the cloud, eg http://localhost:9752")
+	flag.StringVar(&c.cfg.SiteID, "site", cfg.SiteID, "id of the site, defaults to the one set with the use command")
+	flag.StringVar(&c.totpCode, "totp", "", "fresh TOTP code, to step up for the commands which require it, eg disarm")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"sec-ctl/pkg/client"
+)
+
+// runMembers lists the members of the site, or changes the role of one or removes them
+func runMembers(c *cli, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "role":
+			return runMemberRole(c, args[1:])
+		case "remove":
+			return runRemoveMember(c, args[1:])
+		}
+	}
+
+	newFlagSet("members", "[role|remove]").Parse(args)
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	members, err := c.cloud().ListMembers(context.Background(), id)
+	if err != nil {
+		return err
+	}
+
+	return c.print(members, func(w io.Writer) {
+		t := newTable(w, "USER ID", "EMAIL", "ROLE", "PIN")
+		for _, m := range members {
+			t.row(m.UserID, m.Email, m.Role, yesNo(m.HasPIN))
+		}
+		t.flush()
+	})
+}
+
+func runMemberRole(c *cli, args []string) error {
+	fs := newFlagSet("members role", "-role admin|arm-only|view-only <user id>")
+	role := fs.String("role", "", "new role of the member: admin, arm-only or view-only")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *role == "" {
+		fs.Usage()
+		return fmt.Errorf("user id and role are required")
+	}
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	if err := c.cloud().SetMemberRole(context.Background(), id, fs.Arg(0), client.Role(*role)); err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"UserID": fs.Arg(0), "Role": *role}, func(w io.Writer) {
+		fmt.Fprintf(w, "User %s is now %s\n", fs.Arg(0), *role)
+	})
+}
+
+func runRemoveMember(c *cli, args []string) error {
+	fs := newFlagSet("members remove", "<user id>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("user id is required")
+	}
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	if err := c.cloud().RemoveMember(context.Background(), id, fs.Arg(0)); err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"UserID": fs.Arg(0)}, func(w io.Writer) {
+		fmt.Fprintf(w, "Removed user %s from site %s\n", fs.Arg(0), id)
+	})
+}
+
+// runInvites lists the pending invitations of the site, or creates or revokes one
+func runInvites(c *cli, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return runCreateInvite(c, args[1:])
+		case "revoke":
+			return runRevokeInvite(c, args[1:])
+		}
+	}
+
+	newFlagSet("invites", "[create|revoke]").Parse(args)
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	invs, err := c.cloud().ListInvitations(context.Background(), id)
+	if err != nil {
+		return err
+	}
+
+	return c.print(invs, func(w io.Writer) {
+		t := newTable(w, "ID", "EMAIL", "ROLE", "EXPIRES")
+		for _, inv := range invs {
+			t.row(inv.ID, inv.Email, inv.Role, inv.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+		t.flush()
+	})
+}
+
+func runCreateInvite(c *cli, args []string) error {
+	fs := newFlagSet("invites create", "-email EMAIL [-role admin|arm-only|view-only]")
+	email := fs.String("email", "", "email of the user to invite")
+	role := fs.String("role", string(client.RoleViewOnly), "role of the user on the site: admin, arm-only or view-only")
+	fs.Parse(args)
+
+	if *email == "" {
+		fs.Usage()
+		return fmt.Errorf("email is required")
+	}
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	inv, tok, emailed, err := c.cloud().InviteMember(context.Background(), id, *email, client.Role(*role))
+	if err != nil {
+		return err
+	}
+
+	out := map[string]interface{}{"Invitation": inv, "Emailed": emailed}
+	if !emailed {
+		out["Token"] = tok
+	}
+	return c.print(out, func(w io.Writer) {
+		if emailed {
+			fmt.Fprintf(w, "Invited %s as %s: the invitation was emailed to them\n", inv.Email, inv.Role)
+			return
+		}
+		fmt.Fprintf(w, "Invited %s as %s, but the cloud does not send emails: pass this on to them\n\n", inv.Email, inv.Role)
+		fmt.Fprintf(w, "  secctl accept %s\n\n", tok)
+		fmt.Fprintf(w, "The invitation expires on %s.\n", inv.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	})
+}
+
+func runRevokeInvite(c *cli, args []string) error {
+	fs := newFlagSet("invites revoke", "<invitation id>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("invitation id is required")
+	}
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	if err := c.cloud().RevokeInvitation(context.Background(), id, fs.Arg(0)); err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"ID": fs.Arg(0)}, func(w io.Writer) {
+		fmt.Fprintf(w, "Revoked invitation %s\n", fs.Arg(0))
+	})
+}
+
+func runAccept(c *cli, args []string) error {
+	fs := newFlagSet("accept", "<token>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("invitation token is required")
+	}
+	if c.cfg.Token == "" {
+		return fmt.Errorf("not logged in: run `secctl login`")
+	}
+
+	siteID, role, err := c.cloud().AcceptInvitation(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return c.print(map[string]string{"SiteID": siteID, "Role": string(role)}, func(w io.Writer) {
+		fmt.Fprintf(w, "You are now %s of site %s: run `secctl use %s` to select it\n", role, siteID, siteID)
+	})
+}
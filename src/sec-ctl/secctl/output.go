@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"sec-ctl/pkg/sites"
+)
+
+// print writes v as indented json with -json, or calls printText otherwise
+func (c *cli) print(v interface{}, printText func(w io.Writer)) error {
+	if c.jsonOut {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	printText(c.out)
+	return nil
+}
+
+type table struct {
+	w *tabwriter.Writer
+}
+
+func newTable(w io.Writer, headers ...interface{}) *table {
+	t := &table{w: tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)}
+	t.row(headers...)
+	return t
+}
+
+func (t *table) row(cells ...interface{}) {
+	strs := make([]string, len(cells))
+	for i, c := range cells {
+		strs[i] = fmt.Sprint(c)
+	}
+	fmt.Fprintln(t.w, strings.Join(strs, "\t"))
+}
+
+func (t *table) flush() {
+	t.w.Flush()
+}
+
+func printState(w io.Writer, state sites.SystemState) {
+	parts := state.Partitions
+	sort.Slice(parts, func(i, j int) bool { return parts[i].ID < parts[j].ID })
+	zones := state.Zones
+	sort.Slice(zones, func(i, j int) bool { return zones[i].ID < zones[j].ID })
+
+	t := newTable(w, "PARTITION", "STATE", "TROUBLE", "LEDS", "FLASHING")
+	for _, p := range parts {
+		t.row(p.ID, p.State, yesNo(p.TroubleStateLED), orDash(p.KeypadLEDState.String()), orDash(p.KeypadLEDFlashState.String()))
+	}
+	t.flush()
+	fmt.Fprintln(w)
+
+	t = newTable(w, "ZONE", "STATE", "BYPASSED")
+	for _, z := range zones {
+		t.row(z.ID, z.State, yesNo(z.Bypassed))
+	}
+	t.flush()
+
+	active := make([]sites.Alarm, 0)
+	for _, a := range state.Alarms {
+		if a.Restored.IsZero() {
+			active = append(active, a)
+		}
+	}
+	if len(active) > 0 {
+		fmt.Fprintln(w)
+		t = newTable(w, "ALARM", "PARTITION", "ZONE", "TRIGGERED")
+		for _, a := range active {
+			t.row(a.AlarmType, orDash(a.PartitionID), orDash(a.ZoneID), a.Triggered.Format("2006-01-02 15:04:05"))
+		}
+		t.flush()
+	}
+
+	if state.TroubleStatus != 0 {
+		fmt.Fprintf(w, "\nTrouble: %v\n", state.TroubleStatus)
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
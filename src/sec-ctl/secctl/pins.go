@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"sec-ctl/pkg/pinvault"
+)
+
+func runPIN(c *cli, args []string) error {
+	fs := newFlagSet("pin", "[-remove]")
+	remove := fs.Bool("remove", false, "remove your stored code")
+	fs.Parse(args)
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if *remove {
+		if err := c.cloud().DeletePIN(ctx, id); err != nil {
+			return err
+		}
+		return c.print(map[string]string{"SiteID": id}, func(w io.Writer) {
+			fmt.Fprintf(w, "Removed your code for site %s\n", id)
+		})
+	}
+
+	// the code is encrypted here, for the local daemon only: the cloud never sees it
+	pubPEM, memberID, err := c.cloud().PINKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	pub, err := pinvault.ParsePublicKey(pubPEM)
+	if err != nil {
+		return err
+	}
+
+	pin, err := prompt("PIN: ")
+	if err != nil {
+		return err
+	}
+	encryptedPIN, err := pinvault.Encrypt(pub, id, memberID, pin)
+	if err != nil {
+		return err
+	}
+
+	if err := c.cloud().SetPIN(ctx, id, encryptedPIN); err != nil {
+		return err
+	}
+	return c.print(map[string]string{"SiteID": id}, func(w io.Writer) {
+		fmt.Fprintf(w, "Stored your code for site %s\n", id)
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"sec-ctl/pkg/client"
+	"sec-ctl/pkg/sites"
+)
+
+// siteAPI reaches a site, either through the cloud or directly through its local daemon
+type siteAPI interface {
+	State(ctx context.Context) (sites.SystemState, error)
+	SendCommand(ctx context.Context, cmd sites.UserCommand) error
+	StreamEvents(ctx context.Context, fn func(sites.Event) error) error
+}
+
+type cloudSite struct {
+	client *client.Client
+	id     string
+}
+
+func (s cloudSite) State(ctx context.Context) (sites.SystemState, error) {
+	return s.client.State(ctx, s.id)
+}
+
+func (s cloudSite) SendCommand(ctx context.Context, cmd sites.UserCommand) error {
+	return s.client.SendCommand(ctx, s.id, cmd)
+}
+
+func (s cloudSite) StreamEvents(ctx context.Context, fn func(sites.Event) error) error {
+	return s.client.StreamEvents(ctx, s.id, fn)
+}
+
+// localSite calls the REST api of a local daemon, which is not authenticated
+type localSite struct {
+	baseURL string
+}
+
+func newLocalSite(baseURL string) localSite {
+	return localSite{baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (s localSite) State(ctx context.Context) (sites.SystemState, error) {
+	var state sites.SystemState
+	rsp, err := s.do(ctx, "GET", "/", nil)
+	if err != nil {
+		return state, err
+	}
+	defer rsp.Body.Close()
+
+	err = json.NewDecoder(rsp.Body).Decode(&state)
+	return state, err
+}
+
+func (s localSite) SendCommand(ctx context.Context, cmd sites.UserCommand) error {
+	if err := cmd.Validate(); err != nil {
+		return err
+	}
+
+	rsp, err := s.do(ctx, "POST", "/commands", cmd)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (s localSite) StreamEvents(ctx context.Context, fn func(sites.Event) error) error {
+	rsp, err := s.do(ctx, "GET", "/events", nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	return client.ReadEventStream(rsp.Body, fn)
+}
+
+// do sends the request, and returns the response if its status is a success
+func (s localSite) do(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, s.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode >= 300 {
+		defer rsp.Body.Close()
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return nil, fmt.Errorf("request failed with status %d: %s", rsp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return rsp, nil
+}
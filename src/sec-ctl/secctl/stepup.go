@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"sec-ctl/pkg/client"
+)
+
+// runTOTP shows whether TOTP is enabled, or enrolls, confirms or disables it
+func runTOTP(c *cli, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "enroll":
+			return runEnrollTOTP(c, args[1:])
+		case "confirm":
+			return runConfirmTOTP(c, args[1:])
+		case "disable":
+			return runDisableTOTP(c, args[1:])
+		}
+	}
+
+	newFlagSet("totp", "[enroll|confirm|disable]").Parse(args)
+
+	enabled, err := c.cloud().TOTPEnabled(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return c.print(map[string]bool{"Enabled": enabled}, func(w io.Writer) {
+		fmt.Fprintf(w, "TOTP enabled: %s\n", yesNo(enabled))
+	})
+}
+
+func runEnrollTOTP(c *cli, args []string) error {
+	newFlagSet("totp enroll", "").Parse(args)
+
+	password, err := prompt("Password: ")
+	if err != nil {
+		return err
+	}
+
+	enrollment, err := c.cloud().EnrollTOTP(context.Background(), password)
+	if err != nil {
+		return err
+	}
+
+	return c.print(enrollment, func(w io.Writer) {
+		fmt.Fprintf(w, "Secret: %s\n", enrollment.Secret)
+		fmt.Fprintf(w, "URL:    %s\n", enrollment.URL)
+		fmt.Fprintln(w, "\nAdd the secret to your authenticator app, then enable it with `secctl totp confirm <code>`.")
+	})
+}
+
+func runConfirmTOTP(c *cli, args []string) error {
+	fs := newFlagSet("totp confirm", "<code>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("code is required")
+	}
+
+	if err := c.cloud().ConfirmTOTP(context.Background(), fs.Arg(0)); err != nil {
+		return err
+	}
+
+	return c.print(map[string]bool{"Enabled": true}, func(w io.Writer) {
+		fmt.Fprintln(w, "TOTP enabled")
+	})
+}
+
+func runDisableTOTP(c *cli, args []string) error {
+	newFlagSet("totp disable", "").Parse(args)
+
+	if err := c.cloud().DisableTOTP(context.Background()); err != nil {
+		return err
+	}
+
+	return c.print(map[string]bool{"Enabled": false}, func(w io.Writer) {
+		fmt.Fprintln(w, "TOTP disabled")
+	})
+}
+
+// runReauth re-authenticates the stored token, with the password and the global -totp code
+func runReauth(c *cli, args []string) error {
+	newFlagSet("reauth", "").Parse(args)
+
+	password, err := prompt("Password: ")
+	if err != nil {
+		return err
+	}
+
+	until, err := c.cloud().Reauthenticate(context.Background(), password, c.totpCode)
+	if err != nil {
+		return err
+	}
+
+	return c.print(map[string]interface{}{"ReauthenticatedUntil": until}, func(w io.Writer) {
+		fmt.Fprintf(w, "Re-authenticated until %s\n", until.Local().Format("15:04:05"))
+	})
+}
+
+// runStepUp shows the roles whose disarm and panic commands require a step-up, or sets them
+func runStepUp(c *cli, args []string) error {
+	if len(args) > 0 && args[0] == "set" {
+		return runSetStepUp(c, args[1:])
+	}
+
+	newFlagSet("stepup", "[set]").Parse(args)
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	roles, err := c.cloud().StepUpRoles(context.Background(), id)
+	if err != nil {
+		return err
+	}
+
+	return c.print(map[string][]client.Role{"Roles": roles}, func(w io.Writer) {
+		fmt.Fprintf(w, "Step-up required for: %s\n", formatRoles(roles))
+	})
+}
+
+func runSetStepUp(c *cli, args []string) error {
+	fs := newFlagSet("stepup set", "-roles ROLE,...")
+	rolesFlag := fs.String("roles", "", "comma-separated roles whose disarm and panic require a step-up, empty for none")
+	fs.Parse(args)
+
+	id, err := c.cloudSiteID()
+	if err != nil {
+		return err
+	}
+
+	roles := []client.Role{}
+	for _, role := range strings.Split(*rolesFlag, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, client.Role(role))
+		}
+	}
+
+	if err := c.cloud().SetStepUpRoles(context.Background(), id, roles); err != nil {
+		return err
+	}
+
+	return c.print(map[string][]client.Role{"Roles": roles}, func(w io.Writer) {
+		fmt.Fprintf(w, "Step-up required for: %s\n", formatRoles(roles))
+	})
+}
+
+func formatRoles(roles []client.Role) string {
+	if len(roles) == 0 {
+		return "none"
+	}
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = string(role)
+	}
+	return strings.Join(names, ", ")
+}